@@ -0,0 +1,326 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	v2 "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+)
+
+const (
+	// V1SpecAnnotation keeps the v1 fields that v2 cannot represent on a converted v2 object
+	V1SpecAnnotation = "buildpiper.opstreelabs.in/v1-spec"
+	// V2SpecAnnotation keeps the v2 fields that v1 cannot represent on a converted v1 object
+	V2SpecAnnotation = "buildpiper.opstreelabs.in/v2-spec"
+
+	// ScalingQueryMetric is the v2 metric name given to the v1 scalingQuery
+	ScalingQueryMetric = "scaling-query"
+)
+
+// v1Spec is the content of V1SpecAnnotation
+type v1Spec struct {
+	// DeploymentPort is set when the port is not a plain number
+	DeploymentPort *string `json:"deploymentPort,omitempty"`
+	// ScalingParamsMapping holds the keys that are not a canonical resource quantity
+	ScalingParamsMapping map[string]string `json:"scalingParamsMapping,omitempty"`
+}
+
+// v2Spec is the content of V2SpecAnnotation
+type v2Spec struct {
+	Metrics    []v2.Metric        `json:"metrics,omitempty"`
+	Monitoring *v2.Monitoring     `json:"monitoring,omitempty"`
+	Webhook    *v2.WebhookRouting `json:"webhook,omitempty"`
+	Takeover   v2.TakeoverPolicy  `json:"takeover,omitempty"`
+	Driver     v2.ScalingDriver   `json:"driver,omitempty"`
+	Paused     bool               `json:"paused,omitempty"`
+	Freeze     *v2.ReplicaFreeze  `json:"freezeReplicas,omitempty"`
+	Audit      *v2.AuditLog       `json:"audit,omitempty"`
+}
+
+// scalingParamsResources are the scalingParamsMapping keys mapped to Prometheus resource requests
+var scalingParamsResources = []corev1.ResourceName{corev1.ResourceMemory, corev1.ResourceCPU}
+
+var _ conversion.Convertible = &CustomAutoScaling{}
+
+// ConvertTo converts this CustomAutoScaling to the Hub version (v2)
+func (src *CustomAutoScaling) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v2.CustomAutoScaling)
+	in := src.DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	restored := v2Spec{}
+	if err := popAnnotation(&dst.ObjectMeta, V2SpecAnnotation, &restored); err != nil {
+		return err
+	}
+	lost := v1Spec{}
+
+	dst.Spec.Target = v2.ScaleTarget{
+		Name:    in.Spec.ApplicationRef.DeploymentName,
+		Service: in.Spec.ApplicationRef.DeploymentService,
+	}
+	port, err := strconv.ParseInt(in.Spec.ApplicationRef.DeploymentPort, 10, 32)
+	if err == nil && strconv.FormatInt(port, 10) == in.Spec.ApplicationRef.DeploymentPort {
+		dst.Spec.Target.Port = int32(port)
+	} else {
+		lost.DeploymentPort = &in.Spec.ApplicationRef.DeploymentPort
+	}
+
+	dst.Spec.Metrics = nil
+	switch {
+	case len(restored.Metrics) > 0:
+		dst.Spec.Metrics = restored.Metrics
+		dst.Spec.Metrics[0].Query = in.Spec.ScalingQuery
+	case in.Spec.ScalingQuery != "":
+		dst.Spec.Metrics = []v2.Metric{{Name: ScalingQueryMetric, Query: in.Spec.ScalingQuery}}
+	}
+
+	// v1 only knows about the requests kept in scalingParamsMapping, edits made
+	// through v1 win over the requests restored from the annotation
+	dst.Spec.Monitoring = v2.Monitoring{}
+	if restored.Monitoring != nil {
+		dst.Spec.Monitoring = *restored.Monitoring
+	}
+	for _, name := range scalingParamsResources {
+		delete(dst.Spec.Monitoring.Resources.Requests, name)
+	}
+	for key, value := range in.Spec.ScalingParamsMapping {
+		if q, ok := canonicalQuantity(key, value); ok {
+			if dst.Spec.Monitoring.Resources.Requests == nil {
+				dst.Spec.Monitoring.Resources.Requests = corev1.ResourceList{}
+			}
+			dst.Spec.Monitoring.Resources.Requests[corev1.ResourceName(key)] = q
+			continue
+		}
+		if lost.ScalingParamsMapping == nil {
+			lost.ScalingParamsMapping = map[string]string{}
+		}
+		lost.ScalingParamsMapping[key] = value
+	}
+
+	dst.Spec.Webhook = restored.Webhook
+	dst.Spec.Takeover = restored.Takeover
+	dst.Spec.Driver = restored.Driver
+	dst.Spec.Paused = restored.Paused
+	dst.Spec.FreezeReplicas = restored.Freeze
+	dst.Spec.Audit = restored.Audit
+	dst.Spec.MinReplicas = in.Spec.MinReplicas
+	dst.Spec.MaxReplicas = in.Spec.MaxReplicas
+	dst.Spec.Behavior = convertBehaviorTo(in.Spec.Behavior)
+	dst.Spec.Mode = v2.ScalingMode(in.Spec.Mode)
+	dst.Spec.Predictive = convertPredictiveTo(in.Spec.Predictive)
+
+	dst.Status = v2.CustomAutoScalingStatus{
+		Replicas:       in.Status.Replicas,
+		Conditions:     in.Status.Conditions,
+		Forecast:       (*v2.ForecastStatus)(in.Status.Forecast),
+		LastScaleTime:  in.Status.LastScaleTime,
+		Recommendation: (*v2.Recommendation)(in.Status.Recommendation),
+		LastAlert:      (*v2.AlertStatus)(in.Status.LastAlert),
+		LastDecision:   (*v2.DecisionStatus)(in.Status.LastDecision),
+		Override:       (*v2.OverrideStatus)(in.Status.Override),
+	}
+
+	if lost.DeploymentPort != nil || len(lost.ScalingParamsMapping) > 0 {
+		return setAnnotation(&dst.ObjectMeta, V1SpecAnnotation, lost)
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v2) to this version
+func (dst *CustomAutoScaling) ConvertFrom(srcRaw conversion.Hub) error {
+	in := srcRaw.(*v2.CustomAutoScaling).DeepCopy()
+
+	dst.ObjectMeta = in.ObjectMeta
+	lost := v1Spec{}
+	if err := popAnnotation(&dst.ObjectMeta, V1SpecAnnotation, &lost); err != nil {
+		return err
+	}
+	kept := v2Spec{}
+
+	dst.Spec.ApplicationRef = ApplicationReference{
+		DeploymentName:    in.Spec.Target.Name,
+		DeploymentService: in.Spec.Target.Service,
+		DeploymentPort:    strconv.FormatInt(int64(in.Spec.Target.Port), 10),
+	}
+	// the port was not a number in v1 and has not been set through v2 since
+	if in.Spec.Target.Port == 0 && lost.DeploymentPort != nil {
+		dst.Spec.ApplicationRef.DeploymentPort = *lost.DeploymentPort
+	}
+
+	dst.Spec.ScalingQuery = ""
+	if len(in.Spec.Metrics) > 0 {
+		dst.Spec.ScalingQuery = in.Spec.Metrics[0].Query
+		if len(in.Spec.Metrics) != 1 || in.Spec.Metrics[0].Name != ScalingQueryMetric || in.Spec.Metrics[0].Query == "" ||
+			in.Spec.Metrics[0].TargetAverageValue != nil || len(in.Spec.Metrics[0].Thresholds) > 0 ||
+			in.Spec.Metrics[0].Recording != nil {
+			kept.Metrics = in.Spec.Metrics
+		}
+	}
+
+	dst.Spec.ScalingParamsMapping = lost.ScalingParamsMapping
+	monitoring := in.Spec.Monitoring
+	for _, name := range scalingParamsResources {
+		q, ok := monitoring.Resources.Requests[name]
+		if !ok {
+			continue
+		}
+		if dst.Spec.ScalingParamsMapping == nil {
+			dst.Spec.ScalingParamsMapping = map[string]string{}
+		}
+		dst.Spec.ScalingParamsMapping[string(name)] = quantityString(q)
+		delete(monitoring.Resources.Requests, name)
+	}
+	if !apiequality.Semantic.DeepEqual(monitoring, v2.Monitoring{}) {
+		kept.Monitoring = &monitoring
+	}
+
+	kept.Webhook = in.Spec.Webhook
+	kept.Takeover = in.Spec.Takeover
+	kept.Driver = in.Spec.Driver
+	kept.Paused = in.Spec.Paused
+	kept.Freeze = in.Spec.FreezeReplicas
+	kept.Audit = in.Spec.Audit
+	dst.Spec.MinReplicas = in.Spec.MinReplicas
+	dst.Spec.MaxReplicas = in.Spec.MaxReplicas
+	dst.Spec.Behavior = convertBehaviorFrom(in.Spec.Behavior)
+	dst.Spec.Mode = ScalingMode(in.Spec.Mode)
+	dst.Spec.Predictive = convertPredictiveFrom(in.Spec.Predictive)
+
+	dst.Status = CustomAutoScalingStatus{
+		Replicas:       in.Status.Replicas,
+		Conditions:     in.Status.Conditions,
+		Forecast:       (*ForecastStatus)(in.Status.Forecast),
+		LastScaleTime:  in.Status.LastScaleTime,
+		Recommendation: (*Recommendation)(in.Status.Recommendation),
+		LastAlert:      (*AlertStatus)(in.Status.LastAlert),
+		LastDecision:   (*DecisionStatus)(in.Status.LastDecision),
+		Override:       (*OverrideStatus)(in.Status.Override),
+	}
+
+	if kept.Metrics != nil || kept.Monitoring != nil || kept.Webhook != nil || kept.Takeover != "" || kept.Driver != "" ||
+		kept.Paused || kept.Freeze != nil || kept.Audit != nil {
+		return setAnnotation(&dst.ObjectMeta, V2SpecAnnotation, kept)
+	}
+	return nil
+}
+
+// canonicalQuantity parses the scalingParamsMapping entry into a resource
+// request, values that would not print back the same are left to the annotation
+func canonicalQuantity(key, value string) (resource.Quantity, bool) {
+	for _, name := range scalingParamsResources {
+		if string(name) != key {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		return q, err == nil && q.String() == value
+	}
+	return resource.Quantity{}, false
+}
+
+// quantityString prints q the way it prints after being parsed back, a
+// BinarySI quantity that is not a multiple of 1024 parses back as DecimalSI
+func quantityString(q resource.Quantity) string {
+	value := q.String()
+	if parsed, err := resource.ParseQuantity(value); err == nil {
+		return parsed.String()
+	}
+	return value
+}
+
+func convertBehaviorTo(in *ScalingBehavior) *v2.ScalingBehavior {
+	if in == nil {
+		return nil
+	}
+	return &v2.ScalingBehavior{
+		ScaleUp:   (*v2.ScalingRules)(in.ScaleUp),
+		ScaleDown: (*v2.ScalingRules)(in.ScaleDown),
+	}
+}
+
+func convertBehaviorFrom(in *v2.ScalingBehavior) *ScalingBehavior {
+	if in == nil {
+		return nil
+	}
+	return &ScalingBehavior{
+		ScaleUp:   (*ScalingRules)(in.ScaleUp),
+		ScaleDown: (*ScalingRules)(in.ScaleDown),
+	}
+}
+
+func convertPredictiveTo(in *PredictiveScaling) *v2.PredictiveScaling {
+	if in == nil {
+		return nil
+	}
+	return &v2.PredictiveScaling{
+		Query:                 in.Query,
+		Model:                 v2.PredictiveModel(in.Model),
+		Lookback:              in.Lookback,
+		Step:                  in.Step,
+		Season:                in.Season,
+		LeadTime:              in.LeadTime,
+		TargetValuePerReplica: in.TargetValuePerReplica,
+	}
+}
+
+func convertPredictiveFrom(in *v2.PredictiveScaling) *PredictiveScaling {
+	if in == nil {
+		return nil
+	}
+	return &PredictiveScaling{
+		Query:                 in.Query,
+		Model:                 PredictiveModel(in.Model),
+		Lookback:              in.Lookback,
+		Step:                  in.Step,
+		Season:                in.Season,
+		LeadTime:              in.LeadTime,
+		TargetValuePerReplica: in.TargetValuePerReplica,
+	}
+}
+
+// popAnnotation decodes the JSON annotation key into v and removes it from meta
+func popAnnotation(meta *metav1.ObjectMeta, key string, v interface{}) error {
+	value, ok := meta.Annotations[key]
+	if !ok {
+		return nil
+	}
+	delete(meta.Annotations, key)
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("decoding annotation %s: %w", key, err)
+	}
+	return nil
+}
+
+// setAnnotation stores v as JSON under the annotation key
+func setAnnotation(meta *metav1.ObjectMeta, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding annotation %s: %w", key, err)
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = string(data)
+	return nil
+}
@@ -0,0 +1,137 @@
+package v1
+
+import (
+	"strconv"
+	"testing"
+
+	v2 "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	fuzz "github.com/google/gofuzz"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const fuzzIterations = 1000
+
+func newFuzzer(seed int64) *fuzz.Fuzzer {
+	return fuzz.NewWithSeed(seed).NilChance(0.2).NumElements(0, 3).Funcs(
+		func(q *resource.Quantity, c fuzz.Continue) {
+			*q = *resource.NewQuantity(c.Int63n(1<<30), resource.BinarySI)
+		},
+		// managed fields and owner references are carried as is, they only slow the fuzzer down
+		func(m *metav1.ObjectMeta, c fuzz.Continue) {
+			c.Fuzz(&m.Name)
+			c.Fuzz(&m.Namespace)
+			c.Fuzz(&m.Labels)
+			c.Fuzz(&m.Annotations)
+			c.Fuzz(&m.Finalizers)
+		},
+		// make the fields v1 can express in v2 show up often enough
+		func(a *ApplicationReference, c fuzz.Continue) {
+			c.FuzzNoCustom(a)
+			if c.RandBool() {
+				a.DeploymentPort = strconv.Itoa(c.Intn(65536))
+			}
+		},
+		func(s *CustomAutoScalingSpec, c fuzz.Continue) {
+			c.FuzzNoCustom(s)
+			if c.RandBool() {
+				if s.ScalingParamsMapping == nil {
+					s.ScalingParamsMapping = map[string]string{}
+				}
+				s.ScalingParamsMapping["memory"] = resource.NewQuantity(c.Int63n(1<<30), resource.BinarySI).String()
+				s.ScalingParamsMapping["cpu"] = []string{"100m", "0.5", "1", "2k"}[c.Intn(4)]
+			}
+		},
+		func(m *v2.Metric, c fuzz.Continue) {
+			c.FuzzNoCustom(m)
+			if c.RandBool() {
+				m.Name = ScalingQueryMetric
+			}
+		},
+		func(r *corev1.ResourceList, c fuzz.Continue) {
+			*r = corev1.ResourceList{}
+			for _, name := range []corev1.ResourceName{corev1.ResourceMemory, corev1.ResourceCPU, corev1.ResourceStorage} {
+				if c.RandBool() {
+					var q resource.Quantity
+					c.Fuzz(&q)
+					(*r)[name] = q
+				}
+			}
+		},
+	)
+}
+
+func TestSpokeHubSpokeRoundTrip(t *testing.T) {
+	f := newFuzzer(1)
+	for i := 0; i < fuzzIterations; i++ {
+		src := &CustomAutoScaling{}
+		f.Fuzz(src)
+		src.TypeMeta = metav1.TypeMeta{}
+
+		hub := &v2.CustomAutoScaling{}
+		if err := src.ConvertTo(hub); err != nil {
+			t.Fatalf("ConvertTo: %v", err)
+		}
+		got := &CustomAutoScaling{}
+		if err := got.ConvertFrom(hub); err != nil {
+			t.Fatalf("ConvertFrom: %v", err)
+		}
+
+		if !apiequality.Semantic.DeepEqual(src, got) {
+			t.Fatalf("v1 -> v2 -> v1 is lossy\nwant %+v\ngot  %+v", src.Spec, got.Spec)
+		}
+	}
+}
+
+func TestHubSpokeHubRoundTrip(t *testing.T) {
+	f := newFuzzer(2)
+	for i := 0; i < fuzzIterations; i++ {
+		src := &v2.CustomAutoScaling{}
+		f.Fuzz(src)
+		src.TypeMeta = metav1.TypeMeta{}
+
+		spoke := &CustomAutoScaling{}
+		if err := spoke.ConvertFrom(src); err != nil {
+			t.Fatalf("ConvertFrom: %v", err)
+		}
+		got := &v2.CustomAutoScaling{}
+		if err := spoke.ConvertTo(got); err != nil {
+			t.Fatalf("ConvertTo: %v", err)
+		}
+
+		if !apiequality.Semantic.DeepEqual(src, got) {
+			t.Fatalf("v2 -> v1 -> v2 is lossy\nwant %+v\ngot  %+v", src.Spec, got.Spec)
+		}
+	}
+}
+
+func TestConvertToHub(t *testing.T) {
+	src := &CustomAutoScaling{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: CustomAutoScalingSpec{
+			ApplicationRef:       ApplicationReference{DeploymentName: "demo", DeploymentService: "demo-svc", DeploymentPort: "8080"},
+			ScalingParamsMapping: map[string]string{"memory": "400Mi", "team": "frontend"},
+			ScalingQuery:         "up == 0",
+		},
+	}
+
+	hub := &v2.CustomAutoScaling{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatal(err)
+	}
+
+	if hub.Spec.Target != (v2.ScaleTarget{Name: "demo", Service: "demo-svc", Port: 8080}) {
+		t.Errorf("target = %+v", hub.Spec.Target)
+	}
+	if len(hub.Spec.Metrics) != 1 || !apiequality.Semantic.DeepEqual(hub.Spec.Metrics[0], v2.Metric{Name: ScalingQueryMetric, Query: "up == 0"}) {
+		t.Errorf("metrics = %+v", hub.Spec.Metrics)
+	}
+	if q := hub.Spec.Monitoring.Resources.Requests[corev1.ResourceMemory]; q.String() != "400Mi" {
+		t.Errorf("memory request = %s, want 400Mi", q.String())
+	}
+	if got := hub.Annotations[V1SpecAnnotation]; got != `{"scalingParamsMapping":{"team":"frontend"}}` {
+		t.Errorf("%s = %s", V1SpecAnnotation, got)
+	}
+}
@@ -25,6 +25,56 @@ type CustomAutoScalingSpec struct {
 	ApplicationRef       ApplicationReference `json:"applicationRef"`
 	ScalingParamsMapping map[string]string    `json:"scalingParamsMapping"`
 	ScalingQuery         string               `json:"scalingQuery"`
+
+	// MinReplicas is the lower bound applied to every scaling decision
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// MaxReplicas is the upper bound applied to every scaling decision
+	// +optional
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+
+	// Behavior limits how fast the target is scaled in each direction
+	// +optional
+	Behavior *ScalingBehavior `json:"behavior,omitempty"`
+
+	// Mode selects whether decisions are applied to the target or only recommended
+	// +kubebuilder:default=Enforce
+	// +optional
+	Mode ScalingMode `json:"mode,omitempty"`
+
+	// Predictive enables pre-scaling from a forecast of the scaling metric
+	// +optional
+	Predictive *PredictiveScaling `json:"predictive,omitempty"`
+}
+
+// ScalingMode controls what happens to a scaling decision
+// +kubebuilder:validation:Enum=Enforce;Recommend
+type ScalingMode string
+
+const (
+	// EnforceMode updates the target deployment
+	EnforceMode ScalingMode = "Enforce"
+	// RecommendMode only records the decision in status, events and metrics
+	RecommendMode ScalingMode = "Recommend"
+)
+
+// ScalingBehavior configures the scale up and scale down rules
+type ScalingBehavior struct {
+	// +optional
+	ScaleUp *ScalingRules `json:"scaleUp,omitempty"`
+	// +optional
+	ScaleDown *ScalingRules `json:"scaleDown,omitempty"`
+}
+
+// ScalingRules limits the decisions made in one direction
+type ScalingRules struct {
+	// MaxStep caps the replica change of a single decision
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxStep *int32 `json:"maxStep,omitempty"`
+	// Cooldown is the minimum time since the last scale before scaling again
+	// +optional
+	Cooldown *metav1.Duration `json:"cooldown,omitempty"`
 }
 
 // ApplicationReference defines the deployment to scale
@@ -34,9 +84,153 @@ type ApplicationReference struct {
 	DeploymentService string `json:"deploymentService"`
 }
 
+// PredictiveModel names the model used to forecast the scaling metric
+// +kubebuilder:validation:Enum=HoltWinters;Profile
+type PredictiveModel string
+
+const (
+	// HoltWintersModel fits additive triple exponential smoothing over the lookback
+	HoltWintersModel PredictiveModel = "HoltWinters"
+	// ProfileModel averages the lookback by day-of-week and hour
+	ProfileModel PredictiveModel = "Profile"
+)
+
+// PredictiveScaling defines how the scaling metric is forecast from its history
+type PredictiveScaling struct {
+	// Query is the PromQL expression to forecast, defaults to scalingQuery
+	// +optional
+	Query string `json:"query,omitempty"`
+	// Model selects the forecasting model
+	// +kubebuilder:default=HoltWinters
+	// +optional
+	Model PredictiveModel `json:"model,omitempty"`
+	// Lookback is the range of history pulled through query_range
+	// +kubebuilder:default="168h"
+	// +optional
+	Lookback metav1.Duration `json:"lookback,omitempty"`
+	// Step is the query_range resolution and the interval between forecasts
+	// +kubebuilder:default="5m"
+	// +optional
+	Step metav1.Duration `json:"step,omitempty"`
+	// Season is the length of one seasonal cycle
+	// +kubebuilder:default="24h"
+	// +optional
+	Season metav1.Duration `json:"season,omitempty"`
+	// LeadTime is how far ahead of the forecast load the target is scaled
+	// +kubebuilder:default="10m"
+	// +optional
+	LeadTime metav1.Duration `json:"leadTime,omitempty"`
+	// TargetValuePerReplica is the metric value a single replica absorbs
+	TargetValuePerReplica string `json:"targetValuePerReplica"`
+}
+
+// Condition types reported in CustomAutoScalingStatus.Conditions
+const (
+	// ConditionProvisioned is true once every child resource of the CR exists
+	ConditionProvisioned = "Provisioned"
+)
+
 // CustomAutoScalingStatus defines the observed state of CustomAutoScaling
 type CustomAutoScalingStatus struct {
 	Replicas int32 `json:"replicas"`
+
+	// Conditions describe the provisioning and scaling state of the CR
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Forecast is the latest predictive scaling result
+	// +optional
+	Forecast *ForecastStatus `json:"forecast,omitempty"`
+
+	// LastScaleTime is when the target was last scaled by the operator
+	// +optional
+	LastScaleTime *metav1.Time `json:"lastScaleTime,omitempty"`
+
+	// Recommendation is the latest change of the replicas recommended in
+	// Recommend mode, the cooldown counts from its time
+	// +optional
+	Recommendation *Recommendation `json:"recommendation,omitempty"`
+
+	// LastAlert is the latest firing alert received for the CR
+	// +optional
+	LastAlert *AlertStatus `json:"lastAlert,omitempty"`
+
+	// LastDecision is the latest scaling decision made for the CR
+	// +optional
+	LastDecision *DecisionStatus `json:"lastDecision,omitempty"`
+
+	// Override is the manual override holding the target, if any
+	// +optional
+	Override *OverrideStatus `json:"override,omitempty"`
+}
+
+// OverrideStatus records a manual override of the target replicas
+type OverrideStatus struct {
+	// Replicas is the replica count the target was scaled to
+	Replicas int32 `json:"replicas"`
+	// Time is when the override was applied
+	Time metav1.Time `json:"time"`
+	// Until is when the override expires and scaling resumes
+	Until metav1.Time `json:"until"`
+}
+
+// Recommendation is a scaling decision that was not applied to the target
+type Recommendation struct {
+	// Time is when the decision was made
+	Time metav1.Time `json:"time"`
+	// CurrentReplicas is the replica count of the target at that time
+	CurrentReplicas int32 `json:"currentReplicas"`
+	// DesiredReplicas is the replica count the operator would have set
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Reason describes what triggered the decision
+	Reason string `json:"reason"`
+}
+
+// AlertStatus identifies an alert received by the webhook
+type AlertStatus struct {
+	// Name is the alertname label of the alert
+	Name string `json:"name"`
+	// Severity is the severity label of the alert
+	// +optional
+	Severity string `json:"severity,omitempty"`
+	// Time is when the alert was received
+	Time metav1.Time `json:"time"`
+}
+
+// DecisionStatus explains a scaling decision
+type DecisionStatus struct {
+	// Time is when the decision was made
+	Time metav1.Time `json:"time"`
+	// CurrentReplicas is the replica count of the target at that time
+	CurrentReplicas int32 `json:"currentReplicas"`
+	// DesiredReplicas is the replica count asked for before bounds and behavior
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Replicas is the replica count decided on
+	Replicas int32 `json:"replicas"`
+	// Reason describes what triggered the decision
+	Reason string `json:"reason"`
+	// Clamped names the replica bound that changed the desired count
+	// +optional
+	Clamped string `json:"clamped,omitempty"`
+	// Limited names the behavior rule that held back the change
+	// +optional
+	Limited string `json:"limited,omitempty"`
+	// Applied is true when the target was scaled to Replicas
+	Applied bool `json:"applied"`
+}
+
+// ForecastStatus records the forecast against the value actually observed
+type ForecastStatus struct {
+	// Time is when the forecast was computed
+	Time metav1.Time `json:"time"`
+	// Value is the forecast metric value at Time plus the lead time
+	Value string `json:"value"`
+	// Actual is the last observed metric value
+	Actual string `json:"actual"`
+	// Replicas is the replica count implied by the forecast
+	Replicas int32 `json:"replicas"`
 }
 
 //+kubebuilder:object:root=true
@@ -1,5 +1,4 @@
 //go:build !ignore_autogenerated
-// +build !ignore_autogenerated
 
 /*
 Copyright 2023.
@@ -22,9 +21,26 @@ limitations under the License.
 package v1
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AlertStatus) DeepCopyInto(out *AlertStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlertStatus.
+func (in *AlertStatus) DeepCopy() *AlertStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AlertStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ApplicationReference) DeepCopyInto(out *ApplicationReference) {
 	*out = *in
@@ -46,7 +62,7 @@ func (in *CustomAutoScaling) DeepCopyInto(out *CustomAutoScaling) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScaling.
@@ -110,6 +126,26 @@ func (in *CustomAutoScalingSpec) DeepCopyInto(out *CustomAutoScalingSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.MinReplicas != nil {
+		in, out := &in.MinReplicas, &out.MinReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxReplicas != nil {
+		in, out := &in.MaxReplicas, &out.MaxReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Behavior != nil {
+		in, out := &in.Behavior, &out.Behavior
+		*out = new(ScalingBehavior)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Predictive != nil {
+		in, out := &in.Predictive, &out.Predictive
+		*out = new(PredictiveScaling)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScalingSpec.
@@ -125,6 +161,42 @@ func (in *CustomAutoScalingSpec) DeepCopy() *CustomAutoScalingSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CustomAutoScalingStatus) DeepCopyInto(out *CustomAutoScalingStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Forecast != nil {
+		in, out := &in.Forecast, &out.Forecast
+		*out = new(ForecastStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Recommendation != nil {
+		in, out := &in.Recommendation, &out.Recommendation
+		*out = new(Recommendation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastAlert != nil {
+		in, out := &in.LastAlert, &out.LastAlert
+		*out = new(AlertStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastDecision != nil {
+		in, out := &in.LastDecision, &out.LastDecision
+		*out = new(DecisionStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Override != nil {
+		in, out := &in.Override, &out.Override
+		*out = new(OverrideStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScalingStatus.
@@ -136,3 +208,137 @@ func (in *CustomAutoScalingStatus) DeepCopy() *CustomAutoScalingStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DecisionStatus) DeepCopyInto(out *DecisionStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DecisionStatus.
+func (in *DecisionStatus) DeepCopy() *DecisionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DecisionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ForecastStatus) DeepCopyInto(out *ForecastStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ForecastStatus.
+func (in *ForecastStatus) DeepCopy() *ForecastStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ForecastStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OverrideStatus) DeepCopyInto(out *OverrideStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	in.Until.DeepCopyInto(&out.Until)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OverrideStatus.
+func (in *OverrideStatus) DeepCopy() *OverrideStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OverrideStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PredictiveScaling) DeepCopyInto(out *PredictiveScaling) {
+	*out = *in
+	out.Lookback = in.Lookback
+	out.Step = in.Step
+	out.Season = in.Season
+	out.LeadTime = in.LeadTime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PredictiveScaling.
+func (in *PredictiveScaling) DeepCopy() *PredictiveScaling {
+	if in == nil {
+		return nil
+	}
+	out := new(PredictiveScaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Recommendation) DeepCopyInto(out *Recommendation) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Recommendation.
+func (in *Recommendation) DeepCopy() *Recommendation {
+	if in == nil {
+		return nil
+	}
+	out := new(Recommendation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingBehavior) DeepCopyInto(out *ScalingBehavior) {
+	*out = *in
+	if in.ScaleUp != nil {
+		in, out := &in.ScaleUp, &out.ScaleUp
+		*out = new(ScalingRules)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ScaleDown != nil {
+		in, out := &in.ScaleDown, &out.ScaleDown
+		*out = new(ScalingRules)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingBehavior.
+func (in *ScalingBehavior) DeepCopy() *ScalingBehavior {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingBehavior)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingRules) DeepCopyInto(out *ScalingRules) {
+	*out = *in
+	if in.MaxStep != nil {
+		in, out := &in.MaxStep, &out.MaxStep
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Cooldown != nil {
+		in, out := &in.Cooldown, &out.Cooldown
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingRules.
+func (in *ScalingRules) DeepCopy() *ScalingRules {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingRules)
+	in.DeepCopyInto(out)
+	return out
+}
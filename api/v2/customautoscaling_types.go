@@ -0,0 +1,572 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CustomAutoScalingSpec defines the desired state of CustomAutoScaling
+type CustomAutoScalingSpec struct {
+	// Target is the workload scaled by the CR
+	Target ScaleTarget `json:"target"`
+
+	// Metrics are the PromQL expressions that drive scaling. With the Alerts
+	// driver each one becomes an alerting rule named after the metric, with the
+	// HPA driver each one becomes an External metric of the generated HPA
+	// +kubebuilder:validation:MinItems=1
+	// +listType=map
+	// +listMapKey=name
+	Metrics []Metric `json:"metrics"`
+
+	// MinReplicas is the lower bound applied to every scaling decision
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	// MaxReplicas is the upper bound applied to every scaling decision
+	// +optional
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+
+	// Behavior limits how fast the target is scaled in each direction
+	// +optional
+	Behavior *ScalingBehavior `json:"behavior,omitempty"`
+
+	// Mode selects whether decisions are applied to the target or only recommended
+	// +kubebuilder:default=Enforce
+	// +optional
+	Mode ScalingMode `json:"mode,omitempty"`
+
+	// Predictive enables pre-scaling from a forecast of the scaling metric
+	// +optional
+	Predictive *PredictiveScaling `json:"predictive,omitempty"`
+
+	// Monitoring configures the Prometheus instance provisioned for the CR
+	// +optional
+	Monitoring Monitoring `json:"monitoring,omitempty"`
+
+	// Webhook configures how incoming alerts are turned into replica counts
+	// +optional
+	Webhook *WebhookRouting `json:"webhook,omitempty"`
+
+	// Takeover selects what happens when another scaler also targets the deployment
+	// +kubebuilder:default=Never
+	// +optional
+	Takeover TakeoverPolicy `json:"takeover,omitempty"`
+
+	// Driver selects what scales the target
+	// +kubebuilder:default=Alerts
+	// +optional
+	Driver ScalingDriver `json:"driver,omitempty"`
+
+	// Paused stops every scaling decision for the CR while the monitoring
+	// stack is still kept in sync
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// FreezeReplicas pins the target to a replica count until a point in time
+	// +optional
+	FreezeReplicas *ReplicaFreeze `json:"freezeReplicas,omitempty"`
+
+	// Audit configures the ScalingEvents recorded for the decisions of the CR
+	// +optional
+	Audit *AuditLog `json:"audit,omitempty"`
+}
+
+// ReplicaFreeze pins the replicas of the target, alerts and forecasts are
+// ignored and the target is set back to Replicas if something else changes it
+type ReplicaFreeze struct {
+	// Replicas is the replica count the target is held at, bounds and behavior do not apply
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+	// Until is when the freeze ends and scaling resumes
+	Until metav1.Time `json:"until"`
+}
+
+// ScalingDriver selects how scaling decisions are made
+// +kubebuilder:validation:Enum=Alerts;HPA;KEDA
+type ScalingDriver string
+
+const (
+	// AlertsDriver scales on alerts routed from Alertmanager to the operator webhook
+	AlertsDriver ScalingDriver = "Alerts"
+	// HPADriver generates a HorizontalPodAutoscaler that reads the metrics
+	// through the external metrics API served by the operator
+	HPADriver ScalingDriver = "HPA"
+	// KEDADriver leaves scaling to a KEDA ScaledObject of type external that
+	// reads the metrics through the external scaler served by the operator
+	KEDADriver ScalingDriver = "KEDA"
+)
+
+// TakeoverPolicy decides whether the operator scales a target that another scaler also manages
+// +kubebuilder:validation:Enum=Never;Force;Adopt
+type TakeoverPolicy string
+
+const (
+	// TakeoverNever leaves the target alone while a conflict exists
+	TakeoverNever TakeoverPolicy = "Never"
+	// TakeoverForce scales the target regardless of other scalers
+	TakeoverForce TakeoverPolicy = "Force"
+	// TakeoverAdopt copies the bounds of a conflicting HorizontalPodAutoscaler into the CR and deletes it
+	TakeoverAdopt TakeoverPolicy = "Adopt"
+)
+
+// ScaleTarget identifies the deployment to scale and the service its metrics are scraped from
+type ScaleTarget struct {
+	// Name of the deployment
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Service exposing the deployment metrics, defaults to the deployment name
+	// +optional
+	Service string `json:"service,omitempty"`
+	// Port the service serves metrics on
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+}
+
+// Metric is a PromQL expression evaluated by the provisioned Prometheus
+type Metric struct {
+	// Name is used as the alert name of the generated rule, or as the external
+	// metric name with the HPA driver
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Query is the PromQL expression, the alert fires while it returns samples
+	// and the HPA driver reads its value
+	// +kubebuilder:validation:MinLength=1
+	Query string `json:"query"`
+	// TargetAverageValue is the value of the query per replica the HPA and KEDA
+	// drivers scale towards, it is required with the HPA driver. Without it the
+	// KEDA driver reports the replicas the alert logic would request
+	// +optional
+	TargetAverageValue *resource.Quantity `json:"targetAverageValue,omitempty"`
+	// Thresholds turn the query into a ladder of alerts, one per step, firing
+	// while the value of the query exceeds the step. The alerts carry the
+	// replicas of their step, which take precedence over the severity mapping.
+	// Without thresholds the alert fires while the query returns samples
+	// +optional
+	Thresholds []Threshold `json:"thresholds,omitempty"`
+	// Recording evaluates the query, or sub-expressions of it, in recording
+	// rules. The alerts and the queries of the operator then read the
+	// recorded series instead of evaluating the expressions every time
+	// +optional
+	Recording *Recording `json:"recording,omitempty"`
+}
+
+// Recording configures the recording rules generated for a metric
+type Recording struct {
+	// Expressions are sub-expressions of the query to record, each of them
+	// is replaced in the query by its recorded series. Without expressions
+	// the whole query is recorded
+	// +optional
+	Expressions []string `json:"expressions,omitempty"`
+	// Interval is how often the recording rules are evaluated, defaults to
+	// the evaluation interval of Prometheus
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// Threshold is a step of the alert ladder of a metric
+type Threshold struct {
+	// Name is the alert name of the step, defaults to the name of the metric.
+	// Steps sharing a name are told apart by their severity
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Severity is the severity label of the alert of the step, it lets the
+	// generated inhibit rules silence the lower steps of a firing one
+	// +optional
+	Severity string `json:"severity,omitempty"`
+	// Value the query has to exceed for the step to fire
+	Value resource.Quantity `json:"value"`
+	// For is how long the value has to exceed the step before the alert fires,
+	// defaults to 10s
+	// +optional
+	For *metav1.Duration `json:"for,omitempty"`
+	// Replicas the step asks for while its alert fires
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+}
+
+// DefaultThresholdFor is how long a step has to be exceeded before its alert fires
+const DefaultThresholdFor = 10 * time.Second
+
+// AlertName returns the alert name of step t of metric m
+func (t Threshold) AlertName(m Metric) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return m.Name
+}
+
+// ForDuration returns how long step t has to be exceeded before its alert fires
+func (t Threshold) ForDuration() time.Duration {
+	if t.For != nil {
+		return t.For.Duration
+	}
+	return DefaultThresholdFor
+}
+
+// Monitoring configures the Prometheus instance provisioned for the CR
+type Monitoring struct {
+	// Resources of the Prometheus pods
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Replicas of the Prometheus instance, defaults to 3
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Retention is how long samples are kept, defaults to 20d
+	// +optional
+	Retention string `json:"retention,omitempty"`
+	// RemoteWrite accepts metrics pushed with the Prometheus remote write
+	// protocol into the Prometheus instance
+	// +optional
+	RemoteWrite *RemoteWrite `json:"remoteWrite,omitempty"`
+	// Embedded replaces the monitoring stack by the operator, which scrapes
+	// the target itself and evaluates the queries over a short window of
+	// samples. No Prometheus or Alertmanager is provisioned, the queries are
+	// restricted to the subset of PromQL the operator evaluates
+	// +optional
+	Embedded *EmbeddedMonitoring `json:"embedded,omitempty"`
+}
+
+// EmbeddedSource selects the endpoints the operator scrapes in embedded mode
+// +kubebuilder:validation:Enum=Pods;Service
+type EmbeddedSource string
+
+const (
+	// PodsSource scrapes every ready pod of the target on the target port
+	PodsSource EmbeddedSource = "Pods"
+	// ServiceSource scrapes the target service on the target port, which
+	// reaches one of its pods per scrape
+	ServiceSource EmbeddedSource = "Service"
+)
+
+// Defaults of the embedded monitoring of a CR
+const (
+	DefaultEmbeddedPath     = "/metrics"
+	DefaultEmbeddedInterval = 15 * time.Second
+	DefaultEmbeddedWindow   = 5 * time.Minute
+)
+
+// EmbeddedMonitoring configures the scraping and the evaluation of the
+// queries done by the operator
+type EmbeddedMonitoring struct {
+	// Source selects whether the pods of the target or its service are scraped
+	// +kubebuilder:default=Pods
+	// +optional
+	Source EmbeddedSource `json:"source,omitempty"`
+	// Path the target serves its metrics on, defaults to /metrics
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Interval between two scrapes, defaults to 15s
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Window is how long samples are kept, it has to cover the longest range
+	// selected by a query. Defaults to 5m
+	// +optional
+	Window *metav1.Duration `json:"window,omitempty"`
+}
+
+// MetricsPath returns the path scraped on the target
+func (e *EmbeddedMonitoring) MetricsPath() string {
+	if e.Path != "" {
+		return e.Path
+	}
+	return DefaultEmbeddedPath
+}
+
+// ScrapeInterval returns the time between two scrapes of the target
+func (e *EmbeddedMonitoring) ScrapeInterval() time.Duration {
+	if e.Interval != nil {
+		return e.Interval.Duration
+	}
+	return DefaultEmbeddedInterval
+}
+
+// WindowDuration returns how long scraped samples are kept
+func (e *EmbeddedMonitoring) WindowDuration() time.Duration {
+	if e.Window != nil {
+		return e.Window.Duration
+	}
+	return DefaultEmbeddedWindow
+}
+
+// RemoteWrite configures the remote write endpoint of a CR. Requests carry
+// the bearer token of the signals API of the CR and are forwarded to its
+// Prometheus by the operator
+type RemoteWrite struct {
+	// Series are the metric names the queries of the CR read from pushed
+	// samples, the samples of any other series are dropped
+	// +kubebuilder:validation:MinItems=1
+	Series []string `json:"series"`
+}
+
+// Accepts reports whether samples of the series called name are let through
+func (w *RemoteWrite) Accepts(name string) bool {
+	for _, series := range w.Series {
+		if series == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookRouting configures how alerts received on the webhook are handled
+type WebhookRouting struct {
+	// SeverityReplicas maps an alert severity to the replica count it requests,
+	// severities missing from the map use the built-in critical=5, warning=3, other=1
+	// +optional
+	SeverityReplicas map[string]int32 `json:"severityReplicas,omitempty"`
+}
+
+// ScalingMode controls what happens to a scaling decision
+// +kubebuilder:validation:Enum=Enforce;Recommend
+type ScalingMode string
+
+const (
+	// EnforceMode updates the target deployment
+	EnforceMode ScalingMode = "Enforce"
+	// RecommendMode only records the decision in status, events and metrics
+	RecommendMode ScalingMode = "Recommend"
+)
+
+// ScalingBehavior configures the scale up and scale down rules
+type ScalingBehavior struct {
+	// +optional
+	ScaleUp *ScalingRules `json:"scaleUp,omitempty"`
+	// +optional
+	ScaleDown *ScalingRules `json:"scaleDown,omitempty"`
+}
+
+// ScalingRules limits the decisions made in one direction
+type ScalingRules struct {
+	// MaxStep caps the replica change of a single decision
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxStep *int32 `json:"maxStep,omitempty"`
+	// Cooldown is the minimum time since the last scale before scaling again
+	// +optional
+	Cooldown *metav1.Duration `json:"cooldown,omitempty"`
+}
+
+// PredictiveModel names the model used to forecast the scaling metric
+// +kubebuilder:validation:Enum=HoltWinters;Profile
+type PredictiveModel string
+
+const (
+	// HoltWintersModel fits additive triple exponential smoothing over the lookback
+	HoltWintersModel PredictiveModel = "HoltWinters"
+	// ProfileModel averages the lookback by day-of-week and hour
+	ProfileModel PredictiveModel = "Profile"
+)
+
+// PredictiveScaling defines how the scaling metric is forecast from its history
+type PredictiveScaling struct {
+	// Query is the PromQL expression to forecast, defaults to the first metric
+	// +optional
+	Query string `json:"query,omitempty"`
+	// Model selects the forecasting model
+	// +kubebuilder:default=HoltWinters
+	// +optional
+	Model PredictiveModel `json:"model,omitempty"`
+	// Lookback is the range of history pulled through query_range
+	// +kubebuilder:default="168h"
+	// +optional
+	Lookback metav1.Duration `json:"lookback,omitempty"`
+	// Step is the query_range resolution and the interval between forecasts
+	// +kubebuilder:default="5m"
+	// +optional
+	Step metav1.Duration `json:"step,omitempty"`
+	// Season is the length of one seasonal cycle
+	// +kubebuilder:default="24h"
+	// +optional
+	Season metav1.Duration `json:"season,omitempty"`
+	// LeadTime is how far ahead of the forecast load the target is scaled
+	// +kubebuilder:default="10m"
+	// +optional
+	LeadTime metav1.Duration `json:"leadTime,omitempty"`
+	// TargetValuePerReplica is the metric value a single replica absorbs
+	TargetValuePerReplica string `json:"targetValuePerReplica"`
+}
+
+// SkipReconcileAnnotation pauses the reconciliation of a CR while it is set
+const SkipReconcileAnnotation = "buildpiper.opstreelabs.in/skip-reconcile"
+
+const (
+	// OverrideReplicasAnnotation asks the operator to scale the target to the
+	// given replica count once. The operator removes the annotation when it acts
+	// on it and holds the target there for OverrideDurationAnnotation
+	OverrideReplicasAnnotation = "buildpiper.opstreelabs.in/override-replicas"
+	// OverrideDurationAnnotation is how long the override holds the target,
+	// a Go duration that defaults to DefaultOverrideDuration
+	OverrideDurationAnnotation = "buildpiper.opstreelabs.in/override-duration"
+	// DefaultOverrideDuration is how long an override without a duration lasts
+	DefaultOverrideDuration = time.Hour
+)
+
+// Condition types reported in CustomAutoScalingStatus.Conditions
+const (
+	// ConditionProvisioned is true once every child resource of the CR exists
+	ConditionProvisioned = "Provisioned"
+	// ConditionScalingConflict is true while another scaler targets the same deployment
+	ConditionScalingConflict = "ScalingConflict"
+	// ConditionPaused is true while spec.paused is set
+	ConditionPaused = "Paused"
+	// ConditionFrozen is true while spec.freezeReplicas pins the target
+	ConditionFrozen = "Frozen"
+	// ConditionOverridden is true while a manual override holds the target
+	ConditionOverridden = "Overridden"
+	// ConditionRuleLoaded is true while the managed Prometheus evaluates the
+	// generated alerting rules without errors, it is only set with the Alerts driver
+	ConditionRuleLoaded = "RuleLoaded"
+	// ConditionTargetsHealthy is true while every target the managed
+	// Prometheus, or the operator in embedded mode, scrapes for the CR is up
+	ConditionTargetsHealthy = "TargetsHealthy"
+)
+
+// CustomAutoScalingStatus defines the observed state of CustomAutoScaling
+type CustomAutoScalingStatus struct {
+	Replicas int32 `json:"replicas"`
+
+	// Conditions describe the provisioning and scaling state of the CR
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Forecast is the latest predictive scaling result
+	// +optional
+	Forecast *ForecastStatus `json:"forecast,omitempty"`
+
+	// LastScaleTime is when the target was last scaled by the operator
+	// +optional
+	LastScaleTime *metav1.Time `json:"lastScaleTime,omitempty"`
+
+	// Recommendation is the latest change of the replicas recommended in
+	// Recommend mode, the cooldown counts from its time
+	// +optional
+	Recommendation *Recommendation `json:"recommendation,omitempty"`
+
+	// LastAlert is the latest firing alert received for the CR
+	// +optional
+	LastAlert *AlertStatus `json:"lastAlert,omitempty"`
+
+	// LastDecision is the latest scaling decision made for the CR
+	// +optional
+	LastDecision *DecisionStatus `json:"lastDecision,omitempty"`
+
+	// Override is the manual override holding the target, if any
+	// +optional
+	Override *OverrideStatus `json:"override,omitempty"`
+}
+
+// OverrideStatus records a manual override taken from OverrideReplicasAnnotation
+type OverrideStatus struct {
+	// Replicas is the replica count the target was scaled to
+	Replicas int32 `json:"replicas"`
+	// Time is when the override was applied
+	Time metav1.Time `json:"time"`
+	// Until is when the override expires and scaling resumes
+	Until metav1.Time `json:"until"`
+}
+
+// Recommendation is a scaling decision that was not applied to the target
+type Recommendation struct {
+	// Time is when the decision was made
+	Time metav1.Time `json:"time"`
+	// CurrentReplicas is the replica count of the target at that time
+	CurrentReplicas int32 `json:"currentReplicas"`
+	// DesiredReplicas is the replica count the operator would have set
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Reason describes what triggered the decision
+	Reason string `json:"reason"`
+}
+
+// AlertStatus identifies an alert received by the webhook
+type AlertStatus struct {
+	// Name is the alertname label of the alert
+	Name string `json:"name"`
+	// Severity is the severity label of the alert
+	// +optional
+	Severity string `json:"severity,omitempty"`
+	// Time is when the alert was received
+	Time metav1.Time `json:"time"`
+}
+
+// DecisionStatus explains a scaling decision
+type DecisionStatus struct {
+	// Time is when the decision was made
+	Time metav1.Time `json:"time"`
+	// CurrentReplicas is the replica count of the target at that time
+	CurrentReplicas int32 `json:"currentReplicas"`
+	// DesiredReplicas is the replica count asked for before bounds and behavior
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Replicas is the replica count decided on
+	Replicas int32 `json:"replicas"`
+	// Reason describes what triggered the decision
+	Reason string `json:"reason"`
+	// Clamped names the replica bound that changed the desired count
+	// +optional
+	Clamped string `json:"clamped,omitempty"`
+	// Limited names the behavior rule that held back the change
+	// +optional
+	Limited string `json:"limited,omitempty"`
+	// Applied is true when the target was scaled to Replicas
+	Applied bool `json:"applied"`
+}
+
+// ForecastStatus records the forecast against the value actually observed
+type ForecastStatus struct {
+	// Time is when the forecast was computed
+	Time metav1.Time `json:"time"`
+	// Value is the forecast metric value at Time plus the lead time
+	Value string `json:"value"`
+	// Actual is the last observed metric value
+	Actual string `json:"actual"`
+	// Replicas is the replica count implied by the forecast, within the
+	// replica bounds of the CR
+	Replicas int32 `json:"replicas"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+
+// CustomAutoScaling is the Schema for the customautoscalings API
+type CustomAutoScaling struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CustomAutoScalingSpec   `json:"spec,omitempty"`
+	Status CustomAutoScalingStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// CustomAutoScalingList contains a list of CustomAutoScaling
+type CustomAutoScalingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CustomAutoScaling `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CustomAutoScaling{}, &CustomAutoScalingList{})
+}
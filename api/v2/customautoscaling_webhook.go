@@ -0,0 +1,442 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"buildpiper.opstreelabs.in/autoscaler/evaluator"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var customautoscalinglog = logf.Log.WithName("customautoscaling-resource")
+
+// webhookClient is used by the validator to find other CRs targeting the same workload
+var webhookClient client.Reader
+
+func (r *CustomAutoScaling) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookClient = mgr.GetAPIReader()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-buildpiper-opstreelabs-in-v2-customautoscaling,mutating=true,failurePolicy=fail,sideEffects=None,groups=buildpiper.opstreelabs.in,resources=customautoscalings,verbs=create;update,versions=v2,name=mcustomautoscaling.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &CustomAutoScaling{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *CustomAutoScaling) Default() {
+	customautoscalinglog.Info("default", "name", r.Name)
+
+	if r.Spec.Target.Service == "" {
+		r.Spec.Target.Service = r.Spec.Target.Name
+	}
+	if r.Spec.Mode == "" {
+		r.Spec.Mode = EnforceMode
+	}
+	if r.Spec.Takeover == "" {
+		r.Spec.Takeover = TakeoverNever
+	}
+	if r.Spec.Driver == "" {
+		r.Spec.Driver = AlertsDriver
+	}
+
+	if p := r.Spec.Predictive; p != nil {
+		if p.Model == "" {
+			p.Model = HoltWintersModel
+		}
+		defaultDuration(&p.Lookback, 168*time.Hour)
+		defaultDuration(&p.Step, 5*time.Minute)
+		defaultDuration(&p.Season, 24*time.Hour)
+		defaultDuration(&p.LeadTime, 10*time.Minute)
+	}
+}
+
+func defaultDuration(d *metav1.Duration, value time.Duration) {
+	if d.Duration == 0 {
+		d.Duration = value
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-buildpiper-opstreelabs-in-v2-customautoscaling,mutating=false,failurePolicy=fail,sideEffects=None,groups=buildpiper.opstreelabs.in,resources=customautoscalings,verbs=create;update,versions=v2,name=vcustomautoscaling.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &CustomAutoScaling{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *CustomAutoScaling) ValidateCreate() error {
+	customautoscalinglog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *CustomAutoScaling) ValidateUpdate(old runtime.Object) error {
+	customautoscalinglog.Info("validate update", "name", r.Name)
+
+	// let objects that are being deleted drop their finalizer even if their spec became invalid
+	if r.GetDeletionTimestamp() != nil {
+		return nil
+	}
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *CustomAutoScaling) ValidateDelete() error {
+	return nil
+}
+
+func (r *CustomAutoScaling) validate() error {
+	allErrs := r.Spec.validate(field.NewPath("spec"))
+	if _, _, _, err := r.RequestedOverride(); err != nil {
+		allErrs = append(allErrs, err)
+	}
+
+	if len(allErrs) == 0 {
+		if err := r.validateUniqueTarget(); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("CustomAutoScaling").GroupKind(), r.Name, allErrs)
+}
+
+// validate checks the spec without looking at the cluster
+func (s *CustomAutoScalingSpec) validate(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	targetPath := path.Child("target")
+	if s.Target.Name == "" {
+		allErrs = append(allErrs, field.Required(targetPath.Child("name"), ""))
+	}
+	if s.Target.Port < 1 || s.Target.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(targetPath.Child("port"), s.Target.Port, "must be a port number between 1 and 65535"))
+	}
+
+	if len(s.Metrics) == 0 {
+		allErrs = append(allErrs, field.Required(path.Child("metrics"), "at least one metric is required"))
+	}
+	names := map[string]bool{}
+	alerts := map[string]bool{}
+	for i, m := range s.Metrics {
+		metricPath := path.Child("metrics").Index(i)
+		if m.Name == "" {
+			allErrs = append(allErrs, field.Required(metricPath.Child("name"), ""))
+		} else if names[m.Name] {
+			allErrs = append(allErrs, field.Duplicate(metricPath.Child("name"), m.Name))
+		}
+		names[m.Name] = true
+
+		if m.Query == "" {
+			allErrs = append(allErrs, field.Required(metricPath.Child("query"), ""))
+		} else if _, err := parser.ParseExpr(m.Query); err != nil {
+			allErrs = append(allErrs, field.Invalid(metricPath.Child("query"), m.Query, err.Error()))
+		}
+
+		allErrs = append(allErrs, m.validateThresholds(metricPath, alerts)...)
+		allErrs = append(allErrs, m.validateRecording(metricPath)...)
+
+		if s.Driver == HPADriver {
+			if m.TargetAverageValue == nil {
+				allErrs = append(allErrs, field.Required(metricPath.Child("targetAverageValue"), "required with the HPA driver"))
+			} else if m.TargetAverageValue.Sign() <= 0 {
+				allErrs = append(allErrs, field.Invalid(metricPath.Child("targetAverageValue"), m.TargetAverageValue.String(), "must be positive"))
+			}
+		}
+	}
+
+	if r := s.Monitoring.Replicas; r != nil && *r < 1 {
+		allErrs = append(allErrs, field.Invalid(path.Child("monitoring", "replicas"), *r, "must be at least 1"))
+	}
+	if retention := s.Monitoring.Retention; retention != "" {
+		if _, err := model.ParseDuration(retention); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("monitoring", "retention"), retention, err.Error()))
+		}
+	}
+	if w := s.Monitoring.RemoteWrite; w != nil {
+		seriesPath := path.Child("monitoring", "remoteWrite", "series")
+		if len(w.Series) == 0 {
+			allErrs = append(allErrs, field.Required(seriesPath, "at least one series is required"))
+		}
+		for i, series := range w.Series {
+			if !model.IsValidMetricName(model.LabelValue(series)) {
+				allErrs = append(allErrs, field.Invalid(seriesPath.Index(i), series, "must be a metric name"))
+			}
+		}
+	}
+	if s.Monitoring.Embedded != nil {
+		allErrs = append(allErrs, s.validateEmbedded(path)...)
+	}
+
+	if s.Webhook != nil {
+		for severity, replicas := range s.Webhook.SeverityReplicas {
+			if replicas < 0 {
+				allErrs = append(allErrs, field.Invalid(path.Child("webhook", "severityReplicas").Key(severity), replicas, "must not be negative"))
+			}
+		}
+	}
+
+	if s.MinReplicas != nil && *s.MinReplicas < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("minReplicas"), *s.MinReplicas, "must not be negative"))
+	}
+	if s.MaxReplicas != nil && *s.MaxReplicas < 1 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxReplicas"), *s.MaxReplicas, "must be at least 1"))
+	}
+	if s.MinReplicas != nil && s.MaxReplicas != nil && *s.MinReplicas > *s.MaxReplicas {
+		allErrs = append(allErrs, field.Invalid(path.Child("minReplicas"), *s.MinReplicas, fmt.Sprintf("must not be greater than maxReplicas (%d)", *s.MaxReplicas)))
+	}
+
+	if f := s.FreezeReplicas; f != nil {
+		if f.Replicas < 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("freezeReplicas", "replicas"), f.Replicas, "must not be negative"))
+		}
+		if f.Until.IsZero() {
+			allErrs = append(allErrs, field.Required(path.Child("freezeReplicas", "until"), ""))
+		}
+	}
+
+	if s.Mode != "" && s.Mode != EnforceMode && s.Mode != RecommendMode {
+		allErrs = append(allErrs, field.NotSupported(path.Child("mode"), s.Mode, []string{string(EnforceMode), string(RecommendMode)}))
+	}
+
+	if s.Predictive != nil {
+		allErrs = append(allErrs, s.Predictive.validate(path.Child("predictive"))...)
+	}
+
+	switch s.Driver {
+	case "", AlertsDriver:
+	case HPADriver, KEDADriver:
+		allErrs = append(allErrs, s.validateExternalDriver(path)...)
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("driver"), s.Driver, []string{string(AlertsDriver), string(HPADriver), string(KEDADriver)}))
+	}
+
+	return allErrs
+}
+
+// validateThresholds checks the alert ladder of m, alerts holds the alert
+// name and severity pairs of the metrics before m so alerts stay distinct
+func (m Metric) validateThresholds(path *field.Path, alerts map[string]bool) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if len(m.Thresholds) == 0 {
+		alerts[m.Name+"/"] = true
+		return nil
+	}
+	if m.TargetAverageValue != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("thresholds"), "cannot be combined with targetAverageValue"))
+	}
+	for i, t := range m.Thresholds {
+		stepPath := path.Child("thresholds").Index(i)
+		if t.Name == "" && t.Severity == "" {
+			allErrs = append(allErrs, field.Required(stepPath.Child("severity"), "a step needs a severity or a name"))
+		}
+		if key := t.AlertName(m) + "/" + t.Severity; alerts[key] {
+			allErrs = append(allErrs, field.Duplicate(stepPath, fmt.Sprintf("alert %s with severity %q", t.AlertName(m), t.Severity)))
+		} else {
+			alerts[key] = true
+		}
+		if t.Replicas < 0 {
+			allErrs = append(allErrs, field.Invalid(stepPath.Child("replicas"), t.Replicas, "must not be negative"))
+		}
+		if t.For != nil && t.For.Duration < 0 {
+			allErrs = append(allErrs, field.Invalid(stepPath.Child("for"), t.For.Duration.String(), "must not be negative"))
+		}
+	}
+	return allErrs
+}
+
+// validateRecording checks that every expression to record is part of the query of m
+func (m Metric) validateRecording(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if m.Recording == nil {
+		return nil
+	}
+	recordingPath := path.Child("recording")
+	// an invalid query is reported on its own
+	if _, err := parser.ParseExpr(m.Query); err == nil {
+		if _, err := m.recordedQuery(""); err != nil {
+			allErrs = append(allErrs, field.Invalid(recordingPath.Child("expressions"), m.Recording.Expressions, err.Error()))
+		}
+	}
+	if i := m.Recording.Interval; i != nil && i.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(recordingPath.Child("interval"), i.Duration.String(), "must be positive"))
+	}
+	return allErrs
+}
+
+// validateExternalDriver rejects the fields a driver that leaves scaling to an
+// HPA cannot honour
+func (s *CustomAutoScalingSpec) validateExternalDriver(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	// KEDA takes the bounds from the ScaledObject
+	if s.Driver == HPADriver {
+		if s.MaxReplicas == nil {
+			allErrs = append(allErrs, field.Required(path.Child("maxReplicas"), "required with the HPA driver"))
+		}
+		if s.MinReplicas != nil && *s.MinReplicas < 1 {
+			allErrs = append(allErrs, field.Invalid(path.Child("minReplicas"), *s.MinReplicas, "must be at least 1 with the HPA driver"))
+		}
+	}
+	if s.Mode == RecommendMode {
+		allErrs = append(allErrs, field.Invalid(path.Child("mode"), s.Mode, fmt.Sprintf("the %s driver always applies its decisions", s.Driver)))
+	}
+	// the forecast would scale the deployment behind the back of the HPA
+	if s.Predictive != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("predictive"), fmt.Sprintf("not supported with the %s driver", s.Driver)))
+	}
+
+	return allErrs
+}
+
+func (p *PredictiveScaling) validate(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if p.Query != "" {
+		if _, err := parser.ParseExpr(p.Query); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("query"), p.Query, err.Error()))
+		}
+	}
+
+	if value, err := strconv.ParseFloat(p.TargetValuePerReplica, 64); err != nil || value <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("targetValuePerReplica"), p.TargetValuePerReplica, "must be a positive number"))
+	}
+
+	durations := []struct {
+		name string
+		d    metav1.Duration
+	}{{"lookback", p.Lookback}, {"step", p.Step}, {"season", p.Season}, {"leadTime", p.LeadTime}}
+	for _, d := range durations {
+		if d.d.Duration < 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child(d.name), d.d.Duration.String(), "must not be negative"))
+		}
+	}
+	// both models split the history into seasons of season/step samples
+	if p.Step.Duration > 0 && p.Season.Duration/p.Step.Duration < 2 {
+		allErrs = append(allErrs, field.Invalid(path.Child("season"), p.Season.Duration.String(), "must be at least two steps long"))
+	}
+	// Holt-Winters seeds its trend from the first two seasons of history
+	if p.Model == HoltWintersModel && p.Season.Duration > 0 && p.Lookback.Duration < 2*p.Season.Duration {
+		allErrs = append(allErrs, field.Invalid(path.Child("lookback"), p.Lookback.Duration.String(), "must cover at least two seasons for HoltWinters"))
+	}
+
+	return allErrs
+}
+
+// RequestedOverride returns the manual override asked for through
+// OverrideReplicasAnnotation and OverrideDurationAnnotation, ok is false when
+// none is
+func (r *CustomAutoScaling) RequestedOverride() (int32, time.Duration, bool, *field.Error) {
+	path := field.NewPath("metadata", "annotations")
+	value, found := r.Annotations[OverrideReplicasAnnotation]
+	if !found {
+		return 0, 0, false, nil
+	}
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || replicas < 0 {
+		return 0, 0, false, field.Invalid(path.Key(OverrideReplicasAnnotation), value, "must be a replica count")
+	}
+
+	duration := DefaultOverrideDuration
+	if value, found := r.Annotations[OverrideDurationAnnotation]; found {
+		duration, err = time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return 0, 0, false, field.Invalid(path.Key(OverrideDurationAnnotation), value, "must be a positive duration")
+		}
+	}
+	return int32(replicas), duration, true, nil
+}
+
+// validateUniqueTarget rejects a CR whose deployment is already scaled by another CR
+func (r *CustomAutoScaling) validateUniqueTarget() *field.Error {
+	if webhookClient == nil {
+		return nil
+	}
+
+	list := &CustomAutoScalingList{}
+	if err := webhookClient.List(context.Background(), list, client.InNamespace(r.Namespace)); err != nil {
+		return field.InternalError(field.NewPath("spec", "target", "name"), err)
+	}
+
+	for _, other := range list.Items {
+		if other.Name == r.Name || other.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if other.Spec.Target.Name == r.Spec.Target.Name {
+			return field.Duplicate(field.NewPath("spec", "target", "name"),
+				fmt.Sprintf("%s (already scaled by %s)", r.Spec.Target.Name, other.Name))
+		}
+	}
+	return nil
+}
+
+// validateEmbedded checks that the queries of the spec can be evaluated by
+// the operator and that nothing needing a Prometheus is asked for
+func (s *CustomAutoScalingSpec) validateEmbedded(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	e := s.Monitoring.Embedded
+	embeddedPath := path.Child("monitoring", "embedded")
+
+	if e.Interval != nil && e.Interval.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(embeddedPath.Child("interval"), e.Interval.Duration.String(), "must be positive"))
+	}
+	if e.WindowDuration() < 2*e.ScrapeInterval() {
+		allErrs = append(allErrs, field.Invalid(embeddedPath.Child("window"), e.WindowDuration().String(), "must hold at least two scrapes"))
+	}
+	if e.Path != "" && !strings.HasPrefix(e.Path, "/") {
+		allErrs = append(allErrs, field.Invalid(embeddedPath.Child("path"), e.Path, "must start with /"))
+	}
+
+	for i, m := range s.Metrics {
+		queryPath := path.Child("metrics").Index(i).Child("query")
+		expr, err := evaluator.Parse(m.Query)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(queryPath, m.Query, "not supported in embedded mode: "+err.Error()))
+		} else if expr.Range() > e.WindowDuration() {
+			allErrs = append(allErrs, field.Invalid(queryPath, m.Query,
+				fmt.Sprintf("selects %s, more than the %s window of embedded mode", expr.Range(), e.WindowDuration())))
+		}
+		if m.Recording != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("metrics").Index(i).Child("recording"), "recording rules need a Prometheus, not available in embedded mode"))
+		}
+	}
+	if s.Predictive != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("predictive"), "forecasts need the history of a Prometheus, not available in embedded mode"))
+	}
+	if s.Monitoring.RemoteWrite != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("monitoring", "remoteWrite"), "remote write needs a Prometheus, not available in embedded mode"))
+	}
+	return allErrs
+}
@@ -0,0 +1,259 @@
+package v2
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func validCR() *CustomAutoScaling {
+	return &CustomAutoScaling{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: CustomAutoScalingSpec{
+			Target:  ScaleTarget{Name: "demo", Service: "demo", Port: 8080},
+			Metrics: []Metric{{Name: "requests", Query: `sum(rate(http_requests_total{job="demo"}[1m])) > 100`}},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*CustomAutoScaling)
+		field  string
+	}{
+		{name: "valid"},
+		{name: "no metrics", mutate: func(cr *CustomAutoScaling) { cr.Spec.Metrics = nil }, field: "spec.metrics"},
+		{name: "empty query", mutate: func(cr *CustomAutoScaling) { cr.Spec.Metrics[0].Query = "" }, field: "spec.metrics[0].query"},
+		{name: "unparsable query", mutate: func(cr *CustomAutoScaling) { cr.Spec.Metrics[0].Query = "sum(rate(" }, field: "spec.metrics[0].query"},
+		{name: "duplicate metric", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics = append(cr.Spec.Metrics, Metric{Name: "requests", Query: "up == 0"})
+		}, field: "spec.metrics[1].name"},
+		{name: "port out of range", mutate: func(cr *CustomAutoScaling) { cr.Spec.Target.Port = 70000 }, field: "spec.target.port"},
+		{name: "bad retention", mutate: func(cr *CustomAutoScaling) { cr.Spec.Monitoring.Retention = "a while" }, field: "spec.monitoring.retention"},
+		{name: "valid embedded", mutate: func(cr *CustomAutoScaling) { cr.Spec.Monitoring.Embedded = &EmbeddedMonitoring{} }},
+		{name: "embedded query", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Monitoring.Embedded = &EmbeddedMonitoring{}
+			cr.Spec.Metrics[0].Query = `histogram_quantile(0.99, sum by (le) (rate(latency_bucket[1m])))`
+		}, field: "spec.metrics[0].query"},
+		{name: "embedded range beyond window", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Monitoring.Embedded = &EmbeddedMonitoring{Window: &metav1.Duration{Duration: time.Minute}}
+			cr.Spec.Metrics[0].Query = `sum(rate(http_requests_total[5m]))`
+		}, field: "spec.metrics[0].query"},
+		{name: "embedded window", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Monitoring.Embedded = &EmbeddedMonitoring{Interval: &metav1.Duration{Duration: time.Minute}, Window: &metav1.Duration{Duration: time.Minute}}
+		}, field: "spec.monitoring.embedded.window"},
+		{name: "embedded with remote write", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Monitoring.Embedded = &EmbeddedMonitoring{}
+			cr.Spec.Monitoring.RemoteWrite = &RemoteWrite{Series: []string{"queue_depth"}}
+		}, field: "spec.monitoring.remoteWrite"},
+		{name: "no remote write series", mutate: func(cr *CustomAutoScaling) { cr.Spec.Monitoring.RemoteWrite = &RemoteWrite{} }, field: "spec.monitoring.remoteWrite.series"},
+		{name: "bad remote write series", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Monitoring.RemoteWrite = &RemoteWrite{Series: []string{"queue_depth", "queue-depth"}}
+		}, field: "spec.monitoring.remoteWrite.series[1]"},
+		{name: "min above max", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.MinReplicas, cr.Spec.MaxReplicas = int32Ptr(5), int32Ptr(2)
+		}, field: "spec.minReplicas"},
+		{name: "predictive target", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Predictive = &PredictiveScaling{TargetValuePerReplica: "-1"}
+			cr.Default()
+		}, field: "spec.predictive.targetValuePerReplica"},
+		{name: "predictive lookback", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Predictive = &PredictiveScaling{TargetValuePerReplica: "50", Lookback: metav1.Duration{Duration: 24 * time.Hour}}
+			cr.Default()
+		}, field: "spec.predictive.lookback"},
+		{name: "predictive season shorter than two steps", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Predictive = &PredictiveScaling{TargetValuePerReplica: "50", Step: metav1.Duration{Duration: time.Hour}, Season: metav1.Duration{Duration: 90 * time.Minute}}
+			cr.Default()
+		}, field: "spec.predictive.season"},
+		{name: "hpa driver", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Driver = HPADriver
+			cr.Spec.MaxReplicas = int32Ptr(10)
+			cr.Spec.Metrics[0].TargetAverageValue = resource.NewQuantity(50, resource.DecimalSI)
+		}},
+		{name: "hpa driver without target value", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Driver = HPADriver
+			cr.Spec.MaxReplicas = int32Ptr(10)
+		}, field: "spec.metrics[0].targetAverageValue"},
+		{name: "hpa driver without max", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Driver = HPADriver
+			cr.Spec.Metrics[0].TargetAverageValue = resource.NewQuantity(50, resource.DecimalSI)
+		}, field: "spec.maxReplicas"},
+		{name: "hpa driver in recommend mode", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Driver = HPADriver
+			cr.Spec.Mode = RecommendMode
+			cr.Spec.MaxReplicas = int32Ptr(10)
+			cr.Spec.Metrics[0].TargetAverageValue = resource.NewQuantity(50, resource.DecimalSI)
+		}, field: "spec.mode"},
+		{name: "thresholds", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Thresholds = []Threshold{
+				{Severity: "warning", Value: resource.MustParse("100"), Replicas: 3},
+				{Severity: "critical", Value: resource.MustParse("500"), Replicas: 6},
+			}
+		}},
+		{name: "threshold without severity or name", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Thresholds = []Threshold{{Value: resource.MustParse("100"), Replicas: 3}}
+		}, field: "spec.metrics[0].thresholds[0].severity"},
+		{name: "duplicate threshold", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Thresholds = []Threshold{
+				{Severity: "warning", Value: resource.MustParse("100"), Replicas: 3},
+				{Severity: "warning", Value: resource.MustParse("500"), Replicas: 6},
+			}
+		}, field: "spec.metrics[0].thresholds[1]"},
+		{name: "threshold named after another metric", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics = append(cr.Spec.Metrics, Metric{Name: "latency", Query: "up", Thresholds: []Threshold{
+				{Name: "requests", Value: resource.MustParse("1"), Replicas: 3},
+			}})
+		}, field: "spec.metrics[1].thresholds[0]"},
+		{name: "thresholds with target value", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].TargetAverageValue = resource.NewQuantity(50, resource.DecimalSI)
+			cr.Spec.Metrics[0].Thresholds = []Threshold{{Severity: "warning", Value: resource.MustParse("100"), Replicas: 3}}
+		}, field: "spec.metrics[0].thresholds"},
+		{name: "recording", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Recording = &Recording{Expressions: []string{`rate(http_requests_total{job="demo"}[1m])`}}
+		}},
+		{name: "recording of another expression", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Recording = &Recording{Expressions: []string{`rate(http_requests_total[5m])`}}
+		}, field: "spec.metrics[0].recording.expressions"},
+		{name: "recording interval", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Metrics[0].Recording = &Recording{Interval: &metav1.Duration{}}
+		}, field: "spec.metrics[0].recording.interval"},
+		{name: "keda driver", mutate: func(cr *CustomAutoScaling) { cr.Spec.Driver = KEDADriver }},
+		{name: "keda driver with predictive", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.Driver = KEDADriver
+			cr.Spec.Predictive = &PredictiveScaling{TargetValuePerReplica: "50"}
+			cr.Default()
+		}, field: "spec.predictive"},
+		{name: "freeze", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.FreezeReplicas = &ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(time.Now().Add(time.Hour))}
+		}},
+		{name: "freeze without until", mutate: func(cr *CustomAutoScaling) {
+			cr.Spec.FreezeReplicas = &ReplicaFreeze{Replicas: 4}
+		}, field: "spec.freezeReplicas.until"},
+		{name: "override", mutate: func(cr *CustomAutoScaling) {
+			cr.Annotations = map[string]string{OverrideReplicasAnnotation: "6", OverrideDurationAnnotation: "30m"}
+		}},
+		{name: "override without a count", mutate: func(cr *CustomAutoScaling) {
+			cr.Annotations = map[string]string{OverrideReplicasAnnotation: "lots"}
+		}, field: "metadata.annotations[" + OverrideReplicasAnnotation + "]"},
+		{name: "override with a bad duration", mutate: func(cr *CustomAutoScaling) {
+			cr.Annotations = map[string]string{OverrideReplicasAnnotation: "6", OverrideDurationAnnotation: "-1h"}
+		}, field: "metadata.annotations[" + OverrideDurationAnnotation + "]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := validCR()
+			if tt.mutate != nil {
+				tt.mutate(cr)
+			}
+
+			err := cr.ValidateCreate()
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("ValidateCreate() = %v, want nil", err)
+				}
+				return
+			}
+			if !apierrors.IsInvalid(err) {
+				t.Fatalf("ValidateCreate() = %v, want an Invalid error", err)
+			}
+			if !strings.Contains(err.Error(), tt.field) {
+				t.Errorf("ValidateCreate() = %v, want an error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidateUniqueTarget(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := validCR()
+	existing.Name = "existing"
+	webhookClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing).Build()
+	defer func() { webhookClient = nil }()
+
+	if err := validCR().ValidateCreate(); err == nil || !strings.Contains(err.Error(), "already scaled by existing") {
+		t.Errorf("ValidateCreate() = %v, want a duplicate target error", err)
+	}
+
+	// updating the CR that owns the target is allowed
+	if err := existing.ValidateUpdate(existing.DeepCopy()); err != nil {
+		t.Errorf("ValidateUpdate() = %v, want nil", err)
+	}
+
+	other := validCR()
+	other.Spec.Target.Name = "other"
+	if err := other.ValidateCreate(); err != nil {
+		t.Errorf("ValidateCreate() = %v, want nil for a different target", err)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	cr := validCR()
+	cr.Spec.Target.Service = ""
+	cr.Spec.Predictive = &PredictiveScaling{TargetValuePerReplica: "50", Step: metav1.Duration{Duration: time.Minute}}
+	cr.Default()
+
+	if cr.Spec.Target.Service != "demo" {
+		t.Errorf("target service = %q, want the deployment name", cr.Spec.Target.Service)
+	}
+	if cr.Spec.Mode != EnforceMode {
+		t.Errorf("mode = %q, want %q", cr.Spec.Mode, EnforceMode)
+	}
+	p := cr.Spec.Predictive
+	if p.Model != HoltWintersModel || p.Lookback.Duration != 168*time.Hour || p.Season.Duration != 24*time.Hour || p.LeadTime.Duration != 10*time.Minute {
+		t.Errorf("predictive defaults not applied: %+v", p)
+	}
+	if p.Step.Duration != time.Minute {
+		t.Errorf("step = %s, want the user value 1m", p.Step.Duration)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		recording *Recording
+		want      string
+	}{
+		{name: "not recorded", query: "up == 0", want: "up == 0"},
+		{name: "whole query", query: "up == 0", recording: &Recording{}, want: "customautoscaling:demo:web_requests"},
+		{
+			name:  "sub-expressions",
+			query: `sum(rate(http_requests_total{job="demo"}[5m])) / sum(rate(http_requests_total[5m])) > 0.5`,
+			recording: &Recording{Expressions: []string{
+				`sum(rate(http_requests_total{job="demo"}[5m]))`,
+				// the expression is matched whatever its formatting
+				`sum( rate(http_requests_total[5m]) )`,
+			}},
+			want: "customautoscaling:demo:web_requests:0 / customautoscaling:demo:web_requests:1 > 0.5",
+		},
+		{
+			name:      "expression not in the query",
+			query:     "up == 0",
+			recording: &Recording{Expressions: []string{"up == 1"}},
+			want:      "up == 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := validCR()
+			m := Metric{Name: "web-requests", Query: tt.query, Recording: tt.recording}
+			if got := cr.Query(m); got != tt.want {
+				t.Errorf("Query() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
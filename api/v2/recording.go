@@ -0,0 +1,103 @@
+package v2
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// invalidSeriesChars matches what a metric name cannot hold
+var invalidSeriesChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// RecordedSeries returns the name of the series recording expression i of the
+// recording of metric m of the CR name, i is -1 for the whole query:
+//
+//	customautoscaling:<cr>:<metric>      the whole query
+//	customautoscaling:<cr>:<metric>:<i>  recording.expressions[i]
+func RecordedSeries(name string, m Metric, i int) string {
+	series := "customautoscaling:" + name + ":" + m.Name
+	if i >= 0 {
+		series += ":" + strconv.Itoa(i)
+	}
+	return invalidSeriesChars.ReplaceAllString(series, "_")
+}
+
+// Query returns the query of metric m as evaluated by the alerts and the
+// operator, reading the recorded series in place of the recorded expressions
+func (r *CustomAutoScaling) Query(m Metric) string {
+	query, err := m.recordedQuery(r.Name)
+	if err != nil {
+		return m.Query
+	}
+	return query
+}
+
+// recordedQuery rewrites the query of m to read the series recorded for the
+// CR name, it fails when an expression to record is not part of the query
+func (m Metric) recordedQuery(name string) (string, error) {
+	if m.Recording == nil {
+		return m.Query, nil
+	}
+	if len(m.Recording.Expressions) == 0 {
+		return RecordedSeries(name, m, -1), nil
+	}
+
+	query, err := parser.ParseExpr(m.Query)
+	if err != nil {
+		return "", err
+	}
+	for i, expr := range m.Recording.Expressions {
+		sub, err := parser.ParseExpr(expr)
+		if err != nil {
+			return "", fmt.Errorf("expressions[%d]: %w", i, err)
+		}
+		series := RecordedSeries(name, m, i)
+		selector := &parser.VectorSelector{
+			Name:          series,
+			LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, series)},
+		}
+		var found bool
+		if query, found = replaceExpr(query, sub.String(), selector); !found {
+			return "", fmt.Errorf("expressions[%d] %q is not a sub-expression of the query", i, expr)
+		}
+	}
+	return query.String(), nil
+}
+
+// replaceExpr replaces every sub-expression of expr printing as sub with
+// selector, range selectors are left alone as they need a vector selector
+func replaceExpr(expr parser.Expr, sub string, selector parser.Expr) (parser.Expr, bool) {
+	if expr.String() == sub {
+		return selector, true
+	}
+
+	found, f := false, false
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		e.Expr, found = replaceExpr(e.Expr, sub, selector)
+		if e.Param != nil {
+			e.Param, f = replaceExpr(e.Param, sub, selector)
+		}
+	case *parser.BinaryExpr:
+		e.LHS, found = replaceExpr(e.LHS, sub, selector)
+		e.RHS, f = replaceExpr(e.RHS, sub, selector)
+	case *parser.Call:
+		for i, arg := range e.Args {
+			if _, ok := arg.(*parser.MatrixSelector); ok {
+				continue
+			}
+			e.Args[i], f = replaceExpr(arg, sub, selector)
+			found = found || f
+		}
+	case *parser.ParenExpr:
+		e.Expr, found = replaceExpr(e.Expr, sub, selector)
+	case *parser.UnaryExpr:
+		e.Expr, found = replaceExpr(e.Expr, sub, selector)
+	case *parser.SubqueryExpr:
+		e.Expr, found = replaceExpr(e.Expr, sub, selector)
+	}
+	return expr, found || f
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CustomAutoScalingLabel names the CR a ScalingEvent was recorded for
+const CustomAutoScalingLabel = "buildpiper.opstreelabs.in/customautoscaling"
+
+const (
+	// DefaultAuditRetention is how many ScalingEvents are kept per CR
+	DefaultAuditRetention = 100
+	// DefaultAuditTTL is how long a ScalingEvent is kept
+	DefaultAuditTTL = 30 * 24 * time.Hour
+)
+
+// AuditLog configures the ScalingEvents recorded for a CR
+type AuditLog struct {
+	// Retention is how many ScalingEvents are kept for the CR, the oldest are
+	// deleted first. 0 stops recording, defaults to 100
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Retention *int32 `json:"retention,omitempty"`
+	// TTL is how long a ScalingEvent is kept, defaults to 720h
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+}
+
+// TriggerType names what asked for a scaling decision
+// +kubebuilder:validation:Enum=Alert;Request;Forecast;Manual
+type TriggerType string
+
+const (
+	// AlertTrigger is a firing alert received on the webhook
+	AlertTrigger TriggerType = "Alert"
+	// RequestTrigger is a replica count or severity posted to the webhook without an alert
+	RequestTrigger TriggerType = "Request"
+	// ForecastTrigger is a predictive scaling forecast
+	ForecastTrigger TriggerType = "Forecast"
+	// ManualTrigger is spec.freezeReplicas or a manual override
+	ManualTrigger TriggerType = "Manual"
+)
+
+// ScalingTrigger identifies what asked for a scaling decision
+type ScalingTrigger struct {
+	// Type is the kind of trigger
+	Type TriggerType `json:"type"`
+	// Source is the webhook payload format, or the source of a CloudEvent
+	// +optional
+	Source string `json:"source,omitempty"`
+	// Alert is the alertname of the alert
+	// +optional
+	Alert string `json:"alert,omitempty"`
+	// Severity is the severity label of the alert
+	// +optional
+	Severity string `json:"severity,omitempty"`
+	// Fingerprint is the Alertmanager fingerprint of the alert
+	// +optional
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Value is the metric value the decision was computed from
+	// +optional
+	Value string `json:"value,omitempty"`
+	// Hold is freezeReplicas or override for a manual trigger
+	// +optional
+	Hold string `json:"hold,omitempty"`
+}
+
+// ScalingOutcome is what happened to a scaling decision
+// +kubebuilder:validation:Enum=Applied;Recommended;Refused;Failed
+type ScalingOutcome string
+
+const (
+	// OutcomeApplied means the target was scaled
+	OutcomeApplied ScalingOutcome = "Applied"
+	// OutcomeRecommended means the decision was only recorded in Recommend mode
+	OutcomeRecommended ScalingOutcome = "Recommended"
+	// OutcomeRefused means another scaler targets the deployment
+	OutcomeRefused ScalingOutcome = "Refused"
+	// OutcomeFailed means the target could not be updated
+	OutcomeFailed ScalingOutcome = "Failed"
+)
+
+// ScalingEventSpec records one scaling decision made for a CustomAutoScaling
+type ScalingEventSpec struct {
+	// Time is when the decision was made, in microseconds so events of the
+	// same second keep their order
+	Time metav1.MicroTime `json:"time"`
+	// CustomAutoScaling is the name of the CR that made the decision
+	CustomAutoScaling string `json:"customAutoScaling"`
+	// Target is the name of the deployment
+	Target string `json:"target"`
+	// OldReplicas is the replica count of the target before the decision
+	OldReplicas int32 `json:"oldReplicas"`
+	// NewReplicas is the replica count decided on
+	NewReplicas int32 `json:"newReplicas"`
+	// DesiredReplicas is the replica count asked for before bounds and behavior
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	// Trigger is what asked for the decision
+	Trigger ScalingTrigger `json:"trigger"`
+	// Reason describes the trigger as in status.lastDecision
+	Reason string `json:"reason"`
+	// Clamped names the replica bound that changed the desired count
+	// +optional
+	Clamped string `json:"clamped,omitempty"`
+	// Limited names the behavior rule that held back the change
+	// +optional
+	Limited string `json:"limited,omitempty"`
+	// Outcome is what happened to the decision
+	Outcome ScalingOutcome `json:"outcome"`
+	// Message is the error that failed the decision
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:printcolumn:name="CustomAutoScaling",type=string,JSONPath=`.spec.customAutoScaling`
+//+kubebuilder:printcolumn:name="Old",type=integer,JSONPath=`.spec.oldReplicas`
+//+kubebuilder:printcolumn:name="New",type=integer,JSONPath=`.spec.newReplicas`
+//+kubebuilder:printcolumn:name="Trigger",type=string,JSONPath=`.spec.trigger.type`
+//+kubebuilder:printcolumn:name="Outcome",type=string,JSONPath=`.spec.outcome`
+//+kubebuilder:printcolumn:name="Time",type=date,JSONPath=`.spec.time`
+
+// ScalingEvent is a durable record of a scaling decision, it is owned by the
+// CustomAutoScaling that made the decision and pruned by its spec.audit
+type ScalingEvent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ScalingEventSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScalingEventList contains a list of ScalingEvent
+type ScalingEventList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScalingEvent `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScalingEvent{}, &ScalingEventList{})
+}
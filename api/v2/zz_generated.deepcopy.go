@@ -0,0 +1,667 @@
+//go:build !ignore_autogenerated
+
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v2
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AlertStatus) DeepCopyInto(out *AlertStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlertStatus.
+func (in *AlertStatus) DeepCopy() *AlertStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AlertStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AuditLog) DeepCopyInto(out *AuditLog) {
+	*out = *in
+	if in.Retention != nil {
+		in, out := &in.Retention, &out.Retention
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AuditLog.
+func (in *AuditLog) DeepCopy() *AuditLog {
+	if in == nil {
+		return nil
+	}
+	out := new(AuditLog)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomAutoScaling) DeepCopyInto(out *CustomAutoScaling) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScaling.
+func (in *CustomAutoScaling) DeepCopy() *CustomAutoScaling {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomAutoScaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CustomAutoScaling) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomAutoScalingList) DeepCopyInto(out *CustomAutoScalingList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CustomAutoScaling, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScalingList.
+func (in *CustomAutoScalingList) DeepCopy() *CustomAutoScalingList {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomAutoScalingList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CustomAutoScalingList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomAutoScalingSpec) DeepCopyInto(out *CustomAutoScalingSpec) {
+	*out = *in
+	out.Target = in.Target
+	if in.Metrics != nil {
+		in, out := &in.Metrics, &out.Metrics
+		*out = make([]Metric, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.MinReplicas != nil {
+		in, out := &in.MinReplicas, &out.MinReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxReplicas != nil {
+		in, out := &in.MaxReplicas, &out.MaxReplicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Behavior != nil {
+		in, out := &in.Behavior, &out.Behavior
+		*out = new(ScalingBehavior)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Predictive != nil {
+		in, out := &in.Predictive, &out.Predictive
+		*out = new(PredictiveScaling)
+		**out = **in
+	}
+	in.Monitoring.DeepCopyInto(&out.Monitoring)
+	if in.Webhook != nil {
+		in, out := &in.Webhook, &out.Webhook
+		*out = new(WebhookRouting)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FreezeReplicas != nil {
+		in, out := &in.FreezeReplicas, &out.FreezeReplicas
+		*out = new(ReplicaFreeze)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Audit != nil {
+		in, out := &in.Audit, &out.Audit
+		*out = new(AuditLog)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScalingSpec.
+func (in *CustomAutoScalingSpec) DeepCopy() *CustomAutoScalingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomAutoScalingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CustomAutoScalingStatus) DeepCopyInto(out *CustomAutoScalingStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Forecast != nil {
+		in, out := &in.Forecast, &out.Forecast
+		*out = new(ForecastStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Recommendation != nil {
+		in, out := &in.Recommendation, &out.Recommendation
+		*out = new(Recommendation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastAlert != nil {
+		in, out := &in.LastAlert, &out.LastAlert
+		*out = new(AlertStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastDecision != nil {
+		in, out := &in.LastDecision, &out.LastDecision
+		*out = new(DecisionStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Override != nil {
+		in, out := &in.Override, &out.Override
+		*out = new(OverrideStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomAutoScalingStatus.
+func (in *CustomAutoScalingStatus) DeepCopy() *CustomAutoScalingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CustomAutoScalingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DecisionStatus) DeepCopyInto(out *DecisionStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DecisionStatus.
+func (in *DecisionStatus) DeepCopy() *DecisionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DecisionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EmbeddedMonitoring) DeepCopyInto(out *EmbeddedMonitoring) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Window != nil {
+		in, out := &in.Window, &out.Window
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EmbeddedMonitoring.
+func (in *EmbeddedMonitoring) DeepCopy() *EmbeddedMonitoring {
+	if in == nil {
+		return nil
+	}
+	out := new(EmbeddedMonitoring)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ForecastStatus) DeepCopyInto(out *ForecastStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ForecastStatus.
+func (in *ForecastStatus) DeepCopy() *ForecastStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ForecastStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Metric) DeepCopyInto(out *Metric) {
+	*out = *in
+	if in.TargetAverageValue != nil {
+		in, out := &in.TargetAverageValue, &out.TargetAverageValue
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Thresholds != nil {
+		in, out := &in.Thresholds, &out.Thresholds
+		*out = make([]Threshold, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Recording != nil {
+		in, out := &in.Recording, &out.Recording
+		*out = new(Recording)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Metric.
+func (in *Metric) DeepCopy() *Metric {
+	if in == nil {
+		return nil
+	}
+	out := new(Metric)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Monitoring) DeepCopyInto(out *Monitoring) {
+	*out = *in
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RemoteWrite != nil {
+		in, out := &in.RemoteWrite, &out.RemoteWrite
+		*out = new(RemoteWrite)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Embedded != nil {
+		in, out := &in.Embedded, &out.Embedded
+		*out = new(EmbeddedMonitoring)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Monitoring.
+func (in *Monitoring) DeepCopy() *Monitoring {
+	if in == nil {
+		return nil
+	}
+	out := new(Monitoring)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OverrideStatus) DeepCopyInto(out *OverrideStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	in.Until.DeepCopyInto(&out.Until)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OverrideStatus.
+func (in *OverrideStatus) DeepCopy() *OverrideStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OverrideStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PredictiveScaling) DeepCopyInto(out *PredictiveScaling) {
+	*out = *in
+	out.Lookback = in.Lookback
+	out.Step = in.Step
+	out.Season = in.Season
+	out.LeadTime = in.LeadTime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PredictiveScaling.
+func (in *PredictiveScaling) DeepCopy() *PredictiveScaling {
+	if in == nil {
+		return nil
+	}
+	out := new(PredictiveScaling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Recommendation) DeepCopyInto(out *Recommendation) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Recommendation.
+func (in *Recommendation) DeepCopy() *Recommendation {
+	if in == nil {
+		return nil
+	}
+	out := new(Recommendation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Recording) DeepCopyInto(out *Recording) {
+	*out = *in
+	if in.Expressions != nil {
+		in, out := &in.Expressions, &out.Expressions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Recording.
+func (in *Recording) DeepCopy() *Recording {
+	if in == nil {
+		return nil
+	}
+	out := new(Recording)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteWrite) DeepCopyInto(out *RemoteWrite) {
+	*out = *in
+	if in.Series != nil {
+		in, out := &in.Series, &out.Series
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteWrite.
+func (in *RemoteWrite) DeepCopy() *RemoteWrite {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteWrite)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReplicaFreeze) DeepCopyInto(out *ReplicaFreeze) {
+	*out = *in
+	in.Until.DeepCopyInto(&out.Until)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReplicaFreeze.
+func (in *ReplicaFreeze) DeepCopy() *ReplicaFreeze {
+	if in == nil {
+		return nil
+	}
+	out := new(ReplicaFreeze)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScaleTarget) DeepCopyInto(out *ScaleTarget) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScaleTarget.
+func (in *ScaleTarget) DeepCopy() *ScaleTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(ScaleTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingBehavior) DeepCopyInto(out *ScalingBehavior) {
+	*out = *in
+	if in.ScaleUp != nil {
+		in, out := &in.ScaleUp, &out.ScaleUp
+		*out = new(ScalingRules)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ScaleDown != nil {
+		in, out := &in.ScaleDown, &out.ScaleDown
+		*out = new(ScalingRules)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingBehavior.
+func (in *ScalingBehavior) DeepCopy() *ScalingBehavior {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingBehavior)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingEvent) DeepCopyInto(out *ScalingEvent) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingEvent.
+func (in *ScalingEvent) DeepCopy() *ScalingEvent {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingEvent)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ScalingEvent) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingEventList) DeepCopyInto(out *ScalingEventList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ScalingEvent, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingEventList.
+func (in *ScalingEventList) DeepCopy() *ScalingEventList {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingEventList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ScalingEventList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingEventSpec) DeepCopyInto(out *ScalingEventSpec) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	out.Trigger = in.Trigger
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingEventSpec.
+func (in *ScalingEventSpec) DeepCopy() *ScalingEventSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingEventSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingRules) DeepCopyInto(out *ScalingRules) {
+	*out = *in
+	if in.MaxStep != nil {
+		in, out := &in.MaxStep, &out.MaxStep
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Cooldown != nil {
+		in, out := &in.Cooldown, &out.Cooldown
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingRules.
+func (in *ScalingRules) DeepCopy() *ScalingRules {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingRules)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScalingTrigger) DeepCopyInto(out *ScalingTrigger) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScalingTrigger.
+func (in *ScalingTrigger) DeepCopy() *ScalingTrigger {
+	if in == nil {
+		return nil
+	}
+	out := new(ScalingTrigger)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Threshold) DeepCopyInto(out *Threshold) {
+	*out = *in
+	out.Value = in.Value.DeepCopy()
+	if in.For != nil {
+		in, out := &in.For, &out.For
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Threshold.
+func (in *Threshold) DeepCopy() *Threshold {
+	if in == nil {
+		return nil
+	}
+	out := new(Threshold)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookRouting) DeepCopyInto(out *WebhookRouting) {
+	*out = *in
+	if in.SeverityReplicas != nil {
+		in, out := &in.SeverityReplicas, &out.SeverityReplicas
+		*out = make(map[string]int32, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookRouting.
+func (in *WebhookRouting) DeepCopy() *WebhookRouting {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookRouting)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,257 @@
+// Package backtest replays recorded metric history through the scaling
+// decision of a CustomAutoScaling, so that bounds and behavior can be tuned
+// without a cluster.
+//
+// Every metric of the CR is evaluated with query_range over the replay window.
+// At each step a metric with a targetAverageValue asks for the sum of its
+// series divided by the target, any other metric is an alert and asks for the
+// replicas of the most severe of its series, as the webhook would while the
+// alert fires. A metric with a threshold ladder asks for the replicas of the
+// highest step one of its series stayed above for the for of the step, as
+// Prometheus would have fired the alert of that step. The highest ask goes through scaling.Decide, and the target is
+// assumed to follow every decision whatever the mode of the CR. The HPA and
+// KEDA drivers are replayed through the same decision, an approximation of
+// the algorithms of those scalers.
+package backtest
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Source returns the query_range result of a metric of the CR
+type Source interface {
+	Range(ctx context.Context, m autoscaler.Metric, r promv1.Range) (model.Matrix, error)
+}
+
+// Options configures a replay
+type Options struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+	// Replicas is the replica count of the target at Start
+	Replicas int32
+}
+
+// Point is the state of the target at one step of the replay
+type Point struct {
+	Time time.Time
+	// Required is the replica count the metrics asked for, at least one
+	Required int32
+	// Replicas is the replica count of the target after the decision
+	Replicas int32
+	// Decision is nil when no metric asked for replicas at Time
+	Decision *scaling.Decision
+	// Reason names the metric behind Decision
+	Reason string
+}
+
+// Result summarizes a replay
+type Result struct {
+	Timeline    []Point
+	ScaleEvents int
+	// UnderProvisioned and OverProvisioned are the time the target spent
+	// below and above the required replicas
+	UnderProvisioned time.Duration
+	OverProvisioned  time.Duration
+}
+
+// Run replays the metrics of spec from src over the window of opts
+func Run(ctx context.Context, spec *autoscaler.CustomAutoScalingSpec, src Source, opts Options) (*Result, error) {
+	if opts.Step <= 0 {
+		return nil, fmt.Errorf("invalid step %s", opts.Step)
+	}
+	if !opts.End.After(opts.Start) {
+		return nil, fmt.Errorf("end %s is not after start %s", opts.End.Format(time.RFC3339), opts.Start.Format(time.RFC3339))
+	}
+	if len(spec.Metrics) == 0 {
+		return nil, fmt.Errorf("the spec has no metrics to replay")
+	}
+
+	matrices := make([]model.Matrix, len(spec.Metrics))
+	for i, m := range spec.Metrics {
+		matrix, err := src.Range(ctx, m, promv1.Range{Start: opts.Start, End: opts.End, Step: opts.Step})
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", m.Name, err)
+		}
+		matrices[i] = matrix
+	}
+
+	current := opts.Replicas
+	if current < 1 {
+		current = 1
+	}
+	var lastScale time.Time
+	result := &Result{}
+	for t := opts.Start; !t.After(opts.End); t = t.Add(opts.Step) {
+		point := Point{Time: t, Required: 1}
+
+		desired, found := int32(0), false
+		for i, m := range spec.Metrics {
+			replicas, reason, ok := ask(spec, m, matrices[i], t, opts.Step)
+			if ok && (!found || replicas > desired) {
+				desired, point.Reason, found = replicas, reason, true
+			}
+		}
+
+		if found {
+			if desired > point.Required {
+				point.Required = desired
+			}
+			decision := scaling.Decide(spec, current, desired, lastScale, t)
+			point.Decision = &decision
+			if decision.Changed() {
+				current = decision.Replicas
+				lastScale = t
+				result.ScaleEvents++
+			}
+		}
+		point.Replicas = current
+		result.Timeline = append(result.Timeline, point)
+	}
+
+	// every point but the last stands for the step that follows it
+	for _, p := range result.Timeline[:len(result.Timeline)-1] {
+		switch {
+		case p.Replicas < p.Required:
+			result.UnderProvisioned += opts.Step
+		case p.Replicas > p.Required:
+			result.OverProvisioned += opts.Step
+		}
+	}
+	return result, nil
+}
+
+// ask returns the replicas metric m asks for at t, ok is false when none of
+// its series has a sample in the step ending at t
+func ask(spec *autoscaler.CustomAutoScalingSpec, m autoscaler.Metric, matrix model.Matrix, t time.Time, step time.Duration) (int32, string, bool) {
+	if len(m.Thresholds) > 0 {
+		return askThresholds(m, matrix, t, step)
+	}
+
+	var sum float64
+	var replicas int32
+	var severity string
+	found := false
+	for _, series := range matrix {
+		value, ok := sampleAt(series.Values, t, step)
+		if !ok {
+			continue
+		}
+		found = true
+
+		if m.TargetAverageValue != nil {
+			sum += value
+			continue
+		}
+		s := string(series.Metric["severity"])
+		if r := scaling.ReplicasForSeverity(spec, s); r > replicas {
+			replicas, severity = r, s
+		}
+	}
+	if !found {
+		return 0, "", false
+	}
+
+	if target := m.TargetAverageValue; target != nil {
+		perReplica := target.AsApproximateFloat64()
+		replicas := int32(math.Ceil(sum / perReplica))
+		return replicas, fmt.Sprintf("%s %s for %s per replica", m.Name, strconv.FormatFloat(sum, 'f', -1, 64), target), true
+	}
+	return replicas, fmt.Sprintf("alert %s with severity %q", m.Name, severity), true
+}
+
+// askThresholds returns the replicas of the highest step of the threshold
+// ladder of m that fires at t, ok is false when none does
+func askThresholds(m autoscaler.Metric, matrix model.Matrix, t time.Time, step time.Duration) (int32, string, bool) {
+	var replicas int32
+	var reason string
+	found := false
+	for _, series := range matrix {
+		for _, th := range m.Thresholds {
+			if (!found || th.Replicas > replicas) && exceeded(series.Values, th, t, step) {
+				replicas, found = th.Replicas, true
+				reason = fmt.Sprintf("alert %s with severity %q for %d replicas", th.AlertName(m), th.Severity, th.Replicas)
+			}
+		}
+	}
+	return replicas, reason, found
+}
+
+// exceeded reports whether values stayed above the step th at every step from
+// t back to the for of th, a gap in the samples resets the alert
+func exceeded(values []model.SamplePair, th autoscaler.Threshold, t time.Time, step time.Duration) bool {
+	limit := th.Value.AsApproximateFloat64()
+	for at := t; !at.Before(t.Add(-th.ForDuration())); at = at.Add(-step) {
+		value, ok := sampleAt(values, at, step)
+		if !ok || value <= limit {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleAt returns the latest value in (t-step, t], a range query aligned on
+// the step has exactly one
+func sampleAt(values []model.SamplePair, t time.Time, step time.Duration) (float64, bool) {
+	var value float64
+	found := false
+	for _, v := range values {
+		ts := v.Timestamp.Time()
+		if ts.After(t) {
+			break
+		}
+		if ts.After(t.Add(-step)) && !math.IsNaN(float64(v.Value)) {
+			value, found = float64(v.Value), true
+		}
+	}
+	return value, found
+}
+
+// Changes returns the points at which the target was scaled
+func (r *Result) Changes() []Point {
+	var changes []Point
+	for _, p := range r.Timeline {
+		if p.Decision != nil && p.Decision.Changed() {
+			changes = append(changes, p)
+		}
+	}
+	return changes
+}
+
+// WriteCSV writes one row per point of the timeline
+func (r *Result) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"time", "required", "desired", "replicas", "clamped", "limited", "reason"}); err != nil {
+		return err
+	}
+	for _, p := range r.Timeline {
+		var desired, clamped, limited string
+		if d := p.Decision; d != nil {
+			desired, clamped, limited = strconv.Itoa(int(d.Desired)), d.Clamped, d.Limited
+		}
+		if err := cw.Write([]string{
+			p.Time.UTC().Format(time.RFC3339),
+			strconv.Itoa(int(p.Required)),
+			desired,
+			strconv.Itoa(int(p.Replicas)),
+			clamped,
+			limited,
+			p.Reason,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,180 @@
+package backtest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+var start = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// fixture records ten minutes of traffic from 12:00 UTC, the rps metric as a
+// query_range response and the errors alert as a bare matrix
+const fixture = `{
+  "rps": {
+    "status": "success",
+    "data": {
+      "resultType": "matrix",
+      "result": [
+        {"metric": {"pod": "web-1"}, "values": [
+          [1682942400, "100"], [1682942460, "300"], [1682942520, "500"], [1682942580, "500"], [1682942640, "500"], [1682942700, "100"],
+          [1682942760, "100"], [1682942820, "100"], [1682942880, "100"], [1682942940, "100"], [1682943000, "100"]
+        ]},
+        {"metric": {"pod": "web-2"}, "values": [
+          [1682942400, "50"], [1682942460, "150"], [1682942520, "300"], [1682942580, "300"], [1682942640, "300"], [1682942700, "100"],
+          [1682942760, "100"], [1682942820, "100"], [1682942880, "100"], [1682942940, "100"], [1682943000, "100"]
+        ]}
+      ]
+    }
+  },
+  "errors_total > 10": [
+    {"metric": {"alertname": "Errors", "severity": "warning"}, "values": [[1682942760, "12"], [1682942820, "15"]]}
+  ]
+}`
+
+func newTestSpec() *autoscaler.CustomAutoScalingSpec {
+	target := resource.MustParse("100")
+	return &autoscaler.CustomAutoScalingSpec{
+		Metrics: []autoscaler.Metric{
+			{Name: "rps", Query: "sum by (pod) (rate(http_requests_total[1m]))", TargetAverageValue: &target},
+			{Name: "Errors", Query: "errors_total > 10"},
+		},
+		MinReplicas: int32Ptr(2),
+		MaxReplicas: int32Ptr(8),
+		Behavior: &autoscaler.ScalingBehavior{
+			ScaleUp:   &autoscaler.ScalingRules{MaxStep: int32Ptr(2)},
+			ScaleDown: &autoscaler.ScalingRules{Cooldown: &metav1.Duration{Duration: 5 * time.Minute}},
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	src, err := LoadFixture(strings.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Run(context.Background(), newTestSpec(), src, Options{Start: start, End: start.Add(10 * time.Minute), Step: time.Minute, Replicas: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ required, replicas int32 }{
+		{2, 2},
+		// 450 rps asks for 5, the step of 2 holds the target at 4
+		{5, 4},
+		{8, 6},
+		{8, 8},
+		{8, 8},
+		// traffic drops within the scale down cooldown
+		{2, 8},
+		// the errors alert asks for 3
+		{3, 8},
+		{3, 8},
+		// the cooldown ends five minutes after the last scale up
+		{2, 2},
+		{2, 2},
+		{2, 2},
+	}
+	if len(result.Timeline) != len(want) {
+		t.Fatalf("timeline has %d points, want %d", len(result.Timeline), len(want))
+	}
+	for i, w := range want {
+		p := result.Timeline[i]
+		if p.Required != w.required || p.Replicas != w.replicas {
+			t.Errorf("%s: required %d replicas %d, want %d and %d", p.Time.Format("15:04"), p.Required, p.Replicas, w.required, w.replicas)
+		}
+	}
+	if got := result.Timeline[6].Reason; got != `alert Errors with severity "warning"` {
+		t.Errorf("reason at 12:06 = %q", got)
+	}
+
+	if result.ScaleEvents != 4 {
+		t.Errorf("scale events = %d, want 4", result.ScaleEvents)
+	}
+	if result.UnderProvisioned != 2*time.Minute || result.OverProvisioned != 3*time.Minute {
+		t.Errorf("under %s and over %s, want 2m and 3m", result.UnderProvisioned, result.OverProvisioned)
+	}
+	if changes := result.Changes(); len(changes) != 4 || !changes[3].Time.Equal(start.Add(8*time.Minute)) {
+		t.Errorf("changes = %+v", changes)
+	}
+
+	out := &bytes.Buffer{}
+	if err := result.WriteCSV(out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "time,required,desired,replicas,clamped,limited,reason" || len(lines) != len(want)+1 {
+		t.Fatalf("csv:\n%s", out)
+	}
+	if lines[2] != "2023-05-01T12:01:00Z,5,5,4,,scaleUp.maxStep,rps 450 for 100 per replica" {
+		t.Errorf("csv row at 12:01 = %q", lines[2])
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	src := Fixture{}
+	opts := Options{Start: start, End: start.Add(time.Hour), Step: time.Minute}
+
+	if _, err := Run(context.Background(), newTestSpec(), src, opts); err == nil || !strings.Contains(err.Error(), "no series for metric rps") {
+		t.Errorf("missing series error = %v", err)
+	}
+	opts.End = start
+	if _, err := Run(context.Background(), newTestSpec(), src, opts); err == nil {
+		t.Error("an empty range was replayed")
+	}
+	if _, err := LoadFixture(strings.NewReader(`{"rps": {"status": "success", "data": {"resultType": "vector", "result": []}}}`)); err == nil {
+		t.Error("a vector fixture was loaded")
+	}
+}
+
+func TestRunThresholds(t *testing.T) {
+	matrix := `[{"metric": {}, "values": [
+		[1682942400, "0.2"], [1682942460, "0.6"], [1682942520, "1.2"], [1682942580, "1.3"], [1682942640, "1.4"],
+		[1682942700, "0.7"], [1682942760, "0.3"], [1682942820, "0.2"]
+	]}]`
+	src, err := LoadFixture(strings.NewReader(`{"latency": ` + matrix + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &autoscaler.CustomAutoScalingSpec{
+		Metrics: []autoscaler.Metric{{
+			Name:  "latency",
+			Query: "histogram_quantile(0.99, rate(request_duration_seconds_bucket[1m]))",
+			Thresholds: []autoscaler.Threshold{
+				{Severity: "warning", Value: resource.MustParse("500m"), Replicas: 3},
+				{Severity: "critical", Value: resource.MustParse("1"), For: &metav1.Duration{Duration: 2 * time.Minute}, Replicas: 6},
+			},
+		}},
+	}
+
+	result, err := Run(context.Background(), spec, src, Options{Start: start, End: start.Add(7 * time.Minute), Step: time.Minute, Replicas: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the critical step fires once latency stayed above 1s for two minutes
+	want := []int32{1, 3, 3, 3, 6, 3, 1, 1}
+	if len(result.Timeline) != len(want) {
+		t.Fatalf("timeline has %d points, want %d", len(result.Timeline), len(want))
+	}
+	for i, w := range want {
+		if p := result.Timeline[i]; p.Required != w {
+			t.Errorf("%s: required %d, want %d", p.Time.Format("15:04"), p.Required, w)
+		}
+	}
+	if p := result.Timeline[4]; p.Replicas != 6 || p.Reason != `alert latency with severity "critical" for 6 replicas` {
+		t.Errorf("12:04: replicas %d reason %q", p.Replicas, p.Reason)
+	}
+	if p := result.Timeline[6]; p.Decision != nil {
+		t.Errorf("12:06: decision %+v without a firing step", p.Decision)
+	}
+}
@@ -0,0 +1,84 @@
+package backtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// PrometheusSource evaluates the queries of the CR against the Prometheus at Address
+type PrometheusSource struct {
+	Address string
+}
+
+// Range implements Source
+func (s PrometheusSource) Range(ctx context.Context, m autoscaler.Metric, r promv1.Range) (model.Matrix, error) {
+	return utils.QueryMatrix(ctx, s.Address, m.Query, r)
+}
+
+// Fixture holds recorded query_range results keyed by metric name or query
+type Fixture map[string]model.Matrix
+
+// LoadFixture reads a JSON object mapping metric names or queries to either
+// the body of a Prometheus query_range response or a bare matrix
+func LoadFixture(r io.Reader) (Fixture, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decoding fixture: %w", err)
+	}
+
+	fixture := Fixture{}
+	for key, data := range raw {
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			matrix := model.Matrix{}
+			if err := json.Unmarshal(data, &matrix); err != nil {
+				return nil, fmt.Errorf("decoding fixture %q: %w", key, err)
+			}
+			fixture[key] = matrix
+			continue
+		}
+
+		response := struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+			Data   struct {
+				ResultType string          `json:"resultType"`
+				Result     json.RawMessage `json:"result"`
+			} `json:"data"`
+		}{}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, fmt.Errorf("decoding fixture %q: %w", key, err)
+		}
+		if response.Status != "success" {
+			return nil, fmt.Errorf("fixture %q recorded a failed query: %s", key, response.Error)
+		}
+		if response.Data.ResultType != model.ValMatrix.String() {
+			return nil, fmt.Errorf("fixture %q holds a %s, expected matrix", key, response.Data.ResultType)
+		}
+		matrix := model.Matrix{}
+		if err := json.Unmarshal(response.Data.Result, &matrix); err != nil {
+			return nil, fmt.Errorf("decoding fixture %q: %w", key, err)
+		}
+		fixture[key] = matrix
+	}
+	return fixture, nil
+}
+
+// Range implements Source, the metric is looked up by name and then by query.
+// The recorded series are returned whole whatever the range
+func (f Fixture) Range(_ context.Context, m autoscaler.Metric, _ promv1.Range) (model.Matrix, error) {
+	if matrix, ok := f[m.Name]; ok {
+		return matrix, nil
+	}
+	if matrix, ok := f[m.Query]; ok {
+		return matrix, nil
+	}
+	return nil, fmt.Errorf("the fixture has no series for metric %s or query %q", m.Name, m.Query)
+}
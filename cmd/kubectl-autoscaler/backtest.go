@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/backtest"
+	"github.com/spf13/cobra"
+)
+
+type backtestOptions struct {
+	filename   string
+	prometheus string
+	fixture    string
+	start      string
+	end        string
+	since      time.Duration
+	step       time.Duration
+	current    int32
+	csv        string
+}
+
+func newBacktestCommand(o *options) *cobra.Command {
+	b := &backtestOptions{}
+	cmd := &cobra.Command{
+		Use:   "backtest [NAME] (--prometheus URL | --fixture FILE)",
+		Short: "Replay metric history through the scaling decision of a CustomAutoScaling",
+		Long: `Replay metric history through the scaling decision of a CustomAutoScaling.
+
+The CR is read from --filename, or from the cluster when only NAME is given.
+Every metric of the CR is evaluated with query_range against --prometheus, or
+read from a recorded --fixture, and each step is run through the replica
+bounds and the behavior of the CR. A metric with a targetAverageValue asks for
+its value divided by the target, any other metric asks for the replicas of
+the severity of its series while it returns samples.
+
+The fixture is a JSON object keyed by metric name or query, each value is a
+Prometheus query_range response or its result matrix.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cr, err := o.loadCR(cmd.Context(), b.filename, args)
+			if err != nil {
+				return err
+			}
+			src, err := b.source()
+			if err != nil {
+				return err
+			}
+			opts, err := b.options(o.now(), cr)
+			if err != nil {
+				return err
+			}
+
+			result, err := backtest.Run(cmd.Context(), &cr.Spec, src, opts)
+			if err != nil {
+				return err
+			}
+			return o.backtest(result, b.csv)
+		},
+	}
+	cmd.Flags().StringVarP(&b.filename, "filename", "f", "", "Manifest holding the CustomAutoScaling, v1 and v2 objects are accepted.")
+	cmd.Flags().StringVar(&b.prometheus, "prometheus", "", "Address of the Prometheus to query.")
+	cmd.Flags().StringVar(&b.fixture, "fixture", "", "JSON file of recorded query_range results.")
+	cmd.Flags().StringVar(&b.start, "start", "", "Start of the replay in RFC3339, defaults to --since before --end.")
+	cmd.Flags().StringVar(&b.end, "end", "", "End of the replay in RFC3339, defaults to now.")
+	cmd.Flags().DurationVar(&b.since, "since", time.Hour, "Length of the replay when --start is not set.")
+	cmd.Flags().DurationVar(&b.step, "step", time.Minute, "Resolution of the replay.")
+	cmd.Flags().Int32Var(&b.current, "current", 0, "Replicas of the deployment at the start, defaults to the replicas in the CR status or 1.")
+	cmd.Flags().StringVar(&b.csv, "csv", "", "Write the replica timeline as CSV to this file, - writes it to stdout instead of the summary.")
+	return cmd
+}
+
+func (b *backtestOptions) source() (backtest.Source, error) {
+	switch {
+	case b.prometheus != "" && b.fixture != "":
+		return nil, fmt.Errorf("--prometheus and --fixture are mutually exclusive")
+	case b.prometheus != "":
+		return backtest.PrometheusSource{Address: b.prometheus}, nil
+	case b.fixture != "":
+		f, err := os.Open(b.fixture)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return backtest.LoadFixture(f)
+	}
+	return nil, fmt.Errorf("one of --prometheus or --fixture is required")
+}
+
+func (b *backtestOptions) options(now time.Time, cr *autoscaler.CustomAutoScaling) (backtest.Options, error) {
+	opts := backtest.Options{End: now, Step: b.step, Replicas: b.current}
+	if b.end != "" {
+		end, err := time.Parse(time.RFC3339, b.end)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --end: %w", err)
+		}
+		opts.End = end
+	}
+	opts.Start = opts.End.Add(-b.since)
+	if b.start != "" {
+		start, err := time.Parse(time.RFC3339, b.start)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --start: %w", err)
+		}
+		opts.Start = start
+	}
+	if opts.Replicas == 0 {
+		opts.Replicas = cr.Status.Replicas
+	}
+	return opts, nil
+}
+
+// backtest prints the summary and the scale events of result, the timeline
+// goes to the --csv file
+func (o *options) backtest(result *backtest.Result, csvPath string) error {
+	switch csvPath {
+	case "":
+	case "-":
+		return result.WriteCSV(o.out)
+	default:
+		f, err := os.Create(csvPath)
+		if err != nil {
+			return err
+		}
+		if err := result.WriteCSV(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(o.out, "Scale events:       %d\n", result.ScaleEvents)
+	fmt.Fprintf(o.out, "Under-provisioned:  %s\n", result.UnderProvisioned)
+	fmt.Fprintf(o.out, "Over-provisioned:   %s\n", result.OverProvisioned)
+	changes := result.Changes()
+	if len(changes) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(o.out)
+	return writeChanges(o.out, changes)
+}
+
+func writeChanges(out io.Writer, changes []backtest.Point) error {
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "TIME\tREQUIRED\tDECISION\tREASON")
+	for _, p := range changes {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", p.Time.UTC().Format(time.RFC3339), p.Required, p.Decision, p.Reason)
+	}
+	return w.Flush()
+}
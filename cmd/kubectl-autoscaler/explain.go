@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newExplainCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "explain NAME",
+		Short: "Explain why the last scaling decision of a CustomAutoScaling was made",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cr, err := o.getCR(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			o.explain(cr)
+			return nil
+		},
+	}
+}
+
+func (o *options) explain(cr *autoscaler.CustomAutoScaling) {
+	out := o.out
+	fmt.Fprintf(out, "CustomAutoScaling %s/%s scales deployment %s with the %s driver in %s mode.\n",
+		cr.Namespace, cr.Name, cr.Spec.Target.Name, driver(cr), mode(cr))
+	switch hold := scaling.HoldFor(cr, o.now()); {
+	case hold == nil:
+	case hold.Reason == scaling.HoldPaused:
+		fmt.Fprintf(out, "It is paused, run `kubectl autoscaler resume %s` to resume it.\n", cr.Name)
+	case hold.Reason == scaling.HoldFrozen:
+		fmt.Fprintf(out, "spec.freezeReplicas pins the deployment to %d replicas for another %s.\n", *hold.Replicas, o.until(hold.Until))
+	case hold.Reason == scaling.HoldOverride:
+		fmt.Fprintf(out, "A manual override holds the deployment at %d replicas for another %s.\n", *hold.Replicas, o.until(hold.Until))
+	}
+	if c := meta.FindStatusCondition(cr.Status.Conditions, autoscaler.ConditionScalingConflict); c != nil && c.Status == metav1.ConditionTrue {
+		fmt.Fprintf(out, "Another scaler targets the deployment: %s\n", c.Message)
+	}
+	switch driver(cr) {
+	case autoscaler.HPADriver:
+		fmt.Fprintf(out, "The HorizontalPodAutoscaler %s-hpa makes the scaling decisions of this driver.\n", cr.Name)
+		return
+	case autoscaler.KEDADriver:
+		fmt.Fprintln(out, "The KEDA ScaledObject of the deployment makes the scaling decisions of this driver.")
+		return
+	}
+
+	if a := cr.Status.LastAlert; a != nil {
+		fmt.Fprintf(out, "The last alert was %s with severity %q, %s ago.\n", a.Name, a.Severity, o.ago(a.Time))
+	}
+
+	d := cr.Status.LastDecision
+	if d == nil {
+		fmt.Fprintln(out, "No scaling decision has been made yet.")
+		return
+	}
+	fmt.Fprintf(out, "\nThe last decision was made %s ago on %s:\n", o.ago(d.Time), d.Reason)
+	for _, line := range decisionSteps(cr, d) {
+		fmt.Fprintln(out, "  "+line)
+	}
+}
+
+// decisionSteps walks through the steps of scaling.Decide that shaped d
+func decisionSteps(cr *autoscaler.CustomAutoScaling, d *autoscaler.DecisionStatus) []string {
+	steps := []string{fmt.Sprintf("it asked for %d replicas while the deployment had %d", d.DesiredReplicas, d.CurrentReplicas)}
+
+	if d.Clamped != "" {
+		steps = append(steps, fmt.Sprintf("%s clamped the %d replicas to %d", d.Clamped, d.DesiredReplicas, bound(cr, d.Clamped)))
+	}
+	if d.Limited != "" {
+		steps = append(steps, fmt.Sprintf("%s held the deployment at %d replicas", rule(cr, d.Limited), d.Replicas))
+	}
+
+	switch {
+	case d.Applied:
+		steps = append(steps, fmt.Sprintf("the deployment was scaled from %d to %d", d.CurrentReplicas, d.Replicas))
+	case d.Replicas == d.CurrentReplicas:
+		steps = append(steps, fmt.Sprintf("the deployment was left at %d replicas", d.Replicas))
+	case cr.Spec.Mode == autoscaler.RecommendMode:
+		steps = append(steps, fmt.Sprintf("scaling from %d to %d was recommended, Recommend mode does not change the deployment", d.CurrentReplicas, d.Replicas))
+	default:
+		steps = append(steps, fmt.Sprintf("scaling from %d to %d was refused because another scaler targets the deployment (takeover %s)",
+			d.CurrentReplicas, d.Replicas, takeover(cr)))
+	}
+	return steps
+}
+
+func bound(cr *autoscaler.CustomAutoScaling, name string) int32 {
+	if name == "minReplicas" && cr.Spec.MinReplicas != nil {
+		return *cr.Spec.MinReplicas
+	}
+	if name == "maxReplicas" && cr.Spec.MaxReplicas != nil {
+		return *cr.Spec.MaxReplicas
+	}
+	return 0
+}
+
+// rule describes the behavior rule named like scaleUp.maxStep with its current value
+func rule(cr *autoscaler.CustomAutoScaling, name string) string {
+	if cr.Spec.Behavior == nil {
+		return name
+	}
+	rules := cr.Spec.Behavior.ScaleUp
+	if strings.HasPrefix(name, "scaleDown.") {
+		rules = cr.Spec.Behavior.ScaleDown
+	}
+	switch {
+	case rules == nil:
+		return name
+	case strings.HasSuffix(name, ".cooldown") && rules.Cooldown != nil:
+		return fmt.Sprintf("%s of %s", name, rules.Cooldown.Duration)
+	case strings.HasSuffix(name, ".maxStep") && rules.MaxStep != nil:
+		return fmt.Sprintf("%s of %d", name, *rules.MaxStep)
+	}
+	return name
+}
+
+func takeover(cr *autoscaler.CustomAutoScaling) autoscaler.TakeoverPolicy {
+	if cr.Spec.Takeover == "" {
+		return autoscaler.TakeoverNever
+	}
+	return cr.Spec.Takeover
+}
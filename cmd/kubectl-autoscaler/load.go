@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	autoscalerv1 "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// getCR reads the CR named name from the cluster
+func (o *options) getCR(ctx context.Context, name string) (*autoscaler.CustomAutoScaling, error) {
+	ns, err := o.namespace()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := o.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &autoscaler.CustomAutoScaling{}
+	if err := cl.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, cr); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// loadCRs reads the CRs of a manifest, "-" reads stdin. v1 objects are
+// converted to v2 and every object is defaulted the way the admission
+// webhook would, documents of other kinds are skipped
+func (o *options) loadCRs(path string) ([]*autoscaler.CustomAutoScaling, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	ns, err := o.namespace()
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	var crs []*autoscaler.CustomAutoScaling
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, gvk, err := decoder.Decode(doc, nil, nil)
+		if err != nil {
+			if gvk != nil && gvk.Group != autoscaler.GroupVersion.Group {
+				continue
+			}
+			return nil, fmt.Errorf("decoding %s: %w", path, err)
+		}
+
+		var cr *autoscaler.CustomAutoScaling
+		switch obj := obj.(type) {
+		case *autoscaler.CustomAutoScaling:
+			cr = obj
+		case *autoscalerv1.CustomAutoScaling:
+			cr = &autoscaler.CustomAutoScaling{}
+			if err := obj.ConvertTo(cr); err != nil {
+				return nil, fmt.Errorf("converting %s to %s: %w", obj.Name, autoscaler.GroupVersion, err)
+			}
+		default:
+			continue
+		}
+		if cr.Namespace == "" {
+			cr.Namespace = ns
+		}
+		cr.Default()
+		crs = append(crs, cr)
+	}
+
+	if len(crs) == 0 {
+		return nil, fmt.Errorf("%s has no CustomAutoScaling", path)
+	}
+	return crs, nil
+}
+
+// loadCR reads the CR from the manifest at path when it is set and from the cluster otherwise
+func (o *options) loadCR(ctx context.Context, path string, args []string) (*autoscaler.CustomAutoScaling, error) {
+	if path == "" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected the name of a CustomAutoScaling or --filename")
+		}
+		return o.getCR(ctx, args[0])
+	}
+
+	crs, err := o.loadCRs(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		if len(crs) != 1 {
+			return nil, fmt.Errorf("%s has %d CustomAutoScaling objects, name the one to use", path, len(crs))
+		}
+		return crs[0], nil
+	}
+	for _, cr := range crs {
+		if cr.Name == args[0] {
+			return cr, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no CustomAutoScaling named %s", path, args[0])
+}
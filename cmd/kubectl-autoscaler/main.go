@@ -0,0 +1,116 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-autoscaler inspects and operates CustomAutoScaling objects. Install
+// it on the PATH and run it as `kubectl autoscaler`.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	autoscalerv1 "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(autoscalerv1.AddToScheme(scheme))
+	utilruntime.Must(autoscaler.AddToScheme(scheme))
+	utilruntime.Must(monitoringv1.AddToScheme(scheme))
+}
+
+// options is shared by every subcommand, tests replace the client and the clock
+type options struct {
+	config    clientcmd.ClientConfig
+	newClient func() (client.Client, error)
+	now       func() time.Time
+	out       io.Writer
+}
+
+// namespace returns the namespace given by --namespace or the kubeconfig
+// context, manifests are read offline without a kubeconfig
+func (o *options) namespace() (string, error) {
+	ns, _, err := o.config.Namespace()
+	if clientcmd.IsEmptyConfig(err) {
+		return metav1.NamespaceDefault, nil
+	}
+	return ns, err
+}
+
+func newRootCommand(o *options) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "kubectl-autoscaler",
+		Short:         "Inspect and operate CustomAutoScaling objects",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	cmd.SetOut(o.out)
+
+	if o.config == nil {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		overrides := &clientcmd.ConfigOverrides{}
+		cmd.PersistentFlags().StringVar(&loadingRules.ExplicitPath, "kubeconfig", "", "Path to the kubeconfig file to use.")
+		clientcmd.BindOverrideFlags(overrides, cmd.PersistentFlags(), clientcmd.RecommendedConfigOverrideFlags(""))
+		o.config = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	}
+	if o.newClient == nil {
+		o.newClient = func() (client.Client, error) {
+			cfg, err := o.config.ClientConfig()
+			if err != nil {
+				return nil, err
+			}
+			return client.New(cfg, client.Options{Scheme: scheme})
+		}
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+
+	cmd.AddCommand(
+		newStatusCommand(o),
+		newExplainCommand(o),
+		newPauseCommand(o),
+		newResumeCommand(o),
+		newSimulateCommand(o),
+		newRenderCommand(o),
+		newBacktestCommand(o),
+	)
+	return cmd
+}
+
+func main() {
+	if err := newRootCommand(&options{out: os.Stdout}).Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var now = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func newTestCR() *autoscaler.CustomAutoScaling {
+	return &autoscaler.CustomAutoScaling{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: autoscaler.CustomAutoScalingSpec{
+			Target:      autoscaler.ScaleTarget{Name: "web", Service: "web", Port: 8080},
+			Metrics:     []autoscaler.Metric{{Name: "requests", Query: "sum(rate(http_requests_total[1m])) > 100"}},
+			Driver:      autoscaler.AlertsDriver,
+			MinReplicas: int32Ptr(2),
+			MaxReplicas: int32Ptr(6),
+			Behavior: &autoscaler.ScalingBehavior{
+				ScaleUp: &autoscaler.ScalingRules{MaxStep: int32Ptr(2)},
+			},
+		},
+		Status: autoscaler.CustomAutoScalingStatus{
+			Replicas: 2,
+			Conditions: []metav1.Condition{
+				{Type: autoscaler.ConditionProvisioned, Status: metav1.ConditionTrue, Reason: "Provisioned"},
+				{Type: autoscaler.ConditionScalingConflict, Status: metav1.ConditionFalse, Reason: "NoConflict"},
+			},
+			LastAlert: &autoscaler.AlertStatus{Name: "HighLatency", Severity: "critical", Time: metav1.NewTime(now.Add(-5 * time.Minute))},
+			LastDecision: &autoscaler.DecisionStatus{
+				Time:            metav1.NewTime(now.Add(-5 * time.Minute)),
+				CurrentReplicas: 2,
+				DesiredReplicas: 7,
+				Replicas:        4,
+				Reason:          `alert HighLatency with severity "critical"`,
+				Clamped:         "maxReplicas",
+				Limited:         "scaleUp.maxStep",
+				Applied:         true,
+			},
+		},
+	}
+}
+
+// run executes the plugin with args against the cluster behind cl
+func run(t *testing.T, cl client.Client, args ...string) (string, error) {
+	t.Helper()
+
+	out := &bytes.Buffer{}
+	o := &options{
+		config:    clientcmd.NewDefaultClientConfig(*clientcmdapi.NewConfig(), &clientcmd.ConfigOverrides{}),
+		newClient: func() (client.Client, error) { return cl, nil },
+		now:       func() time.Time { return now },
+		out:       out,
+	}
+	cmd := newRootCommand(o)
+	cmd.SetArgs(args)
+	err := cmd.ExecuteContext(context.Background())
+	return out.String(), err
+}
+
+func newTestClient(objs ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStatus(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(4)},
+	}
+	paused := newTestCR()
+	paused.Name = "api"
+	paused.Annotations = map[string]string{autoscaler.SkipReconcileAnnotation: "true"}
+	paused.Status = autoscaler.CustomAutoScalingStatus{}
+
+	out, err := run(t, newTestClient(newTestCR(), paused, deployment), "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("status output:\n%s", out)
+	}
+	if fields := strings.Fields(lines[0]); fields[0] != "NAME" || fields[len(fields)-1] != "ALERT" {
+		t.Errorf("header = %q", lines[0])
+	}
+	// the list is sorted by name, api comes first
+	if want := []string{"api", "web", "Alerts", "Enforce", "4", "2-6", "Paused", "<none>"}; strings.Join(strings.Fields(lines[1]), " ") != strings.Join(want, " ") {
+		t.Errorf("paused row = %q, want %q", lines[1], want)
+	}
+	if want := []string{"web", "web", "Alerts", "Enforce", "4", "2-6", "Provisioned", "HighLatency/critical", "5m", "ago"}; strings.Join(strings.Fields(lines[2]), " ") != strings.Join(want, " ") {
+		t.Errorf("row = %q, want %q", lines[2], want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	out, err := run(t, newTestClient(newTestCR()), "explain", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`The last alert was HighLatency with severity "critical", 5m ago.`,
+		"it asked for 7 replicas while the deployment had 2",
+		"maxReplicas clamped the 7 replicas to 6",
+		"scaleUp.maxStep of 2 held the deployment at 4 replicas",
+		"the deployment was scaled from 2 to 4",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("explain output is missing %q:\n%s", want, out)
+		}
+	}
+
+	recommend := newTestCR()
+	recommend.Spec.Mode = autoscaler.RecommendMode
+	recommend.Status.LastDecision.Applied = false
+	out, err = run(t, newTestClient(recommend), "explain", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "scaling from 2 to 4 was recommended") {
+		t.Errorf("explain output in Recommend mode:\n%s", out)
+	}
+
+	frozen := newTestCR()
+	frozen.Spec.FreezeReplicas = &autoscaler.ReplicaFreeze{Replicas: 3, Until: metav1.NewTime(now.Add(2 * time.Hour))}
+	out, err = run(t, newTestClient(frozen), "explain", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "spec.freezeReplicas pins the deployment to 3 replicas for another 120m.") {
+		t.Errorf("explain output of a frozen CR:\n%s", out)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	cl := newTestClient(newTestCR())
+	key := types.NamespacedName{Namespace: "default", Name: "web"}
+
+	if _, err := run(t, cl, "pause", "web"); err != nil {
+		t.Fatal(err)
+	}
+	cr := &autoscaler.CustomAutoScaling{}
+	if err := cl.Get(context.Background(), key, cr); err != nil {
+		t.Fatal(err)
+	}
+	if !cr.Spec.Paused {
+		t.Errorf("spec.paused is not set after pause")
+	}
+	if out, err := run(t, cl, "pause", "web"); err != nil || !strings.Contains(out, "already paused") {
+		t.Errorf("second pause = %q, %v", out, err)
+	}
+
+	// resume also clears the annotation that paused CRs before spec.paused
+	cr.Annotations = map[string]string{autoscaler.SkipReconcileAnnotation: "true"}
+	if err := cl.Update(context.Background(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, cl, "resume", "web"); err != nil {
+		t.Fatal(err)
+	}
+	cr = &autoscaler.CustomAutoScaling{}
+	if err := cl.Get(context.Background(), key, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cr.Annotations[autoscaler.SkipReconcileAnnotation]; ok || cr.Spec.Paused {
+		t.Errorf("CR after resume: paused %v, annotations %v", cr.Spec.Paused, cr.Annotations)
+	}
+}
+
+const v1Manifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: default
+---
+apiVersion: buildpiper.opstreelabs.in/v1
+kind: CustomAutoScaling
+metadata:
+  name: web
+spec:
+  applicationRef:
+    deploymentName: web
+    deploymentService: web
+    deploymentPort: "8080"
+  scalingQuery: sum(rate(http_requests_total[1m])) > 100
+  minReplicas: 2
+  maxReplicas: 6
+  behavior:
+    scaleUp:
+      maxStep: 2
+      cooldown: 5m
+`
+
+const payload = `{
+  "status": "firing",
+  "alerts": [
+    {"status": "firing", "labels": {"alertname": "HighLatency", "severity": "critical", "customautoscaling": "web"}},
+    {"status": "resolved", "labels": {"alertname": "HighLatency", "severity": "warning"}},
+    {"status": "firing", "labels": {"alertname": "Errors", "severity": "critical", "customautoscaling": "api"}},
+    {"status": "firing", "labels": {"alertname": "HighLatency", "severity": "critical"}}
+  ]
+}`
+
+func TestSimulate(t *testing.T) {
+	manifest := writeFile(t, "web.yaml", v1Manifest)
+	alerts := writeFile(t, "alerts.json", payload)
+
+	out, err := run(t, nil, "simulate", "-f", manifest, "--payload", alerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	want := []string{
+		// critical asks for 5, the step of 2 holds the target at 3
+		"HighLatency critical 5 1 -> 3, limited by scaleUp.maxStep",
+		"HighLatency warning - skipped, resolved",
+		"Errors critical - skipped, alert for customautoscaling api",
+		// the first alert scaled the target within the cooldown
+		"HighLatency critical 5 3 -> 3, limited by scaleUp.cooldown",
+	}
+	if len(lines) != len(want)+1 {
+		t.Fatalf("simulate output:\n%s", out)
+	}
+	for i, w := range want {
+		if got := strings.Join(strings.Fields(lines[i+1]), " "); got != w {
+			t.Errorf("line %d = %q, want %q", i+1, got, w)
+		}
+	}
+
+	if out, err := run(t, nil, "simulate", "-f", manifest, "--payload", alerts, "--current", "6"); err != nil || !strings.Contains(out, "6 -> 5") {
+		t.Errorf("simulate --current 6 = %q, %v", out, err)
+	}
+
+	paused := newTestCR()
+	paused.Spec.Paused = true
+	if out, err := run(t, newTestClient(paused), "simulate", "web", "--payload", alerts); err != nil || !strings.Contains(out, "held, paused") {
+		t.Errorf("simulate of a paused CR = %q, %v", out, err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	manifest := writeFile(t, "web.yaml", v1Manifest)
+
+	out, err := run(t, nil, "render", "-f", manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, doc := range strings.Split(out, "---\n")[1:] {
+		for _, line := range strings.Split(doc, "\n") {
+			if strings.HasPrefix(line, "kind: ") {
+				kinds = append(kinds, strings.TrimPrefix(line, "kind: "))
+			}
+		}
+	}
+	want := "ServiceAccount ClusterRole ClusterRoleBinding ServiceMonitor Secret Prometheus Service Secret Alertmanager Service PrometheusRule"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("rendered kinds = %s, want %s", got, want)
+	}
+	if strings.Contains(out, "resourceVersion") {
+		t.Errorf("rendered objects carry a resourceVersion:\n%s", out)
+	}
+
+	hpa := newTestCR()
+	hpa.Spec.Driver = autoscaler.HPADriver
+	out, err = run(t, newTestClient(hpa), "render", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "kind: HorizontalPodAutoscaler") || strings.Contains(out, "kind: Alertmanager") {
+		t.Errorf("render of an HPA driven CR:\n%s", out)
+	}
+}
+
+const alertsFixture = `{
+  "scaling-query": [
+    {"metric": {"severity": "critical"}, "values": [[1682942460, "1"], [1682942520, "1"], [1682942580, "1"]]}
+  ]
+}`
+
+func TestBacktest(t *testing.T) {
+	manifest := writeFile(t, "web.yaml", v1Manifest)
+	fixture := writeFile(t, "fixture.json", alertsFixture)
+	csvPath := filepath.Join(t.TempDir(), "timeline.csv")
+
+	// the v1 scalingQuery becomes the scaling-query metric
+	out, err := run(t, nil, "backtest", "-f", manifest, "--fixture", fixture,
+		"--start", "2023-05-01T12:00:00Z", "--end", "2023-05-01T12:10:00Z", "--current", "2", "--csv", csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Scale events:       1",
+		// critical asks for 5, the target reaches 4 within the cooldown
+		"Under-provisioned:  3m0s",
+		"2023-05-01T12:01:00Z 5 2 -> 4, limited by scaleUp.maxStep alert scaling-query with severity \"critical\"",
+	} {
+		if !strings.Contains(strings.Join(strings.Fields(out), " "), strings.Join(strings.Fields(want), " ")) {
+			t.Errorf("backtest output is missing %q:\n%s", want, out)
+		}
+	}
+
+	data, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 12 {
+		t.Errorf("csv has %d lines, want a header and 11 rows:\n%s", len(lines), data)
+	}
+
+	if _, err := run(t, nil, "backtest", "-f", manifest); err == nil || !strings.Contains(err.Error(), "--fixture") {
+		t.Errorf("backtest without a source = %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newPauseCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause NAME",
+		Short: "Stop the scaling decisions of a CustomAutoScaling by setting spec.paused",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.setPaused(cmd.Context(), args[0], true)
+		},
+	}
+}
+
+func newResumeCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume NAME",
+		Short: "Resume reconciling a paused CustomAutoScaling",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.setPaused(cmd.Context(), args[0], false)
+		},
+	}
+}
+
+// setPaused sets spec.paused with a merge patch, resuming also removes the
+// skip-reconcile annotation that paused CRs before spec.paused existed
+func (o *options) setPaused(ctx context.Context, name string, pause bool) error {
+	cr, err := o.getCR(ctx, name)
+	if err != nil {
+		return err
+	}
+	if paused(cr) == pause {
+		state := "not paused"
+		if pause {
+			state = "already paused"
+		}
+		fmt.Fprintf(o.out, "customautoscaling %s/%s is %s\n", cr.Namespace, cr.Name, state)
+		return nil
+	}
+
+	cl, err := o.newClient()
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(cr.DeepCopy())
+	state := "resumed"
+	cr.Spec.Paused = pause
+	if pause {
+		state = "paused"
+	} else {
+		delete(cr.Annotations, autoscaler.SkipReconcileAnnotation)
+	}
+	if err := cl.Patch(ctx, cr, patch); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "customautoscaling %s/%s %s\n", cr.Namespace, cr.Name, state)
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/spf13/cobra"
+)
+
+func newRenderCommand(o *options) *cobra.Command {
+	var filename string
+	cmd := &cobra.Command{
+		Use:   "render [NAME]",
+		Short: "Print the child resources the operator creates for a CustomAutoScaling",
+		Long: `Print the child resources the operator creates for a CustomAutoScaling.
+
+The CR is read from --filename, or from the cluster when only NAME is given.
+Every CR of the manifest is rendered when --filename is given without NAME.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var crs []*autoscaler.CustomAutoScaling
+			if filename != "" && len(args) == 0 {
+				var err error
+				if crs, err = o.loadCRs(filename); err != nil {
+					return err
+				}
+			} else {
+				cr, err := o.loadCR(cmd.Context(), filename, args)
+				if err != nil {
+					return err
+				}
+				crs = append(crs, cr)
+			}
+
+			for _, cr := range crs {
+				if err := utils.RenderYAML(o.out, cr); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&filename, "filename", "f", "", "Manifest holding the CustomAutoScaling objects, v1 and v2 objects are accepted.")
+	return cmd
+}
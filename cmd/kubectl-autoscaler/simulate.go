@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/spf13/cobra"
+)
+
+type simulateOptions struct {
+	filename  string
+	payload   string
+	current   int32
+	lastScale time.Duration
+}
+
+func newSimulateCommand(o *options) *cobra.Command {
+	s := &simulateOptions{}
+	cmd := &cobra.Command{
+		Use:   "simulate [NAME] --payload FILE",
+		Short: "Feed an Alertmanager webhook payload through the scaling decision of a CustomAutoScaling",
+		Long: `Feed an Alertmanager webhook payload through the scaling decision of a CustomAutoScaling.
+
+The CR is read from --filename, or from the cluster when only NAME is given.
+Nothing is changed in the cluster, every firing alert of the payload is run
+through the severity mapping, the replica bounds and the behavior of the CR
+in turn, as the webhook would.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cr, err := o.loadCR(cmd.Context(), s.filename, args)
+			if err != nil {
+				return err
+			}
+			return o.simulate(cr, s)
+		},
+	}
+	cmd.Flags().StringVarP(&s.filename, "filename", "f", "", "Manifest holding the CustomAutoScaling, v1 and v2 objects are accepted.")
+	cmd.Flags().StringVar(&s.payload, "payload", "", "Alertmanager webhook payload in JSON, - reads stdin.")
+	cmd.Flags().Int32Var(&s.current, "current", 0, "Replicas of the deployment before the first alert, defaults to the replicas in the CR status or 1.")
+	cmd.Flags().DurationVar(&s.lastScale, "last-scale", 0, "How long ago the deployment was last scaled, 0 when it never was.")
+	_ = cmd.MarkFlagRequired("payload")
+	return cmd
+}
+
+func (o *options) simulate(cr *autoscaler.CustomAutoScaling, s *simulateOptions) error {
+	payload, err := readPayload(s.payload)
+	if err != nil {
+		return err
+	}
+
+	current := s.current
+	if current == 0 {
+		current = cr.Status.Replicas
+	}
+	if current == 0 {
+		current = 1
+	}
+	now := o.now()
+	var lastScale time.Time
+	if s.lastScale > 0 {
+		lastScale = now.Add(-s.lastScale)
+	}
+
+	w := tabwriter.NewWriter(o.out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "ALERT\tSEVERITY\tDESIRED\tDECISION")
+	for _, a := range payload.Alerts {
+		name, severity := a.Labels["alertname"], a.Labels["severity"]
+		if skipped := skipAlert(cr, a, now); skipped != "" {
+			fmt.Fprintf(w, "%s\t%s\t-\t%s\n", name, severity, skipped)
+			continue
+		}
+
+		desired := scaling.ReplicasForSeverity(&cr.Spec, severity)
+		if replicas, ok := utils.AlertReplicas(a); ok {
+			desired = replicas
+		}
+		decision := scaling.Decide(&cr.Spec, current, desired, lastScale, now)
+		result := decision.String()
+		switch {
+		case cr.Spec.Mode == autoscaler.RecommendMode:
+			result += " (recommended)"
+			lastScale = now
+		case decision.Changed():
+			current = decision.Replicas
+			lastScale = now
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", name, severity, desired, result)
+	}
+	return w.Flush()
+}
+
+// skipAlert returns why the webhook would not act on a, alerts without the CR
+// labels are assumed to be meant for cr
+func skipAlert(cr *autoscaler.CustomAutoScaling, a utils.Alert, now time.Time) string {
+	if a.Status == "resolved" {
+		return "skipped, resolved"
+	}
+	if name := a.Labels[utils.AlertLabelName]; name != "" && name != cr.Name {
+		return "skipped, alert for customautoscaling " + name
+	}
+	if ns := a.Labels[utils.AlertLabelNamespace]; ns != "" && ns != cr.Namespace {
+		return "skipped, alert for namespace " + ns
+	}
+	if d := driver(cr); d != autoscaler.AlertsDriver {
+		return "ignored by the " + string(d) + " driver"
+	}
+	if hold := scaling.HoldFor(cr, now); hold != nil {
+		return "held, " + hold.String()
+	}
+	return ""
+}
+
+func readPayload(path string) (*utils.AlertmanagerPayload, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	payload := &utils.AlertmanagerPayload{}
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return nil, fmt.Errorf("decoding alert payload %s: %w", path, err)
+	}
+	return payload, nil
+}
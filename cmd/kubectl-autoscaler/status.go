@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newStatusCommand(o *options) *cobra.Command {
+	var allNamespaces bool
+	cmd := &cobra.Command{
+		Use:   "status [NAME]",
+		Short: "Show the target, replicas, conditions and last alert of CustomAutoScaling objects",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.status(cmd.Context(), args, allNamespaces)
+		},
+	}
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "List the CustomAutoScaling objects of every namespace.")
+	return cmd
+}
+
+func (o *options) status(ctx context.Context, args []string, allNamespaces bool) error {
+	cl, err := o.newClient()
+	if err != nil {
+		return err
+	}
+	ns, err := o.namespace()
+	if err != nil {
+		return err
+	}
+
+	var crs []autoscaler.CustomAutoScaling
+	if len(args) == 1 {
+		cr := autoscaler.CustomAutoScaling{}
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: ns, Name: args[0]}, &cr); err != nil {
+			return err
+		}
+		crs = append(crs, cr)
+	} else {
+		list := &autoscaler.CustomAutoScalingList{}
+		opts := []client.ListOption{}
+		if !allNamespaces {
+			opts = append(opts, client.InNamespace(ns))
+		}
+		if err := cl.List(ctx, list, opts...); err != nil {
+			return err
+		}
+		crs = list.Items
+	}
+	if len(crs) == 0 {
+		fmt.Fprintf(o.out, "No CustomAutoScaling found in %s namespace.\n", ns)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(o.out, 0, 8, 3, ' ', 0)
+	if allNamespaces {
+		fmt.Fprint(w, "NAMESPACE\t")
+	}
+	fmt.Fprintln(w, "NAME\tTARGET\tDRIVER\tMODE\tREPLICAS\tBOUNDS\tCONDITIONS\tLAST ALERT")
+	for i := range crs {
+		cr := &crs[i]
+		if allNamespaces {
+			fmt.Fprintf(w, "%s\t", cr.Namespace)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			cr.Name, cr.Spec.Target.Name, driver(cr), mode(cr), o.replicas(ctx, cl, cr), bounds(cr), conditions(cr), o.lastAlert(cr))
+	}
+	return w.Flush()
+}
+
+// replicas reads the replica count of the target, the status is used when the deployment cannot be read
+func (o *options) replicas(ctx context.Context, cl client.Client, cr *autoscaler.CustomAutoScaling) string {
+	deployment := &appsv1.Deployment{}
+	if err := cl.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.Target.Name}, deployment); err == nil && deployment.Spec.Replicas != nil {
+		return strconv.Itoa(int(*deployment.Spec.Replicas))
+	}
+	return strconv.Itoa(int(cr.Status.Replicas))
+}
+
+func driver(cr *autoscaler.CustomAutoScaling) autoscaler.ScalingDriver {
+	if cr.Spec.Driver == "" {
+		return autoscaler.AlertsDriver
+	}
+	return cr.Spec.Driver
+}
+
+func mode(cr *autoscaler.CustomAutoScaling) autoscaler.ScalingMode {
+	if cr.Spec.Mode == "" {
+		return autoscaler.EnforceMode
+	}
+	return cr.Spec.Mode
+}
+
+func paused(cr *autoscaler.CustomAutoScaling) bool {
+	_, ok := cr.Annotations[autoscaler.SkipReconcileAnnotation]
+	return ok || cr.Spec.Paused
+}
+
+// bounds prints minReplicas-maxReplicas, leaving out the bounds that are not set
+func bounds(cr *autoscaler.CustomAutoScaling) string {
+	var min, max string
+	if cr.Spec.MinReplicas != nil {
+		min = strconv.Itoa(int(*cr.Spec.MinReplicas))
+	}
+	if cr.Spec.MaxReplicas != nil {
+		max = strconv.Itoa(int(*cr.Spec.MaxReplicas))
+	}
+	if min == "" && max == "" {
+		return "<none>"
+	}
+	return min + "-" + max
+}
+
+// conditions lists the true conditions of the CR and whether it is paused,
+// which the operator does not report while the CR is not reconciled
+func conditions(cr *autoscaler.CustomAutoScaling) string {
+	var names []string
+	for _, c := range cr.Status.Conditions {
+		if c.Status == metav1.ConditionTrue {
+			names = append(names, c.Type)
+		}
+	}
+	if paused(cr) && !meta.IsStatusConditionTrue(cr.Status.Conditions, autoscaler.ConditionPaused) {
+		names = append(names, "Paused")
+	}
+	if len(names) == 0 {
+		return "<none>"
+	}
+	return strings.Join(names, ",")
+}
+
+func (o *options) lastAlert(cr *autoscaler.CustomAutoScaling) string {
+	a := cr.Status.LastAlert
+	if a == nil {
+		return "<none>"
+	}
+	s := a.Name
+	if a.Severity != "" {
+		s += "/" + a.Severity
+	}
+	return s + " " + o.ago(a.Time) + " ago"
+}
+
+func (o *options) ago(t metav1.Time) string {
+	return duration.HumanDuration(o.now().Sub(t.Time))
+}
+
+func (o *options) until(t time.Time) string {
+	return duration.HumanDuration(t.Sub(o.now()))
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/receiver"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultAlertSyncInterval is how often the firing alerts of a CR are read
+// back from its Alertmanager unless set by flags
+const DefaultAlertSyncInterval = time.Minute
+
+// alertSyncSource is the source of the signals read back from the Alertmanager API
+const alertSyncSource = "alertmanager-api"
+
+// alertSyncTimeout bounds the query to the Alertmanager made by a reconcile
+const alertSyncTimeout = 10 * time.Second
+
+// reconcileFiringAlerts reads the alerts of the CR still firing in its
+// Alertmanager and scales the target to what they ask for, so a lost webhook
+// delivery is made up for within AlertSyncInterval instead of the next repeat
+// of the notification. Without firing alerts nothing is done, as resolved
+// alerts do not scale through the webhook either
+func (r *CustomAutoScalingReconciler) reconcileFiringAlerts(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	if r.AlertSyncInterval <= 0 || !usesAlerts(instance) || instance.Spec.Monitoring.Embedded != nil {
+		return nil
+	}
+	now := time.Now()
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+	if !r.alertSyncDue(key, now) {
+		return nil
+	}
+	// held and conflicted CRs would only record the same refused decision every time
+	if scaling.HoldFor(instance, now) != nil || conflicted(instance) {
+		return nil
+	}
+
+	address := utils.AlertmanagerURL(instance)
+	if r.AlertmanagerURL != nil {
+		address = r.AlertmanagerURL(instance)
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, alertSyncTimeout)
+	defer cancel()
+	alerts, err := utils.FiringAlerts(queryCtx, address, instance)
+	if err != nil {
+		alertSyncs.WithLabelValues(instance.Namespace, instance.Name, alertSyncFailed).Inc()
+		return err
+	}
+
+	result, err := r.scaleToAlerts(ctx, instance, receiver.AlertSignals(alertSyncSource, alerts), now, "%s still firing in Alertmanager")
+	alertSyncs.WithLabelValues(instance.Namespace, instance.Name, result).Inc()
+	return err
+}
+
+// scaleToAlerts scales the target to what the strongest of the firing
+// signals asks for, bounded by the spec, unless the deployment already runs it, the reason of the
+// decision is formatted into reasonFormat. It returns the alert sync result
+func (r *CustomAutoScalingReconciler) scaleToAlerts(ctx context.Context, instance *autoscaler.CustomAutoScaling, signals []receiver.Signal, now time.Time, reasonFormat string) (string, error) {
+	s, ok := strongestSignal(instance, signals)
+	if !ok {
+		return alertSyncNoAlerts, nil
+	}
+	desired, trigger, reason := signalDecision(instance, s)
+
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.Target.Name, Namespace: instance.Namespace}, deployment); err != nil {
+		return alertSyncFailed, err
+	}
+	current := int32(1)
+	if deployment.Spec.Replicas != nil {
+		current = *deployment.Spec.Replicas
+	}
+	// compare against the bounded count, a desired count beyond the bounds
+	// would otherwise scale to the same replicas on every sync
+	if !scaling.Decide(&instance.Spec, current, desired, lastScaleTime(instance), now).Changed() {
+		return alertSyncInSync, nil
+	}
+
+	log.Info("scaling to the strongest firing alert", "customautoscaling", instance.Namespace+"/"+instance.Name, "alertname", s.Alert, "source", s.Source)
+	instance.Status.LastAlert = &autoscaler.AlertStatus{Name: s.Alert, Severity: s.Severity, Time: metav1.NewTime(now)}
+	if _, err := r.scaleTarget(ctx, instance, desired, trigger, fmt.Sprintf(reasonFormat, reason)); err != nil {
+		return alertSyncFailed, err
+	}
+	return alertSyncScaled, nil
+}
+
+// Results of reading back the firing alerts of a CR
+const (
+	alertSyncScaled   = "scaled"
+	alertSyncInSync   = "in_sync"
+	alertSyncNoAlerts = "no_alerts"
+	alertSyncFailed   = "failed"
+)
+
+// strongestSignal returns the firing signal asking for the most replicas,
+// ties go to the alert name first in order so the choice is stable
+func strongestSignal(instance *autoscaler.CustomAutoScaling, signals []receiver.Signal) (receiver.Signal, bool) {
+	var strongest receiver.Signal
+	var replicas int32
+	found := false
+	for _, s := range signals {
+		if s.Resolved {
+			continue
+		}
+		desired, _, _ := signalDecision(instance, s)
+		if !found || desired > replicas || (desired == replicas && s.Alert < strongest.Alert) {
+			strongest, replicas, found = s, desired, true
+		}
+	}
+	return strongest, found
+}
+
+// alertSyncDue reports whether the firing alerts of the CR key are to be read
+// back at now, and if so remembers now as the time they were
+func (r *CustomAutoScalingReconciler) alertSyncDue(key types.NamespacedName, now time.Time) bool {
+	r.alertSyncMu.Lock()
+	defer r.alertSyncMu.Unlock()
+	if last, ok := r.alertSyncs[key]; ok && now.Sub(last) < r.AlertSyncInterval {
+		return false
+	}
+	if r.alertSyncs == nil {
+		r.alertSyncs = map[types.NamespacedName]time.Time{}
+	}
+	r.alertSyncs[key] = now
+	return true
+}
+
+// forgetAlertSync drops the last read back time of a deleted CR
+func (r *CustomAutoScalingReconciler) forgetAlertSync(key types.NamespacedName) {
+	r.alertSyncMu.Lock()
+	defer r.alertSyncMu.Unlock()
+	delete(r.alertSyncs, key)
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+const firingAlerts = `[
+	{"labels":{"alertname":"latency","severity":"warning","customautoscaling":"web","customautoscaling_namespace":"default"},"annotations":{},"startsAt":"2023-01-01T00:00:00Z","endsAt":"2023-01-01T01:00:00Z","updatedAt":"2023-01-01T00:00:00Z","generatorURL":"","fingerprint":"b","receivers":[{"name":"webhook_receiver"}],"status":{"state":"active","silencedBy":[],"inhibitedBy":[]}},
+	{"labels":{"alertname":"requests","severity":"critical","customautoscaling":"web","customautoscaling_namespace":"default"},"annotations":{},"startsAt":"2023-01-01T00:00:00Z","endsAt":"2023-01-01T01:00:00Z","updatedAt":"2023-01-01T00:00:00Z","generatorURL":"","fingerprint":"a","receivers":[{"name":"webhook_receiver"}],"status":{"state":"active","silencedBy":[],"inhibitedBy":[]}}
+]`
+
+// alertmanagerStub serves alerts on /api/v2/alerts and counts the queries it
+// answered, it fails queries that do not filter on the labels of the CR web
+func alertmanagerStub(t *testing.T, alerts string, queries *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filters := req.URL.Query()["filter"]
+		if req.URL.Path != "/api/v2/alerts" || len(filters) != 2 ||
+			filters[0] != `customautoscaling="web"` || filters[1] != `customautoscaling_namespace="default"` {
+			http.Error(w, "unexpected query "+req.URL.String(), http.StatusBadRequest)
+			return
+		}
+		*queries++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(alerts))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReconcileFiringAlerts(t *testing.T) {
+	ctx := context.Background()
+	queries := 0
+	server := alertmanagerStub(t, firingAlerts, &queries)
+
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	deployment := newHoldDeployment(1)
+	r := newConflictReconciler(t, instance, deployment)
+	r.AlertSyncInterval = time.Minute
+	r.AlertmanagerURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	if err := r.reconcileFiringAlerts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	// the critical alert asks for more replicas than the warning one
+	if got := replicasOf(t, r, deployment); got != 5 {
+		t.Errorf("replicas = %d, want 5", got)
+	}
+	if instance.Status.LastAlert == nil || instance.Status.LastAlert.Name != "requests" {
+		t.Errorf("lastAlert = %+v, want requests", instance.Status.LastAlert)
+	}
+	events := scalingEvents(t, r)
+	if len(events) != 1 || events[0].Spec.Trigger.Source != alertSyncSource || events[0].Spec.Trigger.Fingerprint != "a" {
+		t.Fatalf("scaling events = %+v, want one for the alert read back", events)
+	}
+
+	// within the interval the Alertmanager is not queried again
+	if err := r.reconcileFiringAlerts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 1 {
+		t.Errorf("queries = %d, want 1 within the interval", queries)
+	}
+
+	// once due, alerts already acted on change nothing
+	r.alertSyncs[types.NamespacedName{Namespace: "default", Name: "web"}] = time.Now().Add(-time.Minute)
+	if err := r.reconcileFiringAlerts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 2 || len(scalingEvents(t, r)) != 1 {
+		t.Errorf("queries = %d, scaling events = %d, want 2 and 1 once in sync", queries, len(scalingEvents(t, r)))
+	}
+}
+
+func TestReconcileFiringAlertsBounded(t *testing.T) {
+	ctx := context.Background()
+	queries := 0
+	server := alertmanagerStub(t, firingAlerts, &queries)
+
+	// the critical alert asks for 5 replicas, beyond the maximum of 3
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.MaxReplicas = int32Ptr(3)
+	deployment := newHoldDeployment(1)
+	r := newConflictReconciler(t, instance, deployment)
+	r.AlertSyncInterval = time.Minute
+	r.AlertmanagerURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	key := types.NamespacedName{Namespace: "default", Name: "web"}
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			r.alertSyncs[key] = time.Now().Add(-time.Minute)
+		}
+		if err := r.reconcileFiringAlerts(ctx, instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := replicasOf(t, r, deployment); got != 3 {
+		t.Errorf("replicas = %d, want 3", got)
+	}
+	if queries != 3 || len(scalingEvents(t, r)) != 1 {
+		t.Errorf("queries = %d, scaling events = %d, want 3 and 1 at the maximum", queries, len(scalingEvents(t, r)))
+	}
+	// only the first sync scaled, clamping the alert to the maximum
+	clamped := 0
+	for events := r.Recorder.(*record.FakeRecorder).Events; len(events) > 0; {
+		if strings.Contains(<-events, "ReplicasClamped") {
+			clamped++
+		}
+	}
+	if clamped != 1 {
+		t.Errorf("ReplicasClamped events = %d, want 1", clamped)
+	}
+}
+
+func TestReconcileFiringAlertsSkipped(t *testing.T) {
+	tests := []struct {
+		name     string
+		alerts   string
+		interval time.Duration
+		mutate   func(*autoscaler.CustomAutoScaling)
+		queries  int
+	}{
+		{name: "no alerts", alerts: `[]`, interval: time.Minute, queries: 1},
+		{name: "disabled", alerts: firingAlerts},
+		{name: "hpa driver", alerts: firingAlerts, interval: time.Minute, mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Spec.Driver = autoscaler.HPADriver
+		}},
+		{name: "paused", alerts: firingAlerts, interval: time.Minute, mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Spec.Paused = true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := 0
+			server := alertmanagerStub(t, tt.alerts, &queries)
+
+			instance := newConflictCR("web", autoscaler.TakeoverNever)
+			if tt.mutate != nil {
+				tt.mutate(instance)
+			}
+			deployment := newHoldDeployment(2)
+			r := newConflictReconciler(t, instance, deployment)
+			r.AlertSyncInterval = tt.interval
+			r.AlertmanagerURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+			if err := r.reconcileFiringAlerts(context.Background(), instance); err != nil {
+				t.Fatal(err)
+			}
+			if queries != tt.queries {
+				t.Errorf("queries = %d, want %d", queries, tt.queries)
+			}
+			if got := replicasOf(t, r, deployment); got != 2 {
+				t.Errorf("replicas = %d, want 2", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// auditRetention returns how many ScalingEvents are kept for the CR and for how long
+func auditRetention(instance *autoscaler.CustomAutoScaling) (int, time.Duration) {
+	retention, ttl := autoscaler.DefaultAuditRetention, autoscaler.DefaultAuditTTL
+	if audit := instance.Spec.Audit; audit != nil {
+		if audit.Retention != nil {
+			retention = int(*audit.Retention)
+		}
+		if audit.TTL != nil {
+			ttl = audit.TTL.Duration
+		}
+	}
+	return retention, ttl
+}
+
+// recordScalingEvent persists decision as a ScalingEvent owned by the CR and
+// prunes the older ones. Failing to record does not fail the decision, it is
+// reported as an AuditFailed event instead
+func (r *CustomAutoScalingReconciler) recordScalingEvent(ctx context.Context, instance *autoscaler.CustomAutoScaling, decision scaling.Decision,
+	trigger autoscaler.ScalingTrigger, reason string, outcome autoscaler.ScalingOutcome, message string, now time.Time) {
+	if retention, _ := auditRetention(instance); retention == 0 {
+		return
+	}
+
+	event := &autoscaler.ScalingEvent{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: instance.Name + "-",
+			Namespace:    instance.Namespace,
+			Labels:       map[string]string{autoscaler.CustomAutoScalingLabel: instance.Name},
+		},
+		Spec: autoscaler.ScalingEventSpec{
+			Time:              metav1.NewMicroTime(now),
+			CustomAutoScaling: instance.Name,
+			Target:            instance.Spec.Target.Name,
+			OldReplicas:       decision.Current,
+			NewReplicas:       decision.Replicas,
+			DesiredReplicas:   decision.Desired,
+			Trigger:           trigger,
+			Reason:            reason,
+			Clamped:           decision.Clamped,
+			Limited:           decision.Limited,
+			Outcome:           outcome,
+			Message:           message,
+		},
+	}
+	if err := controllerutil.SetControllerReference(instance, event, r.Scheme); err != nil {
+		log.Error(err, "failed to own scaling event", "customautoscaling", instance.Namespace+"/"+instance.Name)
+		return
+	}
+	if err := r.Create(ctx, event); err != nil {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "AuditFailed", "failed to record %s decision from %d to %d: %s",
+			outcome, decision.Current, decision.Replicas, err)
+		log.Error(err, "failed to record scaling event", "customautoscaling", instance.Namespace+"/"+instance.Name)
+		return
+	}
+	if err := r.pruneScalingEvents(ctx, instance, now); err != nil {
+		log.Error(err, "failed to prune scaling events", "customautoscaling", instance.Namespace+"/"+instance.Name)
+	}
+}
+
+// pruneScalingEvents deletes the ScalingEvents of the CR beyond its retention
+// count or older than its TTL
+func (r *CustomAutoScalingReconciler) pruneScalingEvents(ctx context.Context, instance *autoscaler.CustomAutoScaling, now time.Time) error {
+	events := &autoscaler.ScalingEventList{}
+	if err := r.List(ctx, events, client.InNamespace(instance.Namespace),
+		client.MatchingLabels{autoscaler.CustomAutoScalingLabel: instance.Name}); err != nil {
+		return err
+	}
+
+	newestFirst(events.Items)
+	retention, ttl := auditRetention(instance)
+	cutoff := now.Add(-ttl)
+	for i := range events.Items {
+		event := &events.Items[i]
+		if i < retention && event.Spec.Time.Time.After(cutoff) {
+			continue
+		}
+		if err := r.Delete(ctx, event); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestFirst sorts ScalingEvents by time, the name breaks ties
+func newestFirst(events []autoscaler.ScalingEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i].Spec.Time, events[j].Spec.Time
+		if !a.Equal(&b) {
+			return b.Before(&a)
+		}
+		return events[i].Name > events[j].Name
+	})
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var testTrigger = autoscaler.ScalingTrigger{Type: autoscaler.AlertTrigger, Alert: "HighLoad", Severity: "critical", Fingerprint: "c0ffee"}
+
+func scalingEvents(t *testing.T, r *CustomAutoScalingReconciler) []autoscaler.ScalingEvent {
+	t.Helper()
+	events := &autoscaler.ScalingEventList{}
+	if err := r.List(context.Background(), events, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	return events.Items
+}
+
+func TestScalingEvents(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.MaxReplicas = int32Ptr(4)
+	r := newConflictReconciler(t, instance, newHoldDeployment(2))
+
+	if _, err := r.scaleTarget(ctx, instance, 5, testTrigger, "test"); err != nil {
+		t.Fatal(err)
+	}
+	events := scalingEvents(t, r)
+	if len(events) != 1 {
+		t.Fatalf("recorded %d scaling events, want 1", len(events))
+	}
+	got := events[0]
+	want := autoscaler.ScalingEventSpec{
+		Time:              got.Spec.Time,
+		CustomAutoScaling: "web",
+		Target:            "web",
+		OldReplicas:       2,
+		NewReplicas:       4,
+		DesiredReplicas:   5,
+		Trigger:           testTrigger,
+		Reason:            "test",
+		Clamped:           "maxReplicas",
+		Outcome:           autoscaler.OutcomeApplied,
+	}
+	if got.Spec != want {
+		t.Errorf("scaling event = %+v, want %+v", got.Spec, want)
+	}
+	if got.Labels[autoscaler.CustomAutoScalingLabel] != "web" || len(got.OwnerReferences) != 1 || got.OwnerReferences[0].UID != "web-uid" {
+		t.Errorf("scaling event is not owned by the CR: %+v", got.ObjectMeta)
+	}
+
+	// a decision that changes nothing is not recorded
+	if _, err := r.scaleTarget(ctx, instance, 4, testTrigger, "test"); err != nil {
+		t.Fatal(err)
+	}
+	instance.Spec.Mode = autoscaler.RecommendMode
+	if _, err := r.scaleTarget(ctx, instance, 1, testTrigger, "test"); err != nil {
+		t.Fatal(err)
+	}
+	events = scalingEvents(t, r)
+	if len(events) != 2 {
+		t.Fatalf("recorded %d scaling events, want 2", len(events))
+	}
+	for _, e := range events {
+		if e.Name != got.Name && e.Spec.Outcome != autoscaler.OutcomeRecommended {
+			t.Errorf("outcome in Recommend mode = %s", e.Spec.Outcome)
+		}
+	}
+}
+
+func TestPruneScalingEvents(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Audit = &autoscaler.AuditLog{Retention: int32Ptr(4), TTL: &metav1.Duration{Duration: 5 * time.Hour}}
+
+	objs := []client.Object{instance}
+	for i := 0; i < 6; i++ {
+		objs = append(objs, &autoscaler.ScalingEvent{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("web-%d", i),
+				Namespace: "default",
+				Labels:    map[string]string{autoscaler.CustomAutoScalingLabel: "web"},
+			},
+			Spec: autoscaler.ScalingEventSpec{Time: metav1.NewMicroTime(now.Add(-time.Duration(i*2) * time.Hour))},
+		})
+	}
+	// events of other CRs are left alone
+	objs = append(objs, &autoscaler.ScalingEvent{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-0", Namespace: "default", Labels: map[string]string{autoscaler.CustomAutoScalingLabel: "api"}},
+		Spec:       autoscaler.ScalingEventSpec{Time: metav1.NewMicroTime(now.Add(-100 * time.Hour))},
+	})
+	r := newConflictReconciler(t, objs...)
+
+	if err := r.pruneScalingEvents(ctx, instance, now); err != nil {
+		t.Fatal(err)
+	}
+	// web-3 is within the retention count but older than the TTL
+	var names []string
+	for _, e := range scalingEvents(t, r) {
+		names = append(names, e.Name)
+	}
+	if fmt.Sprint(names) != "[api-0 web-0 web-1 web-2]" {
+		t.Errorf("kept %v, want [api-0 web-0 web-1 web-2]", names)
+	}
+
+	// a retention of 0 stops recording
+	instance.Spec.Audit.Retention = int32Ptr(0)
+	r.recordScalingEvent(ctx, instance, scaling.Decision{Current: 2, Desired: 5, Replicas: 5}, testTrigger, "test", autoscaler.OutcomeApplied, "", now)
+	if n := len(scalingEvents(t, r)); n != 4 {
+		t.Errorf("%d scaling events after recording with a retention of 0, want 4", n)
+	}
+}
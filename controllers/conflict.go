@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/externalscaler"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetIndex indexes scalers by the name of the deployment they scale
+const targetIndex = ".spec.target"
+
+// scaledObjectGVK is the KEDA ScaledObject, it is only watched when the CRD is installed
+var scaledObjectGVK = schema.GroupVersionKind{Group: "keda.sh", Version: "v1alpha1", Kind: "ScaledObject"}
+
+// errScalingConflict is returned by scaleTarget while another scaler owns the target
+var errScalingConflict = errors.New("target is managed by another scaler")
+
+// setupIndexes registers the target index on every kind of scaler the
+// reconciler knows about
+func (r *CustomAutoScalingReconciler) setupIndexes(mgr ctrl.Manager) error {
+	ctx := context.Background()
+	indexer := mgr.GetFieldIndexer()
+
+	if err := indexer.IndexField(ctx, &autoscaler.CustomAutoScaling{}, targetIndex, customAutoScalingTarget); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &autoscalingv2.HorizontalPodAutoscaler{}, targetIndex, hpaTarget); err != nil {
+		return err
+	}
+
+	if _, err := mgr.GetRESTMapper().RESTMapping(scaledObjectGVK.GroupKind(), scaledObjectGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			log.Info("KEDA is not installed, ScaledObjects are not checked for conflicts")
+			return nil
+		}
+		return err
+	}
+	r.kedaInstalled = true
+
+	scaledObject := &unstructured.Unstructured{}
+	scaledObject.SetGroupVersionKind(scaledObjectGVK)
+	return indexer.IndexField(ctx, scaledObject, targetIndex, scaledObjectTarget)
+}
+
+func customAutoScalingTarget(o client.Object) []string {
+	return []string{o.(*autoscaler.CustomAutoScaling).Spec.Target.Name}
+}
+
+func hpaTarget(o client.Object) []string {
+	ref := o.(*autoscalingv2.HorizontalPodAutoscaler).Spec.ScaleTargetRef
+	if ref.Kind != "Deployment" {
+		return nil
+	}
+	return []string{ref.Name}
+}
+
+func scaledObjectTarget(o client.Object) []string {
+	u := o.(*unstructured.Unstructured)
+	// the kind of a ScaledObject target defaults to Deployment
+	if kind, _, _ := unstructured.NestedString(u.Object, "spec", "scaleTargetRef", "kind"); kind != "" && kind != "Deployment" {
+		return nil
+	}
+	name, _, _ := unstructured.NestedString(u.Object, "spec", "scaleTargetRef", "name")
+	return []string{name}
+}
+
+// scalerConflicts are the other scalers of the target of a CR
+type scalerConflicts struct {
+	// hpas can be adopted
+	hpas []autoscalingv2.HorizontalPodAutoscaler
+	// others are reported as kind/name
+	others []string
+}
+
+func (c scalerConflicts) empty() bool {
+	return len(c.hpas) == 0 && len(c.others) == 0
+}
+
+func (c scalerConflicts) String() string {
+	names := append([]string{}, c.others...)
+	for _, hpa := range c.hpas {
+		names = append(names, "HorizontalPodAutoscaler/"+hpa.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// findConflicts lists the HPAs, KEDA ScaledObjects and CustomAutoScalings
+// that scale the same deployment as instance
+func (r *CustomAutoScalingReconciler) findConflicts(ctx context.Context, instance *autoscaler.CustomAutoScaling) (scalerConflicts, error) {
+	var conflicts scalerConflicts
+	opts := []client.ListOption{client.InNamespace(instance.Namespace), client.MatchingFields{targetIndex: instance.Spec.Target.Name}}
+
+	cases := &autoscaler.CustomAutoScalingList{}
+	if err := r.List(ctx, cases, opts...); err != nil {
+		return conflicts, err
+	}
+	for _, other := range cases.Items {
+		if other.Name != instance.Name {
+			conflicts.others = append(conflicts.others, "CustomAutoScaling/"+other.Name)
+		}
+	}
+
+	hpas := &autoscalingv2.HorizontalPodAutoscalerList{}
+	if err := r.List(ctx, hpas, opts...); err != nil {
+		return conflicts, err
+	}
+	for _, hpa := range hpas.Items {
+		// the HPA generated for the HPA driver is the CR itself scaling the target
+		if metav1.IsControlledBy(&hpa, instance) {
+			continue
+		}
+		// KEDA manages an HPA per ScaledObject, the ScaledObject is reported instead
+		if owner := metav1.GetControllerOf(&hpa); owner != nil && owner.Kind == scaledObjectGVK.Kind {
+			continue
+		}
+		conflicts.hpas = append(conflicts.hpas, hpa)
+	}
+
+	if r.kedaInstalled {
+		scaledObjects := &unstructured.UnstructuredList{}
+		scaledObjects.SetGroupVersionKind(scaledObjectGVK.GroupVersion().WithKind(scaledObjectGVK.Kind + "List"))
+		if err := r.List(ctx, scaledObjects, opts...); err != nil {
+			return conflicts, err
+		}
+		for _, so := range scaledObjects.Items {
+			if delegatesTo(&so, instance) {
+				continue
+			}
+			conflicts.others = append(conflicts.others, scaledObjectGVK.Kind+"/"+so.GetName())
+		}
+	}
+
+	return conflicts, nil
+}
+
+// delegatesTo reports whether the ScaledObject reads its metrics from the CR
+// through the external scaler, which is how the KEDA driver scales the target
+func delegatesTo(so *unstructured.Unstructured, instance *autoscaler.CustomAutoScaling) bool {
+	if instance.Spec.Driver != autoscaler.KEDADriver {
+		return false
+	}
+	triggers, _, _ := unstructured.NestedSlice(so.Object, "spec", "triggers")
+	for _, t := range triggers {
+		trigger, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if kind, _, _ := unstructured.NestedString(trigger, "type"); kind != "external" && kind != "external-push" {
+			continue
+		}
+		if name, _, _ := unstructured.NestedString(trigger, "metadata", externalscaler.MetadataCustomAutoScaling); name == instance.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileConflicts adopts conflicting HPAs when the takeover policy asks for
+// it and reports the remaining conflicts in the ScalingConflict condition
+func (r *CustomAutoScalingReconciler) reconcileConflicts(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	conflicts, err := r.findConflicts(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	if instance.Spec.Takeover == autoscaler.TakeoverAdopt && len(conflicts.hpas) > 0 {
+		if err := r.adoptHPAs(ctx, instance, conflicts.hpas); err != nil {
+			return err
+		}
+		conflicts.hpas = nil
+	}
+
+	condition := metav1.Condition{
+		Type:               autoscaler.ConditionScalingConflict,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoConflict",
+		Message:            fmt.Sprintf("no other scaler targets deployment %s", instance.Spec.Target.Name),
+		ObservedGeneration: instance.Generation,
+	}
+	if !conflicts.empty() {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ConflictingScalers"
+		condition.Message = fmt.Sprintf("%s also scale deployment %s", conflicts, instance.Spec.Target.Name)
+		if instance.Spec.Takeover != autoscaler.TakeoverForce {
+			condition.Message += ", scaling is suspended until they are removed or takeover is set to Force"
+		}
+	}
+
+	current := meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionScalingConflict)
+	if current != nil && current.Status == condition.Status && current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration {
+		return nil
+	}
+	if condition.Status == metav1.ConditionTrue {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, "ScalingConflict", condition.Message)
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	return r.Status().Update(ctx, instance)
+}
+
+// adoptHPAs copies the bounds of the first HPA into the CR where it has none
+// of its own and deletes the HPAs so they stop scaling the target
+func (r *CustomAutoScalingReconciler) adoptHPAs(ctx context.Context, instance *autoscaler.CustomAutoScaling, hpas []autoscalingv2.HorizontalPodAutoscaler) error {
+	hpa := hpas[0]
+	if instance.Spec.MinReplicas == nil || instance.Spec.MaxReplicas == nil {
+		if instance.Spec.MinReplicas == nil {
+			instance.Spec.MinReplicas = hpa.Spec.MinReplicas
+		}
+		if instance.Spec.MaxReplicas == nil {
+			instance.Spec.MaxReplicas = &hpa.Spec.MaxReplicas
+		}
+		if err := r.Update(ctx, instance); err != nil {
+			return err
+		}
+	}
+
+	for i := range hpas {
+		if err := client.IgnoreNotFound(r.Delete(ctx, &hpas[i])); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "AdoptedHPA", "took over deployment %s from HorizontalPodAutoscaler %s",
+			instance.Spec.Target.Name, hpas[i].Name)
+	}
+	return nil
+}
+
+// conflicted reports whether scaling of the target is suspended by a conflict
+func conflicted(instance *autoscaler.CustomAutoScaling) bool {
+	return instance.Spec.Takeover != autoscaler.TakeoverForce &&
+		meta.IsStatusConditionTrue(instance.Status.Conditions, autoscaler.ConditionScalingConflict)
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/externalscaler"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func newConflictReconciler(t *testing.T, objs ...client.Object) *CustomAutoScalingReconciler {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := autoscaler.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := monitoringv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).
+		WithIndex(&autoscaler.CustomAutoScaling{}, targetIndex, customAutoScalingTarget).
+		WithIndex(&autoscalingv2.HorizontalPodAutoscaler{}, targetIndex, hpaTarget).
+		Build()
+	return &CustomAutoScalingReconciler{Client: cl, Scheme: scheme, Recorder: record.NewFakeRecorder(20)}
+}
+
+func newConflictCR(name string, takeover autoscaler.TakeoverPolicy) *autoscaler.CustomAutoScaling {
+	return &autoscaler.CustomAutoScaling{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: autoscaler.CustomAutoScalingSpec{
+			Target:   autoscaler.ScaleTarget{Name: "web", Port: 8080},
+			Takeover: takeover,
+		},
+	}
+}
+
+func newHPA(name string, owner *metav1.OwnerReference) *autoscalingv2.HorizontalPodAutoscaler {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+			MinReplicas:    int32Ptr(2),
+			MaxReplicas:    8,
+		},
+	}
+	if owner != nil {
+		hpa.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return hpa
+}
+
+func TestConflictSuspendsScaling(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2)},
+	}
+	kedaOwned := &metav1.OwnerReference{APIVersion: "keda.sh/v1alpha1", Kind: "ScaledObject", Name: "web", UID: "so", Controller: func() *bool { b := true; return &b }()}
+	r := newConflictReconciler(t, instance, deployment,
+		newConflictCR("web-too", autoscaler.TakeoverNever),
+		newHPA("web", nil),
+		newHPA("keda-hpa-web", kedaOwned),
+		&autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+			Spec:       autoscalingv2.HorizontalPodAutoscalerSpec{ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "api"}},
+		},
+	)
+
+	if err := r.reconcileConflicts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	condition := meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionScalingConflict)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("ScalingConflict condition = %+v, want True", condition)
+	}
+	for _, want := range []string{"CustomAutoScaling/web-too", "HorizontalPodAutoscaler/web"} {
+		if !strings.Contains(condition.Message, want) {
+			t.Errorf("condition message %q does not name %s", condition.Message, want)
+		}
+	}
+	for _, unwanted := range []string{"keda-hpa-web", "HorizontalPodAutoscaler/other"} {
+		if strings.Contains(condition.Message, unwanted) {
+			t.Errorf("condition message %q names %s", condition.Message, unwanted)
+		}
+	}
+
+	if _, err := r.scaleTarget(ctx, instance, 5, testTrigger, "test"); !errors.Is(err, errScalingConflict) {
+		t.Fatalf("scaleTarget() = %v, want errScalingConflict", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("deployment scaled to %d while conflicted", *deployment.Spec.Replicas)
+	}
+
+	// Force keeps reporting the conflict but acts on the target
+	instance.Spec.Takeover = autoscaler.TakeoverForce
+	if _, err := r.scaleTarget(ctx, instance, 5, testTrigger, "test"); err != nil {
+		t.Fatalf("scaleTarget() with Force = %v", err)
+	}
+}
+
+func TestConflictAdoptsHPA(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverAdopt)
+	instance.Spec.MaxReplicas = int32Ptr(6)
+	r := newConflictReconciler(t, instance, newHPA("web", nil))
+
+	if err := r.reconcileConflicts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "web"}, &autoscalingv2.HorizontalPodAutoscaler{}); !apierrors.IsNotFound(err) {
+		t.Errorf("adopted HPA still exists: %v", err)
+	}
+	if instance.Spec.MinReplicas == nil || *instance.Spec.MinReplicas != 2 {
+		t.Errorf("minReplicas = %v, want 2 from the HPA", instance.Spec.MinReplicas)
+	}
+	if *instance.Spec.MaxReplicas != 6 {
+		t.Errorf("maxReplicas = %d, want the CR value 6 to be kept", *instance.Spec.MaxReplicas)
+	}
+	if conflicted(instance) {
+		t.Errorf("CR is still conflicted after adopting the HPA: %+v", instance.Status.Conditions)
+	}
+}
+
+func TestOwnHPAIsNotAConflict(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Driver = autoscaler.HPADriver
+	controller := true
+	owned := newHPA("web-hpa", &metav1.OwnerReference{
+		APIVersion: autoscaler.GroupVersion.String(), Kind: "CustomAutoScaling", Name: "web", UID: instance.UID, Controller: &controller,
+	})
+	r := newConflictReconciler(t, instance, owned)
+
+	if err := r.reconcileConflicts(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if conflicted(instance) {
+		t.Errorf("the HPA generated for the CR is reported as a conflict: %+v", instance.Status.Conditions)
+	}
+}
+
+func TestDelegatingScaledObjectIsNotAConflict(t *testing.T) {
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	so := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"scaleTargetRef": map[string]interface{}{"name": "web"},
+			"triggers": []interface{}{
+				map[string]interface{}{"type": "cpu", "metadata": map[string]interface{}{"value": "80"}},
+				map[string]interface{}{"type": "external", "metadata": map[string]interface{}{
+					"scalerAddress":                          "autoscaler-external-scaler.autoscaler-system:9095",
+					externalscaler.MetadataCustomAutoScaling: "web",
+				}},
+			},
+		},
+	}}
+
+	if delegatesTo(so, instance) {
+		t.Errorf("delegatesTo() = true for a CR using the Alerts driver, which also scales the target")
+	}
+	instance.Spec.Driver = autoscaler.KEDADriver
+	if !delegatesTo(so, instance) {
+		t.Errorf("the ScaledObject delegating to the CR is reported as a conflict")
+	}
+	instance.Name = "api"
+	if delegatesTo(so, instance) {
+		t.Errorf("delegatesTo() = true for a ScaledObject naming another CR")
+	}
+}
@@ -2,18 +2,18 @@ package controllers
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	utils "buildpiper.opstreelabs.in/autoscaler/utils"
-	appsv1 "k8s.io/api/apps/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -23,7 +23,42 @@ import (
 // CustomAutoScalingReconciler reconciles a CustomAutoScaling object
 type CustomAutoScalingReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Provisioner creates and removes the monitoring stack of every CR
+	Provisioner *utils.Provisioner
+
+	// Limits bounds the load the webhook server takes
+	Limits ReceiverLimits
+
+	// PrometheusURL returns the address of the Prometheus managed for a CR,
+	// it defaults to utils.PrometheusURL
+	PrometheusURL func(*autoscaler.CustomAutoScaling) string
+
+	// AlertSyncInterval is how often the firing alerts of a CR are read back
+	// from its Alertmanager, zero disables it
+	AlertSyncInterval time.Duration
+
+	// AlertmanagerURL returns the address of the Alertmanager managed for a
+	// CR, it defaults to utils.AlertmanagerURL
+	AlertmanagerURL func(*autoscaler.CustomAutoScaling) string
+	// Scraper collects the samples of the CRs in embedded mode, they are
+	// neither scaled nor checked for health without it
+	Scraper *Scraper
+
+	// kedaInstalled is set when the ScaledObject CRD exists at startup
+	kedaInstalled bool
+	// limiter applies Limits, it is nil until the webhook server starts
+	limiter *receiverLimiter
+
+	// alertSyncs is when the firing alerts of each CR were last read back
+	alertSyncMu sync.Mutex
+	alertSyncs  map[types.NamespacedName]time.Time
+	// embeddedPending is when the rules of each CR in embedded mode started
+	// to return the samples of its alerts, by fingerprint
+	embeddedMu      sync.Mutex
+	embeddedPending map[types.NamespacedName]map[string]time.Time
 }
 
 var log = logf.Log.WithName("controller_autoscaler")
@@ -31,9 +66,18 @@ var log = logf.Log.WithName("controller_autoscaler")
 //+kubebuilder:rbac:groups=buildpiper.opstreelabs.in,resources=customautoscalings,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=buildpiper.opstreelabs.in,resources=customautoscalings/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=buildpiper.opstreelabs.in,resources=customautoscalings/finalizers,verbs=update
+//+kubebuilder:rbac:groups=buildpiper.opstreelabs.in,resources=scalingevents,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=keda.sh,resources=scaledobjects,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts;secrets;services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings,verbs=get;list;watch;create;update;patch;delete;escalate;bind
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheuses;alertmanagers;servicemonitors;prometheusrules,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CustomAutoScalingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	reqLogger := log.WithValues("Request.Service.Namespace", "Request.Service.Name", req.Namespace, req.Name)
+	reqLogger := log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
 
 	reqLogger.Info("reconcilling autoscaler.....")
 
@@ -42,155 +86,107 @@ func (r *CustomAutoScalingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 	err := r.Client.Get(context.TODO(), req.NamespacedName, instance)
 
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
+			forgetMetrics(req.Namespace, req.Name)
+			r.forgetAlertSync(req.NamespacedName)
+			r.forgetEmbedded(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 
-		reqLogger.Error(fmt.Errorf("error while fetching CustomAutoscaling  %s", err.Error()), "")
-		return ctrl.Result{}, nil
+		reqLogger.Error(err, "error while fetching CustomAutoscaling")
+		return ctrl.Result{}, err
 	}
 
-	if _, found := instance.ObjectMeta.GetAnnotations()["buildpiper.opstreelabs.in/skip-reconcile"]; found {
-		reqLogger.Info("Found annotations buildpiper.opstreelabs.in/skip-reconcile", "so skipping reconcile")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	if _, found := instance.ObjectMeta.GetAnnotations()[autoscaler.SkipReconcileAnnotation]; found {
+		// removing the annotation is an update of the CR, which is reconciled again then
+		reqLogger.Info("Found annotation buildpiper.opstreelabs.in/skip-reconcile, skipping reconcile")
+		return ctrl.Result{}, r.reportHold(ctx, instance)
 	}
 
+	observeBounds(instance)
+	r.observeTarget(ctx, instance)
+
 	// handler finalizer
 
-	if err := utils.HandleAutoScalerFinalizer(instance, r.Client); err != nil {
+	if err := r.Provisioner.HandleAutoScalerFinalizer(ctx, instance); err != nil {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "FinalizeFailed", "failed to clean up child resources: %s", err)
 		return ctrl.Result{}, err
 	}
+	if instance.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
 
-	if err := utils.AddCustomautoscaleFinalizer(instance, r.Client); err != nil {
+	if err := r.Provisioner.AddCustomautoscaleFinalizer(ctx, instance); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	// check sa
-
-	_, err = utils.GetSAccount(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("service account", instance.Name+"-sa", "doesnt exists creating service account ...............")
-			_, err = utils.CreateServiceAccount(instance)
-			if err != nil {
-				fmt.Print("getting error while creating acc .............. ", err.Error())
-				reqLogger.Error(fmt.Errorf("error while creating service account for prometheus %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Info("Cant fetch servicemonitor")
-			return ctrl.Result{}, nil
-		}
+	if err := r.provision(ctx, instance); err != nil {
+		return r.provisionFailed(ctx, instance, err)
 	}
-
-	// // check role
-
-	_, err = utils.GetClusterRole(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("Cluster Role", instance.Name+"--clusterrole", "doesnt exists creating now .....")
-			_, err = utils.CreateClusterRole(instance)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating cluster role for prometheus %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Info("Cant fetch clusterrole")
-			return ctrl.Result{}, nil
-		}
+	if err := r.provisioned(ctx, instance); err != nil {
+		return ctrl.Result{}, err
 	}
 
-	// // check rolebinding
-
-	_, err = utils.GetRoleBinding(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("Cluster Rolebindng", instance.Name+"-rolebinding", " doesnt exists creating now .....")
-			_, err = utils.CreateClusterRoleBinding(instance)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating cluster role for prometheus %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Info("Cant fetch clusterrole")
-			return ctrl.Result{}, nil
-		}
+	if err := r.reconcileConflicts(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to check for conflicting scalers")
+		return ctrl.Result{}, err
 	}
 
-	// if servicemonitor is not der then create monitoring that deployment
-	_, err = utils.GetSVCMonitor(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("ServiceMonitor", instance.Name+"-svcm", "doesnt exist creating now ....")
-			_, err = utils.CreateSVCMonitor(instance)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating service monitor for prometheus %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Error(fmt.Errorf("error while fetching service monitor for prometheus %s", err.Error()), "")
-		}
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to apply the pause, freeze or override of the CR")
+		return ctrl.Result{}, err
 	}
 
-	// create alert managers with config and rules
+	if err := r.reconcileDriver(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to reconcile the HorizontalPodAutoscaler")
+		return ctrl.Result{}, err
+	}
 
-	_, err = utils.GetAlertManager(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("AlertManager", instance.Name+"-alert", "doesnt exist creating now ....")
-
-			_, err = utils.CreateAlertManager(instance, 3)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating alertmanager  %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Error(fmt.Errorf("error while fetching alertmanager for prometheus %s", err.Error()), "")
-		}
+	// an unhealthy monitoring stack is reported, scaling goes on with what still works
+	if err := r.reconcileHealth(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to report the health of the monitoring stack")
 	}
 
-	_, err = utils.GetPrometheusRule(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info(instance.Name, "-prometheus-rule", "doesnt exist creating now ....")
-			_, err = utils.CreatePrometheusRule(instance)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating prometheus rule  %s", err.Error()), "")
-				return ctrl.Result{RequeueAfter: time.Second * 15}, nil
-			}
-		} else {
-			reqLogger.Error(fmt.Errorf("error while fetching service monitor for prometheus %s", err.Error()), "")
-		}
+	// the webhook only speeds up scaling, missed alerts are found in the Alertmanager
+	if err := r.reconcileFiringAlerts(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to read back the firing alerts from the Alertmanager")
 	}
 
-	_, err = utils.GetPrometheusInstance(instance)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info(instance.Name, "-prometheus-instance", "doesnt exist creating now ....")
-			_, err = utils.CreatePrometheusInstance(instance)
-			if err != nil {
-				reqLogger.Error(fmt.Errorf("error while creating prometheus instance  %s", err.Error()), "")
-				return ctrl.Result{}, nil
-			}
-		} else {
-			reqLogger.Error(fmt.Errorf("error while fetching service monitor for prometheus %s", err.Error()), "")
-		}
+	// in embedded mode the operator evaluates the alerts itself
+	if err := r.reconcileEmbedded(ctx, instance); err != nil {
+		reqLogger.Error(err, "failed to evaluate the alerts in embedded mode")
 	}
 
-	// add prometheus Rule
+	// ScalingEvents also expire while no decision is made
+	if err := r.pruneScalingEvents(ctx, instance, time.Now()); err != nil {
+		reqLogger.Error(err, "failed to prune scaling events")
+	}
 
 	// find and scale the deployment
 
+	if instance.Spec.Predictive != nil {
+		if err := r.reconcilePredictive(ctx, instance); err != nil {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ForecastFailed", "predictive scaling failed: %s", err)
+			reqLogger.Error(err, "predictive scaling failed")
+		}
+	}
+
 	return ctrl.Result{RequeueAfter: time.Second * 10}, nil
 }
 
 func (r *CustomAutoScalingReconciler) SetupWebhookServer(mgr manager.Manager) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/webhook", r.handleWebhook)
+	mux.HandleFunc("/webhook/", r.handleWebhook)
+	mux.HandleFunc("/v1/", r.handleAPI)
 
+	r.limiter = newReceiverLimiter(r.Limits)
 	server := &http.Server{
-		Addr:    ":3030",
-		Handler: mux,
+		Addr:              ":3030",
+		Handler:           r.limiter.middleware(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       r.Limits.Timeout,
+		WriteTimeout:      r.Limits.writeTimeout(),
 	}
 
 	go func() {
@@ -204,60 +200,14 @@ func (r *CustomAutoScalingReconciler) SetupWebhookServer(mgr manager.Manager) er
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CustomAutoScalingReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := r.setupIndexes(mgr); err != nil {
+		return err
+	}
 	if err := r.SetupWebhookServer(mgr); err != nil {
 		return err
 	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&autoscaler.CustomAutoScaling{}).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}).
 		Complete(r)
 }
-
-func (r *CustomAutoScalingReconciler) handleWebhook(w http.ResponseWriter, req *http.Request) {
-
-	instance := &autoscaler.CustomAutoScaling{}
-
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer req.Body.Close()
-
-	var alert utils.AlertmanagerPayload
-	if err := json.Unmarshal(body, &alert); err != nil {
-		http.Error(w, "Failed to unmarshal alert payload", http.StatusBadRequest)
-		return
-	}
-
-	// Extract relevant information from alert, such as alert name and severity
-	// alertName := alert.Alerts[0].Labels["alertname"]
-	alertSeverity := alert.Alerts[0].Labels["severity"]
-
-	// Determine desired number of replicas based on alert information
-	var desiredReplicas int32
-	desiredReplicas = 0
-	if alertSeverity == "critical" {
-		desiredReplicas = 5
-	} else if alertSeverity == "warning" {
-		desiredReplicas = 3
-	} else {
-		desiredReplicas = 1
-	}
-
-	// Update deployment replica count using Kubernetes API client
-	deployment := &appsv1.Deployment{}
-
-	if err := r.Get(context.Background(), types.NamespacedName{Name: instance.Spec.ApplicationRef.DeploymentName, Namespace: instance.Namespace}, deployment); err != nil {
-		http.Error(w, "Failed to retrieve deployment", http.StatusInternalServerError)
-		return
-	}
-
-	deployment.Spec.Replicas = &desiredReplicas
-	if err := r.Update(context.Background(), deployment); err != nil {
-		http.Error(w, "Failed to update deployment", http.StatusInternalServerError)
-		return
-	}
-
-	// Return success response
-	w.WriteHeader(http.StatusOK)
-}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/receiver"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// embeddedSource is the source of the signals of the alerts evaluated by the operator
+const embeddedSource = "embedded"
+
+// reconcileEmbedded evaluates the alerting rules of a CR in embedded mode
+// over the samples the Scraper collected and scales the target to the
+// strongest firing alert, as the webhook would on its notification. Without
+// firing alerts nothing is done, as resolved alerts do not scale through the
+// webhook either
+func (r *CustomAutoScalingReconciler) reconcileEmbedded(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	if r.Scraper == nil || instance.Spec.Monitoring.Embedded == nil || !usesAlerts(instance) {
+		r.forgetEmbedded(types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+		return nil
+	}
+	now := time.Now()
+	// the rules are evaluated on held CRs too, their alerts keep pending
+	alerts, err := r.embeddedAlerts(ctx, instance, now)
+	if err != nil {
+		return err
+	}
+	// held and conflicted CRs would only record the same refused decision every time
+	if scaling.HoldFor(instance, now) != nil || conflicted(instance) {
+		return nil
+	}
+	_, err = r.scaleToAlerts(ctx, instance, receiver.AlertSignals(embeddedSource, alerts), now, "%s evaluated by the operator")
+	return err
+}
+
+// embeddedAlerts returns the alerts the generated rules of the CR fire at
+// now. An alert carries the labels of its sample and of its rule, as in
+// Prometheus, and is pending until its rule returned the sample for the for
+// of the rule. A sample the rule no longer returns resets its alert
+func (r *CustomAutoScalingReconciler) embeddedAlerts(ctx context.Context, instance *autoscaler.CustomAutoScaling, now time.Time) ([]utils.Alert, error) {
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+	r.embeddedMu.Lock()
+	defer r.embeddedMu.Unlock()
+	pending := r.embeddedPending[key]
+	active := map[string]time.Time{}
+
+	var alerts []utils.Alert
+	for _, rule := range utils.AlertingRules(instance) {
+		var wait model.Duration
+		if rule.For != "" {
+			var err error
+			if wait, err = model.ParseDuration(string(rule.For)); err != nil {
+				return nil, fmt.Errorf("for of alert %s: %w", rule.Alert, err)
+			}
+		}
+		vector, err := r.Scraper.Query(ctx, instance, rule.Expr.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range vector {
+			labels := map[string]string{}
+			for name, value := range sample.Metric {
+				if name != model.MetricNameLabel {
+					labels[string(name)] = string(value)
+				}
+			}
+			for name, value := range rule.Labels {
+				labels[name] = value
+			}
+			labels[model.AlertNameLabel] = rule.Alert
+			fingerprint := fmt.Sprintf("%016x", model.LabelsToSignature(labels))
+
+			activeAt, ok := pending[fingerprint]
+			if !ok {
+				activeAt = now
+			}
+			active[fingerprint] = activeAt
+			if now.Sub(activeAt) < time.Duration(wait) {
+				continue
+			}
+			alerts = append(alerts, utils.Alert{
+				Status:      "firing",
+				Labels:      labels,
+				Annotations: rule.Annotations,
+				StartsAt:    activeAt.UTC().Format(time.RFC3339),
+				Fingerprint: fingerprint,
+			})
+		}
+	}
+
+	if r.embeddedPending == nil {
+		r.embeddedPending = map[types.NamespacedName]map[string]time.Time{}
+	}
+	r.embeddedPending[key] = active
+	return alerts, nil
+}
+
+// forgetEmbedded drops the active alerts of a CR deleted or out of embedded mode
+func (r *CustomAutoScalingReconciler) forgetEmbedded(key types.NamespacedName) {
+	r.embeddedMu.Lock()
+	defer r.embeddedMu.Unlock()
+	delete(r.embeddedPending, key)
+}
@@ -0,0 +1,330 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// stubTarget serves a queue_depth gauge, or fails while code is set
+type stubTarget struct {
+	mu    sync.Mutex
+	depth float64
+	code  int
+}
+
+func (s *stubTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.code != 0 {
+		http.Error(w, "unavailable", s.code)
+		return
+	}
+	fmt.Fprintf(w, "# TYPE queue_depth gauge\nqueue_depth{queue=\"orders\"} %g\n", s.depth)
+}
+
+// newEmbeddedCR returns a CR in embedded mode scraping port with a ladder on the queue depth
+func newEmbeddedCR(port int32) *autoscaler.CustomAutoScaling {
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Target.Port = port
+	instance.Spec.Monitoring.Embedded = &autoscaler.EmbeddedMonitoring{}
+	instance.Spec.Metrics = []autoscaler.Metric{{
+		Name:  "queue",
+		Query: "sum(queue_depth)",
+		Thresholds: []autoscaler.Threshold{
+			{Severity: "warning", Value: resource.MustParse("10"), Replicas: 3},
+			{Severity: "critical", Value: resource.MustParse("40"), Replicas: 6},
+		},
+	}}
+	return instance
+}
+
+// newTargetPod returns a ready pod of the deployment web listening on the loopback
+func newTargetPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Status: corev1.PodStatus{
+			PodIP:      "127.0.0.1",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	ctx := context.Background()
+	target := &stubTarget{depth: 45}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	_, portName, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portName)
+
+	instance := newEmbeddedCR(int32(port))
+	deployment := newHoldDeployment(2)
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	notReady := newTargetPod("web-starting")
+	notReady.Status.Conditions = nil
+	r := newConflictReconciler(t, instance, deployment, newTargetPod("web-a"), notReady)
+	r.Scraper = &Scraper{Client: r.Client, HTTPClient: server.Client()}
+
+	if children := r.childResources(ctx, instance); len(children) != 1 || children[0].kind != "Secret" {
+		t.Errorf("child resources in embedded mode = %v, want only the signals token", children)
+	}
+
+	// nothing is scaled before the first scrape
+	if err := r.reconcileEmbedded(ctx, instance); err == nil {
+		t.Error("reconcileEmbedded() before the first scrape succeeded")
+	}
+
+	if err := r.Scraper.scrapeDue(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileEmbedded(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 2 {
+		t.Errorf("deployment has %d replicas with the alerts pending, want the 2 it ran", got)
+	}
+	backdateEmbedded(r, instance, time.Minute)
+	if err := r.reconcileEmbedded(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 6 {
+		t.Errorf("deployment has %d replicas with a queue of 45, want the 6 of the critical step", got)
+	}
+	events := scalingEvents(t, r)
+	if len(events) != 1 || events[0].Spec.Trigger.Source != embeddedSource || events[0].Spec.Trigger.Alert != "queue" || events[0].Spec.Trigger.Severity != "critical" {
+		t.Errorf("scaling events = %+v, want one for the critical queue alert from %s", events, embeddedSource)
+	}
+
+	// the pod not ready is left out and the queue label is kept on the alert
+	alerts, err := r.embeddedAlerts(ctx, instance, time.Now())
+	if err != nil || len(alerts) != 2 {
+		t.Fatalf("embeddedAlerts() = %v, %v, want the two steps firing", alerts, err)
+	}
+	vector, err := r.Scraper.Query(ctx, instance, `queue_depth`)
+	if err != nil || len(vector) != 1 || vector[0].Metric["pod"] != "web-a" || vector[0].Metric["queue"] != "orders" {
+		t.Errorf("Query(queue_depth) = %v, %v, want the sample of web-a", vector, err)
+	}
+
+	if err := r.reconcileHealth(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := conditionStatus(instance, autoscaler.ConditionTargetsHealthy); got != metav1.ConditionTrue {
+		t.Errorf("TargetsHealthy = %s with web-a up, want True", got)
+	}
+	if meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionRuleLoaded) != nil {
+		t.Error("RuleLoaded is set in embedded mode")
+	}
+
+	target.mu.Lock()
+	target.code = http.StatusInternalServerError
+	target.mu.Unlock()
+	if err := r.Scraper.scrape(ctx, instance, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileHealth(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionTargetsHealthy); c == nil || c.Reason != "TargetsDown" {
+		t.Errorf("TargetsHealthy = %+v with web-a failing, want TargetsDown", c)
+	}
+	if vector, _ := r.Scraper.Query(ctx, instance, `up`); len(vector) != 1 || vector[0].Value != 0 {
+		t.Errorf("up = %v with web-a failing, want 0", vector)
+	}
+	if vector, _ := r.Scraper.Query(ctx, instance, `queue_depth`); len(vector) != 0 {
+		t.Errorf("queue_depth = %v with web-a failing, want no sample", vector)
+	}
+
+	// the CR leaves embedded mode and its samples are dropped
+	instance.Spec.Monitoring.Embedded = nil
+	if err := r.Update(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Scraper.scrapeDue(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Scraper.Targets(types.NamespacedName{Namespace: "default", Name: "web"}); ok {
+		t.Error("targets are still kept after the CR left embedded mode")
+	}
+}
+
+// backdateEmbedded moves the time the active alerts of instance started back by d
+func backdateEmbedded(r *CustomAutoScalingReconciler, instance *autoscaler.CustomAutoScaling, d time.Duration) {
+	r.embeddedMu.Lock()
+	defer r.embeddedMu.Unlock()
+	active := r.embeddedPending[types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}]
+	for fingerprint, activeAt := range active {
+		active[fingerprint] = activeAt.Add(-d)
+	}
+}
+
+func TestEmbeddedFor(t *testing.T) {
+	ctx := context.Background()
+	target := &stubTarget{depth: 45}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	_, portName, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portName)
+
+	instance := newEmbeddedCR(int32(port))
+	instance.Spec.Metrics[0].Thresholds[1].For = &metav1.Duration{Duration: 2 * time.Minute}
+	deployment := newHoldDeployment(2)
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	r := newConflictReconciler(t, instance, deployment, newTargetPod("web-a"))
+	r.Scraper = &Scraper{Client: r.Client, HTTPClient: server.Client()}
+	scrape := func(depth float64) {
+		target.mu.Lock()
+		target.depth = depth
+		target.mu.Unlock()
+		if err := r.Scraper.scrape(ctx, instance, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	firing := func(now time.Time) []string {
+		alerts, err := r.embeddedAlerts(ctx, instance, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var severities []string
+		for _, a := range alerts {
+			severities = append(severities, a.Labels["severity"])
+		}
+		return severities
+	}
+
+	scrape(45)
+	start := time.Now()
+	if got := firing(start); len(got) != 0 {
+		t.Errorf("alerts on the first evaluation = %v, want both pending", got)
+	}
+	if got := firing(start.Add(time.Minute)); len(got) != 1 || got[0] != "warning" {
+		t.Errorf("alerts after a minute = %v, want the warning step past its 10s", got)
+	}
+	if got := firing(start.Add(2 * time.Minute)); len(got) != 2 {
+		t.Errorf("alerts after two minutes = %v, want the critical step past its 2m too", got)
+	}
+
+	// a step no longer exceeded is pending again from the next time it is
+	scrape(20)
+	if got := firing(start.Add(3 * time.Minute)); len(got) != 1 || got[0] != "warning" {
+		t.Errorf("alerts with a queue of 20 = %v, want only the warning step", got)
+	}
+	scrape(45)
+	if got := firing(start.Add(4 * time.Minute)); len(got) != 1 || got[0] != "warning" {
+		t.Errorf("alerts once the queue is back at 45 = %v, want the critical step pending again", got)
+	}
+
+	// the alerts of a CR out of embedded mode are forgotten
+	instance.Spec.Monitoring.Embedded = nil
+	if err := r.reconcileEmbedded(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.embeddedPending[types.NamespacedName{Namespace: "default", Name: "web"}]; ok {
+		t.Error("active alerts are still kept after the CR left embedded mode")
+	}
+}
+
+func TestScraperQueryOr(t *testing.T) {
+	s := &Scraper{}
+	errPrometheus := errors.New("prometheus")
+	query := s.QueryOr(func(context.Context, *autoscaler.CustomAutoScaling, string) (model.Vector, error) {
+		return nil, errPrometheus
+	})
+
+	if _, err := query(context.Background(), newConflictCR("web", autoscaler.TakeoverNever), "up"); err != errPrometheus {
+		t.Errorf("query of a CR with Prometheus = %v, want it sent to Prometheus", err)
+	}
+	if _, err := query(context.Background(), newEmbeddedCR(8080), "up"); err == nil || err == errPrometheus {
+		t.Errorf("query of a CR in embedded mode not scraped yet = %v, want it evaluated by the scraper", err)
+	}
+}
+
+func TestEmbeddedRemovesMonitoring(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "requests", Query: "sum(rate(requests_total[1m])) > 10"}}
+	instance.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"requests_total"}}
+	r := newConflictReconciler(t, instance)
+	r.Provisioner = utils.NewProvisioner(r.Client, r.Scheme, r.Recorder)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaced := func(name string) metav1.ObjectMeta { return metav1.ObjectMeta{Name: name, Namespace: "default"} }
+	stack := []client.Object{
+		&monitoringv1.Prometheus{ObjectMeta: namespaced("web-prometheus-instance")},
+		&monitoringv1.Alertmanager{ObjectMeta: namespaced("web-alert")},
+		&monitoringv1.PrometheusRule{ObjectMeta: namespaced("web-prometheus-rule")},
+		&monitoringv1.ServiceMonitor{ObjectMeta: namespaced("web-svcm")},
+		&corev1.Service{ObjectMeta: namespaced("web-prometheus-service")},
+		&corev1.Service{ObjectMeta: namespaced(utils.RemoteWriteService("web"))},
+		&corev1.ServiceAccount{ObjectMeta: namespaced("web-sa")},
+		&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "web-clusterrole"}},
+		&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "web-rolebinding"}},
+	}
+	for _, obj := range stack {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Fatalf("%T %s before the switch: %v", obj, obj.GetName(), err)
+		}
+	}
+
+	deletedEvents := func() int {
+		deleted := 0
+		for events := r.Recorder.(*record.FakeRecorder).Events; len(events) > 0; {
+			if strings.Contains(<-events, "Deleted") {
+				deleted++
+			}
+		}
+		return deleted
+	}
+	deletedEvents()
+
+	// switching to embedded mode removes the stack and keeps the token
+	instance.Spec.Monitoring.RemoteWrite = nil
+	instance.Spec.Monitoring.Embedded = &autoscaler.EmbeddedMonitoring{}
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deletedEvents(); deleted < len(stack) {
+		t.Errorf("Deleted events = %d, want one per child of the stack", deleted)
+	}
+	for _, obj := range stack {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%T %s in embedded mode: %v, want it deleted", obj, obj.GetName(), err)
+		}
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: utils.SignalsTokenSecret("web")}, &corev1.Secret{}); err != nil {
+		t.Errorf("signals token in embedded mode: %v", err)
+	}
+
+	// the next reconcile finds nothing left to delete
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deletedEvents(); deleted != 0 {
+		t.Errorf("Deleted events of the next reconcile = %d, want 0", deleted)
+	}
+}
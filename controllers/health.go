@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// healthTimeout bounds the queries to Prometheus made by a reconcile
+const healthTimeout = 10 * time.Second
+
+// reconcileHealth asks the managed Prometheus whether it loaded the generated
+// rules and scrapes the target, and reports the answers in the RuleLoaded and
+// TargetsHealthy conditions. An unreachable Prometheus leaves both unknown. In
+// embedded mode TargetsHealthy reports the latest scrape of the operator
+// and RuleLoaded is not set
+func (r *CustomAutoScalingReconciler) reconcileHealth(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	// only the Prometheus of the CR, the rules of the others in the namespace
+	// would otherwise flip RuleLoaded between reconciles
+	address := utils.PrometheusURL(instance)
+	if r.PrometheusURL != nil {
+		address = r.PrometheusURL(instance)
+	}
+
+	var conditions []metav1.Condition
+	changed := false
+	embedded := instance.Spec.Monitoring.Embedded != nil
+	if usesAlerts(instance) && !embedded {
+		rules, err := utils.Rules(ctx, address)
+		conditions = append(conditions, ruleCondition(instance, rules, err))
+	} else if meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionRuleLoaded) != nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, autoscaler.ConditionRuleLoaded)
+		changed = true
+	}
+	switch {
+	case !embedded:
+		targets, err := utils.Targets(ctx, address)
+		conditions = append(conditions, targetsCondition(instance, targets, err))
+	case r.Scraper != nil:
+		targets, scraped := r.Scraper.Targets(types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+		conditions = append(conditions, embeddedTargetsCondition(instance, targets, scraped))
+	}
+
+	for _, condition := range conditions {
+		condition.ObservedGeneration = instance.Generation
+		eventType := corev1.EventTypeNormal
+		if condition.Status == metav1.ConditionFalse {
+			eventType = corev1.EventTypeWarning
+		}
+		changed = r.setCondition(instance, condition, eventType) || changed
+	}
+	if !changed {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// ruleCondition returns the RuleLoaded condition for the rules loaded by
+// Prometheus, the generated alerting rules carry the labels naming the CR
+func ruleCondition(instance *autoscaler.CustomAutoScaling, rules promv1.RulesResult, err error) metav1.Condition {
+	condition := metav1.Condition{Type: autoscaler.ConditionRuleLoaded}
+	if err != nil {
+		condition.Status, condition.Reason = metav1.ConditionUnknown, "PrometheusUnavailable"
+		condition.Message = err.Error()
+		return condition
+	}
+
+	// the steps of a threshold ladder may share an alert name, the failing one is kept
+	loaded := map[string]promv1.AlertingRule{}
+	for _, group := range rules.Groups {
+		for _, rule := range group.Rules {
+			alerting, ok := rule.(promv1.AlertingRule)
+			if !ok || string(alerting.Labels[utils.AlertLabelName]) != instance.Name ||
+				string(alerting.Labels[utils.AlertLabelNamespace]) != instance.Namespace {
+				continue
+			}
+			if seen, found := loaded[alerting.Name]; !found || seen.Health == promv1.RuleHealthGood {
+				loaded[alerting.Name] = alerting
+			}
+		}
+	}
+
+	var missing, failed, pending []string
+	expected := 0
+	for _, m := range instance.Spec.Metrics {
+		for _, name := range utils.AlertNames(m) {
+			expected++
+			rule, ok := loaded[name]
+			switch {
+			case !ok:
+				missing = append(missing, name)
+			case rule.Health == promv1.RuleHealthBad:
+				failed = append(failed, fmt.Sprintf("%s: %s", name, rule.LastError))
+			case rule.Health != promv1.RuleHealthGood:
+				pending = append(pending, name)
+			}
+		}
+	}
+
+	switch {
+	case len(missing) > 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "NotLoaded"
+		condition.Message = fmt.Sprintf("Prometheus has not loaded the rules for %s, check that the rule selector and rule namespace selector of the Prometheus match the PrometheusRule",
+			strings.Join(missing, ", "))
+	case len(failed) > 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "EvaluationFailed"
+		condition.Message = "rules fail to evaluate: " + strings.Join(failed, "; ")
+	case len(pending) > 0:
+		condition.Status, condition.Reason = metav1.ConditionUnknown, "NotEvaluated"
+		condition.Message = "rules are loaded but not evaluated yet: " + strings.Join(pending, ", ")
+	default:
+		condition.Status, condition.Reason = metav1.ConditionTrue, "Loaded"
+		condition.Message = fmt.Sprintf("%d rules are loaded and evaluate without errors", expected)
+	}
+	return condition
+}
+
+// targetsCondition returns the TargetsHealthy condition for the active targets
+// of Prometheus that belong to the ServiceMonitor of the CR
+func targetsCondition(instance *autoscaler.CustomAutoScaling, targets promv1.TargetsResult, err error) metav1.Condition {
+	condition := metav1.Condition{Type: autoscaler.ConditionTargetsHealthy}
+	if err != nil {
+		condition.Status, condition.Reason = metav1.ConditionUnknown, "PrometheusUnavailable"
+		condition.Message = err.Error()
+		return condition
+	}
+
+	pool := utils.ScrapePool(instance)
+	up, total := 0, 0
+	var down []string
+	for _, target := range targets.Active {
+		if !strings.HasPrefix(target.ScrapePool, pool) {
+			continue
+		}
+		total++
+		switch target.Health {
+		case promv1.HealthGood:
+			up++
+		case promv1.HealthBad:
+			down = append(down, fmt.Sprintf("%s: %s", target.Labels[model.InstanceLabel], target.LastError))
+		}
+	}
+	sort.Strings(down)
+
+	switch {
+	case total == 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "NoTargets"
+		condition.Message = fmt.Sprintf("Prometheus has no targets in %s, check that the ServiceMonitor selects the service of %s",
+			strings.TrimSuffix(pool, "/"), instance.Spec.Target.Name)
+	case len(down) > 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "TargetsDown"
+		condition.Message = fmt.Sprintf("%d of %d targets are down: %s", len(down), total, strings.Join(down, "; "))
+	case up < total:
+		condition.Status, condition.Reason = metav1.ConditionUnknown, "NotScraped"
+		condition.Message = fmt.Sprintf("%d of %d targets are not scraped yet", total-up, total)
+	default:
+		condition.Status, condition.Reason = metav1.ConditionTrue, "TargetsUp"
+		condition.Message = fmt.Sprintf("%d targets are up", total)
+	}
+	return condition
+}
+
+// embeddedTargetsCondition returns the TargetsHealthy condition for the
+// targets of the latest scrape of the operator in embedded mode
+func embeddedTargetsCondition(instance *autoscaler.CustomAutoScaling, targets []ScrapeTarget, scraped bool) metav1.Condition {
+	condition := metav1.Condition{Type: autoscaler.ConditionTargetsHealthy}
+	var down []string
+	for _, target := range targets {
+		if target.Health == targetDown {
+			down = append(down, fmt.Sprintf("%s: %s", target.Instance, target.LastError))
+		}
+	}
+	sort.Strings(down)
+
+	switch {
+	case !scraped:
+		condition.Status, condition.Reason = metav1.ConditionUnknown, "NotScraped"
+		condition.Message = fmt.Sprintf("the operator has not scraped %s yet", instance.Spec.Target.Name)
+	case len(targets) == 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "NoTargets"
+		condition.Message = fmt.Sprintf("the operator found no ready pods of %s to scrape", instance.Spec.Target.Name)
+	case len(down) > 0:
+		condition.Status, condition.Reason = metav1.ConditionFalse, "TargetsDown"
+		condition.Message = fmt.Sprintf("%d of %d targets are down: %s", len(down), len(targets), strings.Join(down, "; "))
+	default:
+		condition.Status, condition.Reason = metav1.ConditionTrue, "TargetsUp"
+		condition.Message = fmt.Sprintf("%d targets are up", len(targets))
+	}
+	return condition
+}
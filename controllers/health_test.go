@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const healthyRules = `{"status":"success","data":{"groups":[{"name":"web","file":"rules.yaml","interval":30,"evaluationTime":0.001,"lastEvaluation":"2023-01-01T00:00:00Z","rules":[
+	{"type":"alerting","name":"requests","query":"rate(requests_total[1m]) > 10","duration":0,"labels":{"customautoscaling":"web-scaler","customautoscaling_namespace":"default"},"annotations":{},"alerts":[],"health":"ok","lastError":"","evaluationTime":0.001,"lastEvaluation":"2023-01-01T00:00:00Z","state":"inactive"},
+	{"type":"alerting","name":"requests","query":"up == 0","duration":0,"labels":{"customautoscaling":"other","customautoscaling_namespace":"default"},"annotations":{},"alerts":[],"health":"err","lastError":"boom","evaluationTime":0.001,"lastEvaluation":"2023-01-01T00:00:00Z","state":"inactive"}]}]}}`
+
+const failingRules = `{"status":"success","data":{"groups":[{"name":"web","file":"rules.yaml","interval":30,"evaluationTime":0.001,"lastEvaluation":"2023-01-01T00:00:00Z","rules":[
+	{"type":"alerting","name":"requests","query":"rate(requests_total[1m]) > 10","duration":0,"labels":{"customautoscaling":"web-scaler","customautoscaling_namespace":"default"},"annotations":{},"alerts":[],"health":"err","lastError":"many-to-many matching not allowed","evaluationTime":0.001,"lastEvaluation":"2023-01-01T00:00:00Z","state":"inactive"}]}]}}`
+
+const noRules = `{"status":"success","data":{"groups":[]}}`
+
+const upTargets = `{"status":"success","data":{"activeTargets":[
+	{"discoveredLabels":{},"labels":{"instance":"10.0.0.1:8080"},"scrapePool":"serviceMonitor/default/web-scaler-svcm/0","scrapeUrl":"http://10.0.0.1:8080/metrics","globalUrl":"","lastError":"","lastScrape":"2023-01-01T00:00:00Z","lastScrapeDuration":0.01,"health":"up"},
+	{"discoveredLabels":{},"labels":{"instance":"10.0.0.9:8080"},"scrapePool":"serviceMonitor/default/other-svcm/0","scrapeUrl":"http://10.0.0.9:8080/metrics","globalUrl":"","lastError":"refused","lastScrape":"2023-01-01T00:00:00Z","lastScrapeDuration":0.01,"health":"down"}],"droppedTargets":[]}}`
+
+const downTargets = `{"status":"success","data":{"activeTargets":[
+	{"discoveredLabels":{},"labels":{"instance":"10.0.0.1:8080"},"scrapePool":"serviceMonitor/default/web-scaler-svcm/0","scrapeUrl":"http://10.0.0.1:8080/metrics","globalUrl":"","lastError":"connection refused","lastScrape":"2023-01-01T00:00:00Z","lastScrapeDuration":0.01,"health":"down"}],"droppedTargets":[]}}`
+
+const noTargets = `{"status":"success","data":{"activeTargets":[],"droppedTargets":[]}}`
+
+func prometheusStub(t *testing.T, rules, targets string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/rules", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(rules))
+	})
+	mux.HandleFunc("/api/v1/targets", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(targets))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReconcileHealth(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         string
+		targets       string
+		ruleStatus    metav1.ConditionStatus
+		ruleReason    string
+		targetsStatus metav1.ConditionStatus
+		targetsReason string
+	}{
+		{"healthy", healthyRules, upTargets, metav1.ConditionTrue, "Loaded", metav1.ConditionTrue, "TargetsUp"},
+		{"rule not selected", noRules, upTargets, metav1.ConditionFalse, "NotLoaded", metav1.ConditionTrue, "TargetsUp"},
+		{"rule failing", failingRules, upTargets, metav1.ConditionFalse, "EvaluationFailed", metav1.ConditionTrue, "TargetsUp"},
+		{"targets down", healthyRules, downTargets, metav1.ConditionTrue, "Loaded", metav1.ConditionFalse, "TargetsDown"},
+		{"no targets", healthyRules, noTargets, metav1.ConditionTrue, "Loaded", metav1.ConditionFalse, "NoTargets"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := prometheusStub(t, tt.rules, tt.targets)
+			cr := newConflictCR("web-scaler", "")
+			cr.Spec.Metrics = []autoscaler.Metric{{Name: "requests"}}
+			r := newConflictReconciler(t, cr)
+			r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+			if err := r.reconcileHealth(context.Background(), cr); err != nil {
+				t.Fatal(err)
+			}
+			got := &autoscaler.CustomAutoScaling{}
+			if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "web-scaler"}, got); err != nil {
+				t.Fatal(err)
+			}
+			rule := meta.FindStatusCondition(got.Status.Conditions, autoscaler.ConditionRuleLoaded)
+			if rule == nil || rule.Status != tt.ruleStatus || rule.Reason != tt.ruleReason {
+				t.Errorf("RuleLoaded = %+v, want %s/%s", rule, tt.ruleStatus, tt.ruleReason)
+			}
+			targets := meta.FindStatusCondition(got.Status.Conditions, autoscaler.ConditionTargetsHealthy)
+			if targets == nil || targets.Status != tt.targetsStatus || targets.Reason != tt.targetsReason {
+				t.Errorf("TargetsHealthy = %+v, want %s/%s", targets, tt.targetsStatus, tt.targetsReason)
+			}
+		})
+	}
+}
+
+func TestReconcileHealthTwoCRs(t *testing.T) {
+	// each CR of the namespace has a Prometheus loading only its own rules
+	rulesOf := func(name string) string {
+		return strings.ReplaceAll(healthyRules, "web-scaler", name)
+	}
+	web, api := newConflictCR("web", ""), newConflictCR("api", "")
+	stubs := map[string]string{}
+	for _, cr := range []*autoscaler.CustomAutoScaling{web, api} {
+		cr.Spec.Metrics = []autoscaler.Metric{{Name: "requests"}}
+		stubs[utils.PrometheusURL(cr)] = prometheusStub(t, rulesOf(cr.Name), upTargets).URL
+	}
+	if len(stubs) != 2 {
+		t.Fatalf("PrometheusURL() = %v, want an address per CR", stubs)
+	}
+	r := newConflictReconciler(t, web, api)
+	r.PrometheusURL = func(cr *autoscaler.CustomAutoScaling) string { return stubs[utils.PrometheusURL(cr)] }
+
+	for i := 0; i < 2; i++ {
+		for _, cr := range []*autoscaler.CustomAutoScaling{web, api} {
+			if err := r.reconcileHealth(context.Background(), cr); err != nil {
+				t.Fatal(err)
+			}
+			got := &autoscaler.CustomAutoScaling{}
+			if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: cr.Name}, got); err != nil {
+				t.Fatal(err)
+			}
+			rule := meta.FindStatusCondition(got.Status.Conditions, autoscaler.ConditionRuleLoaded)
+			if rule == nil || rule.Status != metav1.ConditionTrue {
+				t.Errorf("reconcile %d of %s: RuleLoaded = %+v, want True", i, cr.Name, rule)
+			}
+		}
+	}
+}
+
+func TestReconcileHealthPrometheusUnavailable(t *testing.T) {
+	server := prometheusStub(t, noRules, noTargets)
+	server.Close()
+
+	cr := newConflictCR("web-scaler", "")
+	cr.Spec.Metrics = []autoscaler.Metric{{Name: "requests"}}
+	r := newConflictReconciler(t, cr)
+	r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	if err := r.reconcileHealth(context.Background(), cr); err != nil {
+		t.Fatal(err)
+	}
+	for _, conditionType := range []string{autoscaler.ConditionRuleLoaded, autoscaler.ConditionTargetsHealthy} {
+		condition := meta.FindStatusCondition(cr.Status.Conditions, conditionType)
+		if condition == nil || condition.Status != metav1.ConditionUnknown || condition.Reason != "PrometheusUnavailable" {
+			t.Errorf("%s = %+v, want Unknown/PrometheusUnavailable", conditionType, condition)
+		}
+	}
+}
+
+func TestReconcileHealthHPADriver(t *testing.T) {
+	server := prometheusStub(t, noRules, upTargets)
+
+	cr := newConflictCR("web-scaler", "")
+	cr.Spec.Driver = autoscaler.HPADriver
+	meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{Type: autoscaler.ConditionRuleLoaded, Status: metav1.ConditionFalse, Reason: "NotLoaded"})
+	r := newConflictReconciler(t, cr)
+	r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	if err := r.reconcileHealth(context.Background(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if condition := meta.FindStatusCondition(cr.Status.Conditions, autoscaler.ConditionRuleLoaded); condition != nil {
+		t.Errorf("RuleLoaded = %+v, want removed for the HPA driver", condition)
+	}
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reconcileHold takes a manual override from the annotations of the CR, keeps
+// a frozen or overridden target at its pinned replicas and reports the holds
+// in the Paused, Frozen and Overridden conditions
+func (r *CustomAutoScalingReconciler) reconcileHold(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	now := time.Now()
+	if err := r.takeOverride(ctx, instance, now); err != nil {
+		return err
+	}
+	changed := false
+
+	if o := instance.Status.Override; o != nil && !now.Before(o.Until.Time) {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "OverrideExpired", "manual override to %d replicas expired", o.Replicas)
+		instance.Status.Override = nil
+		changed = true
+	}
+
+	hold := scaling.HoldFor(instance, now)
+	if hold != nil && hold.Replicas != nil {
+		pinned, err := r.pinTarget(ctx, instance, hold, now)
+		if err != nil {
+			return err
+		}
+		changed = changed || pinned
+	}
+
+	for _, condition := range holdConditions(instance, hold) {
+		changed = r.setCondition(instance, condition, corev1.EventTypeNormal) || changed
+	}
+
+	if !changed {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// reportHold only sets the hold conditions of the CR. It is all that is
+// reconciled while the skip-reconcile annotation pauses the CR
+func (r *CustomAutoScalingReconciler) reportHold(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	changed := false
+	for _, condition := range holdConditions(instance, scaling.HoldFor(instance, time.Now())) {
+		changed = r.setCondition(instance, condition, corev1.EventTypeNormal) || changed
+	}
+	if !changed {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// takeOverride records the override asked for by the annotations of the CR in
+// status and removes the annotations, an override that cannot be honoured is
+// dropped with a warning event
+func (r *CustomAutoScalingReconciler) takeOverride(ctx context.Context, instance *autoscaler.CustomAutoScaling, now time.Time) error {
+	replicas, duration, ok, invalid := instance.RequestedOverride()
+	if !ok && invalid == nil {
+		return nil
+	}
+
+	taken := false
+	switch hold := scaling.HoldFor(instance, now); {
+	case invalid != nil:
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "OverrideRejected", "ignored manual override: %s", invalid)
+	case hold != nil && hold.Reason != scaling.HoldOverride:
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "OverrideRejected", "ignored manual override to %d replicas while %s", replicas, hold)
+	default:
+		instance.Status.Override = &autoscaler.OverrideStatus{
+			Replicas: replicas,
+			Time:     metav1.NewTime(now),
+			Until:    metav1.NewTime(now.Add(duration)),
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Overridden", "manual override to %d replicas for %s", replicas, duration)
+		taken = true
+	}
+
+	// the status update is lost when the patch replaces instance, it is made
+	// first so a failed patch at worst takes the override again
+	if taken {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return err
+		}
+	}
+	patch := client.MergeFrom(instance.DeepCopy())
+	delete(instance.Annotations, autoscaler.OverrideReplicasAnnotation)
+	delete(instance.Annotations, autoscaler.OverrideDurationAnnotation)
+	return r.Patch(ctx, instance, patch)
+}
+
+// pinTarget sets the target to the replicas of hold when something else
+// changed them, a conflict leaves the target alone as it does for any decision
+func (r *CustomAutoScalingReconciler) pinTarget(ctx context.Context, instance *autoscaler.CustomAutoScaling, hold *scaling.Hold, now time.Time) (bool, error) {
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.Target.Name, Namespace: instance.Namespace}, deployment); err != nil {
+		return false, err
+	}
+
+	current := int32(1)
+	if deployment.Spec.Replicas != nil {
+		current = *deployment.Spec.Replicas
+	}
+	if current == *hold.Replicas || conflicted(instance) {
+		return false, nil
+	}
+
+	decision := scaling.Decision{Current: current, Desired: *hold.Replicas, Replicas: *hold.Replicas}
+	trigger := autoscaler.ScalingTrigger{Type: autoscaler.ManualTrigger, Hold: hold.Reason}
+	deployment.Spec.Replicas = &decision.Replicas
+	if err := r.Update(ctx, deployment); err != nil {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ScaleFailed", "failed to scale %s from %d to %d: %s", deployment.Name, current, decision.Replicas, err)
+		r.recordScalingEvent(ctx, instance, decision, trigger, hold.String(), autoscaler.OutcomeFailed, err.Error(), now)
+		return false, err
+	}
+	event := "ScaledUp"
+	if decision.Direction() == "down" {
+		event = "ScaledDown"
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, event, "scaled %s from %d to %d (%s)", deployment.Name, current, decision.Replicas, hold)
+	scaleEvents.WithLabelValues(instance.Namespace, instance.Name, decision.Direction()).Inc()
+	currentReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(float64(decision.Replicas))
+
+	instance.Status.Replicas = decision.Replicas
+	instance.Status.LastScaleTime = &metav1.Time{Time: now}
+	recordDecision(instance, decision, hold.String(), now, true)
+	r.recordScalingEvent(ctx, instance, decision, trigger, hold.String(), autoscaler.OutcomeApplied, "", now)
+	return true, nil
+}
+
+// holdConditions returns the Paused, Frozen and Overridden conditions for hold
+func holdConditions(instance *autoscaler.CustomAutoScaling, hold *scaling.Hold) []metav1.Condition {
+	reason := ""
+	if hold != nil {
+		reason = hold.Reason
+	}
+
+	paused := metav1.Condition{Type: autoscaler.ConditionPaused, Status: metav1.ConditionFalse, Reason: "NotPaused", Message: "scaling is not paused"}
+	if reason == scaling.HoldPaused {
+		paused.Status, paused.Reason, paused.Message = metav1.ConditionTrue, "Paused", "spec.paused stops every scaling decision"
+		if _, skip := instance.Annotations[autoscaler.SkipReconcileAnnotation]; skip {
+			paused.Message = "the " + autoscaler.SkipReconcileAnnotation + " annotation stops reconciling the CR"
+		}
+	}
+
+	frozen := metav1.Condition{Type: autoscaler.ConditionFrozen, Status: metav1.ConditionFalse, Reason: "NotFrozen", Message: "spec.freezeReplicas is not set"}
+	if f := instance.Spec.FreezeReplicas; f != nil {
+		switch reason {
+		case scaling.HoldFrozen:
+			frozen.Status, frozen.Reason = metav1.ConditionTrue, "Frozen"
+			frozen.Message = fmt.Sprintf("replicas are pinned to %d until %s", f.Replicas, f.Until.UTC().Format(time.RFC3339))
+		case scaling.HoldPaused:
+			frozen.Reason, frozen.Message = "Paused", "spec.paused takes precedence over spec.freezeReplicas"
+		default:
+			frozen.Reason, frozen.Message = "Expired", fmt.Sprintf("the freeze at %d replicas ended at %s", f.Replicas, f.Until.UTC().Format(time.RFC3339))
+		}
+	}
+
+	overridden := metav1.Condition{Type: autoscaler.ConditionOverridden, Status: metav1.ConditionFalse, Reason: "NotOverridden", Message: "no manual override is active"}
+	if o := instance.Status.Override; o != nil {
+		switch reason {
+		case scaling.HoldOverride:
+			overridden.Status, overridden.Reason = metav1.ConditionTrue, "Overridden"
+			overridden.Message = fmt.Sprintf("replicas were set to %d by a manual override until %s", o.Replicas, o.Until.UTC().Format(time.RFC3339))
+		default:
+			overridden.Reason = "Superseded"
+			overridden.Message = fmt.Sprintf("the manual override to %d replicas is superseded by %s", o.Replicas, reason)
+		}
+	}
+
+	conditions := []metav1.Condition{paused, frozen, overridden}
+	for i := range conditions {
+		conditions[i].ObservedGeneration = instance.Generation
+	}
+	return conditions
+}
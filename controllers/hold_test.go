@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newHoldDeployment(replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(replicas)},
+	}
+}
+
+// replicasOf reads the replicas of the deployment back from the client
+func replicasOf(t *testing.T, r *CustomAutoScalingReconciler, deployment *appsv1.Deployment) int32 {
+	t.Helper()
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		t.Fatal(err)
+	}
+	return *deployment.Spec.Replicas
+}
+
+func conditionStatus(instance *autoscaler.CustomAutoScaling, conditionType string) metav1.ConditionStatus {
+	if c := meta.FindStatusCondition(instance.Status.Conditions, conditionType); c != nil {
+		return c.Status
+	}
+	return ""
+}
+
+func TestOverride(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Annotations = map[string]string{
+		autoscaler.OverrideReplicasAnnotation: "7",
+		autoscaler.OverrideDurationAnnotation: "30m",
+	}
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, deployment)
+
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 7 {
+		t.Errorf("deployment has %d replicas after the override, want 7", got)
+	}
+	if _, ok := instance.Annotations[autoscaler.OverrideReplicasAnnotation]; ok {
+		t.Errorf("override annotations were not removed: %v", instance.Annotations)
+	}
+	o := instance.Status.Override
+	if o == nil || o.Replicas != 7 || o.Until.Sub(o.Time.Time) != 30*time.Minute {
+		t.Fatalf("status.override = %+v", o)
+	}
+	if conditionStatus(instance, autoscaler.ConditionOverridden) != metav1.ConditionTrue {
+		t.Errorf("conditions = %+v, want Overridden", instance.Status.Conditions)
+	}
+
+	// alerts are held until the override expires
+	decision, err := r.scaleTarget(ctx, instance, 3, testTrigger, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Changed() || decision.Limited != "override" || replicasOf(t, r, deployment) != 7 {
+		t.Errorf("decision during the override = %+v", decision)
+	}
+
+	instance.Status.Override.Until = metav1.NewTime(time.Now().Add(-time.Second))
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status.Override != nil || conditionStatus(instance, autoscaler.ConditionOverridden) != metav1.ConditionFalse {
+		t.Errorf("expired override is still reported: %+v", instance.Status)
+	}
+	if decision, err := r.scaleTarget(ctx, instance, 3, testTrigger, "test"); err != nil || !decision.Changed() {
+		t.Errorf("decision after the override = %+v, %v", decision, err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.FreezeReplicas = &autoscaler.ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(time.Now().Add(time.Hour))}
+	instance.Annotations = map[string]string{autoscaler.OverrideReplicasAnnotation: "9"}
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, deployment)
+
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 4 {
+		t.Errorf("deployment has %d replicas, want the frozen 4", got)
+	}
+	// an override does not break a freeze
+	if instance.Status.Override != nil {
+		t.Errorf("override taken while frozen: %+v", instance.Status.Override)
+	}
+	if conditionStatus(instance, autoscaler.ConditionFrozen) != metav1.ConditionTrue {
+		t.Errorf("conditions = %+v, want Frozen", instance.Status.Conditions)
+	}
+
+	// something else scaled the deployment, the freeze sets it back
+	deployment.Spec.Replicas = int32Ptr(6)
+	if err := r.Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 4 {
+		t.Errorf("deployment has %d replicas, want it set back to 4", got)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Paused = true
+	instance.Spec.FreezeReplicas = &autoscaler.ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(time.Now().Add(time.Hour))}
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, deployment)
+
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.scaleTarget(ctx, instance, 5, testTrigger, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 2 {
+		t.Errorf("paused deployment was scaled to %d", got)
+	}
+	if conditionStatus(instance, autoscaler.ConditionPaused) != metav1.ConditionTrue || conditionStatus(instance, autoscaler.ConditionFrozen) != metav1.ConditionFalse {
+		t.Errorf("conditions = %+v, want Paused and not Frozen", instance.Status.Conditions)
+	}
+	if d := instance.Status.LastDecision; d == nil || d.Applied || d.Limited != "paused" {
+		t.Errorf("status.lastDecision = %+v, want a decision held by the pause", d)
+	}
+}
+
+func TestSkipReconcilePauses(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Annotations = map[string]string{autoscaler.SkipReconcileAnnotation: ""}
+	r := newConflictReconciler(t, instance, newHoldDeployment(2))
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(instance)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(instance), instance); err != nil {
+		t.Fatal(err)
+	}
+	if conditionStatus(instance, autoscaler.ConditionPaused) != metav1.ConditionTrue {
+		t.Errorf("conditions = %+v, want Paused while reconciling is skipped", instance.Status.Conditions)
+	}
+	if len(instance.Finalizers) != 0 {
+		t.Errorf("finalizers %v were added while reconciling is skipped", instance.Finalizers)
+	}
+
+	// the annotation removed, the CR is no longer paused
+	delete(instance.Annotations, autoscaler.SkipReconcileAnnotation)
+	if err := r.reconcileHold(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if conditionStatus(instance, autoscaler.ConditionPaused) != metav1.ConditionFalse {
+		t.Errorf("conditions = %+v, want not Paused", instance.Status.Conditions)
+	}
+}
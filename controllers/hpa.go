@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// reconcileDriver keeps the HPA of a CR using the HPA driver in line with its
+// spec. The HPA is removed when the CR goes back to the Alerts driver, while
+// another scaler targets the deployment unless takeover is Force, and while the
+// CR is paused, frozen or overridden
+func (r *CustomAutoScalingReconciler) reconcileDriver(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	p := r.Provisioner
+	if instance.Spec.Driver != autoscaler.HPADriver || conflicted(instance) || scaling.HoldFor(instance, time.Now()) != nil {
+		return p.DeleteHPA(ctx, instance)
+	}
+
+	hpa, err := p.GetHPA(ctx, instance)
+	if apierrors.IsNotFound(err) {
+		_, err := p.CreateHPA(ctx, instance)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = p.UpdateHPA(ctx, instance, hpa)
+	return err
+}
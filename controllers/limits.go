@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"buildpiper.opstreelabs.in/autoscaler/receiver"
+	"golang.org/x/time/rate"
+)
+
+// ReceiverLimits bounds the load the webhook server takes, a zero field
+// disables its limit
+type ReceiverLimits struct {
+	// SourceRate and SourceBurst limit the requests per second of a remote address
+	SourceRate  float64
+	SourceBurst int
+	// CRRate and CRBurst limit the requests per second carrying signals for a CR
+	CRRate  float64
+	CRBurst int
+	// MaxBodyBytes is the largest request body read
+	MaxBodyBytes int64
+	// Timeout bounds handling a request
+	Timeout time.Duration
+	// MaxConcurrent is how many requests are handled at once
+	MaxConcurrent int
+}
+
+// DefaultReceiverLimits are the limits of the webhook server unless set by flags
+var DefaultReceiverLimits = ReceiverLimits{
+	SourceRate:    10,
+	SourceBurst:   20,
+	CRRate:        2,
+	CRBurst:       10,
+	MaxBodyBytes:  1 << 20,
+	Timeout:       30 * time.Second,
+	MaxConcurrent: 32,
+}
+
+// writeTimeoutMargin keeps the write deadline of the server past the handler
+// timeout so the timeout response still reaches the client
+const writeTimeoutMargin = 5 * time.Second
+
+// writeTimeout is the write deadline of the webhook server, zero when handling
+// is not bounded
+func (l ReceiverLimits) writeTimeout() time.Duration {
+	if l.Timeout <= 0 {
+		return 0
+	}
+	return l.Timeout + writeTimeoutMargin
+}
+
+// Reasons a request is shed, reported in customautoscaling_webhook_shed_total
+const (
+	shedConcurrency = "concurrency"
+	shedSource      = "source"
+	shedCR          = "customautoscaling"
+	shedBodySize    = "body_size"
+)
+
+// receiverLimiter applies ReceiverLimits, a nil receiverLimiter limits nothing
+type receiverLimiter struct {
+	limits  ReceiverLimits
+	sources *keyedLimiter
+	crs     *keyedLimiter
+	slots   chan struct{}
+}
+
+func newReceiverLimiter(limits ReceiverLimits) *receiverLimiter {
+	l := &receiverLimiter{
+		limits:  limits,
+		sources: newKeyedLimiter(limits.SourceRate, limits.SourceBurst),
+		crs:     newKeyedLimiter(limits.CRRate, limits.CRBurst),
+	}
+	if limits.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return l
+}
+
+// middleware sheds requests beyond the concurrency limit or the rate of their
+// source and bounds the body size and handling time of the others. A slot is
+// held until the handler itself returns, which outlives the timeout response.
+// Remote write requests are exempt from the rate and concurrency limits, a
+// Prometheus sends them continuously from several shards and retries what is
+// shed, which would crowd out the signals of every other source
+func (l *receiverLimiter) middleware(next http.Handler) http.Handler {
+	limited, unlimited := next, next
+	if l.slots != nil {
+		limited = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			defer func() { <-l.slots }()
+			next.ServeHTTP(w, req)
+		})
+	}
+	if l.limits.Timeout > 0 {
+		limited = http.TimeoutHandler(limited, l.limits.Timeout, "Request timed out")
+		unlimited = http.TimeoutHandler(unlimited, l.limits.Timeout, "Request timed out")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.limits.MaxBodyBytes > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, l.limits.MaxBodyBytes)
+		}
+		if isRemoteWrite(req) {
+			unlimited.ServeHTTP(w, req)
+			return
+		}
+
+		source, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			source = req.RemoteAddr
+		}
+		if retry := l.sources.reserve(time.Now(), source); retry > 0 {
+			shed(w, shedSource, retry)
+			return
+		}
+
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				shed(w, shedConcurrency, time.Second)
+				return
+			}
+		}
+		limited.ServeHTTP(w, req)
+	})
+}
+
+// isRemoteWrite reports whether req is a remote write request of the API of a CR
+func isRemoteWrite(req *http.Request) bool {
+	return req.Method == http.MethodPost && strings.HasPrefix(req.URL.Path, "/v1/") && strings.HasSuffix(req.URL.Path, "/write")
+}
+
+// reserveSignals takes a token for every CR the firing signals are for and
+// returns how long to wait when one of them is over its rate. Tokens are only
+// taken when every CR has one, a shed request leaves all buckets untouched
+func (l *receiverLimiter) reserveSignals(signals []receiver.Signal) time.Duration {
+	if l == nil {
+		return 0
+	}
+	seen := map[string]bool{}
+	var keys []string
+	for _, s := range signals {
+		key := s.Namespace + "/" + s.Name
+		if s.Resolved || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return l.crs.reserve(time.Now(), keys...)
+}
+
+// shed answers a request that is not handled with 429 and when to retry it,
+// Alertmanager honours Retry-After
+func shed(w http.ResponseWriter, reason string, retry time.Duration) {
+	webhookShed.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	http.Error(w, "Too many requests, retry later", http.StatusTooManyRequests)
+}
+
+// limiterIdle is how long a keyedLimiter keeps the bucket of a key nobody uses
+const limiterIdle = 10 * time.Minute
+
+// keyedLimiter keeps a token bucket per key, a nil keyedLimiter limits nothing
+type keyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func newKeyedLimiter(perSecond float64, burst int) *keyedLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &keyedLimiter{limit: rate.Limit(perSecond), burst: burst, buckets: map[string]*bucket{}}
+}
+
+// reserve takes a token from the bucket of every key at now, it returns 0 when
+// each had one and otherwise how long until they all do, without taking any
+func (k *keyedLimiter) reserve(now time.Time, keys ...string) time.Duration {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if now.Sub(k.lastSweep) > limiterIdle {
+		for key, b := range k.buckets {
+			if now.Sub(b.seen) > limiterIdle {
+				delete(k.buckets, key)
+			}
+		}
+		k.lastSweep = now
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	var retry time.Duration
+	for _, key := range keys {
+		b, ok := k.buckets[key]
+		if !ok {
+			b = &bucket{limiter: rate.NewLimiter(k.limit, k.burst)}
+			k.buckets[key] = b
+		}
+		b.seen = now
+
+		r := b.limiter.ReserveN(now, 1)
+		reservations = append(reservations, r)
+		if delay := r.DelayFrom(now); delay > retry {
+			retry = delay
+		}
+	}
+	if retry > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	return retry
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/receiver"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	k := newKeyedLimiter(1, 2)
+
+	for i := 0; i < 2; i++ {
+		if retry := k.reserve(now, "a"); retry != 0 {
+			t.Fatalf("request %d within the burst waits %s", i, retry)
+		}
+	}
+	if retry := k.reserve(now, "a"); retry != time.Second {
+		t.Errorf("request beyond the burst waits %s, want 1s", retry)
+	}
+	// a shed request does not take a token
+	if retry := k.reserve(now.Add(time.Second), "a"); retry != 0 {
+		t.Errorf("request after the refill waits %s", retry)
+	}
+	if retry := k.reserve(now, "b"); retry != 0 {
+		t.Errorf("another key waits %s", retry)
+	}
+
+	k.reserve(now.Add(limiterIdle+time.Minute), "c")
+	if _, ok := k.buckets["a"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+
+	if retry := newKeyedLimiter(0, 10).reserve(now, "a"); retry != 0 {
+		t.Errorf("disabled limiter waits %s", retry)
+	}
+}
+
+func TestReceiverLimits(t *testing.T) {
+	block, entered := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-block
+	})
+
+	// the second request finds the only slot taken
+	h := newReceiverLimiter(ReceiverLimits{MaxConcurrent: 1}).middleware(slow)
+	done, done2 := make(chan struct{}), make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		close(done)
+	}()
+	<-entered
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("request beyond the concurrency limit = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(block)
+	<-done
+
+	// a timed out request keeps its slot until its handler returns
+	block = make(chan struct{})
+	h = newReceiverLimiter(ReceiverLimits{MaxConcurrent: 1, Timeout: 10 * time.Millisecond}).middleware(slow)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("timed out request = %d, want %d", w.Code, http.StatusServiceUnavailable)
+		}
+		close(done2)
+	}()
+	<-entered
+	<-done2
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request while a timed out handler runs = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	close(block)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	h = newReceiverLimiter(ReceiverLimits{SourceRate: 0.1, SourceBurst: 1}).middleware(ok)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		if w.Code != want {
+			t.Errorf("request %d from one source = %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Errorf("Retry-After = %q, want 10", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestReceiverLimitsSignals(t *testing.T) {
+	const token = "s3cret"
+	objs := []client.Object{newHoldDeployment(2)}
+	for _, name := range []string{"web", "api"} {
+		objs = append(objs, newConflictCR(name, autoscaler.TakeoverNever), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret(name), Namespace: "default"},
+			Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+		})
+	}
+	r := newConflictReconciler(t, objs...)
+	r.limiter = newReceiverLimiter(ReceiverLimits{CRRate: 0.5, CRBurst: 1, MaxBodyBytes: 64})
+	h := r.limiter.middleware(http.HandlerFunc(r.handleWebhook))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/webhook/plain", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := post(`{"target": "default/web", "replicas": 3}`); w.Code != http.StatusOK {
+		t.Fatalf("first signal = %d %s", w.Code, w.Body)
+	}
+	if w := post(`{"target": "default/web", "replicas": 4}`); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("second signal for the CR = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// the other CR has a bucket of its own
+	if w := post(`{"target": "default/api", "replicas": 4}`); w.Code == http.StatusTooManyRequests {
+		t.Errorf("signal for another CR was shed")
+	}
+	if w := post(`{"target": "default/web", "replicas": 4, "severity": "` + strings.Repeat("x", 64) + `"}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestReserveSignals(t *testing.T) {
+	l := newReceiverLimiter(ReceiverLimits{CRRate: 0.5, CRBurst: 1})
+	signal := func(name string) receiver.Signal { return receiver.Signal{Namespace: "default", Name: name} }
+
+	if retry := l.reserveSignals([]receiver.Signal{signal("web")}); retry != 0 {
+		t.Fatalf("first signal for web waits %s", retry)
+	}
+	if retry := l.reserveSignals([]receiver.Signal{signal("api"), signal("web")}); retry == 0 {
+		t.Fatal("signals for api and web were not shed while web is over its rate")
+	}
+	// the shed request did not take the token of api
+	if retry := l.reserveSignals([]receiver.Signal{signal("api")}); retry != 0 {
+		t.Errorf("signal for api waits %s after a shed request", retry)
+	}
+}
+
+func TestReceiverLimitsRemoteWrite(t *testing.T) {
+	const token = "s3cret"
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"queue_depth"}}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret("web"), Namespace: "default"},
+		Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+	}
+	r := newConflictReconciler(t, instance, secret)
+	block, entered := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", r.handleAPI)
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-block
+	})
+	h := newReceiverLimiter(ReceiverLimits{SourceRate: 0.1, SourceBurst: 1, MaxConcurrent: 1, MaxBodyBytes: 64}).middleware(mux)
+
+	// a signal takes the token of the source and the only slot
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		close(done)
+	}()
+	<-entered
+	defer func() { close(block); <-done }()
+
+	write := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, utils.RemoteWritePath("default", "web"), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := write(""); code == http.StatusTooManyRequests {
+			t.Errorf("remote write %d was shed", i)
+		}
+	}
+	if code := write(strings.Repeat("x", 128)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized remote write = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
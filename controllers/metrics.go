@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"net/http"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	forecastValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_forecast_value",
+		Help: "Forecast value of the scaling metric at the end of the lead time",
+	}, []string{"namespace", "name"})
+
+	actualValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_actual_value",
+		Help: "Last observed value of the scaling metric",
+	}, []string{"namespace", "name"})
+
+	forecastReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_forecast_replicas",
+		Help: "Replica count implied by the forecast within the replica bounds",
+	}, []string{"namespace", "name"})
+
+	desiredReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_desired_replicas",
+		Help: "Replica count of the latest scaling decision after bounds and behavior",
+	}, []string{"namespace", "name"})
+
+	currentReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_current_replicas",
+		Help: "Replica count of the target deployment",
+	}, []string{"namespace", "name"})
+
+	minReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_min_replicas",
+		Help: "Lower replica bound of the CR",
+	}, []string{"namespace", "name"})
+
+	maxReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "customautoscaling_max_replicas",
+		Help: "Upper replica bound of the CR",
+	}, []string{"namespace", "name"})
+
+	scaleEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_scale_events_total",
+		Help: "Number of replica updates applied to the target by direction",
+	}, []string{"namespace", "name", "direction"})
+
+	webhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_webhook_requests_total",
+		Help: "Number of alert webhook requests by response code and alert severity",
+	}, []string{"code", "severity"})
+
+	webhookShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_webhook_shed_total",
+		Help: "Number of webhook requests answered with 429 or 413 by limit",
+	}, []string{"reason"})
+
+	alertSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_alert_sync_total",
+		Help: "Number of times the firing alerts were read back from the Alertmanager by result",
+	}, []string{"namespace", "name", "result"})
+
+	remoteWriteSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_remote_write_samples_total",
+		Help: "Number of samples pushed through the remote write endpoint by result",
+	}, []string{"namespace", "name", "result"})
+
+	embeddedScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_embedded_scrapes_total",
+		Help: "Number of target scrapes made by the operator in embedded mode by target health",
+	}, []string{"namespace", "name", "health"})
+
+	provisioningErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "customautoscaling_provisioning_errors_total",
+		Help: "Number of failures to get or create a child resource by resource type",
+	}, []string{"resource"})
+
+	decisionLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "customautoscaling_decision_latency_seconds",
+		Help:    "Time from the alert starting to fire until the replica update",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"namespace", "name"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		forecastValue,
+		actualValue,
+		forecastReplicas,
+		desiredReplicas,
+		currentReplicas,
+		minReplicas,
+		maxReplicas,
+		scaleEvents,
+		webhookRequests,
+		webhookShed,
+		alertSyncs,
+		remoteWriteSamples,
+		embeddedScrapes,
+		provisioningErrors,
+		decisionLatency,
+	)
+}
+
+// observeBounds exports the replica bounds of the CR, an unset bound is reported as -1
+func observeBounds(instance *autoscaler.CustomAutoScaling) {
+	min, max := float64(-1), float64(-1)
+	if instance.Spec.MinReplicas != nil {
+		min = float64(*instance.Spec.MinReplicas)
+	}
+	if instance.Spec.MaxReplicas != nil {
+		max = float64(*instance.Spec.MaxReplicas)
+	}
+	minReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(min)
+	maxReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(max)
+}
+
+// forgetMetrics drops every series of a deleted CR
+func forgetMetrics(namespace, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "name": name}
+	for _, vec := range []*prometheus.GaugeVec{forecastValue, actualValue, forecastReplicas, desiredReplicas, currentReplicas, minReplicas, maxReplicas} {
+		vec.Delete(labels)
+	}
+	scaleEvents.DeletePartialMatch(labels)
+	alertSyncs.DeletePartialMatch(labels)
+	remoteWriteSamples.DeletePartialMatch(labels)
+	embeddedScrapes.DeletePartialMatch(labels)
+	decisionLatency.Delete(labels)
+}
+
+// severityLabel returns the severity label of webhookRequests for severity.
+// Severities come from the request body, those without a built-in replica
+// mapping are counted as other to keep the number of series bounded
+func severityLabel(severity string) string {
+	switch severity {
+	case "", "critical", "warning":
+		return severity
+	}
+	return "other"
+}
+
+// statusRecorder keeps the response code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
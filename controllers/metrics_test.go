@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWebhookRequestsSeverity(t *testing.T) {
+	const token = "s3cret"
+	for _, tc := range []struct {
+		severity string
+		label    string
+	}{
+		{severity: "critical", label: "critical"},
+		{severity: "warning", label: "warning"},
+		{severity: "page-oncall-7f3a", label: "other"},
+		{severity: "", label: ""},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			instance := newConflictCR("web", autoscaler.TakeoverNever)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret("web"), Namespace: "default"},
+				Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+			}
+			r := newConflictReconciler(t, instance, secret, newHoldDeployment(2))
+
+			before := testutil.ToFloat64(webhookRequests.WithLabelValues("200", tc.label))
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"alerts": [{"status": "firing", "fingerprint": "f1",
+				"labels": {"alertname": "load", "severity": "`+tc.severity+`", "customautoscaling": "web", "customautoscaling_namespace": "default"}}]}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			r.handleWebhook(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("code = %d: %s", w.Code, w.Body)
+			}
+
+			if got := testutil.ToFloat64(webhookRequests.WithLabelValues("200", tc.label)) - before; got != 1 {
+				t.Errorf("%s severity counted %v times, want once", tc.label, got)
+			}
+			if tc.severity != tc.label && webhookRequests.DeleteLabelValues("200", tc.severity) {
+				t.Errorf("severity %q from the request body is a label value", tc.severity)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/predict"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reconcilePredictive forecasts the scaling metric once per step and scales the
+// target up ahead of the forecast load
+func (r *CustomAutoScalingReconciler) reconcilePredictive(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	spec := instance.Spec.Predictive
+	if last := instance.Status.Forecast; last != nil && time.Since(last.Time.Time) < spec.Step.Duration {
+		return nil
+	}
+
+	perReplica, err := strconv.ParseFloat(spec.TargetValuePerReplica, 64)
+	if err != nil || perReplica <= 0 {
+		return fmt.Errorf("invalid targetValuePerReplica %q", spec.TargetValuePerReplica)
+	}
+
+	query := spec.Query
+	if query == "" && len(instance.Spec.Metrics) > 0 {
+		query = instance.Spec.Metrics[0].Query
+	}
+
+	address := utils.PrometheusURL(instance)
+	if r.PrometheusURL != nil {
+		address = r.PrometheusURL(instance)
+	}
+	now := time.Now()
+	series, err := utils.QueryRange(ctx, address, query, now.Add(-spec.Lookback.Duration), now, spec.Step.Duration)
+	if err != nil {
+		return err
+	}
+
+	forecast, err := predict.Forecast(series, predict.Params{
+		Model:    string(spec.Model),
+		Step:     spec.Step.Duration,
+		Season:   spec.Season.Duration,
+		LeadTime: spec.LeadTime.Duration,
+	})
+	if err != nil {
+		return err
+	}
+	actual := series[len(series)-1].Value
+
+	desired := int32(math.Ceil(forecast / perReplica))
+	// the replicas the forecast would actually scale to are published, the
+	// raw forecast is kept in the value
+	bounded, _ := scaling.Bound(&instance.Spec, desired)
+
+	labels := []string{instance.Namespace, instance.Name}
+	forecastValue.WithLabelValues(labels...).Set(forecast)
+	actualValue.WithLabelValues(labels...).Set(actual)
+	forecastReplicas.WithLabelValues(labels...).Set(float64(bounded))
+
+	// only pre-scale upwards, scaling down is left to the alerts
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.Target.Name, Namespace: instance.Namespace}, deployment); err != nil {
+		return err
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas < bounded {
+		reason := fmt.Sprintf("forecast %s in %s", strconv.FormatFloat(forecast, 'f', 2, 64), spec.LeadTime.Duration)
+		trigger := autoscaler.ScalingTrigger{Type: autoscaler.ForecastTrigger, Value: strconv.FormatFloat(forecast, 'f', -1, 64)}
+		// the forecast is still recorded while a conflict holds the target
+		if _, err := r.scaleTarget(ctx, instance, desired, trigger, reason); err != nil && !errors.Is(err, errScalingConflict) {
+			return err
+		}
+	}
+
+	instance.Status.Forecast = &autoscaler.ForecastStatus{
+		Time:     metav1.NewTime(now),
+		Value:    strconv.FormatFloat(forecast, 'f', -1, 64),
+		Actual:   strconv.FormatFloat(actual, 'f', -1, 64),
+		Replicas: bounded,
+	}
+	return r.Status().Update(ctx, instance)
+}
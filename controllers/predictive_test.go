@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/predict"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// queryRangeStub serves value hourly over the last day from query_range, or
+// an empty result without value, and counts the queries it answered
+func queryRangeStub(t *testing.T, value string, queries *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(queries, 1)
+		var values []string
+		if value != "" {
+			now := time.Now().Truncate(time.Hour)
+			for at := now.Add(-24 * time.Hour); !at.After(now); at = at.Add(time.Hour) {
+				values = append(values, fmt.Sprintf(`[%d,"%s"]`, at.Unix(), value))
+			}
+		}
+		result := "[]"
+		if len(values) > 0 {
+			result = `[{"metric":{},"values":[` + strings.Join(values, ",") + `]}]`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":%s}}`, result)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newPredictiveCR() *autoscaler.CustomAutoScaling {
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Predictive = &autoscaler.PredictiveScaling{
+		Query:                 "sum(rate(requests_total[5m]))",
+		Model:                 autoscaler.ProfileModel,
+		Lookback:              metav1.Duration{Duration: 24 * time.Hour},
+		Step:                  metav1.Duration{Duration: 5 * time.Minute},
+		Season:                metav1.Duration{Duration: 24 * time.Hour},
+		LeadTime:              metav1.Duration{Duration: 10 * time.Minute},
+		TargetValuePerReplica: "10",
+	}
+	return instance
+}
+
+func TestReconcilePredictive(t *testing.T) {
+	ctx := context.Background()
+	instance := newPredictiveCR()
+	instance.Spec.MaxReplicas = int32Ptr(6)
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, deployment)
+	var queries int32
+	server := queryRangeStub(t, "100", &queries)
+	r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	if err := r.reconcilePredictive(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	// a forecast of 10 replicas is published within the maximum of 6
+	if f := instance.Status.Forecast; f == nil || f.Value != "100" || f.Replicas != 6 {
+		t.Errorf("status.forecast = %+v, want 6 replicas for 100", f)
+	}
+	if got := testutil.ToFloat64(forecastReplicas.WithLabelValues("default", "web")); got != 6 {
+		t.Errorf("forecast replicas gauge = %v, want 6", got)
+	}
+	if got := replicasOf(t, r, deployment); got != 6 {
+		t.Errorf("deployment has %d replicas, want 6", got)
+	}
+
+	// the next forecast waits for a step
+	if err := r.reconcilePredictive(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 1 {
+		t.Errorf("%d queries within a step, want 1", queries)
+	}
+	instance.Status.Forecast.Time = metav1.NewTime(instance.Status.Forecast.Time.Add(-5 * time.Minute))
+	if err := r.reconcilePredictive(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 2 {
+		t.Errorf("%d queries after a step, want 2", queries)
+	}
+}
+
+func TestReconcilePredictiveNotEnoughHistory(t *testing.T) {
+	ctx := context.Background()
+	instance := newPredictiveCR()
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, deployment)
+	var queries int32
+	server := queryRangeStub(t, "", &queries)
+	r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	if err := r.reconcilePredictive(ctx, instance); !errors.Is(err, predict.ErrNotEnoughHistory) {
+		t.Fatalf("reconcilePredictive() = %v, want ErrNotEnoughHistory", err)
+	}
+	if instance.Status.Forecast != nil {
+		t.Errorf("status.forecast = %+v without a forecast", instance.Status.Forecast)
+	}
+	if got := replicasOf(t, r, deployment); got != 2 {
+		t.Errorf("deployment scaled to %d without a forecast", got)
+	}
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// childResource is a resource the reconciler creates for every CustomAutoScaling
+type childResource struct {
+	kind   string
+	name   string
+	get    func() error
+	create func() error
+	// update brings the child get found in line with the spec and reports
+	// whether it changed it, children without one are only created
+	update func() (bool, error)
+}
+
+func (r *CustomAutoScalingReconciler) childResources(ctx context.Context, instance *autoscaler.CustomAutoScaling) []childResource {
+	p := r.Provisioner
+	token := childResource{
+		kind:   "Secret",
+		name:   utils.SignalsTokenSecret(instance.Name),
+		get:    func() error { _, err := p.GetSignalsToken(ctx, instance); return err },
+		create: func() error { _, err := p.CreateSignalsToken(ctx, instance); return err },
+	}
+	// in embedded mode the operator scrapes and evaluates the metrics itself,
+	// only the token of the per-CR API is created
+	if instance.Spec.Monitoring.Embedded != nil {
+		return []childResource{token}
+	}
+
+	var prometheus *monitoringv1.Prometheus
+	children := []childResource{
+		token,
+		{
+			kind:   "ServiceAccount",
+			name:   instance.Name + "-sa",
+			get:    func() error { _, err := p.GetSAccount(ctx, instance); return err },
+			create: func() error { _, err := p.CreateServiceAccount(ctx, instance); return err },
+		},
+		{
+			kind:   "ClusterRole",
+			name:   instance.Name + "-clusterrole",
+			get:    func() error { _, err := p.GetClusterRole(ctx, instance); return err },
+			create: func() error { _, err := p.CreateClusterRole(ctx, instance); return err },
+		},
+		{
+			kind:   "ClusterRoleBinding",
+			name:   instance.Name + "-rolebinding",
+			get:    func() error { _, err := p.GetRoleBinding(ctx, instance); return err },
+			create: func() error { _, err := p.CreateClusterRoleBinding(ctx, instance); return err },
+		},
+		{
+			kind:   "ServiceMonitor",
+			name:   instance.Name + "-svcm",
+			get:    func() error { _, err := p.GetSVCMonitor(ctx, instance); return err },
+			create: func() error { _, err := p.CreateSVCMonitor(ctx, instance); return err },
+		},
+		{
+			kind:   "Prometheus",
+			name:   instance.Name + "-prometheus-instance",
+			get:    func() (err error) { prometheus, err = p.GetPrometheusInstance(ctx, instance); return err },
+			create: func() error { _, err := p.CreatePrometheusInstance(ctx, instance); return err },
+			update: func() (bool, error) { return p.UpdatePrometheusInstance(ctx, instance, prometheus) },
+		},
+		{
+			kind:   "Service",
+			name:   instance.Name + "-prometheus-service",
+			get:    func() error { _, err := p.GetPrometheusService(ctx, instance); return err },
+			create: func() error { _, err := p.CreatePrometheusService(ctx, instance); return err },
+		},
+	}
+	if instance.Spec.Monitoring.RemoteWrite != nil {
+		children = append(children, childResource{
+			kind:   "Service",
+			name:   utils.RemoteWriteService(instance.Name),
+			get:    func() error { _, err := p.GetRemoteWriteService(ctx, instance); return err },
+			create: func() error { _, err := p.CreateRemoteWriteService(ctx, instance); return err },
+		})
+	}
+
+	var promRule *monitoringv1.PrometheusRule
+	rule := childResource{
+		kind:   "PrometheusRule",
+		name:   instance.Name + "-prometheus-rule",
+		get:    func() (err error) { promRule, err = p.GetPrometheusRule(ctx, instance); return err },
+		create: func() error { _, err := p.CreatePrometheusRule(ctx, instance); return err },
+		update: func() (bool, error) { return p.UpdatePrometheusRule(ctx, instance, promRule) },
+	}
+
+	// the HPA and KEDA drivers read the metrics through the operator instead
+	// of alerts, only the recording rules they query are generated for them
+	if !usesAlerts(instance) {
+		if utils.HasRecordingRules(instance) {
+			children = append(children, rule)
+		}
+		return children
+	}
+	var alertConfig *corev1.Secret
+	var alertManager *monitoringv1.Alertmanager
+	return append(children, childResource{
+		kind:   "Secret",
+		name:   instance.Name + "-alertsecret",
+		get:    func() (err error) { alertConfig, err = p.GetAlertConfigSecret(ctx, instance); return err },
+		create: func() error { _, err := p.CreateAlertConfigSecret(ctx, instance); return err },
+		update: func() (bool, error) { return p.UpdateAlertConfigSecret(ctx, instance, alertConfig) },
+	}, childResource{
+		kind:   "Alertmanager",
+		name:   instance.Name + "-alert",
+		get:    func() (err error) { alertManager, err = p.GetAlertManager(ctx, instance); return err },
+		create: func() error { _, err := p.CreateAlertManager(ctx, instance, utils.AlertManagerReplicas); return err },
+		update: func() (bool, error) {
+			return p.UpdateAlertManager(ctx, instance, alertManager, utils.AlertManagerReplicas)
+		},
+	}, childResource{
+		kind:   "Service",
+		name:   instance.Name + "-alert-service",
+		get:    func() error { _, err := p.GetAlertManagerService(ctx, instance); return err },
+		create: func() error { _, err := p.CreateAlertManagerService(ctx, instance); return err },
+	}, rule)
+}
+
+// usesAlerts reports whether the CR is scaled on alerts received by the webhook
+func usesAlerts(instance *autoscaler.CustomAutoScaling) bool {
+	return instance.Spec.Driver == "" || instance.Spec.Driver == autoscaler.AlertsDriver
+}
+
+// provision creates every missing child resource of the CR, updates those
+// that drifted from the spec and stops at the first failure. A CR in embedded
+// mode has the monitoring stack it was provisioned with before removed
+func (r *CustomAutoScalingReconciler) provision(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	reqLogger := log.WithValues("Request.Namespace", instance.Namespace, "Request.Name", instance.Name)
+
+	if instance.Spec.Monitoring.Embedded != nil {
+		if err := r.Provisioner.DeleteMonitoring(ctx, instance); err != nil {
+			reqLogger.Error(err, "error while deleting the monitoring stack in embedded mode")
+			return err
+		}
+	}
+
+	// the rule of the HPA and KEDA drivers only holds recording rules
+	if instance.Spec.Monitoring.Embedded == nil && !usesAlerts(instance) && !utils.HasRecordingRules(instance) {
+		if err := r.Provisioner.DeletePrometheusRule(ctx, instance); err != nil {
+			reqLogger.Error(err, "error while deleting the PrometheusRule without recording rules")
+			return err
+		}
+	}
+
+	for _, child := range r.childResources(ctx, instance) {
+		err := child.get()
+		if err == nil {
+			if child.update == nil {
+				continue
+			}
+			if _, err := child.update(); err != nil {
+				provisioningErrors.WithLabelValues(child.kind).Inc()
+				reqLogger.Error(err, "error while updating child resource", child.kind, child.name)
+				return err
+			}
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			provisioningErrors.WithLabelValues(child.kind).Inc()
+			reqLogger.Error(err, "error while fetching child resource", child.kind, child.name)
+			return err
+		}
+
+		reqLogger.Info("child resource doesnt exist, creating now", child.kind, child.name)
+		if err := child.create(); err != nil {
+			provisioningErrors.WithLabelValues(child.kind).Inc()
+			reqLogger.Error(err, "error while creating child resource", child.kind, child.name)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// provisionFailed reports err in the Provisioned condition and picks how the
+// request is retried, an invalid spec waits for the CR to change while every
+// other failure is returned so the workqueue requeues it with backoff
+func (r *CustomAutoScalingReconciler) provisionFailed(ctx context.Context, instance *autoscaler.CustomAutoScaling, err error) (ctrl.Result, error) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               autoscaler.ConditionProvisioned,
+		Status:             metav1.ConditionFalse,
+		Reason:             provisionReason(err),
+		Message:            err.Error(),
+		ObservedGeneration: instance.Generation,
+	})
+	if uerr := r.Status().Update(ctx, instance); uerr != nil {
+		log.Error(uerr, "failed to update status", "Request.Namespace", instance.Namespace, "Request.Name", instance.Name)
+	}
+
+	if errors.Is(err, utils.ErrInvalidSpec) {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, err
+}
+
+// provisioned marks the Provisioned condition true
+func (r *CustomAutoScalingReconciler) provisioned(ctx context.Context, instance *autoscaler.CustomAutoScaling) error {
+	current := meta.FindStatusCondition(instance.Status.Conditions, autoscaler.ConditionProvisioned)
+	if current != nil && current.Status == metav1.ConditionTrue && current.ObservedGeneration == instance.Generation {
+		return nil
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               autoscaler.ConditionProvisioned,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Provisioned",
+		Message:            "all child resources exist",
+		ObservedGeneration: instance.Generation,
+	})
+	return r.Status().Update(ctx, instance)
+}
+
+func provisionReason(err error) string {
+	switch {
+	case errors.Is(err, utils.ErrCRDMissing):
+		return "CRDMissing"
+	case errors.Is(err, utils.ErrForbidden):
+		return "Forbidden"
+	case errors.Is(err, utils.ErrInvalidSpec):
+		return "InvalidSpec"
+	case errors.Is(err, utils.ErrClientConfig):
+		return "ClientConfig"
+	}
+	return "ProvisioningFailed"
+}
+
+// setCondition sets condition on the CR and reports whether it changed. A
+// change of its status is recorded as an event of eventType, as is a new
+// condition that is true or comes with a warning
+func (r *CustomAutoScalingReconciler) setCondition(instance *autoscaler.CustomAutoScaling, condition metav1.Condition, eventType string) bool {
+	current := meta.FindStatusCondition(instance.Status.Conditions, condition.Type)
+	if current != nil && current.Status == condition.Status && current.Reason == condition.Reason &&
+		current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration {
+		return false
+	}
+	if (current == nil && (condition.Status == metav1.ConditionTrue || eventType == corev1.EventTypeWarning)) ||
+		(current != nil && current.Status != condition.Status) {
+		r.Recorder.Event(instance, eventType, condition.Reason, condition.Message)
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	return true
+}
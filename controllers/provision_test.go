@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newProvisionReconciler returns a reconciler provisioning the children of
+// its CRs on the fake client
+func newProvisionReconciler(t *testing.T, objs ...client.Object) *CustomAutoScalingReconciler {
+	t.Helper()
+	r := newConflictReconciler(t, objs...)
+	r.Recorder = record.NewFakeRecorder(100)
+	r.Provisioner = utils.NewProvisioner(r.Client, r.Scheme, r.Recorder)
+	return r
+}
+
+// ruleExprs returns the expressions of the rules in the PrometheusRule of the CR web, in order
+func ruleExprs(t *testing.T, r *CustomAutoScalingReconciler) ([]string, string) {
+	t.Helper()
+	rule := &monitoringv1.PrometheusRule{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "web-prometheus-rule"}, rule); err != nil {
+		t.Fatal(err)
+	}
+	var exprs []string
+	for _, group := range rule.Spec.Groups {
+		for _, rule := range group.Rules {
+			exprs = append(exprs, rule.Expr.String())
+		}
+	}
+	return exprs, rule.ResourceVersion
+}
+
+func TestProvisionUpdatesThresholds(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{
+		Name:       "queue",
+		Query:      "sum(queue_depth)",
+		Thresholds: []autoscaler.Threshold{{Severity: "warning", Value: resource.MustParse("10"), Replicas: 3}},
+	}}
+	r := newProvisionReconciler(t, instance)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if exprs, _ := ruleExprs(t, r); len(exprs) != 1 {
+		t.Fatalf("rules = %v, want the warning step", exprs)
+	}
+
+	// the ladder of the existing CR is edited
+	instance.Spec.Metrics[0].Thresholds[0].Value = resource.MustParse("20")
+	instance.Spec.Metrics[0].Thresholds = append(instance.Spec.Metrics[0].Thresholds,
+		autoscaler.Threshold{Severity: "critical", Value: resource.MustParse("40"), Replicas: 6})
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	exprs, version := ruleExprs(t, r)
+	want := []string{"(sum(queue_depth)) > 20", "(sum(queue_depth)) > 40"}
+	if !reflect.DeepEqual(exprs, want) {
+		t.Errorf("rules after the edit = %q, want %q", exprs, want)
+	}
+
+	// a spec without changes leaves the rule alone
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if _, again := ruleExprs(t, r); again != version {
+		t.Errorf("resourceVersion = %s after a reconcile without changes, want %s", again, version)
+	}
+}
+
+func TestProvisionUpdatesRecordingRules(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "requests", Query: "sum(rate(requests_total[1m])) > 10"}}
+	r := newProvisionReconciler(t, instance)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	// the query of the existing CR is recorded, the alert reads the recorded series
+	instance.Spec.Metrics[0].Recording = &autoscaler.Recording{Expressions: []string{"sum(rate(requests_total[1m]))"}}
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	series := autoscaler.RecordedSeries("web", instance.Spec.Metrics[0], 0)
+	exprs, _ := ruleExprs(t, r)
+	want := []string{"sum(rate(requests_total[1m]))", series + " > 10"}
+	if !reflect.DeepEqual(exprs, want) {
+		t.Errorf("rules once recorded = %q, want %q", exprs, want)
+	}
+
+	// the HPA driver keeps the rule for its recording rules only
+	instance.Spec.Driver = autoscaler.HPADriver
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if exprs, _ := ruleExprs(t, r); !reflect.DeepEqual(exprs, want[:1]) {
+		t.Errorf("rules with the HPA driver = %q, want %q", exprs, want[:1])
+	}
+	instance.Spec.Metrics[0].Recording = nil
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	rule := &monitoringv1.PrometheusRule{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "web-prometheus-rule"}, rule); !apierrors.IsNotFound(err) {
+		t.Errorf("PrometheusRule without recording rules: %v, want it deleted", err)
+	}
+}
+
+func TestProvisionEnablesRemoteWrite(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "requests", Query: "sum(rate(requests_total[1m])) > 10"}}
+	r := newProvisionReconciler(t, instance)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	prometheus := &monitoringv1.Prometheus{}
+	key := types.NamespacedName{Namespace: "default", Name: "web-prometheus-instance"}
+	if err := r.Get(ctx, key, prometheus); err != nil || prometheus.Spec.EnableRemoteWriteReceiver {
+		t.Fatalf("Prometheus without remoteWrite = %v, receiver enabled %t", err, prometheus.Spec.EnableRemoteWriteReceiver)
+	}
+	version := prometheus.ResourceVersion
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, prometheus); err != nil || prometheus.ResourceVersion != version {
+		t.Errorf("Prometheus after a reconcile without changes = %v, resourceVersion %s, want %s", err, prometheus.ResourceVersion, version)
+	}
+
+	// remote write is turned on for the existing CR
+	instance.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"requests_total"}}
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, prometheus); err != nil || !prometheus.Spec.EnableRemoteWriteReceiver {
+		t.Errorf("Prometheus with remoteWrite = %v, receiver enabled %t, want it enabled", err, prometheus.Spec.EnableRemoteWriteReceiver)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: utils.RemoteWriteService("web")}, &corev1.Service{}); err != nil {
+		t.Errorf("remote write Service: %v", err)
+	}
+}
+
+// recordedEvents drains the events the reconciler recorded
+func recordedEvents(r *CustomAutoScalingReconciler) []string {
+	var events []string
+	for ch := r.Recorder.(*record.FakeRecorder).Events; len(ch) > 0; {
+		events = append(events, <-ch)
+	}
+	return events
+}
+
+func TestProvisionEvents(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{
+		Name:       "queue",
+		Query:      "sum(queue_depth)",
+		Thresholds: []autoscaler.Threshold{{Severity: "warning", Value: resource.MustParse("10"), Replicas: 3}},
+	}}
+	r := newProvisionReconciler(t, instance)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	created := map[string]bool{}
+	for _, event := range recordedEvents(r) {
+		if !strings.HasPrefix(event, "Normal Created created ") {
+			t.Errorf("event %q on creation, want only Created events", event)
+		}
+		created[strings.TrimPrefix(event, "Normal Created created ")] = true
+	}
+	for _, child := range r.childResources(ctx, instance) {
+		if !created[child.kind+" "+child.name] {
+			t.Errorf("no Created event for %s %s in %v", child.kind, child.name, created)
+		}
+	}
+
+	// an edit of the spec updates the rule only
+	instance.Spec.Metrics[0].Thresholds[0].Value = resource.MustParse("20")
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if events := recordedEvents(r); !reflect.DeepEqual(events, []string{"Normal Updated updated PrometheusRule web-prometheus-rule"}) {
+		t.Errorf("events after an edit = %q, want the rule updated", events)
+	}
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	if events := recordedEvents(r); len(events) != 0 {
+		t.Errorf("events of a reconcile without changes = %q, want none", events)
+	}
+}
+
+func TestProvisionUpdatesAlertmanagerConfig(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.UID = "web-uid"
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "requests", Query: "sum(rate(requests_total[1m])) > 10"}}
+	// an earlier version configured the Alertmanager to post to /webhook without a token
+	config := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-alertsecret", Namespace: "default"},
+		Data: map[string][]byte{"alertmanager.yaml": []byte(`receivers:
+- name: 'webhook_receiver'
+  webhook_configs:
+  - url: "http://autoscaler-signals.autoscaler-system.svc:3030/webhook"`)},
+	}
+	alertManager := &monitoringv1.Alertmanager{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-alert", Namespace: "default"},
+		Spec:       monitoringv1.AlertmanagerSpec{ConfigSecret: "web-alertsecret", Secrets: []string{"web-alertsecret"}},
+	}
+	r := newProvisionReconciler(t, instance, config, alertManager)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(config), config); err != nil {
+		t.Fatal(err)
+	}
+	got := string(config.Data["alertmanager.yaml"])
+	for _, want := range []string{utils.SignalsPath("default", "web"), "credentials_file: \"/etc/alertmanager/secrets/web-signals-token/token\""} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Alertmanager configuration does not contain %s:\n%s", want, got)
+		}
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(alertManager), alertManager); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web-alertsecret", utils.SignalsTokenSecret("web")}; !reflect.DeepEqual(alertManager.Spec.Secrets, want) {
+		t.Errorf("Alertmanager mounts %v, want %v", alertManager.Spec.Secrets, want)
+	}
+}
+
+func TestProvisionAlertmanagerService(t *testing.T) {
+	ctx := context.Background()
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "requests", Query: "sum(rate(requests_total[1m])) > 10"}}
+	r := newProvisionReconciler(t, instance)
+	if err := r.provision(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+
+	// alert read back queries the Alertmanager through this Service
+	service := &corev1.Service{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "web-alert-service"}, service); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web-alert-service.default.svc:9093"; utils.AlertmanagerURL(instance) != want {
+		t.Errorf("AlertmanagerURL = %s, want %s", utils.AlertmanagerURL(instance), want)
+	}
+	if service.Spec.Type != corev1.ServiceTypeClusterIP || service.Spec.Ports[0].NodePort != 0 {
+		t.Errorf("Alertmanager service is %s on node port %d, want an in cluster service", service.Spec.Type, service.Spec.Ports[0].NodePort)
+	}
+	alertManager := &monitoringv1.Alertmanager{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "web-alert"}, alertManager); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range service.Spec.Selector {
+		if alertManager.Spec.PodMetadata == nil || alertManager.Spec.PodMetadata.Labels[k] != v {
+			t.Errorf("Alertmanager pods do not carry the %s=%s label the service selects", k, v)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// remoteWriteTimeout bounds the forwarding of a remote write request to Prometheus
+const remoteWriteTimeout = 10 * time.Second
+
+// serveWrite forwards a remote write request to every Prometheus pod of the CR key,
+// keeping only the series its spec.monitoring.remoteWrite declares. Prometheus
+// rejecting the samples is passed on so the sender drops them, Prometheus
+// being unreachable is answered with 503 so the sender retries
+func (r *CustomAutoScalingReconciler) serveWrite(w http.ResponseWriter, req *http.Request, key types.NamespacedName) {
+	instance := &autoscaler.CustomAutoScaling{}
+	if err := r.Get(req.Context(), key, instance); err != nil {
+		apiError(w, key, err)
+		return
+	}
+	if instance.Spec.Monitoring.RemoteWrite == nil {
+		http.Error(w, "remote write is not enabled for customautoscaling "+key.String(), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		webhookShed.WithLabelValues(shedBodySize).Inc()
+		http.Error(w, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	write, err := decodeWriteRequest(body)
+	if err != nil {
+		http.Error(w, "Failed to decode remote write request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	accepted, dropped := filterSeries(write, instance.Spec.Monitoring.RemoteWrite)
+	remoteWriteSamples.WithLabelValues(key.Namespace, key.Name, "accepted").Add(float64(accepted))
+	remoteWriteSamples.WithLabelValues(key.Namespace, key.Name, "dropped").Add(float64(dropped))
+	if len(write.Timeseries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	addresses, err := r.prometheusPodURLs(req.Context(), instance)
+	if err != nil {
+		http.Error(w, "Failed to list the Prometheus pods: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(addresses) == 0 {
+		http.Error(w, "no Prometheus pod of customautoscaling "+key.String()+" is ready", http.StatusServiceUnavailable)
+		return
+	}
+	code, msg := forwardWrites(req.Context(), addresses, write)
+	if code != http.StatusNoContent {
+		log.Info("remote write was not accepted by Prometheus", "customautoscaling", key.String(), "code", code, "message", msg)
+		http.Error(w, msg, code)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prometheusWebPort is the port Prometheus listens on unless its pod names another
+const prometheusWebPort = 9090
+
+// prometheusPodURLs returns the addresses of the ready pods of the Prometheus
+// of the CR. Each replica keeps its own TSDB, so a write goes to all of them
+func (r *CustomAutoScalingReconciler) prometheusPodURLs(ctx context.Context, instance *autoscaler.CustomAutoScaling) ([]string, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(instance.Namespace), client.MatchingLabels(utils.PrometheusPodLabels(instance))); err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.PodIP == "" || !podReady(pod) {
+			continue
+		}
+		addresses = append(addresses, "http://"+net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(prometheusPort(pod)))))
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// prometheusPort returns the port of the web container port of pod
+func prometheusPort(pod *corev1.Pod) int32 {
+	for _, c := range pod.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.Name == "web" {
+				return port.ContainerPort
+			}
+		}
+	}
+	return prometheusWebPort
+}
+
+// forwardWrites posts write to every address at once and returns the answer
+// of the first address in order that did not store it, a sender retrying
+// after a partial failure rewrites samples the others already hold, which
+// Prometheus accepts as duplicates
+func forwardWrites(ctx context.Context, addresses []string, write *prompb.WriteRequest) (int, string) {
+	codes := make([]int, len(addresses))
+	msgs := make([]string, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			codes[i], msgs[i] = forwardWrite(ctx, address, write)
+		}(i, address)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusNoContent {
+			return code, msgs[i]
+		}
+	}
+	return http.StatusNoContent, ""
+}
+
+// decodeWriteRequest decodes the snappy compressed protobuf of a remote write request
+func decodeWriteRequest(body []byte) (*prompb.WriteRequest, error) {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	write := &prompb.WriteRequest{}
+	if err := proto.Unmarshal(data, write); err != nil {
+		return nil, err
+	}
+	return write, nil
+}
+
+// filterSeries drops the series of write rw does not accept and returns the
+// number of samples kept and dropped. Metadata is dropped as well
+func filterSeries(write *prompb.WriteRequest, rw *autoscaler.RemoteWrite) (accepted, dropped int) {
+	kept := write.Timeseries[:0]
+	for _, ts := range write.Timeseries {
+		if rw.Accepts(seriesName(ts)) {
+			kept = append(kept, ts)
+			accepted += len(ts.Samples)
+			continue
+		}
+		dropped += len(ts.Samples)
+	}
+	write.Timeseries = kept
+	write.Metadata = nil
+	return accepted, dropped
+}
+
+// seriesName returns the metric name of ts
+func seriesName(ts prompb.TimeSeries) string {
+	for _, l := range ts.Labels {
+		if l.Name == labels.MetricName {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// forwardWrite posts write to the remote write receiver of the Prometheus at
+// address and returns the code and message to answer the sender with
+func forwardWrite(ctx context.Context, address string, write *prompb.WriteRequest) (int, string) {
+	data, err := proto.Marshal(write)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to encode remote write request"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteWriteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address+"/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return http.StatusServiceUnavailable, "Prometheus is unavailable: " + err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return http.StatusNoContent, ""
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 4 {
+		return resp.StatusCode, fmt.Sprintf("Prometheus rejected the samples: %s", bytes.TrimSpace(msg))
+	}
+	return http.StatusServiceUnavailable, fmt.Sprintf("Prometheus failed to store the samples: %s", bytes.TrimSpace(msg))
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/externalscaler"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubPrometheus stores the samples written per metric name and answers
+// instant and range queries of a bare metric name with them
+type stubPrometheus struct {
+	mu      sync.Mutex
+	samples map[string]float64
+	history map[string][]prompb.Sample
+	code    int
+}
+
+func (p *stubPrometheus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/api/v1/write":
+		if p.code != 0 {
+			http.Error(w, "out of order sample", p.code)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		write, err := decodeWriteRequest(body)
+		if err != nil || req.Header.Get("Content-Encoding") != "snappy" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, ts := range write.Timeseries {
+			for _, s := range ts.Samples {
+				p.samples[seriesName(ts)] = s.Value
+				if p.history != nil {
+					p.history[seriesName(ts)] = append(p.history[seriesName(ts)], s)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v1/query":
+		_ = req.ParseForm()
+		result := []interface{}{}
+		if v, ok := p.samples[req.Form.Get("query")]; ok {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]string{"__name__": req.Form.Get("query")},
+				"value":  []interface{}{1, fmt.Sprint(v)},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": result},
+		})
+	case "/api/v1/query_range":
+		// every step takes the latest sample at or before it, as Prometheus
+		// looks back for the value of an instant
+		_ = req.ParseForm()
+		start, _ := strconv.ParseFloat(req.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(req.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(req.Form.Get("step"), 64)
+		var values []interface{}
+		for at := start; step > 0 && at <= end; at += step {
+			var latest *prompb.Sample
+			for i, s := range p.history[req.Form.Get("query")] {
+				if float64(s.Timestamp) <= at*1000 && (latest == nil || s.Timestamp > latest.Timestamp) {
+					latest = &p.history[req.Form.Get("query")][i]
+				}
+			}
+			if latest != nil {
+				values = append(values, []interface{}{at, fmt.Sprint(latest.Value)})
+			}
+		}
+		result := []interface{}{}
+		if len(values) > 0 {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]string{"__name__": req.Form.Get("query")},
+				"values": values,
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "matrix", "result": result},
+		})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// encodeWrite returns the remote write request of one sample per metric name
+func encodeWrite(t *testing.T, samples map[string]float64) []byte {
+	t.Helper()
+	write := &prompb.WriteRequest{}
+	for name, v := range samples {
+		write.Timeseries = append(write.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}, {Name: "job", Value: "worker"}},
+			Samples: []prompb.Sample{{Value: v, Timestamp: 1}},
+		})
+	}
+	data, err := proto.Marshal(write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+// prometheusPod returns a Prometheus pod of the CR called cr listening at the
+// address of server
+func prometheusPod(t *testing.T, cr, name string, server *httptest.Server, ready bool) *corev1.Pod {
+	t.Helper()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: utils.PrometheusPodLabels(&autoscaler.CustomAutoScaling{ObjectMeta: metav1.ObjectMeta{Name: cr}})},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "prometheus",
+			Ports: []corev1.ContainerPort{{Name: "web", ContainerPort: int32(port)}},
+		}}},
+		Status: corev1.PodStatus{
+			PodIP:      u.Hostname(),
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	const token = "s3cret"
+	// the Prometheus of web runs two replicas, the one of api must not get its samples
+	proms := []*stubPrometheus{{samples: map[string]float64{}}, {samples: map[string]float64{}}, {samples: map[string]float64{}}, {samples: map[string]float64{}}}
+	servers := make([]*httptest.Server, len(proms))
+	for i, prom := range proms {
+		servers[i] = httptest.NewServer(prom)
+		defer servers[i].Close()
+	}
+	server := servers[0]
+	pods := []*corev1.Pod{
+		prometheusPod(t, "web", "web-prometheus-0", servers[0], true),
+		prometheusPod(t, "web", "web-prometheus-1", servers[1], true),
+		prometheusPod(t, "web", "web-prometheus-2", servers[2], false),
+		prometheusPod(t, "api", "api-prometheus-0", servers[3], true),
+	}
+
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Driver = autoscaler.KEDADriver
+	instance.Spec.Metrics = []autoscaler.Metric{{Name: "queue", Query: "queue_depth", TargetAverageValue: resource.NewQuantity(10, resource.DecimalSI)}}
+	instance.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"queue_depth"}}
+	other := newConflictCR("api", autoscaler.TakeoverNever)
+	secrets := []*corev1.Secret{}
+	for _, name := range []string{"web", "api"} {
+		secrets = append(secrets, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret(name), Namespace: "default"},
+			Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+		})
+	}
+	r := newConflictReconciler(t, instance, other, secrets[0], secrets[1], newHoldDeployment(1), pods[0], pods[1], pods[2], pods[3])
+
+	write := func(name string, body []byte) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, utils.RemoteWritePath("default", name), bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.handleAPI(w, req)
+		return w.Code
+	}
+
+	if code := write("web", encodeWrite(t, map[string]float64{"queue_depth": 45, "go_goroutines": 12})); code != http.StatusNoContent {
+		t.Fatalf("write = %d, want %d", code, http.StatusNoContent)
+	}
+	for i, want := range []float64{45, 45, 0, 0} {
+		if _, ok := proms[i].samples["go_goroutines"]; ok || proms[i].samples["queue_depth"] != want {
+			t.Errorf("Prometheus %s stored %v, want only queue_depth %v", pods[i].Name, proms[i].samples, want)
+		}
+	}
+
+	// KEDA reads the pushed value through the external scaler and runs
+	// ceil(45 / 10) replicas
+	scaler := &externalscaler.Scaler{
+		Client: r.Client,
+		Query: func(ctx context.Context, _ *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+			return utils.QueryInstant(ctx, server.URL, query, metav1.Now().Time)
+		},
+	}
+	ref := &externalscaler.ScaledObjectRef{Name: "web", Namespace: "default", ScalerMetadata: map[string]string{externalscaler.MetadataCustomAutoScaling: "web"}}
+	metrics, err := scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref, MetricName: "queue"})
+	if err != nil || metrics.MetricValues[0].MetricValueFloat != 45 {
+		t.Fatalf("GetMetrics() = %v, %v, want 45", metrics, err)
+	}
+	if active, err := scaler.IsActive(context.Background(), ref); err != nil || !active.Result {
+		t.Errorf("IsActive() = %v, %v, want active", active, err)
+	}
+
+	// a replica failing fails the write, the sender retries it
+	for _, tc := range []struct {
+		name string
+		cr   string
+		body []byte
+		code int
+		prom int
+	}{
+		{name: "not snappy", cr: "web", body: []byte("queue_depth 45"), code: http.StatusBadRequest},
+		{name: "remote write disabled", cr: "api", body: encodeWrite(t, map[string]float64{"queue_depth": 1}), code: http.StatusNotFound},
+		{name: "rejected by Prometheus", cr: "web", body: encodeWrite(t, map[string]float64{"queue_depth": 1}), code: http.StatusBadRequest, prom: http.StatusBadRequest},
+		{name: "Prometheus failing", cr: "web", body: encodeWrite(t, map[string]float64{"queue_depth": 1}), code: http.StatusServiceUnavailable, prom: http.StatusInternalServerError},
+	} {
+		proms[1].mu.Lock()
+		proms[1].code = tc.prom
+		proms[1].mu.Unlock()
+		if code := write(tc.cr, tc.body); code != tc.code {
+			t.Errorf("%s: write = %d, want %d", tc.name, code, tc.code)
+		}
+	}
+	proms[1].code = 0
+
+	server.Close()
+	if code := write("web", encodeWrite(t, map[string]float64{"queue_depth": 1})); code != http.StatusServiceUnavailable {
+		t.Errorf("write with a replica down = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	for _, pod := range pods[:2] {
+		if err := r.Delete(context.Background(), pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := write("web", encodeWrite(t, map[string]float64{"queue_depth": 1})); code != http.StatusServiceUnavailable {
+		t.Errorf("write without a ready replica = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRemoteWriteScales(t *testing.T) {
+	const token = "s3cret"
+	prom := &stubPrometheus{samples: map[string]float64{}, history: map[string][]prompb.Sample{}}
+	server := httptest.NewServer(prom)
+	defer server.Close()
+
+	// the queue depth pushed by the workers is forecast ahead and absorbed at
+	// 10 per replica
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"queue_depth"}}
+	instance.Spec.Predictive = &autoscaler.PredictiveScaling{
+		Query:                 "queue_depth",
+		Model:                 autoscaler.HoltWintersModel,
+		Lookback:              metav1.Duration{Duration: time.Hour},
+		Step:                  metav1.Duration{Duration: 5 * time.Minute},
+		Season:                metav1.Duration{Duration: 10 * time.Minute},
+		LeadTime:              metav1.Duration{Duration: 10 * time.Minute},
+		TargetValuePerReplica: "10",
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret("web"), Namespace: "default"},
+		Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+	}
+	deployment := newHoldDeployment(1)
+	r := newConflictReconciler(t, instance, secret, deployment, prometheusPod(t, "web", "web-prometheus-0", server, true))
+	r.PrometheusURL = func(*autoscaler.CustomAutoScaling) string { return server.URL }
+
+	// an hour of samples, one a minute, as a remote write sender batches them
+	write := &prompb.WriteRequest{}
+	ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "queue_depth"}}}
+	now := time.Now()
+	for at := now.Add(-time.Hour); !at.After(now); at = at.Add(time.Minute) {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: 45, Timestamp: at.UnixMilli()})
+	}
+	write.Timeseries = append(write.Timeseries, ts)
+	data, err := proto.Marshal(write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, utils.RemoteWritePath("default", "web"), bytes.NewReader(snappy.Encode(nil, data)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.handleAPI(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("write = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+
+	if err := r.reconcilePredictive(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	if got := replicasOf(t, r, deployment); got != 5 {
+		t.Errorf("replicas = %d, want ceil(45 / 10)", got)
+	}
+	if events := scalingEvents(t, r); len(events) != 1 || events[0].Spec.Trigger.Type != autoscaler.ForecastTrigger {
+		t.Errorf("scaling events = %+v, want one for the forecast", events)
+	}
+}
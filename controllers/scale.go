@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// scaleTarget runs desired through the bounds and behavior of the CR and then
+// either updates the target deployment or, in Recommend mode, records a
+// decision changing the replicas in status and an event. Every decision is
+// kept in status.lastDecision and the desired replicas gauge. A paused,
+// frozen or overridden CR only records that the decision was held. Decisions
+// that change the replicas are also recorded as a ScalingEvent for trigger
+func (r *CustomAutoScalingReconciler) scaleTarget(ctx context.Context, instance *autoscaler.CustomAutoScaling, desired int32,
+	trigger autoscaler.ScalingTrigger, reason string) (scaling.Decision, error) {
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.Target.Name, Namespace: instance.Namespace}, deployment); err != nil {
+		return scaling.Decision{}, err
+	}
+
+	current := int32(1)
+	if deployment.Spec.Replicas != nil {
+		current = *deployment.Spec.Replicas
+	}
+
+	currentReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(float64(current))
+
+	now := time.Now()
+	if hold := scaling.HoldFor(instance, now); hold != nil {
+		decision := scaling.Decision{Current: current, Desired: desired, Replicas: current, Limited: hold.Reason}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "ScalingHeld", "not scaling %s for %s while %s", deployment.Name, reason, hold)
+		recordDecision(instance, decision, reason, now, false)
+		return decision, r.Status().Update(ctx, instance)
+	}
+
+	recommend := instance.Spec.Mode == autoscaler.RecommendMode
+	decision := scaling.Decide(&instance.Spec, current, desired, lastScaleTime(instance), now)
+	desiredReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(float64(decision.Replicas))
+
+	if decision.Clamped != "" {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "ReplicasClamped", "desired replicas %d clamped to %d by %s (%s)",
+			decision.Desired, decision.Replicas, decision.Clamped, reason)
+	}
+	if decision.Limited != "" {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "ScalingLimited", "scaling of %s held at %d by %s (%s)",
+			deployment.Name, decision.Replicas, decision.Limited, reason)
+	}
+
+	if recommend {
+		recordDecision(instance, decision, reason, now, false)
+		// only a recommended change counts as a scale for the cooldown, as
+		// decisions that keep the replicas do not restart it in Enforce mode
+		if decision.Changed() {
+			instance.Status.Recommendation = &autoscaler.Recommendation{
+				Time:            metav1.NewTime(now),
+				CurrentReplicas: current,
+				DesiredReplicas: decision.Replicas,
+				Reason:          reason,
+			}
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Recommendation", "recommend %s scaling of %s: %s (%s)",
+				decision.Direction(), deployment.Name, decision, reason)
+			r.recordScalingEvent(ctx, instance, decision, trigger, reason, autoscaler.OutcomeRecommended, "", now)
+		}
+		return decision, r.Status().Update(ctx, instance)
+	}
+
+	if !decision.Changed() {
+		recordDecision(instance, decision, reason, now, false)
+		return decision, r.Status().Update(ctx, instance)
+	}
+	if conflicted(instance) {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ScalingRefused", "not scaling %s from %d to %d while another scaler targets it (%s)",
+			deployment.Name, current, decision.Replicas, reason)
+		recordDecision(instance, decision, reason, now, false)
+		r.recordScalingEvent(ctx, instance, decision, trigger, reason, autoscaler.OutcomeRefused, "", now)
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return decision, err
+		}
+		return decision, errScalingConflict
+	}
+
+	deployment.Spec.Replicas = &decision.Replicas
+	if err := r.Update(ctx, deployment); err != nil {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ScaleFailed", "failed to scale %s from %d to %d: %s", deployment.Name, current, decision.Replicas, err)
+		r.recordScalingEvent(ctx, instance, decision, trigger, reason, autoscaler.OutcomeFailed, err.Error(), now)
+		return decision, err
+	}
+	event := "ScaledUp"
+	if decision.Direction() == "down" {
+		event = "ScaledDown"
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, event, "scaled %s from %d to %d (%s)", deployment.Name, current, decision.Replicas, reason)
+	scaleEvents.WithLabelValues(instance.Namespace, instance.Name, decision.Direction()).Inc()
+	currentReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(float64(decision.Replicas))
+
+	instance.Status.Replicas = decision.Replicas
+	instance.Status.LastScaleTime = &metav1.Time{Time: now}
+	recordDecision(instance, decision, reason, now, true)
+	r.recordScalingEvent(ctx, instance, decision, trigger, reason, autoscaler.OutcomeApplied, "", now)
+	return decision, r.Status().Update(ctx, instance)
+}
+
+// recordDecision keeps decision in status so it can be explained later
+func recordDecision(instance *autoscaler.CustomAutoScaling, decision scaling.Decision, reason string, now time.Time, applied bool) {
+	instance.Status.LastDecision = &autoscaler.DecisionStatus{
+		Time:            metav1.NewTime(now),
+		CurrentReplicas: decision.Current,
+		DesiredReplicas: decision.Desired,
+		Replicas:        decision.Replicas,
+		Reason:          reason,
+		Clamped:         decision.Clamped,
+		Limited:         decision.Limited,
+		Applied:         applied,
+	}
+}
+
+// observeTarget exports the replica count of the target deployment
+func (r *CustomAutoScalingReconciler) observeTarget(ctx context.Context, instance *autoscaler.CustomAutoScaling) {
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.Target.Name, Namespace: instance.Namespace}, deployment); err != nil {
+		return
+	}
+	if deployment.Spec.Replicas != nil {
+		currentReplicas.WithLabelValues(instance.Namespace, instance.Name).Set(float64(*deployment.Spec.Replicas))
+	}
+}
+
+// lastScaleTime is when the CR last scaled its target, or last recommended
+// changing its replicas in recommend mode. Decisions that kept the replicas
+// are only in status.lastDecision and do not count
+func lastScaleTime(instance *autoscaler.CustomAutoScaling) time.Time {
+	if instance.Spec.Mode == autoscaler.RecommendMode {
+		if instance.Status.Recommendation != nil {
+			return instance.Status.Recommendation.Time.Time
+		}
+		return time.Time{}
+	}
+	if instance.Status.LastScaleTime != nil {
+		return instance.Status.LastScaleTime.Time
+	}
+	return time.Time{}
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// elapse moves the scale and recommendation times of instance d into the past
+func elapse(instance *autoscaler.CustomAutoScaling, d time.Duration) {
+	if t := instance.Status.LastScaleTime; t != nil {
+		t.Time = t.Add(-d)
+	}
+	if rec := instance.Status.Recommendation; rec != nil {
+		rec.Time = metav1.NewTime(rec.Time.Add(-d))
+	}
+}
+
+func TestRecommendCooldownMatchesEnforce(t *testing.T) {
+	steps := []struct {
+		after   time.Duration
+		desired int32
+		changed bool
+		limited string
+	}{
+		{desired: 5, changed: true},
+		// within the cooldown of the first change
+		{after: time.Minute, desired: 8, limited: "scaleUp.cooldown"},
+		// the held decision above does not restart the cooldown
+		{after: 4*time.Minute + 30*time.Second, desired: 8, changed: true},
+	}
+
+	for _, mode := range []autoscaler.ScalingMode{autoscaler.EnforceMode, autoscaler.RecommendMode} {
+		t.Run(string(mode), func(t *testing.T) {
+			ctx := context.Background()
+			instance := newConflictCR("web", autoscaler.TakeoverNever)
+			instance.Spec.Mode = mode
+			instance.Spec.Behavior = &autoscaler.ScalingBehavior{
+				ScaleUp: &autoscaler.ScalingRules{Cooldown: &metav1.Duration{Duration: 5 * time.Minute}},
+			}
+			deployment := newHoldDeployment(2)
+			r := newProvisionReconciler(t, instance, deployment)
+
+			recommendations := 0
+			for i, step := range steps {
+				elapse(instance, step.after)
+				decision, err := r.scaleTarget(ctx, instance, step.desired, testTrigger, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decision.Changed() != step.changed || decision.Limited != step.limited {
+					t.Errorf("step %d: decision = %+v, want changed %v limited %q", i, decision, step.changed, step.limited)
+				}
+				for _, event := range recordedEvents(r) {
+					if strings.HasPrefix(event, "Normal Recommendation ") {
+						recommendations++
+					}
+				}
+			}
+
+			want := 0
+			if mode == autoscaler.RecommendMode {
+				want = 2
+				if rec := instance.Status.Recommendation; rec == nil || rec.DesiredReplicas != 8 {
+					t.Errorf("status.recommendation = %+v, want 8 replicas", rec)
+				}
+			}
+			if recommendations != want {
+				t.Errorf("%d Recommendation events, want %d", recommendations, want)
+			}
+		})
+	}
+}
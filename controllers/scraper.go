@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/evaluator"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// scrapeTimeout bounds the scrape of a single target
+const scrapeTimeout = 10 * time.Second
+
+// Health of a scrape target
+const (
+	targetUp   = "up"
+	targetDown = "down"
+)
+
+// ScrapeTarget is an endpoint scraped for a CR in embedded mode
+type ScrapeTarget struct {
+	// Instance is the host and port of the endpoint
+	Instance string
+	// URL the metrics are read from
+	URL string
+	// Pod is the name of the scraped pod, empty when the service is scraped
+	Pod string
+	// Health is up or down after the last scrape
+	Health string
+	// LastError is why the last scrape failed
+	LastError string
+}
+
+// scrapeState is what the Scraper keeps for a CR
+type scrapeState struct {
+	store   *evaluator.Store
+	last    time.Time
+	targets []ScrapeTarget
+}
+
+// Scraper scrapes the targets of the CRs in embedded mode and keeps their
+// samples for the evaluator, it is added to the manager as a Runnable
+type Scraper struct {
+	Client     client.Reader
+	HTTPClient *http.Client
+
+	// Tick is how often the CRs are checked for a due scrape
+	Tick time.Duration
+
+	mu     sync.Mutex
+	states map[types.NamespacedName]*scrapeState
+}
+
+// NewScraper returns a Scraper reading CRs and their targets through cl
+func NewScraper(cl client.Reader) *Scraper {
+	return &Scraper{
+		Client:     cl,
+		HTTPClient: &http.Client{Timeout: scrapeTimeout},
+		Tick:       time.Second,
+	}
+}
+
+// Start scrapes the CRs in embedded mode until ctx is cancelled
+func (s *Scraper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.Tick)
+	defer ticker.Stop()
+	for {
+		if err := s.scrapeDue(ctx, time.Now()); err != nil {
+			log.Error(err, "failed to list the CRs to scrape")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection lets every replica scrape, the evaluator serves the
+// external metrics API and the external scaler of the replica it runs in
+func (s *Scraper) NeedLeaderElection() bool {
+	return false
+}
+
+// scrapeDue scrapes the CRs whose interval has passed at now and forgets
+// the CRs that are gone or left embedded mode
+func (s *Scraper) scrapeDue(ctx context.Context, now time.Time) error {
+	list := &autoscaler.CustomAutoScalingList{}
+	if err := s.Client.List(ctx, list); err != nil {
+		return err
+	}
+
+	embedded := map[types.NamespacedName]bool{}
+	var wg sync.WaitGroup
+	for i := range list.Items {
+		cr := &list.Items[i]
+		if cr.Spec.Monitoring.Embedded == nil || cr.GetDeletionTimestamp() != nil {
+			continue
+		}
+		key := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+		embedded[key] = true
+		if !s.due(key, cr.Spec.Monitoring.Embedded.ScrapeInterval(), now) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.scrape(ctx, cr, now); err != nil {
+				log.Error(err, "failed to find the targets to scrape", "customautoscaling", key.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.states {
+		if !embedded[key] {
+			delete(s.states, key)
+		}
+	}
+	return nil
+}
+
+// due reports whether the CR key is to be scraped at now
+func (s *Scraper) due(key types.NamespacedName, interval time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[key]
+	return !ok || now.Sub(state.last) >= interval
+}
+
+// scrape reads the metrics of every target of cr and appends them to its
+// window. A target failing to answer is reported down, its series go stale
+func (s *Scraper) scrape(ctx context.Context, cr *autoscaler.CustomAutoScaling, now time.Time) error {
+	key := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	targets, err := s.targets(ctx, cr)
+	if err != nil {
+		return err
+	}
+
+	samples := make([][]evaluator.Sample, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := &targets[i]
+			lbls := targetLabels(cr, *target)
+			scraped, err := s.scrapeTarget(ctx, target.URL, lbls)
+			up := 1.0
+			target.Health = targetUp
+			if err != nil {
+				up, target.Health, target.LastError = 0, targetDown, err.Error()
+			}
+			embeddedScrapes.WithLabelValues(cr.Namespace, cr.Name, target.Health).Inc()
+			samples[i] = append(scraped, evaluator.Sample{
+				Labels: labels.NewBuilder(lbls).Set(labels.MetricName, "up").Labels(nil),
+				Value:  up,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = map[types.NamespacedName]*scrapeState{}
+	}
+	state, ok := s.states[key]
+	if !ok {
+		state = &scrapeState{store: evaluator.NewStore(cr.Spec.Monitoring.Embedded.WindowDuration())}
+		s.states[key] = state
+	}
+	state.store.SetWindow(cr.Spec.Monitoring.Embedded.WindowDuration())
+	var all []evaluator.Sample
+	for _, scraped := range samples {
+		all = append(all, scraped...)
+	}
+	state.store.Append(now, all)
+	state.last, state.targets = now, targets
+	return nil
+}
+
+// scrapeTarget reads the metrics served at url
+func (s *Scraper) scrapeTarget(ctx context.Context, url string, target labels.Labels) ([]evaluator.Sample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", evaluator.AcceptHeader)
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return evaluator.ParseText(resp.Body, target)
+}
+
+// targets returns the endpoints to scrape for cr, the ready pods of the
+// deployment or its service
+func (s *Scraper) targets(ctx context.Context, cr *autoscaler.CustomAutoScaling) ([]ScrapeTarget, error) {
+	e := cr.Spec.Monitoring.Embedded
+	port := strconv.Itoa(int(cr.Spec.Target.Port))
+	if e.Source == autoscaler.ServiceSource {
+		service := cr.Spec.Target.Service
+		if service == "" {
+			service = cr.Spec.Target.Name
+		}
+		host := net.JoinHostPort(fmt.Sprintf("%s.%s.svc", service, cr.Namespace), port)
+		return []ScrapeTarget{{Instance: host, URL: "http://" + host + e.MetricsPath()}}, nil
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.Target.Name}, deployment); err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	pods := &corev1.PodList{}
+	if err := s.Client.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	var targets []ScrapeTarget
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !podReady(&pod) {
+			continue
+		}
+		host := net.JoinHostPort(pod.Status.PodIP, port)
+		targets = append(targets, ScrapeTarget{Instance: host, URL: "http://" + host + e.MetricsPath(), Pod: pod.Name})
+	}
+	return targets, nil
+}
+
+// targetLabels returns the labels added to the samples scraped from target,
+// named like the ones a ServiceMonitor adds
+func targetLabels(cr *autoscaler.CustomAutoScaling, target ScrapeTarget) labels.Labels {
+	b := labels.NewBuilder(nil).
+		Set("namespace", cr.Namespace).
+		Set("job", cr.Spec.Target.Name).
+		Set(model.InstanceLabel, target.Instance)
+	if target.Pod != "" {
+		b.Set("pod", target.Pod)
+	}
+	return b.Labels(nil)
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Query evaluates query over the samples scraped for cr
+func (s *Scraper) Query(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+	expr, err := evaluator.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	state, ok := s.states[types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("customautoscaling %s/%s has not been scraped yet", cr.Namespace, cr.Name)
+	}
+	return expr.Eval(state.store, time.Now()), nil
+}
+
+// QueryOr returns a query function evaluating the queries of the CRs in
+// embedded mode with the Scraper and the queries of the other CRs with next
+func (s *Scraper) QueryOr(next func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error)) func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+	return func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+		if cr.Spec.Monitoring.Embedded != nil {
+			return s.Query(ctx, cr, query)
+		}
+		return next(ctx, cr, query)
+	}
+}
+
+// Targets returns the targets of the latest scrape of the CR key, ok is
+// false while it has not been scraped
+func (s *Scraper) Targets(key types.NamespacedName) (targets []ScrapeTarget, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]ScrapeTarget(nil), state.targets...), true
+}
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/receiver"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// handleWebhook scales the CRs named by the signals decoded from the request,
+// the payload format is chosen by the path below /webhook or the content type.
+// Every format carries the signals token of the CR its signals name
+func (r *CustomAutoScalingReconciler) handleWebhook(w http.ResponseWriter, req *http.Request) {
+	r.receive(w, req, strings.Trim(strings.TrimPrefix(req.URL.Path, "/webhook"), "/"), nil)
+}
+
+// handleAPI serves the API of a single CR below
+// /v1/namespaces/{namespace}/customautoscalings/{name}:
+//
+//	GET  {name}            the status of the CR
+//	GET  {name}/decisions  the ScalingEvents of the CR, newest first, at most ?limit
+//	POST {name}/signals    signals in any receiver format, chosen by ?format or the content type
+//	POST {name}/write      Prometheus remote write requests for the Prometheus of the CR
+//
+// Every request carries the token of the signals token Secret of the CR as a bearer token
+func (r *CustomAutoScalingReconciler) handleAPI(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 5 || len(parts) > 6 || parts[0] != "v1" || parts[1] != "namespaces" || parts[3] != "customautoscalings" {
+		http.NotFound(w, req)
+		return
+	}
+	key := types.NamespacedName{Namespace: parts[2], Name: parts[4]}
+	resource := ""
+	if len(parts) == 6 {
+		resource = parts[5]
+	}
+
+	method := http.MethodGet
+	switch resource {
+	case "", "decisions":
+	case "signals", "write":
+		method = http.MethodPost
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req, key) {
+		unauthorized(w)
+		return
+	}
+
+	switch resource {
+	case "":
+		r.serveStatus(w, req, key)
+	case "decisions":
+		r.serveDecisions(w, req, key)
+	case "signals":
+		r.receive(w, req, req.URL.Query().Get("format"), &key)
+	case "write":
+		r.serveWrite(w, req, key)
+	}
+}
+
+// authorized reports whether req carries the signals token of the CR
+func (r *CustomAutoScalingReconciler) authorized(req *http.Request, key types.NamespacedName) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(req.Context(), types.NamespacedName{Namespace: key.Namespace, Name: utils.SignalsTokenSecret(key.Name)}, secret); err != nil {
+		return false
+	}
+	token := secret.Data[utils.SignalsTokenKey]
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), token) == 1
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="customautoscaling"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// StatusResponse is returned by GET on a CR
+type StatusResponse struct {
+	Namespace string                             `json:"namespace"`
+	Name      string                             `json:"name"`
+	Status    autoscaler.CustomAutoScalingStatus `json:"status"`
+}
+
+// DecisionsResponse is returned by GET on the decisions of a CR
+type DecisionsResponse struct {
+	Items []autoscaler.ScalingEventSpec `json:"items"`
+}
+
+func (r *CustomAutoScalingReconciler) serveStatus(w http.ResponseWriter, req *http.Request, key types.NamespacedName) {
+	instance := &autoscaler.CustomAutoScaling{}
+	if err := r.Get(req.Context(), key, instance); err != nil {
+		apiError(w, key, err)
+		return
+	}
+	writeJSON(w, StatusResponse{Namespace: instance.Namespace, Name: instance.Name, Status: instance.Status})
+}
+
+func (r *CustomAutoScalingReconciler) serveDecisions(w http.ResponseWriter, req *http.Request, key types.NamespacedName) {
+	limit := -1
+	if value := req.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a number of at least 0", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events := &autoscaler.ScalingEventList{}
+	if err := r.List(req.Context(), events, client.InNamespace(key.Namespace),
+		client.MatchingLabels{autoscaler.CustomAutoScalingLabel: key.Name}); err != nil {
+		apiError(w, key, err)
+		return
+	}
+	newestFirst(events.Items)
+	if limit >= 0 && len(events.Items) > limit {
+		events.Items = events.Items[:limit]
+	}
+
+	resp := DecisionsResponse{Items: []autoscaler.ScalingEventSpec{}}
+	for _, e := range events.Items {
+		resp.Items = append(resp.Items, e.Spec)
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err, "failed to write API response")
+	}
+}
+
+func apiError(w http.ResponseWriter, key types.NamespacedName, err error) {
+	if apierrors.IsNotFound(err) {
+		http.Error(w, "customautoscaling "+key.String()+" not found", http.StatusNotFound)
+		return
+	}
+	log.Error(err, "failed to serve API request", "customautoscaling", key.String())
+	http.Error(w, "Failed to retrieve customautoscaling "+key.String(), http.StatusInternalServerError)
+}
+
+// receive decodes the signals of req with the decoder called format and scales
+// the CRs they name. Signals posted for a single CR, key, may leave it out
+func (r *CustomAutoScalingReconciler) receive(rw http.ResponseWriter, req *http.Request, format string, key *types.NamespacedName) {
+	w := &statusRecorder{ResponseWriter: rw, code: http.StatusOK}
+	reqLogger := log.WithValues("webhook", req.URL.Path, "remote", req.RemoteAddr)
+	var severity string
+	defer func() {
+		webhookRequests.WithLabelValues(strconv.Itoa(w.code), severity).Inc()
+	}()
+
+	decoder, err := receiver.Select(format, req.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		webhookShed.WithLabelValues(shedBodySize).Inc()
+		http.Error(w, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to read webhook body")
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+
+	signals, err := decoder.Decode(req.Header, body)
+	if err == nil {
+		err = addressSignals(signals, key)
+	}
+	if err != nil {
+		// a payload that cannot be decoded cannot be attributed to a CR either
+		reqLogger.Error(err, "rejected webhook payload")
+		http.Error(w, "Failed to decode payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the endpoint of a CR authorized the request before it was read
+	if key == nil {
+		for _, s := range signals {
+			if !r.authorized(req, types.NamespacedName{Namespace: s.Namespace, Name: s.Name}) {
+				reqLogger.Info("rejected webhook payload without the signals token of its customautoscaling", "customautoscaling", s.Namespace+"/"+s.Name)
+				unauthorized(w)
+				return
+			}
+		}
+	}
+	if len(signals) > 0 {
+		severity = severityLabel(signals[0].Severity)
+	}
+	if retry := r.limiter.reserveSignals(signals); retry > 0 {
+		reqLogger.Info("shed signals of a customautoscaling over its rate limit", "retryAfter", retry)
+		shed(w, shedCR, retry)
+		return
+	}
+
+	for _, s := range signals {
+		if s.Resolved {
+			continue
+		}
+		if code, msg := r.actOnSignal(req.Context(), s); code != http.StatusOK {
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	// Return success response
+	w.WriteHeader(http.StatusOK)
+}
+
+// addressSignals fills in key on signals that do not name their CR, without a
+// key every signal has to name one. A signal naming another CR than key is rejected
+func addressSignals(signals []receiver.Signal, key *types.NamespacedName) error {
+	for i := range signals {
+		s := &signals[i]
+		if key == nil {
+			if s.Namespace == "" || s.Name == "" {
+				return fmt.Errorf("signal does not name a customautoscaling with its namespace, post it to %s",
+					utils.SignalsPath("{namespace}", "{name}"))
+			}
+			continue
+		}
+		if (s.Name != "" && s.Name != key.Name) || (s.Namespace != "" && s.Namespace != key.Namespace) {
+			return fmt.Errorf("signal for customautoscaling %s/%s posted to %s", s.Namespace, s.Name, key)
+		}
+		s.Namespace, s.Name = key.Namespace, key.Name
+	}
+	return nil
+}
+
+// actOnSignal scales the CR named by s and returns the response code and
+// message to fail the request with, http.StatusOK when it succeeded
+func (r *CustomAutoScalingReconciler) actOnSignal(ctx context.Context, s receiver.Signal) (int, string) {
+	instance := &autoscaler.CustomAutoScaling{}
+	key := types.NamespacedName{Name: s.Name, Namespace: s.Namespace}
+	if err := r.Get(ctx, key, instance); err != nil {
+		log.Error(err, "rejected signal for unknown customautoscaling", "alertname", s.Alert, "source", s.Source, "customautoscaling", key.String())
+		return http.StatusNotFound, "Failed to retrieve customautoscaling " + key.String()
+	}
+
+	// an HPA scales CRs using the other drivers, their alerts are left over from the Alerts driver
+	if !usesAlerts(instance) {
+		log.Info("ignored signal for customautoscaling using the "+string(instance.Spec.Driver)+" driver", "customautoscaling", key.String())
+		return http.StatusOK, ""
+	}
+
+	desiredReplicas, trigger, reason := signalDecision(instance, s)
+	if s.Alert != "" {
+		instance.Status.LastAlert = &autoscaler.AlertStatus{Name: s.Alert, Severity: s.Severity, Time: metav1.Now()}
+	}
+	decision, err := r.scaleTarget(ctx, instance, desiredReplicas, trigger, reason)
+	if errors.Is(err, errScalingConflict) {
+		log.Info("ignored signal for conflicted target", "customautoscaling", key.String())
+		return http.StatusConflict, "Target is managed by another scaler"
+	}
+	if err != nil {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "WebhookRejected", "failed to act on %s: %s", reason, err)
+		log.Error(err, "failed to scale deployment", "customautoscaling", key.String())
+		return http.StatusInternalServerError, "Failed to scale deployment"
+	}
+
+	if decision.Changed() && instance.Spec.Mode != autoscaler.RecommendMode && !s.StartsAt.IsZero() {
+		decisionLatency.WithLabelValues(instance.Namespace, instance.Name).Observe(time.Since(s.StartsAt).Seconds())
+	}
+	return http.StatusOK, ""
+}
+
+// signalDecision returns the replicas a signal asks the CR for, the trigger
+// recorded with the decision and its reason. An explicit replica count is
+// bounded by the minReplicas and maxReplicas of the CR
+func signalDecision(instance *autoscaler.CustomAutoScaling, s receiver.Signal) (int32, autoscaler.ScalingTrigger, string) {
+	trigger := autoscaler.ScalingTrigger{
+		Type:        autoscaler.RequestTrigger,
+		Source:      s.Source,
+		Alert:       s.Alert,
+		Severity:    s.Severity,
+		Fingerprint: s.Fingerprint,
+		Value:       s.Value,
+	}
+	if s.Alert != "" {
+		trigger.Type = autoscaler.AlertTrigger
+	}
+
+	if s.Replicas != nil {
+		// a decoded count is bounded before anything acts on it
+		replicas, clamped := scaling.Bound(&instance.Spec, *s.Replicas)
+		reason := fmt.Sprintf("request for %d replicas from %s", *s.Replicas, s.Source)
+		if s.Alert != "" {
+			reason = fmt.Sprintf("alert %s with severity %q for %d replicas", s.Alert, s.Severity, *s.Replicas)
+		}
+		if clamped != "" {
+			reason += fmt.Sprintf(", bounded to %d by %s", replicas, clamped)
+		}
+		return replicas, trigger, reason
+	}
+	replicas := scaling.ReplicasForSeverity(&instance.Spec, s.Severity)
+	if s.Alert == "" {
+		return replicas, trigger, fmt.Sprintf("request with severity %q from %s", s.Severity, s.Source)
+	}
+	return replicas, trigger, fmt.Sprintf("alert %s with severity %q", s.Alert, s.Severity)
+}
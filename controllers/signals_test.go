@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWebhookFormats(t *testing.T) {
+	const token = "s3cret"
+	for _, tc := range []struct {
+		name     string
+		path     string
+		auth     string
+		header   http.Header
+		body     string
+		max      int32
+		code     int
+		replicas int32
+		trigger  autoscaler.TriggerType
+	}{
+		{
+			name: "alertmanager",
+			path: "/webhook",
+			auth: token,
+			body: `{"alerts": [{"status": "firing", "fingerprint": "f1", "labels": {"alertname": "load", "severity": "critical",
+				"customautoscaling": "web", "customautoscaling_namespace": "default"}}]}`,
+			code:     http.StatusOK,
+			replicas: 5,
+			trigger:  autoscaler.AlertTrigger,
+		},
+		{
+			name: "alertmanager without token",
+			path: "/webhook",
+			body: `{"alerts": [{"status": "firing", "fingerprint": "f1", "labels": {"alertname": "load", "severity": "critical",
+				"customautoscaling": "web", "customautoscaling_namespace": "default"}, "annotations": {"replicas": "500"}}]}`,
+			code:     http.StatusUnauthorized,
+			replicas: 2,
+		},
+		{
+			name:     "plain",
+			path:     "/webhook/plain",
+			auth:     token,
+			body:     `{"target": "default/web", "replicas": 4}`,
+			code:     http.StatusOK,
+			replicas: 4,
+			trigger:  autoscaler.RequestTrigger,
+		},
+		{
+			name:     "cloudevents",
+			path:     "/webhook",
+			auth:     token,
+			header:   http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"1"}, "Ce-Source": {"ci"}, "Ce-Type": {"prescale"}, "Ce-Subject": {"default/web"}},
+			body:     `{"severity": "warning"}`,
+			code:     http.StatusOK,
+			replicas: 3,
+			trigger:  autoscaler.RequestTrigger,
+		},
+		{
+			name:     "replicas beyond the maximum",
+			path:     "/webhook/plain",
+			auth:     token,
+			body:     `{"target": "default/web", "replicas": 500}`,
+			max:      8,
+			code:     http.StatusOK,
+			replicas: 8,
+			trigger:  autoscaler.RequestTrigger,
+		},
+		{name: "plain without token", path: "/webhook/plain", body: `{"target": "default/web", "replicas": 4}`, code: http.StatusUnauthorized, replicas: 2},
+		{name: "plain with wrong token", path: "/webhook/plain", auth: "guess", body: `{"target": "default/web", "replicas": 4}`, code: http.StatusUnauthorized, replicas: 2},
+		{
+			name:     "cloudevents without token",
+			path:     "/webhook",
+			header:   http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"1"}, "Ce-Source": {"ci"}, "Ce-Type": {"prescale"}, "Ce-Subject": {"default/web"}},
+			body:     `{"severity": "warning"}`,
+			code:     http.StatusUnauthorized,
+			replicas: 2,
+		},
+		{name: "unknown format", path: "/webhook/opsgenie", body: `{}`, code: http.StatusNotFound, replicas: 2},
+		{name: "invalid payload", path: "/webhook/plain", auth: token, body: `{"target": "default/web"}`, code: http.StatusBadRequest, replicas: 2},
+		{name: "token of another CR", path: "/webhook/plain", auth: token, body: `{"target": "default/api", "replicas": 4}`, code: http.StatusUnauthorized, replicas: 2},
+		{name: "no CR", path: "/webhook/plain", auth: token, body: `{"replicas": 4}`, code: http.StatusBadRequest, replicas: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			instance := newConflictCR("web", autoscaler.TakeoverNever)
+			if tc.max > 0 {
+				instance.Spec.MaxReplicas = &tc.max
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret("web"), Namespace: "default"},
+				Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+			}
+			deployment := newHoldDeployment(2)
+			r := newConflictReconciler(t, instance, secret, deployment)
+
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			if tc.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.auth)
+			}
+			for key, values := range tc.header {
+				req.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			r.handleWebhook(w, req)
+
+			if w.Code != tc.code {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tc.code, w.Body)
+			}
+			if got := replicasOf(t, r, deployment); got != tc.replicas {
+				t.Errorf("deployment has %d replicas, want %d", got, tc.replicas)
+			}
+			if tc.trigger == "" {
+				return
+			}
+			events := scalingEvents(t, r)
+			if len(events) != 1 || events[0].Spec.Trigger.Type != tc.trigger {
+				t.Errorf("scaling events = %+v, want one with a %s trigger", events, tc.trigger)
+			}
+		})
+	}
+}
+
+func TestAPI(t *testing.T) {
+	const token = "s3cret"
+	instance := newConflictCR("web", autoscaler.TakeoverNever)
+	instance.Status.Replicas = 2
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: utils.SignalsTokenSecret("web"), Namespace: "default"},
+		Data:       map[string][]byte{utils.SignalsTokenKey: []byte(token)},
+	}
+	deployment := newHoldDeployment(2)
+	r := newConflictReconciler(t, instance, secret, deployment)
+
+	do := func(method, path, auth, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		r.handleAPI(w, req)
+		return w
+	}
+	base := "/v1/namespaces/default/customautoscalings/web"
+
+	for _, tc := range []struct {
+		name, method, path, auth string
+		code                     int
+	}{
+		{"no token", http.MethodGet, base, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, base, "guess", http.StatusUnauthorized},
+		{"token of another CR", http.MethodGet, "/v1/namespaces/default/customautoscalings/api", token, http.StatusUnauthorized},
+		{"unknown resource", http.MethodGet, base + "/pods", token, http.StatusNotFound},
+		{"short path", http.MethodGet, "/v1/namespaces/default", token, http.StatusNotFound},
+		{"GET signals", http.MethodGet, base + "/signals", token, http.StatusMethodNotAllowed},
+		{"POST status", http.MethodPost, base, token, http.StatusMethodNotAllowed},
+		{"bad limit", http.MethodGet, base + "/decisions?limit=x", token, http.StatusBadRequest},
+	} {
+		if w := do(tc.method, tc.path, tc.auth, ""); w.Code != tc.code {
+			t.Errorf("%s: code = %d, want %d", tc.name, w.Code, tc.code)
+		}
+	}
+
+	w := do(http.MethodGet, base, token, "")
+	status := StatusResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != http.StatusOK || status.Name != "web" || status.Status.Replicas != 2 {
+		t.Errorf("GET %s = %d %s", base, w.Code, w.Body)
+	}
+
+	// the endpoint names the CR, the payload does not have to
+	if w := do(http.MethodPost, base+"/signals?format=plain", token, `{"replicas": 4}`); w.Code != http.StatusOK {
+		t.Fatalf("POST signals = %d %s", w.Code, w.Body)
+	}
+	if got := replicasOf(t, r, deployment); got != 4 {
+		t.Errorf("deployment has %d replicas, want 4", got)
+	}
+	if w := do(http.MethodPost, base+"/signals?format=plain", token, `{"target": "default/api", "replicas": 4}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST signals for another CR = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	alert := `{"alerts": [{"status": "firing", "labels": {"alertname": "load", "severity": "critical"}}]}`
+	if w := do(http.MethodPost, base+"/signals", token, alert); w.Code != http.StatusOK {
+		t.Fatalf("POST alertmanager signals = %d %s", w.Code, w.Body)
+	}
+
+	w = do(http.MethodGet, base+"/decisions?limit=1", token, "")
+	decisions := DecisionsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &decisions); err != nil || len(decisions.Items) != 1 {
+		t.Fatalf("GET decisions = %d %s", w.Code, w.Body)
+	}
+	if d := decisions.Items[0]; d.NewReplicas != 5 || d.Trigger.Type != autoscaler.AlertTrigger {
+		t.Errorf("latest decision = %+v, want the alert scaling to 5", d)
+	}
+}
@@ -0,0 +1,150 @@
+package evaluator
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// scrape appends the text exposition body of each pod to s at t
+func scrape(t *testing.T, s *Store, at time.Time, pods map[string]string) {
+	t.Helper()
+	var samples []Sample
+	for pod, body := range pods {
+		got, err := ParseText(strings.NewReader(body), labels.FromStrings("pod", pod))
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, got...)
+	}
+	s.Append(at, samples)
+}
+
+func TestParse(t *testing.T) {
+	for _, query := range []string{
+		`sum(rate(http_requests_total{code!~"5.."}[1m]))`,
+		`avg by (pod) (max_over_time(queue_depth[2m])) > 10`,
+		`sum(queue_depth) / count(up == 1)`,
+		`-increase(jobs_total[5m]) + 3`,
+	} {
+		if _, err := Parse(query); err != nil {
+			t.Errorf("Parse(%q) = %v", query, err)
+		}
+	}
+
+	for query, want := range map[string]string{
+		`histogram_quantile(0.9, rate(x_bucket[1m]))`: "function histogram_quantile is not supported",
+		`topk(3, x)`:     "aggregation topk is not supported",
+		`rate(x[5m:1m])`: "subqueries are not supported",
+		`x offset 5m`:    "offset and @ modifiers are not supported",
+		`x and y`:        "operator and is not supported",
+		`x > bool 1`:     "the bool modifier is not supported",
+		`x / on(pod) y`:  "on, ignoring, group_left and group_right are not supported",
+		`x[5m]`:          "range selector x[5m] is only supported",
+		`sum(rate(`:      "unclosed left parenthesis",
+	} {
+		if _, err := Parse(query); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) = %v, want %q", query, err, want)
+		}
+	}
+
+	e, _ := Parse(`rate(x[1m]) + avg_over_time(y[3m])`)
+	if e.Range() != 3*time.Minute {
+		t.Errorf("Range() = %s, want 3m", e.Range())
+	}
+}
+
+func TestEval(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := NewStore(2 * time.Minute)
+	for i := 0; i <= 4; i++ {
+		scrape(t, s, start.Add(time.Duration(i)*15*time.Second), map[string]string{
+			"web-a": "# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} " + strconv.Itoa(100+30*i) + "\nqueue_depth " + strconv.Itoa(10+i) + "\n",
+			"web-b": "# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} " + strconv.Itoa(60*i) + "\nqueue_depth " + strconv.Itoa(20-i) + "\n",
+		})
+	}
+	now := start.Add(time.Minute)
+
+	for query, want := range map[string][]float64{
+		`sum(rate(http_requests_total[1m]))`:                  {6},
+		`rate(http_requests_total{pod="web-a"}[1m])`:          {2},
+		`increase(http_requests_total{pod="web-b"}[1m])`:      {180},
+		`avg(queue_depth)`:                                    {15},
+		`max(max_over_time(queue_depth[1m]))`:                 {19},
+		`sum by (pod) (queue_depth)`:                          {14, 16},
+		`queue_depth > 15`:                                    {16},
+		`sum(queue_depth) / count(queue_depth)`:               {15},
+		`queue_depth{pod="web-a"} - queue_depth{pod="web-a"}`: {0},
+		`sum(queue_depth) * 2`:                                {60},
+		`2 + 3`:                                               {5},
+		`missing_metric`:                                      nil,
+	} {
+		e, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", query, err)
+		}
+		got := e.Eval(s, now)
+		if len(got) != len(want) {
+			t.Errorf("Eval(%q) = %v, want %v", query, got, want)
+			continue
+		}
+		for i, sample := range got {
+			if float64(sample.Value) != want[i] {
+				t.Errorf("Eval(%q) = %v, want %v", query, got, want)
+			}
+		}
+	}
+
+	// web-b goes away, it is stale at once and its points leave the window
+	scrape(t, s, now.Add(15*time.Second), map[string]string{"web-a": "queue_depth 15\n"})
+	e, _ := Parse(`count(queue_depth)`)
+	if got := e.Eval(s, now.Add(15*time.Second)); len(got) != 1 || got[0].Value != 1 {
+		t.Errorf("count after web-b went away = %v, want 1", got)
+	}
+	scrape(t, s, now.Add(3*time.Minute), map[string]string{"web-a": "queue_depth 15\n"})
+	if s.Len() != 1 {
+		t.Errorf("Len() = %d after the window passed, want 1", s.Len())
+	}
+}
+
+func TestParseText(t *testing.T) {
+	body := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 3
+latency_seconds_bucket{le="1"} 5
+latency_seconds_sum 1.5
+latency_seconds_count 6
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2
+rpc_seconds_sum 4
+rpc_seconds_count 20
+# TYPE up gauge
+up{pod="spoofed"} 1
+`
+	samples, err := ParseText(strings.NewReader(body), labels.FromStrings("pod", "web-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, s := range samples {
+		got[s.Labels.String()] = s.Value
+	}
+	for series, want := range map[string]float64{
+		`{__name__="latency_seconds_bucket", le="0.1", pod="web-a"}`:  3,
+		`{__name__="latency_seconds_bucket", le="+Inf", pod="web-a"}`: 6,
+		`{__name__="latency_seconds_count", pod="web-a"}`:             6,
+		`{__name__="rpc_seconds", pod="web-a", quantile="0.5"}`:       0.2,
+		`{__name__="rpc_seconds_sum", pod="web-a"}`:                   4,
+		`{__name__="up", pod="web-a"}`:                                1,
+	} {
+		if v, ok := got[series]; !ok || v != want {
+			t.Errorf("%s = %v, %v, want %v in %v", series, v, ok, want, got)
+		}
+	}
+
+	if _, err := ParseText(strings.NewReader("not a metric line {"), nil); err == nil {
+		t.Error("ParseText() of a broken scrape succeeded")
+	}
+}
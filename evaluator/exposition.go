@@ -0,0 +1,78 @@
+package evaluator
+
+import (
+	"io"
+	"math"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// AcceptHeader asks a scraped endpoint for the text exposition format
+const AcceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// ParseText parses a scrape in the text exposition format into samples.
+// Histograms and summaries are split into the series Prometheus stores for
+// them. The labels of target are added to every sample and replace the
+// scraped labels of the same name
+func ParseText(r io.Reader, target labels.Labels) ([]Sample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	add := func(name string, m *dto.Metric, v float64, extra ...string) {
+		b := labels.NewBuilder(nil).Set(labels.MetricName, name)
+		for _, l := range m.GetLabel() {
+			b.Set(l.GetName(), l.GetValue())
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			b.Set(extra[i], extra[i+1])
+		}
+		target.Range(func(l labels.Label) { b.Set(l.Name, l.Value) })
+		samples = append(samples, Sample{Labels: b.Labels(nil), Value: v})
+	}
+
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, m.GetSummary().GetSampleSum())
+				add(name+"_count", m, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !inf {
+					add(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			default:
+				add(name, m, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return samples, nil
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
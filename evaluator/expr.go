@@ -0,0 +1,374 @@
+// Package evaluator evaluates the queries of CustomAutoScalings in the
+// operator, over samples it scraped itself instead of a Prometheus. It
+// supports the subset of PromQL needed to scale on: selectors, rate,
+// increase and the _over_time functions on a range, sum, avg, min, max and
+// count aggregations and arithmetic and comparisons between the results
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// rangeFunctions are the functions over the points of a range selector
+var rangeFunctions = map[string]func(points []Point) (float64, bool){
+	"rate":          rate,
+	"increase":      increase,
+	"avg_over_time": func(points []Point) (float64, bool) { return sum(points) / float64(len(points)), true },
+	"sum_over_time": func(points []Point) (float64, bool) { return sum(points), true },
+	"max_over_time": func(points []Point) (float64, bool) { return extreme(points, math.Max), true },
+	"min_over_time": func(points []Point) (float64, bool) { return extreme(points, math.Min), true },
+}
+
+// aggregations are the aggregation operators over the samples of a group
+var aggregations = map[parser.ItemType]func(values []float64) float64{
+	parser.SUM: func(values []float64) float64 {
+		var s float64
+		for _, v := range values {
+			s += v
+		}
+		return s
+	},
+	parser.AVG: func(values []float64) float64 {
+		var s float64
+		for _, v := range values {
+			s += v
+		}
+		return s / float64(len(values))
+	},
+	parser.MAX:   func(values []float64) float64 { return reduce(values, math.Max) },
+	parser.MIN:   func(values []float64) float64 { return reduce(values, math.Min) },
+	parser.COUNT: func(values []float64) float64 { return float64(len(values)) },
+}
+
+// Expr is a parsed query the evaluator supports
+type Expr struct {
+	root  parser.Expr
+	rng   time.Duration
+	query string
+}
+
+// Parse parses query and fails when it uses PromQL the evaluator does not support
+func Parse(query string) (*Expr, error) {
+	root, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	e := &Expr{root: root, query: query}
+	if err := e.check(root); err != nil {
+		return nil, err
+	}
+	if root.Type() != parser.ValueTypeVector && root.Type() != parser.ValueTypeScalar {
+		return nil, fmt.Errorf("the query has to return a vector or a scalar, not a %s", root.Type())
+	}
+	return e, nil
+}
+
+// Range returns the longest range selected by the query, the window of
+// samples kept has to cover it
+func (e *Expr) Range() time.Duration {
+	return e.rng
+}
+
+// String returns the query as it was parsed
+func (e *Expr) String() string {
+	return e.query
+}
+
+// check walks node and records the longest range selected
+func (e *Expr) check(node parser.Expr) error {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		return nil
+	case *parser.ParenExpr:
+		return e.check(n.Expr)
+	case *parser.UnaryExpr:
+		return e.check(n.Expr)
+	case *parser.VectorSelector:
+		if n.OriginalOffset != 0 || n.Timestamp != nil || n.StartOrEnd != 0 {
+			return errors.New("offset and @ modifiers are not supported")
+		}
+		return nil
+	case *parser.MatrixSelector:
+		return fmt.Errorf("range selector %s is only supported as the argument of %s", n, strings.Join(functionNames(), ", "))
+	case *parser.Call:
+		if _, ok := rangeFunctions[n.Func.Name]; !ok {
+			return fmt.Errorf("function %s is not supported, use one of %s", n.Func.Name, strings.Join(functionNames(), ", "))
+		}
+		m, ok := n.Args[0].(*parser.MatrixSelector)
+		if !ok {
+			return errors.New("subqueries are not supported")
+		}
+		if m.Range > e.rng {
+			e.rng = m.Range
+		}
+		return e.check(m.VectorSelector)
+	case *parser.AggregateExpr:
+		if _, ok := aggregations[n.Op]; !ok {
+			return fmt.Errorf("aggregation %s is not supported, use one of sum, avg, min, max or count", n.Op)
+		}
+		return e.check(n.Expr)
+	case *parser.BinaryExpr:
+		switch {
+		case n.Op.IsSetOperator():
+			return fmt.Errorf("operator %s is not supported", n.Op)
+		case n.ReturnBool:
+			return errors.New("the bool modifier is not supported")
+		case n.VectorMatching != nil && (n.VectorMatching.Card != parser.CardOneToOne || len(n.VectorMatching.MatchingLabels) > 0):
+			return errors.New("on, ignoring, group_left and group_right are not supported")
+		case n.Op == parser.POW || n.Op == parser.MOD || n.Op == parser.ATAN2:
+			return fmt.Errorf("operator %s is not supported", n.Op)
+		}
+		if err := e.check(n.LHS); err != nil {
+			return err
+		}
+		return e.check(n.RHS)
+	case *parser.SubqueryExpr:
+		return errors.New("subqueries are not supported")
+	default:
+		return fmt.Errorf("%s is not supported", node)
+	}
+}
+
+// functionNames returns the supported functions in a stable order
+func functionNames() []string {
+	names := make([]string, 0, len(rangeFunctions))
+	for name := range rangeFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// result is the value of a node, a scalar is a single sample without labels
+type result struct {
+	scalar  bool
+	samples []Sample
+}
+
+// Eval evaluates the query at now over the points of s. A scalar result is
+// returned as a single sample without labels
+func (e *Expr) Eval(s *Store, now time.Time) model.Vector {
+	s.mu.RLock()
+	res := eval(e.root, s, now)
+	s.mu.RUnlock()
+
+	sort.Slice(res.samples, func(i, j int) bool { return labels.Compare(res.samples[i].Labels, res.samples[j].Labels) < 0 })
+	vector := make(model.Vector, 0, len(res.samples))
+	for _, sample := range res.samples {
+		metric := model.Metric{}
+		sample.Labels.Range(func(l labels.Label) { metric[model.LabelName(l.Name)] = model.LabelValue(l.Value) })
+		vector = append(vector, &model.Sample{Metric: metric, Value: model.SampleValue(sample.Value), Timestamp: model.TimeFromUnixNano(now.UnixNano())})
+	}
+	return vector
+}
+
+func eval(node parser.Expr, s *Store, now time.Time) result {
+	switch n := node.(type) {
+	case *parser.NumberLiteral:
+		return result{scalar: true, samples: []Sample{{Value: n.Val}}}
+	case *parser.ParenExpr:
+		return eval(n.Expr, s, now)
+	case *parser.UnaryExpr:
+		res := eval(n.Expr, s, now)
+		if n.Op == parser.SUB {
+			for i := range res.samples {
+				res.samples[i] = Sample{Labels: dropName(res.samples[i].Labels), Value: -res.samples[i].Value}
+			}
+		}
+		return res
+	case *parser.VectorSelector:
+		return result{samples: s.latest(n.LabelMatchers)}
+	case *parser.Call:
+		m := n.Args[0].(*parser.MatrixSelector)
+		f := rangeFunctions[n.Func.Name]
+		res := result{}
+		s.between(m.VectorSelector.(*parser.VectorSelector).LabelMatchers, now.Add(-m.Range), now, func(lbls labels.Labels, points []Point) {
+			if v, ok := f(points); ok {
+				res.samples = append(res.samples, Sample{Labels: dropName(lbls), Value: v})
+			}
+		})
+		return res
+	case *parser.AggregateExpr:
+		return aggregate(n, eval(n.Expr, s, now))
+	case *parser.BinaryExpr:
+		return binary(n.Op, eval(n.LHS, s, now), eval(n.RHS, s, now))
+	}
+	return result{}
+}
+
+// aggregate groups the samples of res by the grouping labels of n
+func aggregate(n *parser.AggregateExpr, res result) result {
+	f := aggregations[n.Op]
+	var keys []uint64
+	groups := map[uint64]labels.Labels{}
+	values := map[uint64][]float64{}
+	for _, sample := range res.samples {
+		b := labels.NewBuilder(sample.Labels)
+		if n.Without {
+			b.Del(append(n.Grouping, labels.MetricName)...)
+		} else {
+			b.Keep(n.Grouping...)
+		}
+		lbls := b.Labels(nil)
+		h := lbls.Hash()
+		if _, ok := groups[h]; !ok {
+			keys = append(keys, h)
+			groups[h] = lbls
+		}
+		values[h] = append(values[h], sample.Value)
+	}
+
+	out := result{}
+	for _, h := range keys {
+		out.samples = append(out.samples, Sample{Labels: groups[h], Value: f(values[h])})
+	}
+	return out
+}
+
+// binary applies op between lhs and rhs. Arithmetic drops the metric name,
+// comparisons keep the samples of the vector side that pass
+func binary(op parser.ItemType, lhs, rhs result) result {
+	switch {
+	case lhs.scalar && rhs.scalar:
+		v, _ := apply(op, lhs.samples[0].Value, rhs.samples[0].Value)
+		return result{scalar: true, samples: []Sample{{Value: v}}}
+	case rhs.scalar:
+		return result{samples: applyScalar(op, lhs.samples, func(v float64) (float64, bool) { return apply(op, v, rhs.samples[0].Value) })}
+	case lhs.scalar:
+		return result{samples: applyScalar(op, rhs.samples, func(v float64) (float64, bool) { return apply(op, lhs.samples[0].Value, v) })}
+	}
+
+	// one to one matching on the labels without the metric name
+	right := map[uint64]float64{}
+	for _, sample := range rhs.samples {
+		right[dropName(sample.Labels).Hash()] = sample.Value
+	}
+	out := result{}
+	for _, sample := range lhs.samples {
+		lbls := dropName(sample.Labels)
+		r, ok := right[lbls.Hash()]
+		if !ok {
+			continue
+		}
+		v, keep := apply(op, sample.Value, r)
+		if !keep {
+			continue
+		}
+		if op.IsComparisonOperator() {
+			out.samples = append(out.samples, sample)
+			continue
+		}
+		out.samples = append(out.samples, Sample{Labels: lbls, Value: v})
+	}
+	return out
+}
+
+// applyScalar applies f to every sample of a vector operand
+func applyScalar(op parser.ItemType, samples []Sample, f func(v float64) (float64, bool)) []Sample {
+	var out []Sample
+	for _, sample := range samples {
+		v, keep := f(sample.Value)
+		switch {
+		case !keep:
+		case op.IsComparisonOperator():
+			out = append(out, sample)
+		default:
+			out = append(out, Sample{Labels: dropName(sample.Labels), Value: v})
+		}
+	}
+	return out
+}
+
+// apply returns the result of op on l and r, keep is false for a comparison that does not hold
+func apply(op parser.ItemType, l, r float64) (v float64, keep bool) {
+	switch op {
+	case parser.ADD:
+		return l + r, true
+	case parser.SUB:
+		return l - r, true
+	case parser.MUL:
+		return l * r, true
+	case parser.DIV:
+		return l / r, true
+	case parser.EQLC:
+		return l, l == r
+	case parser.NEQ:
+		return l, l != r
+	case parser.GTR:
+		return l, l > r
+	case parser.LSS:
+		return l, l < r
+	case parser.GTE:
+		return l, l >= r
+	case parser.LTE:
+		return l, l <= r
+	}
+	return math.NaN(), false
+}
+
+// increase returns the growth of a counter over points, without the
+// extrapolation to the edges of the range Prometheus does. A drop is a reset
+func increase(points []Point) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	var inc float64
+	for i := 1; i < len(points); i++ {
+		if d := points[i].V - points[i-1].V; d >= 0 {
+			inc += d
+		} else {
+			inc += points[i].V
+		}
+	}
+	return inc, true
+}
+
+// rate returns the per second increase of a counter over points
+func rate(points []Point) (float64, bool) {
+	inc, ok := increase(points)
+	if !ok {
+		return 0, false
+	}
+	elapsed := points[len(points)-1].T.Sub(points[0].T).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return inc / elapsed, true
+}
+
+func sum(points []Point) float64 {
+	var s float64
+	for _, p := range points {
+		s += p.V
+	}
+	return s
+}
+
+func extreme(points []Point, f func(a, b float64) float64) float64 {
+	v := points[0].V
+	for _, p := range points[1:] {
+		v = f(v, p.V)
+	}
+	return v
+}
+
+func reduce(values []float64, f func(a, b float64) float64) float64 {
+	v := values[0]
+	for _, x := range values[1:] {
+		v = f(v, x)
+	}
+	return v
+}
+
+func dropName(lbls labels.Labels) labels.Labels {
+	return labels.NewBuilder(lbls).Del(labels.MetricName).Labels(nil)
+}
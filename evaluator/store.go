@@ -0,0 +1,125 @@
+package evaluator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Sample is a value of a series, scraped or computed by a query
+type Sample struct {
+	Labels labels.Labels
+	Value  float64
+}
+
+// Point is a value of a series at a point in time
+type Point struct {
+	T time.Time
+	V float64
+}
+
+// series is a stored series, its points are in time order
+type series struct {
+	labels labels.Labels
+	points []Point
+}
+
+// Store keeps the points of the last window of every scraped series. A
+// series missing from the latest scrape is stale, instant selectors no
+// longer return it while its points are still read by range selectors
+type Store struct {
+	mu     sync.RWMutex
+	window time.Duration
+	last   time.Time
+	series map[uint64]*series
+}
+
+// NewStore returns a Store keeping window of points
+func NewStore(window time.Duration) *Store {
+	return &Store{window: window, series: map[uint64]*series{}}
+}
+
+// SetWindow changes how long points are kept, it applies from the next Append
+func (s *Store) SetWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window = window
+}
+
+// Append records the samples of a scrape made at t and drops the points
+// that fell out of the window
+func (s *Store) Append(t time.Time, samples []Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sample := range samples {
+		h := sample.Labels.Hash()
+		ser, ok := s.series[h]
+		if !ok {
+			ser = &series{labels: sample.Labels}
+			s.series[h] = ser
+		}
+		ser.points = append(ser.points, Point{T: t, V: sample.Value})
+	}
+	s.last = t
+
+	oldest := t.Add(-s.window)
+	for h, ser := range s.series {
+		i := 0
+		for i < len(ser.points) && !ser.points[i].T.After(oldest) {
+			i++
+		}
+		if i == len(ser.points) {
+			delete(s.series, h)
+			continue
+		}
+		ser.points = ser.points[i:]
+	}
+}
+
+// Len returns the number of series in the window
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.series)
+}
+
+// latest returns the value in the latest scrape of every series matching matchers
+func (s *Store) latest(matchers []*labels.Matcher) []Sample {
+	var samples []Sample
+	for _, ser := range s.series {
+		last := ser.points[len(ser.points)-1]
+		if last.T.Equal(s.last) && matches(ser.labels, matchers) {
+			samples = append(samples, Sample{Labels: ser.labels, Value: last.V})
+		}
+	}
+	return samples
+}
+
+// between calls f with the points in (start, end] of every series matching matchers
+func (s *Store) between(matchers []*labels.Matcher, start, end time.Time, f func(lbls labels.Labels, points []Point)) {
+	for _, ser := range s.series {
+		if !matches(ser.labels, matchers) {
+			continue
+		}
+		var points []Point
+		for _, p := range ser.points {
+			if p.T.After(start) && !p.T.After(end) {
+				points = append(points, p)
+			}
+		}
+		if len(points) > 0 {
+			f(ser.labels, points)
+		}
+	}
+}
+
+func matches(lbls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
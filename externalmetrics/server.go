@@ -0,0 +1,373 @@
+// Package externalmetrics serves the external.metrics.k8s.io API for the
+// CustomAutoScalings using the HPA driver. Every metric of such a CR is the
+// current value of its PromQL query against the Prometheus provisioned for it,
+// read from the recorded series when the metric has a recording.
+//
+// Only what the HPA controller uses is implemented: discovery of the group
+// version and reading the values of a metric in a namespace. Requests are
+// only served to the aggregator, which presents the front-proxy client
+// certificate published in the extension-apiserver-authentication ConfigMap.
+// The CA in that ConfigMap is reloaded every ClientCAReload, so a rotated
+// front-proxy CA is picked up without restarting the operator.
+package externalmetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("external_metrics")
+
+// apiPrefix is the path the aggregator proxies the group version under
+var apiPrefix = "/apis/" + externalmetrics.SchemeGroupVersion.String()
+
+// QueryFunc evaluates a PromQL query against the Prometheus of a CR
+type QueryFunc func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error)
+
+// The ConfigMap the kube-apiserver publishes the client CA of the aggregator in
+const (
+	authenticationNamespace = "kube-system"
+	authenticationConfigMap = "extension-apiserver-authentication"
+	// clientCAKey holds the PEM bundle the front-proxy client certificate is signed by
+	clientCAKey = "requestheader-client-ca-file"
+	// allowedNamesKey holds the JSON list of common names the front-proxy
+	// client certificate may have, any name is allowed when it is empty
+	allowedNamesKey = "requestheader-allowed-names"
+)
+
+// DefaultClientCAReload is how often the client CA of the aggregator is reloaded
+const DefaultClientCAReload = time.Minute
+
+// Server is the external metrics API server, it is added to the manager as a Runnable
+type Server struct {
+	Client client.Reader
+	// APIReader reads the extension-apiserver-authentication ConfigMap, it
+	// is not cached so the operator does not watch every ConfigMap
+	APIReader client.Reader
+	Query     QueryFunc
+
+	// Addr is the address the HTTPS server listens on
+	Addr string
+	// CertDir holds tls.crt and tls.key, the webhook serving certificate is reused
+	CertDir string
+	// ClientCAReload is how often the client CA is reloaded, zero loads it once
+	ClientCAReload time.Duration
+
+	// clientCAs and allowedNames verify the client certificate of the
+	// aggregator, they are loaded by Start and nothing is served without them
+	mu           sync.RWMutex
+	clientCAs    *x509.CertPool
+	allowedNames []string
+}
+
+// NewServer returns a Server reading CRs through cl and querying their Prometheus
+func NewServer(cl, apiReader client.Reader, addr, certDir string) *Server {
+	return &Server{
+		Client:    cl,
+		APIReader: apiReader,
+		Addr:      addr,
+		CertDir:   certDir,
+		// the kube-apiserver republishes the ConfigMap when the front-proxy CA rotates
+		ClientCAReload: DefaultClientCAReload,
+		Query: func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+			return utils.QueryInstant(ctx, utils.PrometheusURL(cr), query, time.Now())
+		},
+	}
+}
+
+// Start serves the API until ctx is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+	if err != nil {
+		return err
+	}
+	if err := s.loadClientCA(ctx); err != nil {
+		return err
+	}
+	go s.reloadClientCA(ctx)
+
+	// the client certificate is verified by ServeHTTP, which answers an
+	// unauthenticated request with a Status instead of failing the handshake
+	server := &http.Server{
+		Addr:    s.Addr,
+		Handler: s,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error(err, "failed to shut down the external metrics server")
+		}
+	}()
+
+	log.Info("serving external metrics", "addr", s.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection lets every replica serve, the API is read only
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// loadClientCA reads the client CA and allowed names of the aggregator from
+// the extension-apiserver-authentication ConfigMap
+func (s *Server) loadClientCA(ctx context.Context) error {
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{Namespace: authenticationNamespace, Name: authenticationConfigMap}
+	if err := s.APIReader.Get(ctx, key, cm); err != nil {
+		return fmt.Errorf("reading the client CA of the aggregator: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(cm.Data[clientCAKey])) {
+		return fmt.Errorf("configmap %s has no certificate in %s, the kube-apiserver runs without --requestheader-client-ca-file", key, clientCAKey)
+	}
+	var names []string
+	if raw := cm.Data[allowedNamesKey]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &names); err != nil {
+			return fmt.Errorf("configmap %s has an invalid %s: %w", key, allowedNamesKey, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientCAs, s.allowedNames = pool, names
+	return nil
+}
+
+// reloadClientCA reloads the client CA every ClientCAReload until ctx is
+// cancelled. A ConfigMap that cannot be read or parsed keeps the previous CA
+func (s *Server) reloadClientCA(ctx context.Context) {
+	if s.ClientCAReload <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ClientCAReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.loadClientCA(ctx); err != nil {
+			log.Error(err, "failed to reload the client CA of the aggregator, keeping the previous one")
+		}
+	}
+}
+
+// authenticate verifies that req comes from the aggregator, its client
+// certificate is signed by the front-proxy CA and has an allowed common name
+func (s *Server) authenticate(req *http.Request) error {
+	s.mu.RLock()
+	clientCAs, allowedNames := s.clientCAs, s.allowedNames
+	s.mu.RUnlock()
+	if clientCAs == nil {
+		return errors.New("the client CA of the aggregator is not loaded")
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return errors.New("a front-proxy client certificate is required")
+	}
+	leaf := req.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("verifying the client certificate: %w", err)
+	}
+	if len(allowedNames) == 0 {
+		return nil
+	}
+	for _, name := range allowedNames {
+		if leaf.Subject.CommonName == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %q is not an allowed front-proxy name", leaf.Subject.CommonName)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := s.authenticate(req); err != nil {
+		writeError(w, apierrors.NewUnauthorized(err.Error()))
+		return
+	}
+	if req.Method != http.MethodGet {
+		writeError(w, apierrors.NewMethodNotSupported(externalmetrics.Resource("*"), req.Method))
+		return
+	}
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if path == apiPrefix {
+		s.serveDiscovery(w, req)
+		return
+	}
+
+	// namespaces/<namespace>/<metric>
+	parts := strings.Split(strings.TrimPrefix(path, apiPrefix+"/"), "/")
+	if !strings.HasPrefix(path, apiPrefix+"/") || len(parts) != 3 || parts[0] != "namespaces" {
+		writeError(w, apierrors.NewNotFound(externalmetrics.Resource("*"), path))
+		return
+	}
+	s.serveMetric(w, req, parts[1], parts[2])
+}
+
+// serveDiscovery lists the metrics of every CR using the HPA driver
+func (s *Server) serveDiscovery(w http.ResponseWriter, req *http.Request) {
+	list := &autoscaler.CustomAutoScalingList{}
+	if err := s.Client.List(req.Context(), list); err != nil {
+		writeError(w, apierrors.NewInternalError(err))
+		return
+	}
+
+	names := map[string]bool{}
+	for _, cr := range list.Items {
+		if cr.Spec.Driver != autoscaler.HPADriver {
+			continue
+		}
+		for _, m := range cr.Spec.Metrics {
+			names[m.Name] = true
+		}
+	}
+
+	resources := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: externalmetrics.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{},
+	}
+	for name := range names {
+		resources.APIResources = append(resources.APIResources, metav1.APIResource{
+			Name:       name,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      metav1.Verbs{"get"},
+		})
+	}
+	sort.Slice(resources.APIResources, func(i, j int) bool {
+		return resources.APIResources[i].Name < resources.APIResources[j].Name
+	})
+	writeJSON(w, http.StatusOK, resources)
+}
+
+// serveMetric answers with one value per series returned by the query of the
+// metric, the CR is picked by the HPASelectorLabel of the label selector
+func (s *Server) serveMetric(w http.ResponseWriter, req *http.Request, namespace, metricName string) {
+	selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	name, ok := selector.RequiresExactMatch(utils.HPASelectorLabel)
+	if !ok {
+		writeError(w, apierrors.NewBadRequest("labelSelector must select a CustomAutoScaling with "+utils.HPASelectorLabel+"=<name>"))
+		return
+	}
+
+	cr := &autoscaler.CustomAutoScaling{}
+	if err := s.Client.Get(req.Context(), types.NamespacedName{Namespace: namespace, Name: name}, cr); err != nil {
+		writeError(w, err)
+		return
+	}
+	metric, ok := findMetric(cr, metricName)
+	if !ok {
+		writeError(w, apierrors.NewNotFound(externalmetrics.Resource(metricName), namespace+"/"+name))
+		return
+	}
+
+	vector, err := s.Query(req.Context(), cr, cr.Query(metric))
+	if err != nil {
+		log.Error(err, "failed to evaluate metric", "customautoscaling", namespace+"/"+name, "metric", metric.Name)
+		writeError(w, apierrors.NewServiceUnavailable(err.Error()))
+		return
+	}
+
+	values := &externalmetrics.ExternalMetricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: externalmetrics.SchemeGroupVersion.String()},
+		Items:    []externalmetrics.ExternalMetricValue{},
+	}
+	for _, sample := range vector {
+		value := float64(sample.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		metricLabels := map[string]string{}
+		for k, v := range sample.Metric {
+			metricLabels[string(k)] = string(v)
+		}
+		values.Items = append(values.Items, externalmetrics.ExternalMetricValue{
+			MetricName:   metricName,
+			MetricLabels: metricLabels,
+			Timestamp:    metav1.NewTime(sample.Timestamp.Time()),
+			Value:        *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI),
+		})
+	}
+	writeJSON(w, http.StatusOK, values)
+}
+
+// findMetric looks the metric up by name, the HPA controller may lowercase it
+func findMetric(cr *autoscaler.CustomAutoScaling, name string) (autoscaler.Metric, bool) {
+	if cr.Spec.Driver != autoscaler.HPADriver {
+		return autoscaler.Metric{}, false
+	}
+	for _, m := range cr.Spec.Metrics {
+		if strings.EqualFold(m.Name, name) {
+			return m, true
+		}
+	}
+	return autoscaler.Metric{}, false
+}
+
+// writeError answers with the Status of err, errors that are not API errors become internal errors
+func writeError(w http.ResponseWriter, err error) {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		status = apierrors.NewInternalError(err)
+	}
+	body := status.Status()
+	body.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(body.Code), &body)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err, "failed to write response")
+	}
+}
@@ -0,0 +1,316 @@
+package externalmetrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testPKI is a front-proxy CA with the client certificate the aggregator
+// presents and one signed by another CA
+type testPKI struct {
+	caPEM      []byte
+	frontProxy *x509.Certificate
+	stranger   *x509.Certificate
+	wrongName  *x509.Certificate
+}
+
+var (
+	pkiOnce sync.Once
+	pki     testPKI
+)
+
+// newTestPKI returns the certificates of the tests, generated once
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	pkiOnce.Do(func() {
+		ca, caKey := newCertificate(t, "front-proxy-ca", nil, nil)
+		other, otherKey := newCertificate(t, "other-ca", nil, nil)
+		pki.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		pki.frontProxy, _ = newCertificate(t, "front-proxy-client", ca, caKey)
+		pki.stranger, _ = newCertificate(t, "front-proxy-client", other, otherKey)
+		pki.wrongName, _ = newCertificate(t, "system:anonymous", ca, caKey)
+	})
+	return pki
+}
+
+// newCertificate returns a CA certificate called cn without a parent, or a
+// client certificate signed by parent
+func newCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newTestServer(t *testing.T, query QueryFunc) *Server {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := autoscaler.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:  autoscaler.HPADriver,
+				Metrics: []autoscaler.Metric{{Name: "requests", Query: "sum by (pod) (rate(http_requests_total[1m]))"}},
+			},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:  autoscaler.AlertsDriver,
+				Metrics: []autoscaler.Metric{{Name: "latency", Query: "up == 0"}},
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: authenticationConfigMap, Namespace: authenticationNamespace},
+			Data: map[string]string{
+				clientCAKey:     string(newTestPKI(t).caPEM),
+				allowedNamesKey: `["front-proxy-client"]`,
+			},
+		},
+	).Build()
+
+	s := &Server{Client: cl, APIReader: cl, Query: query}
+	if err := s.loadClientCA(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func get(t *testing.T, s *Server, path, selector string, v interface{}) int {
+	t.Helper()
+
+	target := path
+	if selector != "" {
+		target += "?labelSelector=" + url.QueryEscape(selector)
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newTestPKI(t).frontProxy}}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestDiscovery(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	resources := &metav1.APIResourceList{}
+	if code := get(t, s, apiPrefix, "", resources); code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if resources.GroupVersion != externalmetrics.SchemeGroupVersion.String() {
+		t.Errorf("groupVersion = %s", resources.GroupVersion)
+	}
+	if len(resources.APIResources) != 1 || resources.APIResources[0].Name != "requests" {
+		t.Errorf("resources = %+v, want only the metric of the HPA driven CR", resources.APIResources)
+	}
+}
+
+func TestMetricValues(t *testing.T) {
+	s := newTestServer(t, func(_ context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+		if cr.Name != "web" || query != cr.Spec.Metrics[0].Query {
+			t.Errorf("query %q for %s", query, cr.Name)
+		}
+		return model.Vector{
+			{Metric: model.Metric{"pod": "web-1"}, Value: 12.5},
+			{Metric: model.Metric{"pod": "web-2"}, Value: model.SampleValue(0.25)},
+		}, nil
+	})
+
+	values := &externalmetrics.ExternalMetricValueList{}
+	code := get(t, s, apiPrefix+"/namespaces/default/Requests", utils.HPASelectorLabel+"=web", values)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if len(values.Items) != 2 {
+		t.Fatalf("items = %+v", values.Items)
+	}
+	if got := values.Items[0]; got.Value.MilliValue() != 12500 || got.MetricLabels["pod"] != "web-1" || got.MetricName != "Requests" {
+		t.Errorf("first item = %+v", got)
+	}
+	if got := values.Items[1].Value.MilliValue(); got != 250 {
+		t.Errorf("second value = %dm, want 250m", got)
+	}
+}
+
+func TestMetricErrors(t *testing.T) {
+	s := newTestServer(t, func(context.Context, *autoscaler.CustomAutoScaling, string) (model.Vector, error) {
+		return nil, errors.New("prometheus is down")
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		selector string
+		code     int
+	}{
+		{name: "no selector", path: "/namespaces/default/requests", code: http.StatusBadRequest},
+		{name: "unknown CR", path: "/namespaces/default/requests", selector: utils.HPASelectorLabel + "=missing", code: http.StatusNotFound},
+		{name: "alerts driver", path: "/namespaces/default/latency", selector: utils.HPASelectorLabel + "=api", code: http.StatusNotFound},
+		{name: "unknown metric", path: "/namespaces/default/errors", selector: utils.HPASelectorLabel + "=web", code: http.StatusNotFound},
+		{name: "query failure", path: "/namespaces/default/requests", selector: utils.HPASelectorLabel + "=web", code: http.StatusServiceUnavailable},
+		{name: "unknown path", path: "/requests", code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &metav1.Status{}
+			if code := get(t, s, apiPrefix+tt.path, tt.selector, status); code != tt.code || int(status.Code) != tt.code {
+				t.Errorf("status = %d (%+v), want %d", code, status, tt.code)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer(t, nil)
+	pki := newTestPKI(t)
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		code  int
+	}{
+		{name: "front-proxy client", certs: []*x509.Certificate{pki.frontProxy}, code: http.StatusOK},
+		{name: "no client certificate", code: http.StatusUnauthorized},
+		{name: "signed by another CA", certs: []*x509.Certificate{pki.stranger}, code: http.StatusUnauthorized},
+		{name: "name not allowed", certs: []*x509.Certificate{pki.wrongName}, code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, apiPrefix, nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: tt.certs}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+		})
+	}
+
+	// plain HTTP and a server that failed to load the CA serve nothing
+	rec := httptest.NewRecorder()
+	(&Server{Client: s.Client}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, apiPrefix, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without a client CA = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestClientCAReload(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.ClientCAReload = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.reloadClientCA(ctx)
+
+	status := func(cert *x509.Certificate) int {
+		req := httptest.NewRequest(http.MethodGet, apiPrefix, nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// waitFor polls until cert is answered with code, the reload is asynchronous
+	waitFor := func(cert *x509.Certificate, code int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); status(cert) != code; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("status = %d, want %d after the reload", status(cert), code)
+			}
+		}
+	}
+	publish := func(data map[string]string) {
+		t.Helper()
+		cm := &corev1.ConfigMap{}
+		if err := s.APIReader.Get(ctx, types.NamespacedName{Namespace: authenticationNamespace, Name: authenticationConfigMap}, cm); err != nil {
+			t.Fatal(err)
+		}
+		cm.Data = data
+		if err := s.Client.(client.Client).Update(ctx, cm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the front-proxy CA is rotated
+	ca, caKey := newCertificate(t, "front-proxy-ca-2", nil, nil)
+	rotated, _ := newCertificate(t, "front-proxy-client", ca, caKey)
+	if code := status(rotated); code != http.StatusUnauthorized {
+		t.Fatalf("status of the rotated certificate before the reload = %d", code)
+	}
+	publish(map[string]string{
+		clientCAKey:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		allowedNamesKey: `["front-proxy-client"]`,
+	})
+	waitFor(rotated, http.StatusOK)
+	if code := status(newTestPKI(t).frontProxy); code != http.StatusUnauthorized {
+		t.Errorf("status of a certificate of the replaced CA = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// a ConfigMap without a CA keeps the previous one
+	publish(map[string]string{allowedNamesKey: `["front-proxy-client"]`})
+	if err := s.loadClientCA(ctx); err == nil {
+		t.Fatal("loadClientCA() accepted a ConfigMap without a CA")
+	}
+	if code := status(rotated); code != http.StatusOK {
+		t.Errorf("status after publishing no CA = %d, want %d", code, http.StatusOK)
+	}
+}
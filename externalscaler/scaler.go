@@ -0,0 +1,335 @@
+// Package externalscaler implements the KEDA external scaler protocol on top
+// of CustomAutoScaling objects. A ScaledObject with a trigger of type external
+// names the CR in its metadata and KEDA reads the metrics of the CR from the
+// operator:
+//
+//	triggers:
+//	- type: external
+//	  metadata:
+//	    scalerAddress: autoscaler-external-scaler.autoscaler-system:9095
+//	    customAutoScaling: my-autoscaler
+//
+// The CR is looked up in the namespace of the ScaledObject and must use the
+// KEDA driver. While the CR is paused, frozen or overridden every metric
+// reports the replicas the deployment is held at instead of its query.
+//
+// The messages in externalscaler.pb.go and the service in
+// externalscaler_grpc.pb.go are generated from externalscaler.proto, run
+// `make externalscaler` after changing it.
+package externalscaler
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/scaling"
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// MetadataCustomAutoScaling is the scaler metadata key naming the CR
+	MetadataCustomAutoScaling = "customAutoScaling"
+	// MetadataMetric is the optional scaler metadata key restricting the scaler to one metric of the CR
+	MetadataMetric = "metric"
+)
+
+var log = logf.Log.WithName("external_scaler")
+
+// QueryFunc evaluates a PromQL query against the Prometheus of a CR
+type QueryFunc func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error)
+
+// Scaler is the ExternalScaler gRPC service, it is added to the manager as a Runnable
+type Scaler struct {
+	UnimplementedExternalScalerServer
+
+	Client client.Reader
+	Query  QueryFunc
+
+	// Addr is the address the gRPC server listens on
+	Addr string
+	// Interval is how often StreamIsActive evaluates the CR
+	Interval time.Duration
+}
+
+// NewScaler returns a Scaler reading CRs through cl and querying their Prometheus
+func NewScaler(cl client.Reader, addr string) *Scaler {
+	return &Scaler{
+		Client:   cl,
+		Addr:     addr,
+		Interval: 10 * time.Second,
+		Query: func(ctx context.Context, cr *autoscaler.CustomAutoScaling, query string) (model.Vector, error) {
+			return utils.QueryInstant(ctx, utils.PrometheusURL(cr), query, time.Now())
+		},
+	}
+}
+
+// Start serves the scaler until ctx is cancelled
+func (s *Scaler) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	RegisterExternalScalerServer(server, s)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	log.Info("serving KEDA external scaler", "addr", s.Addr)
+	return server.Serve(lis)
+}
+
+// NeedLeaderElection lets every replica serve, KEDA only reads from the scaler
+func (s *Scaler) NeedLeaderElection() bool {
+	return false
+}
+
+// IsActive reports whether any metric of the CR asks for replicas
+func (s *Scaler) IsActive(ctx context.Context, ref *ScaledObjectRef) (*IsActiveResponse, error) {
+	cr, metrics, err := s.lookup(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := s.active(ctx, cr, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return &IsActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive sends the activity of the CR every Interval while it changes
+func (s *Scaler) StreamIsActive(ref *ScaledObjectRef, stream ExternalScaler_StreamIsActiveServer) error {
+	ctx := stream.Context()
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	var last *bool
+	for {
+		cr, metrics, err := s.lookup(ctx, ref)
+		if err != nil {
+			return err
+		}
+		active, err := s.active(ctx, cr, metrics)
+		if err != nil {
+			return err
+		}
+		if last == nil || *last != active {
+			if err := stream.Send(&IsActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			last = &active
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetMetricSpec returns one metric per metric of the CR with its target per replica
+func (s *Scaler) GetMetricSpec(ctx context.Context, ref *ScaledObjectRef) (*GetMetricSpecResponse, error) {
+	_, metrics, err := s.lookup(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &GetMetricSpecResponse{}
+	for _, m := range metrics {
+		target := targetValue(m)
+		resp.MetricSpecs = append(resp.MetricSpecs, &MetricSpec{
+			MetricName:      m.Name,
+			TargetSize:      int64(math.Ceil(target)),
+			TargetSizeFloat: target,
+		})
+	}
+	return resp, nil
+}
+
+// GetMetrics returns the current value of the requested metric of the CR
+func (s *Scaler) GetMetrics(ctx context.Context, req *GetMetricsRequest) (*GetMetricsResponse, error) {
+	cr, metrics, err := s.lookup(ctx, req.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range metrics {
+		if !strings.EqualFold(m.Name, req.MetricName) {
+			continue
+		}
+		value, err := s.evaluate(ctx, cr, m)
+		if err != nil {
+			return nil, err
+		}
+		return &GetMetricsResponse{MetricValues: []*MetricValue{{
+			MetricName:       req.MetricName,
+			MetricValue:      int64(math.Round(value)),
+			MetricValueFloat: value,
+		}}}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "customautoscaling %s/%s has no metric %q", cr.Namespace, cr.Name, req.MetricName)
+}
+
+// lookup resolves the CR named in the scaler metadata and the metrics the scaler uses
+func (s *Scaler) lookup(ctx context.Context, ref *ScaledObjectRef) (*autoscaler.CustomAutoScaling, []autoscaler.Metric, error) {
+	if ref == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "scaledObjectRef is required")
+	}
+	name := ref.ScalerMetadata[MetadataCustomAutoScaling]
+	if name == "" {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "scaler metadata %s is required", MetadataCustomAutoScaling)
+	}
+
+	cr := &autoscaler.CustomAutoScaling{}
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: name}, cr); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "customautoscaling %s/%s not found", ref.Namespace, name)
+		}
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	if cr.Spec.Driver != autoscaler.KEDADriver {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "customautoscaling %s/%s uses the %s driver, the external scaler needs %s",
+			cr.Namespace, cr.Name, cr.Spec.Driver, autoscaler.KEDADriver)
+	}
+
+	metric := ref.ScalerMetadata[MetadataMetric]
+	if metric == "" {
+		return cr, cr.Spec.Metrics, nil
+	}
+	for _, m := range cr.Spec.Metrics {
+		if m.Name == metric {
+			return cr, []autoscaler.Metric{m}, nil
+		}
+	}
+	return nil, nil, status.Errorf(codes.NotFound, "customautoscaling %s/%s has no metric %q", cr.Namespace, cr.Name, metric)
+}
+
+func (s *Scaler) active(ctx context.Context, cr *autoscaler.CustomAutoScaling, metrics []autoscaler.Metric) (bool, error) {
+	if hold := scaling.HoldFor(cr, time.Now()); hold != nil {
+		replicas, err := s.heldReplicas(ctx, cr, hold)
+		return replicas > 0, err
+	}
+	for _, m := range metrics {
+		value, err := s.evaluate(ctx, cr, m)
+		if err != nil {
+			return false, err
+		}
+		if value > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// evaluate returns the value KEDA compares to the target of the metric. A
+// metric with a targetAverageValue is the sum of its query, any other metric
+// is an alert and its value is the replica count the webhook would set while
+// it fires: each alerting rule generated for the metric is evaluated on its
+// own, a threshold step asks for its replicas and any other rule for the
+// replicas of its severity, and the highest asked for is taken. The for of a
+// rule is not waited for. A held CR reports the held replicas times the target
+// so KEDA keeps the deployment there
+func (s *Scaler) evaluate(ctx context.Context, cr *autoscaler.CustomAutoScaling, m autoscaler.Metric) (float64, error) {
+	if hold := scaling.HoldFor(cr, time.Now()); hold != nil {
+		replicas, err := s.heldReplicas(ctx, cr, hold)
+		return float64(replicas) * targetValue(m), err
+	}
+
+	if m.TargetAverageValue != nil {
+		vector, err := s.query(ctx, cr, m, cr.Query(m))
+		if err != nil {
+			return 0, err
+		}
+		var sum float64
+		for _, sample := range vector {
+			if v := float64(sample.Value); !math.IsNaN(v) && !math.IsInf(v, 0) {
+				sum += v
+			}
+		}
+		return sum, nil
+	}
+
+	var replicas int32
+	for _, rule := range utils.MetricAlertingRules(cr, m) {
+		vector, err := s.query(ctx, cr, m, rule.Expr.String())
+		if err != nil {
+			return 0, err
+		}
+		for _, sample := range vector {
+			if r := ruleReplicas(cr, rule, sample.Metric); r > replicas {
+				replicas = r
+			}
+		}
+	}
+	return float64(replicas), nil
+}
+
+// query evaluates query of metric m of cr
+func (s *Scaler) query(ctx context.Context, cr *autoscaler.CustomAutoScaling, m autoscaler.Metric, query string) (model.Vector, error) {
+	vector, err := s.Query(ctx, cr, query)
+	if err != nil {
+		log.Error(err, "failed to evaluate metric", "customautoscaling", cr.Namespace+"/"+cr.Name, "metric", m.Name)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return vector, nil
+}
+
+// ruleReplicas returns the replicas the alert of rule for a series with
+// labels asks for. Like Prometheus the labels of the rule override those of
+// the series, and like the webhook the replicas annotation of a threshold
+// step overrides the severity
+func ruleReplicas(cr *autoscaler.CustomAutoScaling, rule monitoringv1.Rule, labels model.Metric) int32 {
+	if replicas, err := strconv.ParseInt(rule.Annotations[utils.AlertAnnotationReplicas], 10, 32); err == nil {
+		return int32(replicas)
+	}
+	severity, ok := rule.Labels["severity"]
+	if !ok {
+		severity = string(labels["severity"])
+	}
+	return scaling.ReplicasForSeverity(&cr.Spec, severity)
+}
+
+// heldReplicas returns the replicas hold pins the deployment to, a paused CR
+// holds the deployment at its current replicas
+func (s *Scaler) heldReplicas(ctx context.Context, cr *autoscaler.CustomAutoScaling, hold *scaling.Hold) (int32, error) {
+	if hold.Replicas != nil {
+		return *hold.Replicas, nil
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.Target.Name}, deployment); err != nil {
+		return 0, status.Error(codes.Unavailable, err.Error())
+	}
+	if deployment.Spec.Replicas == nil {
+		return 1, nil
+	}
+	return *deployment.Spec.Replicas, nil
+}
+
+// targetValue is the value of the metric one replica absorbs, an alert asks
+// for its value in replicas
+func targetValue(m autoscaler.Metric) float64 {
+	if m.TargetAverageValue != nil {
+		return m.TargetAverageValue.AsApproximateFloat64()
+	}
+	return 1
+}
@@ -0,0 +1,277 @@
+package externalscaler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// series is what the stubbed Prometheus returns for each query
+var series = map[string]model.Vector{
+	"rps":  {{Metric: model.Metric{"pod": "a"}, Value: 120}, {Metric: model.Metric{"pod": "b"}, Value: 30.5}},
+	"errs": {{Metric: model.Metric{"severity": "warning"}, Value: 1}, {Metric: model.Metric{"severity": "critical"}, Value: 1}},
+	"idle": {},
+	// each step of a ladder is its own expression, as in the generated rules
+	"(depth) > 10": {{Metric: model.Metric{"queue": "orders"}, Value: 40}},
+	"(depth) > 50": {},
+}
+
+func newTestClient(t *testing.T, query QueryFunc) ExternalScalerClient {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := autoscaler.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := appsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver: autoscaler.KEDADriver,
+				Metrics: []autoscaler.Metric{
+					{Name: "requests", Query: "rps", TargetAverageValue: resource.NewQuantity(50, resource.DecimalSI)},
+					{Name: "errors", Query: "errs"},
+				},
+				Webhook: &autoscaler.WebhookRouting{SeverityReplicas: map[string]int32{"critical": 7}},
+			},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "queue", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver: autoscaler.KEDADriver,
+				Metrics: []autoscaler.Metric{{Name: "depth", Query: "depth", Thresholds: []autoscaler.Threshold{
+					{Severity: "warning", Value: resource.MustParse("10"), Replicas: 2},
+					{Severity: "critical", Value: resource.MustParse("50"), Replicas: 6},
+				}}},
+			},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "quiet", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:  autoscaler.KEDADriver,
+				Metrics: []autoscaler.Metric{{Name: "errors", Query: "idle"}},
+			},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "frozen", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:         autoscaler.KEDADriver,
+				Target:         autoscaler.ScaleTarget{Name: "web"},
+				Metrics:        []autoscaler.Metric{{Name: "requests", Query: "rps", TargetAverageValue: resource.NewQuantity(50, resource.DecimalSI)}},
+				FreezeReplicas: &autoscaler.ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(time.Now().Add(time.Hour))},
+			},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "paused", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:  autoscaler.KEDADriver,
+				Target:  autoscaler.ScaleTarget{Name: "web"},
+				Metrics: []autoscaler.Metric{{Name: "errors", Query: "idle"}},
+				Paused:  true,
+			},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+		},
+		&autoscaler.CustomAutoScaling{
+			ObjectMeta: metav1.ObjectMeta{Name: "alerts", Namespace: "default"},
+			Spec: autoscaler.CustomAutoScalingSpec{
+				Driver:  autoscaler.AlertsDriver,
+				Metrics: []autoscaler.Metric{{Name: "errors", Query: "errs"}},
+			},
+		},
+	).Build()
+
+	if query == nil {
+		query = func(_ context.Context, _ *autoscaler.CustomAutoScaling, q string) (model.Vector, error) {
+			return series[q], nil
+		}
+	}
+	scaler := &Scaler{Client: cl, Query: query, Interval: 10 * time.Millisecond}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterExternalScalerServer(server, scaler)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewExternalScalerClient(conn)
+}
+
+func ref(name string) *ScaledObjectRef {
+	return &ScaledObjectRef{Name: "so", Namespace: "default", ScalerMetadata: map[string]string{MetadataCustomAutoScaling: name}}
+}
+
+func TestGetMetricSpec(t *testing.T) {
+	c := newTestClient(t, nil)
+
+	resp, err := c.GetMetricSpec(context.Background(), ref("web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.MetricSpecs) != 2 {
+		t.Fatalf("metricSpecs = %v", resp.MetricSpecs)
+	}
+	if got := resp.MetricSpecs[0]; got.MetricName != "requests" || got.TargetSize != 50 || got.TargetSizeFloat != 50 {
+		t.Errorf("requests spec = %v", got)
+	}
+	if got := resp.MetricSpecs[1]; got.MetricName != "errors" || got.TargetSizeFloat != 1 {
+		t.Errorf("alert spec = %v, want a target of one replica", got)
+	}
+
+	only := ref("web")
+	only.ScalerMetadata[MetadataMetric] = "errors"
+	if resp, err := c.GetMetricSpec(context.Background(), only); err != nil || len(resp.MetricSpecs) != 1 {
+		t.Errorf("GetMetricSpec() with metric metadata = %v, %v", resp, err)
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	c := newTestClient(t, nil)
+
+	tests := []struct {
+		metric string
+		value  float64
+	}{
+		// the sum of the series of a value metric
+		{metric: "requests", value: 150.5},
+		// the replicas of the most severe firing alert, critical is overridden by the CR
+		{metric: "errors", value: 7},
+	}
+	for _, tt := range tests {
+		resp, err := c.GetMetrics(context.Background(), &GetMetricsRequest{ScaledObjectRef: ref("web"), MetricName: tt.metric})
+		if err != nil {
+			t.Fatalf("GetMetrics(%s) = %v", tt.metric, err)
+		}
+		if len(resp.MetricValues) != 1 || resp.MetricValues[0].MetricValueFloat != tt.value || resp.MetricValues[0].MetricName != tt.metric {
+			t.Errorf("GetMetrics(%s) = %v, want %v", tt.metric, resp.MetricValues, tt.value)
+		}
+	}
+
+	// only the warning step fires, its replicas are reported
+	resp, err := c.GetMetrics(context.Background(), &GetMetricsRequest{ScaledObjectRef: ref("queue"), MetricName: "depth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.MetricValues) != 1 || resp.MetricValues[0].MetricValueFloat != 2 {
+		t.Errorf("GetMetrics(depth) = %v, want the 2 replicas of the warning step", resp.MetricValues)
+	}
+}
+
+func TestHeld(t *testing.T) {
+	c := newTestClient(t, nil)
+
+	tests := []struct {
+		cr     string
+		metric string
+		value  float64
+	}{
+		// 4 frozen replicas of 50 each, whatever the query returns
+		{cr: "frozen", metric: "requests", value: 200},
+		// the 3 replicas of the deployment while paused, even though the alert does not fire
+		{cr: "paused", metric: "errors", value: 3},
+	}
+	for _, tt := range tests {
+		resp, err := c.GetMetrics(context.Background(), &GetMetricsRequest{ScaledObjectRef: ref(tt.cr), MetricName: tt.metric})
+		if err != nil {
+			t.Fatalf("GetMetrics(%s) = %v", tt.cr, err)
+		}
+		if got := resp.MetricValues[0].MetricValueFloat; got != tt.value {
+			t.Errorf("GetMetrics(%s) = %v, want %v", tt.cr, got, tt.value)
+		}
+		if active, err := c.IsActive(context.Background(), ref(tt.cr)); err != nil || !active.Result {
+			t.Errorf("IsActive(%s) = %v, %v, want active", tt.cr, active, err)
+		}
+	}
+}
+
+func TestIsActive(t *testing.T) {
+	c := newTestClient(t, nil)
+
+	for name, want := range map[string]bool{"web": true, "quiet": false} {
+		resp, err := c.IsActive(context.Background(), ref(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Result != want {
+			t.Errorf("IsActive(%s) = %v, want %v", name, resp.Result, want)
+		}
+	}
+}
+
+func TestStreamIsActive(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.StreamIsActive(ctx, ref("web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Result {
+		t.Errorf("first StreamIsActive message = %v, want active", resp.Result)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t, func(context.Context, *autoscaler.CustomAutoScaling, string) (model.Vector, error) {
+		return nil, errors.New("prometheus is down")
+	})
+
+	noMetadata := ref("")
+	delete(noMetadata.ScalerMetadata, MetadataCustomAutoScaling)
+	unknownMetric := ref("web")
+	unknownMetric.ScalerMetadata[MetadataMetric] = "latency"
+
+	tests := []struct {
+		name string
+		ref  *ScaledObjectRef
+		code codes.Code
+	}{
+		{name: "no metadata", ref: noMetadata, code: codes.InvalidArgument},
+		{name: "unknown CR", ref: ref("missing"), code: codes.NotFound},
+		{name: "alerts driver", ref: ref("alerts"), code: codes.FailedPrecondition},
+		{name: "unknown metric", ref: unknownMetric, code: codes.NotFound},
+		{name: "query failure", ref: ref("web"), code: codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.IsActive(context.Background(), tt.ref)
+			if status.Code(err) != tt.code {
+				t.Errorf("IsActive() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+#!/usr/bin/env bash
+# Rewrites every CustomAutoScaling so it is stored as v2, then drops v1 from the
+# storedVersions of the CRD. Run it once after upgrading to an operator that
+# stores v2, the conversion webhook must be up.
+set -euo pipefail
+
+CRD=customautoscalings.buildpiper.opstreelabs.in
+
+# a no-op replace re-encodes the object in the storage version, rerun the
+# script if it fails on a conflict with the operator updating a status
+kubectl get "customautoscalings.v2.buildpiper.opstreelabs.in" --all-namespaces -o json \
+  | kubectl replace -f -
+
+kubectl patch crd "${CRD}" --subresource=status --type=merge \
+  -p '{"status":{"storedVersions":["v2"]}}'
+
+kubectl get crd "${CRD}" -o jsonpath='{.status.storedVersions}{"\n"}'
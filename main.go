@@ -19,11 +19,14 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -32,7 +35,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	buildpiperopstreelabsinv1 "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	buildpiperopstreelabsinv2 "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	"buildpiper.opstreelabs.in/autoscaler/controllers"
+	"buildpiper.opstreelabs.in/autoscaler/externalmetrics"
+	"buildpiper.opstreelabs.in/autoscaler/externalscaler"
+	"buildpiper.opstreelabs.in/autoscaler/utils"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -45,6 +52,8 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(buildpiperopstreelabsinv1.AddToScheme(scheme))
+	utilruntime.Must(buildpiperopstreelabsinv2.AddToScheme(scheme))
+	utilruntime.Must(monitoringv1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,8 +61,34 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var externalMetricsAddr string
+	var externalMetricsCertDir string
+	var externalScalerAddr string
+	var alertSyncInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&externalMetricsAddr, "external-metrics-bind-address", "0",
+		"The address the external.metrics.k8s.io API binds to, used by the HPA driver. Set to 0 to disable it.")
+	flag.StringVar(&externalMetricsCertDir, "external-metrics-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		"The directory holding tls.crt and tls.key for the external.metrics.k8s.io API.")
+	flag.StringVar(&externalScalerAddr, "external-scaler-bind-address", "0",
+		"The address the KEDA external scaler gRPC service binds to, used by the KEDA driver. Set to 0 to disable it.")
+	flag.StringVar(&utils.SignalsURL, "signals-url", utils.SignalsURL,
+		"The base URL the Alertmanager of a CR posts its alerts to, the address of the signals Service.")
+	limits := controllers.DefaultReceiverLimits
+	flag.Float64Var(&limits.SourceRate, "webhook-source-rate", limits.SourceRate,
+		"Requests per second the webhook server accepts from a remote address. Set to 0 to disable the limit.")
+	flag.IntVar(&limits.SourceBurst, "webhook-source-burst", limits.SourceBurst, "Burst of requests accepted from a remote address.")
+	flag.Float64Var(&limits.CRRate, "webhook-cr-rate", limits.CRRate,
+		"Requests per second the webhook server accepts with signals for a CustomAutoScaling. Set to 0 to disable the limit.")
+	flag.IntVar(&limits.CRBurst, "webhook-cr-burst", limits.CRBurst, "Burst of requests accepted with signals for a CustomAutoScaling.")
+	flag.Int64Var(&limits.MaxBodyBytes, "webhook-max-body-bytes", limits.MaxBodyBytes,
+		"Largest request body the webhook server reads. Set to 0 to disable the limit.")
+	flag.DurationVar(&limits.Timeout, "webhook-timeout", limits.Timeout, "Time the webhook server takes to handle a request. Set to 0 to disable it.")
+	flag.IntVar(&limits.MaxConcurrent, "webhook-max-concurrent", limits.MaxConcurrent,
+		"Requests the webhook server handles at once. Set to 0 to disable the limit.")
+	flag.DurationVar(&alertSyncInterval, "alert-sync-interval", controllers.DefaultAlertSyncInterval,
+		"How often the firing alerts of a CustomAutoScaling are read back from its Alertmanager. Set to 0 to disable it.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -89,13 +124,47 @@ func main() {
 		os.Exit(1)
 	}
 
+	scraper := controllers.NewScraper(mgr.GetClient())
+	if err := mgr.Add(scraper); err != nil {
+		setupLog.Error(err, "unable to set up the scraper of embedded mode")
+		os.Exit(1)
+	}
+
+	recorder := mgr.GetEventRecorderFor("customautoscaling-controller")
 	if err = (&controllers.CustomAutoScalingReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Recorder:          recorder,
+		Provisioner:       utils.NewProvisioner(mgr.GetClient(), mgr.GetScheme(), recorder),
+		Limits:            limits,
+		AlertSyncInterval: alertSyncInterval,
+		Scraper:           scraper,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CustomAutoScaling")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&buildpiperopstreelabsinv2.CustomAutoScaling{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CustomAutoScaling")
+			os.Exit(1)
+		}
+	}
+	if externalMetricsAddr != "0" {
+		server := externalmetrics.NewServer(mgr.GetClient(), mgr.GetAPIReader(), externalMetricsAddr, externalMetricsCertDir)
+		server.Query = scraper.QueryOr(server.Query)
+		if err := mgr.Add(server); err != nil {
+			setupLog.Error(err, "unable to set up external metrics server")
+			os.Exit(1)
+		}
+	}
+	if externalScalerAddr != "0" {
+		scaler := externalscaler.NewScaler(mgr.GetClient(), externalScalerAddr)
+		scaler.Query = scraper.QueryOr(scaler.Query)
+		if err := mgr.Add(scaler); err != nil {
+			setupLog.Error(err, "unable to set up KEDA external scaler")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
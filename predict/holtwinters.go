@@ -0,0 +1,64 @@
+package predict
+
+// Smoothing holds the Holt-Winters level, trend and seasonal factors
+type Smoothing struct {
+	Alpha float64
+	Beta  float64
+	Gamma float64
+}
+
+// DefaultSmoothing favours the seasonal shape over short term noise
+var DefaultSmoothing = Smoothing{Alpha: 0.3, Beta: 0.05, Gamma: 0.3}
+
+// HoltWintersModel is an additive triple exponential smoothing model
+type HoltWintersModel struct {
+	level     float64
+	trend     float64
+	seasonals []float64
+	n         int
+}
+
+// FitHoltWinters fits the model to values with a seasonal cycle of period
+// samples, at least two full cycles are required to seed the trend
+func FitHoltWinters(values []float64, period int, s Smoothing) (*HoltWintersModel, error) {
+	if period < 2 || len(values) < 2*period {
+		return nil, ErrNotEnoughHistory
+	}
+
+	first := mean(values[:period])
+	second := mean(values[period : 2*period])
+
+	m := &HoltWintersModel{
+		level:     first,
+		trend:     (second - first) / float64(period),
+		seasonals: make([]float64, period),
+		n:         len(values),
+	}
+	for i := 0; i < period; i++ {
+		m.seasonals[i] = values[i] - first
+	}
+
+	for t, y := range values {
+		seasonal := m.seasonals[t%period]
+		lastLevel := m.level
+		m.level = s.Alpha*(y-seasonal) + (1-s.Alpha)*(m.level+m.trend)
+		m.trend = s.Beta*(m.level-lastLevel) + (1-s.Beta)*m.trend
+		m.seasonals[t%period] = s.Gamma*(y-m.level) + (1-s.Gamma)*seasonal
+	}
+
+	return m, nil
+}
+
+// Forecast returns the value expected h steps after the last fitted sample
+func (m *HoltWintersModel) Forecast(h int) float64 {
+	period := len(m.seasonals)
+	return m.level + float64(h)*m.trend + m.seasonals[(m.n+h-1)%period]
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,93 @@
+package predict
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sample is a single point of a metric time series
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+const (
+	HoltWinters = "HoltWinters"
+	Profile     = "Profile"
+)
+
+var ErrNotEnoughHistory = errors.New("not enough history to fit the model")
+
+// Params configures a forecast over a series sampled every Step
+type Params struct {
+	Model    string
+	Step     time.Duration
+	Season   time.Duration
+	LeadTime time.Duration
+}
+
+// Forecast fits the configured model to series and returns the value expected
+// LeadTime after the last sample
+func Forecast(series []Sample, params Params) (float64, error) {
+	if params.Step <= 0 {
+		return 0, fmt.Errorf("invalid step %s", params.Step)
+	}
+	if len(series) == 0 {
+		return 0, ErrNotEnoughHistory
+	}
+
+	series = regularize(series, params.Step)
+	last := series[len(series)-1].Time
+
+	switch params.Model {
+	case HoltWinters, "":
+		period := int(params.Season / params.Step)
+		if period < 2 {
+			return 0, fmt.Errorf("season %s must span at least two steps of %s", params.Season, params.Step)
+		}
+		model, err := FitHoltWinters(values(series), period, DefaultSmoothing)
+		if err != nil {
+			return 0, err
+		}
+		horizon := int((params.LeadTime + params.Step - 1) / params.Step)
+		if horizon < 1 {
+			horizon = 1
+		}
+		return model.Forecast(horizon), nil
+	case Profile:
+		return FitProfile(series).At(last.Add(params.LeadTime))
+	default:
+		return 0, fmt.Errorf("unknown model %q", params.Model)
+	}
+}
+
+// regularize sorts series and fills missing steps with the previous value so
+// that index arithmetic in the models maps onto wall clock time
+func regularize(series []Sample, step time.Duration) []Sample {
+	sorted := make([]Sample, len(series))
+	copy(sorted, series)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	out := []Sample{sorted[0]}
+	for _, s := range sorted[1:] {
+		prev := out[len(out)-1]
+		for t := prev.Time.Add(step); s.Time.Sub(t) >= step/2; t = t.Add(step) {
+			out = append(out, Sample{Time: t, Value: prev.Value})
+		}
+		if s.Time.Sub(out[len(out)-1].Time) < step/2 {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func values(series []Sample) []float64 {
+	v := make([]float64, len(series))
+	for i, s := range series {
+		v[i] = s.Value
+	}
+	return v
+}
@@ -0,0 +1,86 @@
+package predict
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// dailySine is a canned series with a daily cycle between 10 and 30 and a
+// small upward trend
+func dailySine(days int, step time.Duration) []Sample {
+	var series []Sample
+	for t := start; t.Before(start.Add(time.Duration(days) * 24 * time.Hour)); t = t.Add(step) {
+		phase := 2 * math.Pi * float64(t.Sub(start)) / float64(24*time.Hour)
+		trend := float64(t.Sub(start)) / float64(24*time.Hour) * 0.1
+		series = append(series, Sample{Time: t, Value: 20 + 10*math.Sin(phase) + trend})
+	}
+	return series
+}
+
+func TestHoltWintersFollowsSeason(t *testing.T) {
+	step := 15 * time.Minute
+	history := dailySine(7, step)
+	actual := dailySine(8, step)
+
+	for _, lead := range []time.Duration{step, time.Hour, 6 * time.Hour} {
+		got, err := Forecast(history, Params{Model: HoltWinters, Step: step, Season: 24 * time.Hour, LeadTime: lead})
+		if err != nil {
+			t.Fatalf("forecast: %v", err)
+		}
+		want := actual[len(history)-1+int(lead/step)].Value
+		if math.Abs(got-want) > 1 {
+			t.Errorf("lead %s: forecast %.2f, want %.2f", lead, got, want)
+		}
+	}
+}
+
+func TestHoltWintersNeedsTwoSeasons(t *testing.T) {
+	step := time.Hour
+	_, err := Forecast(dailySine(1, step), Params{Model: HoltWinters, Step: step, Season: 24 * time.Hour, LeadTime: step})
+	if err != ErrNotEnoughHistory {
+		t.Fatalf("expected ErrNotEnoughHistory, got %v", err)
+	}
+}
+
+func TestProfileUsesWeekdayHour(t *testing.T) {
+	step := time.Hour
+	var history []Sample
+	for t := start; t.Before(start.Add(14 * 24 * time.Hour)); t = t.Add(step) {
+		v := 5.0
+		if t.Weekday() == time.Monday && t.Hour() == 9 {
+			v = 50
+		}
+		history = append(history, Sample{Time: t, Value: v})
+	}
+
+	// the last sample is Sunday 23:00, ten hours later is the Monday peak
+	got, err := Forecast(history, Params{Model: Profile, Step: step, LeadTime: 10 * time.Hour})
+	if err != nil {
+		t.Fatalf("forecast: %v", err)
+	}
+	if got != 50 {
+		t.Errorf("forecast %.2f, want 50", got)
+	}
+}
+
+func TestRegularizeFillsGaps(t *testing.T) {
+	step := time.Minute
+	series := []Sample{
+		{Time: start.Add(3 * step), Value: 3},
+		{Time: start, Value: 1},
+		{Time: start.Add(step), Value: 2},
+	}
+	got := regularize(series, step)
+	want := []float64{1, 2, 2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i, s := range got {
+		if s.Value != want[i] || !s.Time.Equal(start.Add(time.Duration(i)*step)) {
+			t.Errorf("sample %d = %v@%s, want %v@%s", i, s.Value, s.Time, want[i], start.Add(time.Duration(i)*step))
+		}
+	}
+}
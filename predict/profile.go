@@ -0,0 +1,44 @@
+package predict
+
+import "time"
+
+const hoursPerWeek = 7 * 24
+
+// ProfileModel averages the history into day-of-week/hour buckets
+type ProfileModel struct {
+	weekly [hoursPerWeek]bucket
+	hourly [24]bucket
+}
+
+type bucket struct {
+	sum   float64
+	count int
+}
+
+// FitProfile builds the weekly profile of series
+func FitProfile(series []Sample) *ProfileModel {
+	m := &ProfileModel{}
+	for _, s := range series {
+		t := s.Time.UTC()
+		w := &m.weekly[int(t.Weekday())*24+t.Hour()]
+		w.sum += s.Value
+		w.count++
+		h := &m.hourly[t.Hour()]
+		h.sum += s.Value
+		h.count++
+	}
+	return m
+}
+
+// At returns the average for the bucket of t, falling back to the hour of
+// day when the lookback did not cover that weekday
+func (m *ProfileModel) At(t time.Time) (float64, error) {
+	t = t.UTC()
+	if w := m.weekly[int(t.Weekday())*24+t.Hour()]; w.count > 0 {
+		return w.sum / float64(w.count), nil
+	}
+	if h := m.hourly[t.Hour()]; h.count > 0 {
+		return h.sum / float64(h.count), nil
+	}
+	return 0, ErrNotEnoughHistory
+}
@@ -0,0 +1,53 @@
+package receiver
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+)
+
+// Alertmanager decodes the Alertmanager webhook, the rules generated by the
+// operator label every alert with the CR it belongs to
+type Alertmanager struct{}
+
+func (Alertmanager) Decode(_ http.Header, body []byte) ([]Signal, error) {
+	var payload utils.AlertmanagerPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	return AlertSignals("alertmanager", payload.Alerts), nil
+}
+
+// AlertSignals maps alerts read from source, the webhook or the Alertmanager
+// API, to signals
+func AlertSignals(source string, alerts []utils.Alert) []Signal {
+	signals := make([]Signal, 0, len(alerts))
+	for _, a := range alerts {
+		signals = append(signals, alertSignal(source, a))
+	}
+	return signals
+}
+
+// alertSignal maps an alert labelled with its CR to a signal, the replicas
+// annotated on the steps of a threshold ladder are carried over
+func alertSignal(source string, a utils.Alert) Signal {
+	s := Signal{
+		Namespace:   a.Labels[utils.AlertLabelNamespace],
+		Name:        a.Labels[utils.AlertLabelName],
+		Source:      source,
+		Resolved:    a.Status == "resolved",
+		Alert:       a.Labels["alertname"],
+		Severity:    a.Labels["severity"],
+		Fingerprint: a.Fingerprint,
+	}
+	if replicas, ok := utils.AlertReplicas(a); ok {
+		s.Replicas = &replicas
+	}
+	if startsAt, err := time.Parse(time.RFC3339, a.StartsAt); err == nil {
+		s.StartsAt = startsAt
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package receiver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const cloudEventsContentType = "application/cloudevents+json"
+
+// CloudEvents decodes a CloudEvent 1.0 in structured mode, the event is the
+// JSON body, or in binary mode, the attributes are ce- headers and the body
+// is the data. The data is a Request, the subject of the event names the CR
+// when the request has no target
+type CloudEvents struct{}
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+func (CloudEvents) Decode(header http.Header, body []byte) ([]Signal, error) {
+	event := cloudEvent{}
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType == cloudEventsContentType {
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, err
+		}
+		if event.DataBase64 != "" {
+			data, err := base64.StdEncoding.DecodeString(event.DataBase64)
+			if err != nil {
+				return nil, fmt.Errorf("data_base64: %w", err)
+			}
+			event.Data = data
+		}
+	} else {
+		event = cloudEvent{
+			SpecVersion:     header.Get("ce-specversion"),
+			ID:              header.Get("ce-id"),
+			Source:          header.Get("ce-source"),
+			Type:            header.Get("ce-type"),
+			Subject:         header.Get("ce-subject"),
+			Time:            header.Get("ce-time"),
+			DataContentType: header.Get("Content-Type"),
+			Data:            body,
+		}
+	}
+
+	if err := event.validate(); err != nil {
+		return nil, err
+	}
+	s, err := decodeRequest(event.Data, event.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("data of event %s: %w", event.ID, err)
+	}
+	s.Source = event.Source
+	s.Fingerprint = event.ID
+	if t, err := time.Parse(time.RFC3339, event.Time); err == nil {
+		s.StartsAt = t
+	}
+	return []Signal{s}, nil
+}
+
+func (e *cloudEvent) validate() error {
+	switch {
+	case e.SpecVersion != "1.0":
+		return fmt.Errorf("unsupported specversion %q, want 1.0", e.SpecVersion)
+	case e.ID == "" || e.Source == "" || e.Type == "":
+		return errors.New("id, source and type are required")
+	case len(e.Data) == 0:
+		return errors.New("data is required")
+	}
+	if e.DataContentType != "" {
+		if mediaType, _, _ := mime.ParseMediaType(e.DataContentType); mediaType != "application/json" {
+			return fmt.Errorf("unsupported datacontenttype %q, want application/json", e.DataContentType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package receiver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	utils "buildpiper.opstreelabs.in/autoscaler/utils"
+)
+
+// Grafana decodes the webhook of Grafana unified alerting. Its alerts follow
+// the Alertmanager format, the alert rule has to add the customautoscaling
+// and customautoscaling_namespace labels the generated rules carry
+type Grafana struct{}
+
+type grafanaPayload struct {
+	Status string         `json:"status"`
+	Alerts []grafanaAlert `json:"alerts"`
+}
+
+type grafanaAlert struct {
+	utils.Alert
+	// Values are the results of the queries and expressions of the rule by refId
+	Values map[string]float64 `json:"values"`
+}
+
+func (Grafana) Decode(_ http.Header, body []byte) ([]Signal, error) {
+	var payload grafanaPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	signals := make([]Signal, 0, len(payload.Alerts))
+	for _, a := range payload.Alerts {
+		s := alertSignal("grafana", a.Alert)
+		s.Value = grafanaValue(a.Values)
+		signals = append(signals, s)
+	}
+	return signals, nil
+}
+
+// grafanaValue prints the single value of a rule as is and several as refId=value
+func grafanaValue(values map[string]float64) string {
+	if len(values) == 1 {
+		for _, v := range values {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	refs := make([]string, 0, len(values))
+	for ref := range values {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for i, ref := range refs {
+		refs[i] = ref + "=" + strconv.FormatFloat(values[ref], 'f', -1, 64)
+	}
+	return strings.Join(refs, " ")
+}
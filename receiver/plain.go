@@ -0,0 +1,60 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Plain decodes a replica request posted by a script or CI job
+type Plain struct{}
+
+// Request asks the CR named by Target for Replicas, or for the replicas its
+// webhook routing maps Severity to
+type Request struct {
+	// Target is the CR as namespace/name, or its name with Namespace. It can
+	// be left out when the request is posted to the endpoint of the CR
+	Target    string `json:"target"`
+	Namespace string `json:"namespace,omitempty"`
+	Replicas  *int32 `json:"replicas,omitempty"`
+	Severity  string `json:"severity,omitempty"`
+}
+
+func (Plain) Decode(_ http.Header, body []byte) ([]Signal, error) {
+	s, err := decodeRequest(body, "")
+	if err != nil {
+		return nil, err
+	}
+	s.Source = "plain"
+	return []Signal{s}, nil
+}
+
+// decodeRequest reads a Request, subject names the CR when the request does not
+func decodeRequest(body []byte, subject string) (Signal, error) {
+	var req Request
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return Signal{}, err
+	}
+
+	target := req.Target
+	if target == "" {
+		target = subject
+	}
+	s := Signal{Namespace: req.Namespace, Name: target, Replicas: req.Replicas, Severity: req.Severity}
+	if namespace, name, ok := strings.Cut(target, "/"); ok {
+		s.Namespace, s.Name = namespace, name
+	}
+
+	switch {
+	case req.Replicas == nil && req.Severity == "":
+		return Signal{}, errors.New("replicas or severity is required")
+	case req.Replicas != nil && *req.Replicas < 0:
+		return Signal{}, fmt.Errorf("replicas must be at least 0, got %d", *req.Replicas)
+	}
+	return s, nil
+}
@@ -0,0 +1,90 @@
+// Package receiver decodes the payloads posted to the operator webhook into
+// scaling signals. A format is chosen by name or, without one, by content type:
+//
+//	alertmanager  Alertmanager webhook
+//	grafana       Grafana unified alerting webhook
+//	cloudevents   CloudEvent in structured or binary HTTP mode
+//	plain         {"target": "namespace/name", "replicas": 3}
+package receiver
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Signal asks a CustomAutoScaling for replicas, either through an alert
+// severity or an explicit replica count
+type Signal struct {
+	// Namespace and Name identify the CR, they are empty when the payload
+	// leaves the CR to the endpoint it is posted to
+	Namespace string
+	Name      string
+	// Source is the decoder the signal came from, or the source attribute of a CloudEvent
+	Source string
+	// Resolved is true once the alert stopped firing, resolved signals do not scale
+	Resolved bool
+	// Alert is the alertname of the alert, empty for a replica request
+	Alert string
+	// Severity is mapped to replicas through the webhook routing of the CR
+	Severity string
+	// Fingerprint identifies the alert or the CloudEvent id
+	Fingerprint string
+	// Value is the metric value reported with the alert
+	Value string
+	// Replicas is an explicit replica count, it takes precedence over Severity
+	Replicas *int32
+	// StartsAt is when the alert started firing, zero when unknown
+	StartsAt time.Time
+}
+
+// Decoder turns a webhook request into signals
+type Decoder interface {
+	Decode(header http.Header, body []byte) ([]Signal, error)
+}
+
+// Decoders are the decoders served under /webhook/<name>
+var Decoders = map[string]Decoder{
+	"alertmanager": Alertmanager{},
+	"grafana":      Grafana{},
+	"cloudevents":  CloudEvents{},
+	"plain":        Plain{},
+}
+
+// Names returns the names of Decoders in order
+func Names() []string {
+	names := make([]string, 0, len(Decoders))
+	for name := range Decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select returns the decoder called name. Without a name a CloudEvent is
+// recognised by its content type or ce-specversion header and anything else
+// is read as an Alertmanager webhook
+func Select(name string, header http.Header) (Decoder, error) {
+	if name != "" {
+		decoder, ok := Decoders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown payload format %q, want one of %v", name, Names())
+		}
+		return decoder, nil
+	}
+	if isCloudEvent(header) {
+		return Decoders["cloudevents"], nil
+	}
+	return Decoders["alertmanager"], nil
+}
+
+// isCloudEvent reports whether header belongs to a CloudEvent in either HTTP mode
+func isCloudEvent(header http.Header) bool {
+	if header.Get("ce-specversion") != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == cloudEventsContentType
+}
@@ -0,0 +1,152 @@
+package receiver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func decode(t *testing.T, decoder Decoder, header http.Header, body []byte) []Signal {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	signals, err := decoder.Decode(header, body)
+	if err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+	return signals
+}
+
+func TestAlertmanager(t *testing.T) {
+	got := decode(t, Alertmanager{}, nil, fixture(t, "alertmanager.json"))
+	want := []Signal{
+		{Namespace: "shop", Name: "web", Source: "alertmanager", Alert: "web-requests", Severity: "critical",
+			Fingerprint: "3b15fd163d36582e", StartsAt: time.Date(2023, 5, 1, 11, 58, 0, 0, time.UTC)},
+		// a step of a threshold ladder annotates its replicas
+		{Namespace: "shop", Name: "web", Source: "alertmanager", Resolved: true, Alert: "web-latency", Severity: "warning",
+			Fingerprint: "9d4c3e0f1a2b7c58", Replicas: int32Ptr(3), StartsAt: time.Date(2023, 5, 1, 11, 30, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %+v, want %+v", got, want)
+	}
+
+	if _, err := (Alertmanager{}).Decode(http.Header{}, []byte("{")); err == nil {
+		t.Error("Decode() of truncated JSON succeeded")
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	got := decode(t, Grafana{}, nil, fixture(t, "grafana.json"))
+	want := []Signal{
+		{Namespace: "shop", Name: "checkout", Source: "grafana", Alert: "CheckoutLatency", Severity: "warning",
+			Fingerprint: "b6a1ee0c3f7a2d41", Value: "0.72", StartsAt: time.Date(2023, 5, 1, 11, 59, 30, 0, time.UTC)},
+		{Namespace: "shop", Name: "checkout", Source: "grafana", Alert: "CheckoutErrors", Severity: "critical",
+			Fingerprint: "0f2e9d8c7b6a5948", Value: "A=12.5 C=1", StartsAt: time.Date(2023, 5, 1, 11, 59, 45, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	structured := http.Header{"Content-Type": {"application/cloudevents+json; charset=utf-8"}}
+	got := decode(t, CloudEvents{}, structured, fixture(t, "cloudevents-structured.json"))
+	want := []Signal{{Namespace: "shop", Name: "web", Source: "https://ci.example.com/pipelines/shop", Fingerprint: "deploy-4711",
+		Replicas: int32Ptr(6), StartsAt: time.Date(2023, 5, 1, 11, 59, 0, 0, time.UTC)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("structured Decode() = %+v, want %+v", got, want)
+	}
+
+	binary := http.Header{
+		"Content-Type":   {"application/json"},
+		"Ce-Specversion": {"1.0"},
+		"Ce-Id":          {"b1"},
+		"Ce-Source":      {"/monitoring/checkout"},
+		"Ce-Type":        {"com.example.alert"},
+	}
+	got = decode(t, CloudEvents{}, binary, fixture(t, "cloudevents-binary.json"))
+	want = []Signal{{Namespace: "shop", Name: "checkout", Source: "/monitoring/checkout", Fingerprint: "b1", Severity: "critical"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("binary Decode() = %+v, want %+v", got, want)
+	}
+
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   string
+		err    string
+	}{
+		"specversion": {structured, `{"specversion": "0.3", "id": "1", "source": "s", "type": "t", "data": {}}`, "specversion"},
+		"attributes":  {structured, `{"specversion": "1.0", "source": "s", "type": "t", "data": {}}`, "required"},
+		"no data":     {structured, `{"specversion": "1.0", "id": "1", "source": "s", "type": "t"}`, "data is required"},
+		"xml data":    {http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"1"}, "Ce-Source": {"s"}, "Ce-Type": {"t"}, "Content-Type": {"text/xml"}}, `<a/>`, "datacontenttype"},
+	} {
+		if _, err := (CloudEvents{}).Decode(tc.header, []byte(tc.body)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: Decode() = %v, want an error containing %q", name, err, tc.err)
+		}
+	}
+}
+
+func TestPlain(t *testing.T) {
+	got := decode(t, Plain{}, nil, fixture(t, "plain.json"))
+	want := []Signal{{Namespace: "shop", Name: "web", Source: "plain", Replicas: int32Ptr(4)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %+v, want %+v", got, want)
+	}
+
+	// the endpoint of the CR fills in a missing target or namespace
+	got = decode(t, Plain{}, nil, []byte(`{"target": "web", "severity": "warning"}`))
+	want = []Signal{{Name: "web", Source: "plain", Severity: "warning"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() without a namespace = %+v, want %+v", got, want)
+	}
+
+	for body, msg := range map[string]string{
+		`{"target": "shop/web"}`:                       "replicas or severity",
+		`{"target": "shop/web", "replicas": -1}`:       "at least 0",
+		`{"target": "shop/web", "replica": 4}`:         "unknown field",
+		`{"target": "web", "namespace": "shop"}`:       "replicas or severity",
+		`{"target": "shop/web", "severity": "warning"`: "unexpected EOF",
+	} {
+		if _, err := (Plain{}).Decode(http.Header{}, []byte(body)); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Decode(%s) = %v, want an error containing %q", body, err, msg)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   Decoder
+	}{
+		{"", http.Header{"Content-Type": {"application/json"}}, Alertmanager{}},
+		{"", http.Header{"Content-Type": {"application/cloudevents+json"}}, CloudEvents{}},
+		{"", http.Header{"Ce-Specversion": {"1.0"}}, CloudEvents{}},
+		{"grafana", http.Header{}, Grafana{}},
+		{"plain", http.Header{"Ce-Specversion": {"1.0"}}, Plain{}},
+	} {
+		got, err := Select(tc.name, tc.header)
+		if err != nil || got != tc.want {
+			t.Errorf("Select(%q, %v) = %T, %v, want %T", tc.name, tc.header, got, err, tc.want)
+		}
+	}
+	if _, err := Select("opsgenie", http.Header{}); err == nil {
+		t.Error("Select() of an unknown format succeeded")
+	}
+}
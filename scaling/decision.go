@@ -0,0 +1,128 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+)
+
+// Decision is the outcome of running a desired replica count through the
+// bounds and behavior of a CustomAutoScaling
+type Decision struct {
+	Current int32
+	Desired int32
+	// Replicas is the replica count the target should be set to
+	Replicas int32
+	// Clamped names the bound that changed Desired, if any
+	Clamped string
+	// Limited names the behavior rule that changed the bounded count, if any
+	Limited string
+}
+
+// Changed reports whether the decision moves the target
+func (d Decision) Changed() bool {
+	return d.Replicas != d.Current
+}
+
+// Direction returns "up", "down" or "none"
+func (d Decision) Direction() string {
+	switch {
+	case d.Replicas > d.Current:
+		return "up"
+	case d.Replicas < d.Current:
+		return "down"
+	}
+	return "none"
+}
+
+func (d Decision) String() string {
+	s := fmt.Sprintf("%d -> %d", d.Current, d.Replicas)
+	if d.Clamped != "" {
+		s += fmt.Sprintf(", desired %d clamped by %s", d.Desired, d.Clamped)
+	}
+	if d.Limited != "" {
+		s += ", limited by " + d.Limited
+	}
+	return s
+}
+
+// Bound clamps replicas to the replica bounds of spec and names the bound
+// that changed it, if any
+func Bound(spec *autoscaler.CustomAutoScalingSpec, replicas int32) (int32, string) {
+	if min := spec.MinReplicas; min != nil && replicas < *min {
+		return *min, "minReplicas"
+	}
+	if max := spec.MaxReplicas; max != nil && replicas > *max {
+		return *max, "maxReplicas"
+	}
+	return replicas, ""
+}
+
+// Decide clamps desired to the replica bounds of spec and then applies the
+// scale up or scale down rules, lastScale is when the previous decision moved
+// the target
+func Decide(spec *autoscaler.CustomAutoScalingSpec, current, desired int32, lastScale, now time.Time) Decision {
+	d := Decision{Current: current, Desired: desired}
+	d.Replicas, d.Clamped = Bound(spec, desired)
+
+	if spec.Behavior == nil || d.Replicas == current {
+		return d
+	}
+
+	rules, direction := spec.Behavior.ScaleUp, "scaleUp"
+	if d.Replicas < current {
+		rules, direction = spec.Behavior.ScaleDown, "scaleDown"
+	}
+	if rules == nil {
+		return d
+	}
+
+	if rules.Cooldown != nil && !lastScale.IsZero() && now.Sub(lastScale) < rules.Cooldown.Duration {
+		d.Replicas = current
+		d.Limited = direction + ".cooldown"
+		return d
+	}
+
+	if step := rules.MaxStep; step != nil {
+		if d.Replicas > current+*step {
+			d.Replicas = current + *step
+			d.Limited = direction + ".maxStep"
+		} else if d.Replicas < current-*step {
+			d.Replicas = current - *step
+			d.Limited = direction + ".maxStep"
+		}
+	}
+
+	return d
+}
+
+// ReplicasForThresholds returns the replicas of the highest step of the
+// threshold ladder of m that value exceeds, and the alert and severity of that
+// step. ok is false when no step is exceeded
+func ReplicasForThresholds(m autoscaler.Metric, value float64) (replicas int32, step autoscaler.Threshold, ok bool) {
+	for _, t := range m.Thresholds {
+		if value > t.Value.AsApproximateFloat64() && (!ok || t.Replicas > replicas) {
+			replicas, step, ok = t.Replicas, t, true
+		}
+	}
+	return replicas, step, ok
+}
+
+// ReplicasForSeverity maps the severity label of an alert to a replica count,
+// spec.webhook.severityReplicas takes precedence over the built-in mapping
+func ReplicasForSeverity(spec *autoscaler.CustomAutoScalingSpec, severity string) int32 {
+	if spec.Webhook != nil {
+		if replicas, ok := spec.Webhook.SeverityReplicas[severity]; ok {
+			return replicas
+		}
+	}
+
+	switch severity {
+	case "critical":
+		return 5
+	case "warning":
+		return 3
+	}
+	return 1
+}
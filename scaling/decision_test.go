@@ -0,0 +1,82 @@
+package scaling
+
+import (
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func TestDecide(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	spec := &autoscaler.CustomAutoScalingSpec{
+		MinReplicas: int32Ptr(2),
+		MaxReplicas: int32Ptr(8),
+		Behavior: &autoscaler.ScalingBehavior{
+			ScaleUp:   &autoscaler.ScalingRules{MaxStep: int32Ptr(2)},
+			ScaleDown: &autoscaler.ScalingRules{Cooldown: &metav1.Duration{Duration: 5 * time.Minute}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		current   int32
+		desired   int32
+		lastScale time.Time
+		want      Decision
+	}{
+		{
+			name:    "within bounds and step",
+			current: 3, desired: 4,
+			want: Decision{Current: 3, Desired: 4, Replicas: 4},
+		},
+		{
+			name:    "clamped to max then limited by step",
+			current: 5, desired: 20,
+			want: Decision{Current: 5, Desired: 20, Replicas: 7, Clamped: "maxReplicas", Limited: "scaleUp.maxStep"},
+		},
+		{
+			name:    "clamped to min",
+			current: 4, desired: 0,
+			want: Decision{Current: 4, Desired: 0, Replicas: 2, Clamped: "minReplicas"},
+		},
+		{
+			name:    "scale down during cooldown",
+			current: 6, desired: 3, lastScale: now.Add(-time.Minute),
+			want: Decision{Current: 6, Desired: 3, Replicas: 6, Limited: "scaleDown.cooldown"},
+		},
+		{
+			name:    "scale down after cooldown",
+			current: 6, desired: 3, lastScale: now.Add(-10 * time.Minute),
+			want: Decision{Current: 6, Desired: 3, Replicas: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Decide(spec, tt.current, tt.desired, tt.lastScale, now)
+			if got != tt.want {
+				t.Errorf("Decide() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicasForSeverity(t *testing.T) {
+	spec := &autoscaler.CustomAutoScalingSpec{}
+	for severity, want := range map[string]int32{"critical": 5, "warning": 3, "info": 1} {
+		if got := ReplicasForSeverity(spec, severity); got != want {
+			t.Errorf("ReplicasForSeverity(%q) = %d, want %d", severity, got, want)
+		}
+	}
+
+	spec.Webhook = &autoscaler.WebhookRouting{SeverityReplicas: map[string]int32{"critical": 10, "page": 7}}
+	for severity, want := range map[string]int32{"critical": 10, "page": 7, "warning": 3} {
+		if got := ReplicasForSeverity(spec, severity); got != want {
+			t.Errorf("routed ReplicasForSeverity(%q) = %d, want %d", severity, got, want)
+		}
+	}
+}
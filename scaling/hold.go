@@ -0,0 +1,50 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+)
+
+// Reasons a Hold suspends scaling, in order of precedence
+const (
+	HoldPaused   = "paused"
+	HoldFrozen   = "freezeReplicas"
+	HoldOverride = "override"
+)
+
+// Hold suspends the scaling decisions of a CR
+type Hold struct {
+	// Reason is one of HoldPaused, HoldFrozen or HoldOverride
+	Reason string
+	// Replicas is the replica count the target is pinned to, nil while
+	// paused as the target is left where it is
+	Replicas *int32
+	// Until is when the hold ends, zero while paused
+	Until time.Time
+}
+
+func (h *Hold) String() string {
+	if h.Replicas == nil {
+		return h.Reason
+	}
+	return fmt.Sprintf("%s at %d replicas until %s", h.Reason, *h.Replicas, h.Until.UTC().Format(time.RFC3339))
+}
+
+// HoldFor returns what suspends the scaling of cr at now, nil when it scales
+// normally. The skip-reconcile annotation pauses the CR as spec.paused does
+func HoldFor(cr *autoscaler.CustomAutoScaling, now time.Time) *Hold {
+	if _, skip := cr.Annotations[autoscaler.SkipReconcileAnnotation]; skip || cr.Spec.Paused {
+		return &Hold{Reason: HoldPaused}
+	}
+	if f := cr.Spec.FreezeReplicas; f != nil && now.Before(f.Until.Time) {
+		replicas := f.Replicas
+		return &Hold{Reason: HoldFrozen, Replicas: &replicas, Until: f.Until.Time}
+	}
+	if o := cr.Status.Override; o != nil && now.Before(o.Until.Time) {
+		replicas := o.Replicas
+		return &Hold{Reason: HoldOverride, Replicas: &replicas, Until: o.Until.Time}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package scaling
+
+import (
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHoldFor(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	freeze := &autoscaler.ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(now.Add(time.Hour))}
+	override := &autoscaler.OverrideStatus{Replicas: 6, Time: metav1.NewTime(now.Add(-time.Minute)), Until: metav1.NewTime(now.Add(time.Minute))}
+
+	tests := []struct {
+		name   string
+		mutate func(*autoscaler.CustomAutoScaling)
+		want   string
+	}{
+		{name: "none", want: ""},
+		{name: "paused", mutate: func(cr *autoscaler.CustomAutoScaling) { cr.Spec.Paused = true }, want: "paused"},
+		{name: "skip reconcile", mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Annotations = map[string]string{autoscaler.SkipReconcileAnnotation: "true"}
+		}, want: "paused"},
+		{name: "paused wins over freeze", mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Spec.Paused = true
+			cr.Spec.FreezeReplicas = freeze
+		}, want: "paused"},
+		{name: "frozen", mutate: func(cr *autoscaler.CustomAutoScaling) { cr.Spec.FreezeReplicas = freeze },
+			want: "freezeReplicas at 4 replicas until 2023-05-01T13:00:00Z"},
+		{name: "freeze wins over override", mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Spec.FreezeReplicas = freeze
+			cr.Status.Override = override
+		}, want: "freezeReplicas at 4 replicas until 2023-05-01T13:00:00Z"},
+		{name: "freeze expired", mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Spec.FreezeReplicas = &autoscaler.ReplicaFreeze{Replicas: 4, Until: metav1.NewTime(now)}
+		}, want: ""},
+		{name: "overridden", mutate: func(cr *autoscaler.CustomAutoScaling) { cr.Status.Override = override },
+			want: "override at 6 replicas until 2023-05-01T12:01:00Z"},
+		{name: "override expired", mutate: func(cr *autoscaler.CustomAutoScaling) {
+			cr.Status.Override = &autoscaler.OverrideStatus{Replicas: 6, Until: metav1.NewTime(now.Add(-time.Second))}
+		}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &autoscaler.CustomAutoScaling{}
+			if tt.mutate != nil {
+				tt.mutate(cr)
+			}
+			got := ""
+			if hold := HoldFor(cr, now); hold != nil {
+				got = hold.String()
+			}
+			if got != tt.want {
+				t.Errorf("HoldFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
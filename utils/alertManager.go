@@ -2,12 +2,12 @@ package utils
 
 import (
 	"context"
+	"strconv"
 
-	"fmt"
-
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	main "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -46,60 +46,92 @@ type Alert struct {
 	Fingerprint  string            `json:"fingerprint"`
 }
 
-func GetAlertManager(cr *autoscaler.CustomAutoScaling) (*v1.Alertmanager, error) {
-	alertManagerName := cr.Name + "-alert"
-	logger := k8sLogger(cr.Namespace, cr.Name+"-alert")
-	client, err := generatePromClient()
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
+// AlertReplicas returns the replicas a as stated in its AlertAnnotationReplicas
+// annotation, ok is false for alerts without a valid one
+func AlertReplicas(a Alert) (replicas int32, ok bool) {
+	value, found := a.Annotations[AlertAnnotationReplicas]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || n < 0 {
+		return 0, false
 	}
+	return int32(n), true
+}
 
-	alertManager, err := client.MonitoringV1().Alertmanagers(cr.Namespace).Get(context.TODO(), alertManagerName, metav1.GetOptions{})
+func (p *Provisioner) GetAlertManager(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.Alertmanager, error) {
+	alertManagerName := cr.Name + "-alert"
+	logger := k8sLogger(cr.Namespace, cr.Name+"-alert")
 
-	if err != nil {
-		logger.Error(fmt.Errorf("unable to fetch alertManager %s", err.Error()), "")
+	alertManager := &v1.Alertmanager{}
+	if err := p.get(ctx, "Alertmanager", cr.Namespace, alertManagerName, alertManager); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "unable to fetch alertManager")
+		}
 		return nil, err
 	}
 
 	logger.Info("alert Manager fetched succesfully")
-	return alertManager, err
+	return alertManager, nil
 
 }
 
-func CreateAlertManager(cr *autoscaler.CustomAutoScaling, replicas int32) (*v1.Alertmanager, error) {
+func (p *Provisioner) CreateAlertManager(ctx context.Context, cr *autoscaler.CustomAutoScaling, replicas int32) (*v1.Alertmanager, error) {
 	alertManagerName := cr.Name + "-alert"
 	logger := k8sLogger(cr.Namespace, cr.Name+"-alert")
-	client, err := generatePromClient()
 
+	_, err := p.getSecret(ctx, cr, alertManagerName+"secret")
 	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", alertManagerName, cr.Namespace, err.Error()), "")
-		panic(err)
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+
+		_, err = p.CreateAlertConfigSecret(ctx, cr)
+		if err != nil {
+			logger.Error(err, "error while creating alert secret", "Secret", alertManagerName+"secret")
+			return nil, err
+		}
 	}
 
-	_, err = getSecret(cr, alertManagerName+"secret")
-	if err != nil {
-		if errors.IsAlreadyExists(err) || errors.IsNotFound(err) {
+	alertManager := generateAlertManagerDef(alertManagerParams(cr, replicas))
 
-			_, err = createAlertConfigSecret(cr)
-			if err != nil {
-				panic(err)
-			}
-		}
-		panic(err)
+	if err := p.create(ctx, cr, "Alertmanager", alertManager); err != nil {
+		logger.Error(err, "unable to create alertManager")
+		return nil, err
+	}
+
+	logger.Info("alert Manager created succesfully")
+
+	return alertManager, nil
+
+}
 
+// UpdateAlertManager brings the spec of alertManager in line with cr and
+// reports whether it had to be updated, fields the CR leaves unset keep the
+// value they were defaulted to
+func (p *Provisioner) UpdateAlertManager(ctx context.Context, cr *autoscaler.CustomAutoScaling, alertManager *v1.Alertmanager, replicas int32) (bool, error) {
+	desired := generateAlertManagerDef(alertManagerParams(cr, replicas))
+	if apiequality.Semantic.DeepDerivative(desired.Spec, alertManager.Spec) {
+		return false, nil
 	}
 
-	if err != nil {
-		logger.Error(fmt.Errorf("error while creating alert secret %s  in namespace %s : %s", alertManagerName+"secret", cr.Namespace, err.Error()), "")
-		panic(err)
+	alertManager.Spec = desired.Spec
+	if err := p.update(ctx, cr, "Alertmanager", alertManager); err != nil {
+		k8sLogger(cr.Namespace, alertManager.Name).Error(err, "unable to update alertManager")
+		return false, err
 	}
+	return true, nil
+}
+
+// alertManagerParams returns the parameters of the Alertmanager of cr
+func alertManagerParams(cr *autoscaler.CustomAutoScaling, replicas int32) AlertManagerParams {
+	alertManagerName := cr.Name + "-alert"
 
 	labels := generateAlertLabels(alertManagerName, "Cluster", cr.ObjectMeta.Labels)
 	annotations := generateAlertAnots(cr.ObjectMeta)
 
-	params := AlertManagerParams{
+	return AlertManagerParams{
 		Name:       alertManagerName,
 		Namespace:  cr.Namespace,
 		TypeMeta:   generateMetaInformation("Alertmanager", "monitoring.coreos.com/v1"),
@@ -109,22 +141,8 @@ func CreateAlertManager(cr *autoscaler.CustomAutoScaling, replicas int32) (*v1.A
 		},
 		Replicas: replicas,
 		image:    "quay.io/prometheus/alertmanager:v0.25.0",
-		Secrets:  []string{alertManagerName + "secret"},
+		Secrets:  []string{alertManagerName + "secret", SignalsTokenSecret(cr.Name)},
 	}
-
-	alertManagerDef := generateAlertManagerDef(params)
-
-	alertManager, err := client.MonitoringV1().Alertmanagers(params.Namespace).Create(context.TODO(), alertManagerDef, metav1.CreateOptions{})
-
-	if err != nil {
-		logger.Error(fmt.Errorf("unable to create alertManager %s", err.Error()), "")
-		return nil, err
-	}
-
-	logger.Info("alert Manager created succesfully")
-
-	return alertManager, nil
-
 }
 
 func generateAlertManagerDef(params AlertManagerParams) *v1.Alertmanager {
@@ -151,6 +169,10 @@ func generateAlertManagerDef(params AlertManagerParams) *v1.Alertmanager {
 				MatchLabels: params.ConfigSelector,
 			},
 			Secrets: params.Secrets,
+			// the Service of the CR selects its Alertmanager pods by app
+			PodMetadata: &v1.EmbeddedObjectMetadata{
+				Labels: map[string]string{"app": params.Name},
+			},
 			// Image:   &params.image,
 			SecurityContext: &main.PodSecurityContext{
 				RunAsUser:    &runAsUser,
@@ -166,30 +188,37 @@ func generateAlertManagerDef(params AlertManagerParams) *v1.Alertmanager {
 	return &alertManager
 }
 
-func CreateAlertManagerService(cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+func (p *Provisioner) CreateAlertManagerService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
 	name := cr.Name + "-alert-service"
 	logger := k8sLogger(cr.Namespace, name)
 
-	params := ServiceParams{
-		Name:       name,
-		Namespace:  cr.Namespace,
-		Port:       9093,
-		TargetPort: 9093,
-		TargetApp:  cr.Name + "-alert",
-		Type:       "NodePort",
-		NodePort:   30900,
-	}
-
-	service, err := CreateService(cr, params)
+	service, err := p.CreateService(ctx, cr, alertManagerServiceParams(cr))
 
 	if err != nil {
-
-		logger.Error(fmt.Errorf("error while creating prometheus  service  %s  in namespace %s : %s", name, cr.Namespace, err.Error()), "")
-		panic(err)
+		logger.Error(err, "error while creating alertmanager service")
+		return nil, err
 	}
 
-	logger.Info("Prometheus service created succesfully")
+	logger.Info("Alertmanager service created succesfully")
 
 	return service, nil
 
 }
+
+func (p *Provisioner) GetAlertManagerService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+	return p.GetService(ctx, cr, alertManagerServiceParams(cr).Name)
+}
+
+// alertManagerServiceParams returns the parameters of the service exposing the
+// Alertmanager of cr inside the cluster, the operator reads active alerts
+// back through it
+func alertManagerServiceParams(cr *autoscaler.CustomAutoScaling) ServiceParams {
+	return ServiceParams{
+		Name:       cr.Name + "-alert-service",
+		Namespace:  cr.Namespace,
+		Port:       9093,
+		TargetPort: 9093,
+		TargetApp:  cr.Name + "-alert",
+		Type:       string(main.ServiceTypeClusterIP),
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+)
+
+// AlertmanagerURL returns the in cluster address of the Alertmanager managed for the CR
+func AlertmanagerURL(cr *autoscaler.CustomAutoScaling) string {
+	params := alertManagerServiceParams(cr)
+	return fmt.Sprintf("http://%s.%s.svc:%d", params.Name, params.Namespace, params.Port)
+}
+
+// gettableAlert is an alert as served by the Alertmanager v2 API
+type gettableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+	Status       struct {
+		State string `json:"state"`
+	} `json:"status"`
+}
+
+// FiringAlerts returns the alerts of cr the Alertmanager at address holds as
+// active, silenced and inhibited alerts are left out as they would not be sent
+// to the webhook either. The alerts are returned as the webhook would carry them
+func FiringAlerts(ctx context.Context, address string, cr *autoscaler.CustomAutoScaling) ([]Alert, error) {
+	query := url.Values{
+		"active":    {"true"},
+		"silenced":  {"false"},
+		"inhibited": {"false"},
+		"filter": {
+			fmt.Sprintf("%s=%q", AlertLabelName, cr.Name),
+			fmt.Sprintf("%s=%q", AlertLabelNamespace, cr.Namespace),
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/api/v2/alerts?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("alerts failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("alerts failed: %s: %s", resp.Status, body)
+	}
+
+	var gettable []gettableAlert
+	if err := json.NewDecoder(resp.Body).Decode(&gettable); err != nil {
+		return nil, fmt.Errorf("alerts failed: %w", err)
+	}
+
+	alerts := make([]Alert, 0, len(gettable))
+	for _, a := range gettable {
+		if a.Status.State != "active" {
+			continue
+		}
+		alerts = append(alerts, Alert{
+			Status:       "firing",
+			Labels:       a.Labels,
+			Annotations:  a.Annotations,
+			StartsAt:     a.StartsAt,
+			EndsAt:       a.EndsAt,
+			GeneratorURL: a.GeneratorURL,
+			Fingerprint:  a.Fingerprint,
+		})
+	}
+	return alerts, nil
+}
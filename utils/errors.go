@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+var (
+	// ErrCRDMissing is returned when a prometheus-operator CRD is not installed in the cluster
+	ErrCRDMissing = errors.New("custom resource definition is not installed")
+	// ErrForbidden is returned when the operator's RBAC does not allow the request
+	ErrForbidden = errors.New("forbidden by RBAC")
+	// ErrInvalidSpec is returned when the CR cannot be turned into a child resource
+	ErrInvalidSpec = errors.New("invalid spec")
+	// ErrClientConfig is returned when no client can be built for the cluster
+	ErrClientConfig = errors.New("unable to build cluster client")
+)
+
+// ProvisionError is a failure to get, create or delete a child resource of a CustomAutoScaling
+type ProvisionError struct {
+	Kind string
+	Name string
+	Op   string
+	// Cause is one of the sentinel errors above, nil if the failure was not classified
+	Cause error
+	Err   error
+}
+
+func (e *ProvisionError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s %s %s: %s: %v", e.Op, e.Kind, e.Name, e.Cause, e.Err)
+	}
+	return fmt.Sprintf("%s %s %s: %v", e.Op, e.Kind, e.Name, e.Err)
+}
+
+func (e *ProvisionError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is match the sentinel cause as well as the wrapped error
+func (e *ProvisionError) Is(target error) bool {
+	return e.Cause != nil && e.Cause == target
+}
+
+// wrapError classifies err and wraps it with the child resource it was returned for
+func wrapError(kind, name, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pe *ProvisionError
+	if errors.As(err, &pe) {
+		return err
+	}
+
+	cause := classify(err)
+	// the API server answers 404 on create when the resource type itself is unknown
+	if cause == nil && op == "create" && apierrors.IsNotFound(err) {
+		cause = ErrCRDMissing
+	}
+	return &ProvisionError{Kind: kind, Name: name, Op: op, Cause: cause, Err: err}
+}
+
+func classify(err error) error {
+	switch {
+	case meta.IsNoMatchError(err):
+		return ErrCRDMissing
+	case apierrors.IsForbidden(err):
+		return ErrForbidden
+	case errors.Is(err, ErrInvalidSpec):
+		return ErrInvalidSpec
+	case errors.Is(err, ErrClientConfig):
+		return ErrClientConfig
+	}
+	return nil
+}
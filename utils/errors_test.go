@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestWrapError(t *testing.T) {
+	gr := schema.GroupResource{Group: "monitoring.coreos.com", Resource: "alertmanagers"}
+
+	tests := []struct {
+		name     string
+		op       string
+		err      error
+		cause    error
+		notFound bool
+	}{
+		{name: "no kind match", op: "get", err: &meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: gr.Group, Kind: "Alertmanager"}}, cause: ErrCRDMissing},
+		{name: "create on unknown resource", op: "create", err: apierrors.NewNotFound(gr, ""), cause: ErrCRDMissing, notFound: true},
+		{name: "get of missing object", op: "get", err: apierrors.NewNotFound(gr, "demo-alert"), notFound: true},
+		{name: "forbidden", op: "create", err: apierrors.NewForbidden(gr, "demo-alert", errors.New("denied")), cause: ErrForbidden},
+		{name: "invalid spec", op: "create", err: fmt.Errorf("%w: bad memory", ErrInvalidSpec), cause: ErrInvalidSpec},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapError("Alertmanager", "demo-alert", tt.op, tt.err)
+
+			var pe *ProvisionError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected a ProvisionError, got %T", err)
+			}
+			if tt.cause != nil && !errors.Is(err, tt.cause) {
+				t.Errorf("expected errors.Is(%v), got cause %v", tt.cause, pe.Cause)
+			}
+			if tt.cause == nil && pe.Cause != nil {
+				t.Errorf("expected no cause, got %v", pe.Cause)
+			}
+			if got := apierrors.IsNotFound(err); got != tt.notFound {
+				t.Errorf("IsNotFound = %v, want %v", got, tt.notFound)
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@ package utils
 
 import (
 	"context"
+	"errors"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	"github.com/go-logr/logr"
-	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -15,132 +19,167 @@ const (
 	AutoscaleFinalizer string = "customautoscalingFinalizer"
 )
 
-func HandleAutoScalerFinalizer(cr *autoscaler.CustomAutoScaling, cl client.Client) error {
+func (p *Provisioner) HandleAutoScalerFinalizer(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
 	if cr.GetDeletionTimestamp() != nil {
 		if controllerutil.ContainsFinalizer(cr, AutoscaleFinalizer) {
-			if err := finalizePrometheus(cr); err != nil {
+			if err := p.finalizePrometheus(ctx, cr); err != nil {
 				return err
 			}
 
-			if err := finalizeAlertManager(cr); err != nil {
+			if err := p.finalizeAlertManager(ctx, cr); err != nil {
 				return err
 			}
-			if err := finalizeServiceAccount(cr); err != nil {
+			if err := p.finalizeServiceAccount(ctx, cr); err != nil {
 				return err
 			}
-			if err := finalizeRoles(cr); err != nil {
+			if err := p.finalizeRoles(ctx, cr); err != nil {
 				return err
 			}
-			if err := finalizeSVCMonitor(cr); err != nil {
+			if err := p.finalizeSVCMonitor(ctx, cr); err != nil {
 				return err
 			}
 
 			controllerutil.RemoveFinalizer(cr, AutoscaleFinalizer)
-			if err := cl.Update(context.TODO(), cr); err != nil {
-				logger.Error(err, "could not remove finalizer"+AutoscaleFinalizer)
+			if err := p.Client.Update(ctx, cr); err != nil {
+				logger.Error(err, "could not remove finalizer", "finalizer", AutoscaleFinalizer)
 				return err
 			}
+			logger.Info("Finalized the stack succesfully")
 		}
 	}
-	logger.Info("Finalized the stack succesfully")
 	return nil
 }
 
-func AddCustomautoscaleFinalizer(cr *autoscaler.CustomAutoScaling, cl client.Client) error {
+func (p *Provisioner) AddCustomautoscaleFinalizer(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	if !controllerutil.ContainsFinalizer(cr, AutoscaleFinalizer) {
 		controllerutil.AddFinalizer(cr, AutoscaleFinalizer)
-		return cl.Update(context.TODO(), cr)
+		return p.Client.Update(ctx, cr)
 	}
 	return nil
 
 }
 
-func finalizePrometheus(cr *autoscaler.CustomAutoScaling) error {
+func (p *Provisioner) finalizePrometheus(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
-	client, err := generatePromClient()
-
-	if err != nil {
-		panic(err)
-	}
 	promInstances := cr.Name + "-prometheus-instance"
 	for _, instance := range []string{promInstances} {
-		err = client.MonitoringV1().Prometheuses(cr.Namespace).Delete(context.TODO(), instance, metav1.DeleteOptions{})
-		if err != nil && !errors.IsNotFound(err) {
-			logger.Error(err, "could not delete prometheus", instance)
+		prometheus := &v1.Prometheus{ObjectMeta: metav1.ObjectMeta{Name: instance, Namespace: cr.Namespace}}
+		if err := p.delete(ctx, "Prometheus", prometheus); err != nil {
+			logger.Error(err, "could not delete prometheus", "Prometheus", instance)
 			return err
 		}
 	}
 	return nil
 }
 
-func finalizeAlertManager(cr *autoscaler.CustomAutoScaling) error {
+func (p *Provisioner) finalizeAlertManager(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
-	client, err := generatePromClient()
-
-	if err != nil {
-		panic(err)
-	}
 	alertInstances := cr.Name + "-alert"
 	for _, instance := range []string{alertInstances} {
-		err = client.MonitoringV1().Alertmanagers(cr.Namespace).Delete(context.TODO(), instance, metav1.DeleteOptions{})
-		if err != nil && !errors.IsNotFound(err) {
-			logger.Error(err, "could not delete alert", instance)
+		alertManager := &v1.Alertmanager{ObjectMeta: metav1.ObjectMeta{Name: instance, Namespace: cr.Namespace}}
+		if err := p.delete(ctx, "Alertmanager", alertManager); err != nil {
+			logger.Error(err, "could not delete alertmanager", "Alertmanager", instance)
 			return err
 		}
 	}
 	return nil
 }
 
-func finalizeServiceAccount(cr *autoscaler.CustomAutoScaling) error {
+func (p *Provisioner) finalizeServiceAccount(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
 
 	saName := cr.Name + "-sa"
 
-	err := generateK8sClient().CoreV1().ServiceAccounts(cr.Namespace).Delete(context.TODO(), saName, metav1.DeleteOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		logger.Error(err, "could not delete service account", saName)
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: saName, Namespace: cr.Namespace}}
+	if err := p.delete(ctx, "ServiceAccount", sa); err != nil {
+		logger.Error(err, "could not delete service account", "ServiceAccount", saName)
 		return err
 	}
 
 	return nil
 }
 
-func finalizeSVCMonitor(cr *autoscaler.CustomAutoScaling) error {
+func (p *Provisioner) finalizeSVCMonitor(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
-	client, err := generatePromClient()
-
-	if err != nil {
-		panic(err)
-	}
 
 	serviceMonitor := cr.Name + "-svcm"
 
-	err = client.MonitoringV1().ServiceMonitors(cr.Namespace).Delete(context.TODO(), serviceMonitor, metav1.DeleteOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		logger.Error(err, "could not delete service monitor", serviceMonitor)
+	svcMonitor := &v1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Name: serviceMonitor, Namespace: cr.Namespace}}
+	if err := p.delete(ctx, "ServiceMonitor", svcMonitor); err != nil {
+		logger.Error(err, "could not delete service monitor", "ServiceMonitor", serviceMonitor)
 		return err
 	}
 
 	return nil
 }
 
-func finalizeRoles(cr *autoscaler.CustomAutoScaling) error {
+// finalizeRoles removes the cluster scoped RBAC objects, they cannot be owned by the CR
+func (p *Provisioner) finalizeRoles(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
 	logger := finalizerLogger(cr.Namespace, AutoscaleFinalizer)
 
-	roleName := cr.Name + "-role"
+	roleName := cr.Name + "-clusterrole"
+	bindingName := cr.Name + "-rolebinding"
 
-	err := generateK8sClient().RbacV1().ClusterRoles().Delete(context.TODO(), roleName, metav1.DeleteOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		logger.Error(err, "could not delete cluster role", roleName)
+	role := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: roleName}}
+	if err := p.delete(ctx, "ClusterRole", role); err != nil {
+		logger.Error(err, "could not delete cluster role", "ClusterRole", roleName)
 		return err
 	}
 
+	binding := &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: bindingName}}
+	if err := p.delete(ctx, "ClusterRoleBinding", binding); err != nil {
+		logger.Error(err, "could not delete cluster role binding", "ClusterRoleBinding", bindingName)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteMonitoring removes the monitoring stack provisioned for cr, which it
+// no longer uses once switched to embedded mode, and records each child it
+// deleted on cr. The signals token is kept
+func (p *Provisioner) DeleteMonitoring(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
+	namespaced := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: cr.Namespace}
+	}
+	children := []struct {
+		kind string
+		obj  client.Object
+	}{
+		{"Prometheus", &v1.Prometheus{ObjectMeta: namespaced(cr.Name + "-prometheus-instance")}},
+		{"Alertmanager", &v1.Alertmanager{ObjectMeta: namespaced(cr.Name + "-alert")}},
+		{"PrometheusRule", &v1.PrometheusRule{ObjectMeta: namespaced(cr.Name + "-prometheus-rule")}},
+		{"ServiceMonitor", &v1.ServiceMonitor{ObjectMeta: namespaced(cr.Name + "-svcm")}},
+		{"Service", &corev1.Service{ObjectMeta: namespaced(prometheusServiceParams(cr).Name)}},
+		{"Service", &corev1.Service{ObjectMeta: namespaced(alertManagerServiceParams(cr).Name)}},
+		{"Service", &corev1.Service{ObjectMeta: namespaced(RemoteWriteService(cr.Name))}},
+		{"Secret", &corev1.Secret{ObjectMeta: namespaced(cr.Name + "-secret")}},
+		{"Secret", &corev1.Secret{ObjectMeta: namespaced(cr.Name + "-alertsecret")}},
+		{"ServiceAccount", &corev1.ServiceAccount{ObjectMeta: namespaced(cr.Name + "-sa")}},
+		{"ClusterRoleBinding", &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-rolebinding"}}},
+		{"ClusterRole", &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: cr.Name + "-clusterrole"}}},
+	}
+
+	for _, child := range children {
+		// reads are served from the cache, only children still there are deleted
+		err := p.get(ctx, child.kind, child.obj.GetNamespace(), child.obj.GetName(), child.obj)
+		switch {
+		case apierrors.IsNotFound(err), errors.Is(err, ErrCRDMissing):
+			continue
+		case err != nil:
+			return err
+		}
+		if err := p.delete(ctx, child.kind, child.obj); err != nil {
+			return err
+		}
+		p.Recorder.Eventf(cr, corev1.EventTypeNormal, "Deleted", "deleted %s %s, embedded mode does not use it", child.kind, child.obj.GetName())
+	}
 	return nil
 }
 
 // finalizeLogger will generate logging interface
 func finalizerLogger(namespace string, name string) logr.Logger {
-	reqLogger := log.WithValues("Request.Service.Namespace", namespace, "Request.Finalizer.Name", name)
+	reqLogger := log.WithValues("Request.Namespace", namespace, "Request.Finalizer.Name", name)
 	return reqLogger
 }
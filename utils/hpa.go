@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HPASelectorLabel selects the CR in the external metrics of a generated HPA,
+// the external metrics API uses it to find the query behind a metric
+const HPASelectorLabel = "buildpiper.opstreelabs.in/customautoscaling"
+
+// hpaPolicyPeriod is the window a maxStep is applied over
+const hpaPolicyPeriod int32 = 60
+
+func hpaName(cr *autoscaler.CustomAutoScaling) string {
+	return cr.Name + "-hpa"
+}
+
+func generateHPADef(cr *autoscaler.CustomAutoScaling) *autoscalingv2.HorizontalPodAutoscaler {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		TypeMeta:   generateMetaInformation("HorizontalPodAutoscaler", "autoscaling/v2"),
+		ObjectMeta: generateObjectMetaInformation(hpaName(cr), cr.Namespace, cr.Labels, nil),
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       cr.Spec.Target.Name,
+			},
+			MinReplicas: cr.Spec.MinReplicas,
+		},
+	}
+	if cr.Spec.MaxReplicas != nil {
+		hpa.Spec.MaxReplicas = *cr.Spec.MaxReplicas
+	}
+
+	for _, m := range cr.Spec.Metrics {
+		hpa.Spec.Metrics = append(hpa.Spec.Metrics, autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				Metric: autoscalingv2.MetricIdentifier{
+					Name: m.Name,
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{HPASelectorLabel: cr.Name},
+					},
+				},
+				Target: autoscalingv2.MetricTarget{
+					Type:         autoscalingv2.AverageValueMetricType,
+					AverageValue: m.TargetAverageValue,
+				},
+			},
+		})
+	}
+
+	if b := cr.Spec.Behavior; b != nil {
+		hpa.Spec.Behavior = &autoscalingv2.HorizontalPodAutoscalerBehavior{
+			ScaleUp:   generateHPAScalingRules(b.ScaleUp),
+			ScaleDown: generateHPAScalingRules(b.ScaleDown),
+		}
+	}
+
+	return hpa
+}
+
+// generateHPAScalingRules maps maxStep to a Pods policy and cooldown to the
+// stabilization window, the closest the HPA algorithm gets to either
+func generateHPAScalingRules(rules *autoscaler.ScalingRules) *autoscalingv2.HPAScalingRules {
+	if rules == nil {
+		return nil
+	}
+
+	hpaRules := &autoscalingv2.HPAScalingRules{}
+	if rules.Cooldown != nil {
+		window := int32(rules.Cooldown.Duration.Seconds())
+		hpaRules.StabilizationWindowSeconds = &window
+	}
+	if rules.MaxStep != nil {
+		hpaRules.Policies = []autoscalingv2.HPAScalingPolicy{
+			{Type: autoscalingv2.PodsScalingPolicy, Value: *rules.MaxStep, PeriodSeconds: hpaPolicyPeriod},
+		}
+	}
+	return hpaRules
+}
+
+func (p *Provisioner) GetHPA(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	name := hpaName(cr)
+	logger := k8sLogger(cr.Namespace, name)
+
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+	if err := p.get(ctx, "HorizontalPodAutoscaler", cr.Namespace, name, hpa); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "error while fetching horizontalpodautoscaler")
+		}
+		return nil, err
+	}
+
+	return hpa, nil
+}
+
+func (p *Provisioner) CreateHPA(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	name := hpaName(cr)
+	logger := k8sLogger(cr.Namespace, name)
+
+	hpa := generateHPADef(cr)
+	if err := p.create(ctx, cr, "HorizontalPodAutoscaler", hpa); err != nil {
+		logger.Error(err, "error while creating horizontalpodautoscaler")
+		return nil, err
+	}
+
+	logger.Info("HorizontalPodAutoscaler created succesfully")
+
+	return hpa, nil
+}
+
+// UpdateHPA brings the spec of hpa in line with the CR and reports whether it
+// had to be updated, fields the CR leaves unset keep the value the API server
+// defaulted them to
+func (p *Provisioner) UpdateHPA(ctx context.Context, cr *autoscaler.CustomAutoScaling, hpa *autoscalingv2.HorizontalPodAutoscaler) (bool, error) {
+	desired := generateHPADef(cr)
+	if apiequality.Semantic.DeepDerivative(desired.Spec, hpa.Spec) {
+		return false, nil
+	}
+
+	hpa.Spec = desired.Spec
+	if err := p.update(ctx, cr, "HorizontalPodAutoscaler", hpa); err != nil {
+		k8sLogger(cr.Namespace, hpa.Name).Error(err, "error while updating horizontalpodautoscaler")
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteHPA removes the HPA generated for the CR, an HPA of the same name that
+// the CR does not control is left alone
+func (p *Provisioner) DeleteHPA(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
+	hpa, err := p.GetHPA(ctx, cr)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(hpa, cr) {
+		return nil
+	}
+	return p.delete(ctx, "HorizontalPodAutoscaler", hpa)
+}
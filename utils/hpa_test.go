@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func newHPACR() *autoscaler.CustomAutoScaling {
+	cr := newTestCR()
+	cr.Spec.Driver = autoscaler.HPADriver
+	cr.Spec.MaxReplicas = int32Ptr(10)
+	cr.Spec.Metrics[0].TargetAverageValue = resource.NewQuantity(50, resource.DecimalSI)
+	cr.Spec.Behavior = &autoscaler.ScalingBehavior{
+		ScaleUp: &autoscaler.ScalingRules{MaxStep: int32Ptr(2), Cooldown: &metav1.Duration{Duration: 30 * time.Second}},
+	}
+	return cr
+}
+
+func TestHPA(t *testing.T) {
+	ctx := context.Background()
+	cr := newHPACR()
+	p := newTestProvisioner(t, cr)
+
+	if _, err := p.CreateHPA(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	hpa, err := p.GetHPA(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !metav1.IsControlledBy(hpa, cr) {
+		t.Errorf("HPA owner references = %+v", hpa.OwnerReferences)
+	}
+	if ref := hpa.Spec.ScaleTargetRef; ref.Kind != "Deployment" || ref.Name != "demo" {
+		t.Errorf("scaleTargetRef = %+v", ref)
+	}
+	if hpa.Spec.MaxReplicas != 10 {
+		t.Errorf("maxReplicas = %d, want 10", hpa.Spec.MaxReplicas)
+	}
+	if len(hpa.Spec.Metrics) != 1 || hpa.Spec.Metrics[0].External == nil {
+		t.Fatalf("metrics = %+v", hpa.Spec.Metrics)
+	}
+	external := hpa.Spec.Metrics[0].External
+	if external.Metric.Name != "requests" || external.Metric.Selector.MatchLabels[HPASelectorLabel] != "demo" {
+		t.Errorf("external metric = %+v", external.Metric)
+	}
+	if external.Target.Type != autoscalingv2.AverageValueMetricType || external.Target.AverageValue.Value() != 50 {
+		t.Errorf("external target = %+v", external.Target)
+	}
+	up := hpa.Spec.Behavior.ScaleUp
+	if *up.StabilizationWindowSeconds != 30 || len(up.Policies) != 1 || up.Policies[0].Value != 2 {
+		t.Errorf("scaleUp = %+v", up)
+	}
+
+	// what the API server defaults does not count as drift
+	hpa.Spec.MinReplicas = int32Ptr(1)
+	hpa.Spec.Behavior.ScaleDown = &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: int32Ptr(300)}
+	if err := p.Client.Update(ctx, hpa); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := p.UpdateHPA(ctx, cr, hpa); err != nil || updated {
+		t.Errorf("UpdateHPA() on defaulted HPA = %v, %v, want no update", updated, err)
+	}
+
+	cr.Spec.MaxReplicas = int32Ptr(12)
+	if updated, err := p.UpdateHPA(ctx, cr, hpa); err != nil || !updated {
+		t.Fatalf("UpdateHPA() after maxReplicas change = %v, %v, want an update", updated, err)
+	}
+	if hpa, err = p.GetHPA(ctx, cr); err != nil || hpa.Spec.MaxReplicas != 12 {
+		t.Errorf("maxReplicas after update = %d, %v, want 12", hpa.Spec.MaxReplicas, err)
+	}
+
+	if err := p.DeleteHPA(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetHPA(ctx, cr); !apierrors.IsNotFound(err) {
+		t.Errorf("GetHPA() after delete = %v, want NotFound", err)
+	}
+}
+
+func TestDeleteHPALeavesForeignHPA(t *testing.T) {
+	ctx := context.Background()
+	cr := newHPACR()
+	foreign := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: "demo-hpa", Namespace: "default"}}
+	p := newTestProvisioner(t, cr, foreign)
+
+	if err := p.DeleteHPA(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetHPA(ctx, cr); err != nil {
+		t.Errorf("GetHPA() = %v, the HPA not owned by the CR was deleted", err)
+	}
+}
@@ -2,9 +2,8 @@ package utils
 
 import (
 	"context"
-	"fmt"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
@@ -12,17 +11,15 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func GetSAccount(cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAccount, error) {
+func (p *Provisioner) GetSAccount(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAccount, error) {
 	saName := cr.Name + "-sa"
 	logger := k8sLogger(cr.Namespace, saName)
-	getOpts := metav1.GetOptions{
-		TypeMeta: generateMetaInformation("ServiceAccount", "v1"),
-	}
-	saInfo, err := generateK8sClient().CoreV1().ServiceAccounts(cr.Namespace).Get(context.TODO(), saName, getOpts)
 
-	if err != nil {
-
-		logger.Error(fmt.Errorf("get serviceAccount failed %s  : %s", saName, err.Error()), "")
+	saInfo := &corev1.ServiceAccount{}
+	if err := p.get(ctx, "ServiceAccount", cr.Namespace, saName, saInfo); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "get serviceAccount failed")
+		}
 		return nil, err
 	}
 
@@ -31,26 +28,14 @@ func GetSAccount(cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAccount, erro
 	return saInfo, nil
 }
 
-func CreateServiceAccount(cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAccount, error) {
+func (p *Provisioner) CreateServiceAccount(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAccount, error) {
 	saName := cr.Name + "-sa"
 	logger := k8sLogger(cr.Namespace, saName)
 
-	sa := &corev1.ServiceAccount{
-		TypeMeta: generateMetaInformation("ServiceAccount", "v1"),
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      saName,
-			Namespace: cr.Namespace,
-		},
-	}
-
-	sa, err := generateK8sClient().CoreV1().ServiceAccounts(cr.Namespace).Create(context.Background(), sa, metav1.CreateOptions{})
-	if err != nil {
-		if errors.IsAlreadyExists(err) {
-
-			logger.Error(fmt.Errorf("ServiceAccount %s already exists in namespace  : %s", saName, err.Error()), "")
-			return nil, err
-		}
-		return nil, fmt.Errorf("failed to create ServiceAccount %s in namespace %s: %v", saName, cr.Namespace, err)
+	sa := generateServiceAccountDef(saName, cr.Namespace)
+	if err := p.create(ctx, cr, "ServiceAccount", sa); err != nil {
+		logger.Error(err, "create serviceAccount failed")
+		return nil, err
 	}
 
 	logger.Info("Service Account creation Success")
@@ -58,30 +43,40 @@ func CreateServiceAccount(cr *autoscaler.CustomAutoScaling) (*corev1.ServiceAcco
 	return sa, nil
 }
 
-func GetClusterRole(cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRole, error) {
+func generateServiceAccountDef(name, namespace string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta: generateMetaInformation("ServiceAccount", "v1"),
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+func (p *Provisioner) GetClusterRole(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRole, error) {
 	roleName := cr.Name + "-clusterrole"
 	logger := k8sLogger(cr.Namespace, roleName)
 	logger.Info("Fetching clusterRole ......")
-	clusterRole, err := generateK8sClient().RbacV1().ClusterRoles().Get(context.TODO(), roleName, metav1.GetOptions{})
-	if err != nil {
 
-		logger.Error(fmt.Errorf("error while fetching clusterRole %s  in namespace %s : %s", roleName, cr.Namespace, err.Error()), "")
+	clusterRole := &rbacv1.ClusterRole{}
+	if err := p.get(ctx, "ClusterRole", "", roleName, clusterRole); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "error while fetching clusterRole")
+		}
 		return nil, err
 	}
 	logger.Info("ClusterRole fetched succesfully")
 	return clusterRole, nil
 }
 
-func CreateClusterRole(cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRole, error) {
+func (p *Provisioner) CreateClusterRole(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRole, error) {
 	roleName := cr.Name + "-clusterrole"
 	logger := k8sLogger(cr.Namespace, roleName)
-	logger.Info("Fetching clusterRole ......")
+	logger.Info("Creating clusterRole ......")
 
-	clusterRoleDef := generateClusterDef(roleName, cr.Namespace)
-	clusterRole, err := generateK8sClient().RbacV1().ClusterRoles().Create(context.TODO(), clusterRoleDef, metav1.CreateOptions{})
-	if err != nil {
-
-		logger.Error(fmt.Errorf("error while fetching clusterRole %s  in namespace %s : %s", roleName, cr.Namespace, err.Error()), "")
+	clusterRole := generateClusterDef(roleName, cr.Namespace)
+	if err := p.create(ctx, cr, "ClusterRole", clusterRole); err != nil {
+		logger.Error(err, "error while creating clusterRole")
 		return nil, err
 	}
 	logger.Info("ClusterRole created succesfully")
@@ -115,8 +110,7 @@ func generateClusterDef(name, namespace string) *rbacv1.ClusterRole {
 
 		TypeMeta: generateMetaInformation("ClusterRole", "rbac.authorization.k8s.io/v1"),
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
+			Name: name,
 		},
 		Rules: rules,
 	}
@@ -125,31 +119,31 @@ func generateClusterDef(name, namespace string) *rbacv1.ClusterRole {
 
 }
 
-func GetRoleBinding(cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRoleBinding, error) {
+func (p *Provisioner) GetRoleBinding(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRoleBinding, error) {
 	binding := cr.Name + "-rolebinding"
 	logger := k8sLogger(cr.Namespace, binding)
 
-	roleBinding, err := generateK8sClient().RbacV1().ClusterRoleBindings().Get(context.TODO(), binding, metav1.GetOptions{})
-
-	if err != nil {
-		logger.Error(fmt.Errorf("unable to fetch rolebinding %s", err.Error()), "")
+	roleBinding := &rbacv1.ClusterRoleBinding{}
+	if err := p.get(ctx, "ClusterRoleBinding", "", binding, roleBinding); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "unable to fetch rolebinding")
+		}
 		return nil, err
 	}
 
-	logger.Info("ClusterRoleBinding created succesfully")
+	logger.Info("ClusterRoleBinding fetched succesfully")
 
 	return roleBinding, nil
 
 }
 
-func CreateClusterRoleBinding(cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRoleBinding, error) {
+func (p *Provisioner) CreateClusterRoleBinding(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*rbacv1.ClusterRoleBinding, error) {
 	binding := cr.Name + "-rolebinding"
 	logger := k8sLogger(cr.Namespace, binding)
-	client := generateK8sClient()
-	clusterRoleBindingDef := generateClusterRoleBindindingDef(binding, cr.Namespace, cr.Name+"-sa")
-	roleBinding, err := client.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBindingDef, metav1.CreateOptions{})
-	if err != nil {
-		logger.Error(fmt.Errorf("unable to create clusterrolebinding %s", err.Error()), "")
+
+	roleBinding := generateClusterRoleBindindingDef(binding, cr.Namespace, cr.Name+"-sa", cr.Name+"-clusterrole")
+	if err := p.create(ctx, cr, "ClusterRoleBinding", roleBinding); err != nil {
+		logger.Error(err, "unable to create clusterrolebinding")
 		return nil, err
 	}
 	logger.Info("clusterrolebinding created succesfully")
@@ -157,16 +151,16 @@ func CreateClusterRoleBinding(cr *autoscaler.CustomAutoScaling) (*rbacv1.Cluster
 	return roleBinding, nil
 }
 
-func generateClusterRoleBindindingDef(name, namespace, sa string) *rbacv1.ClusterRoleBinding {
+func generateClusterRoleBindindingDef(name, namespace, sa, role string) *rbacv1.ClusterRoleBinding {
 	clusterRolebinding := &rbacv1.ClusterRoleBinding{
-		TypeMeta: generateMetaInformation("ClusterRoleBinding", " rbac.authorization.k8s.io/v1"),
+		TypeMeta: generateMetaInformation("ClusterRoleBinding", "rbac.authorization.k8s.io/v1"),
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
 		},
 		RoleRef: rbacv1.RoleRef{
 			APIGroup: "rbac.authorization.k8s.io",
 			Kind:     "ClusterRole",
-			Name:     name,
+			Name:     role,
 		},
 		Subjects: []rbacv1.Subject{
 			{
@@ -180,6 +174,6 @@ func generateClusterRoleBindindingDef(name, namespace, sa string) *rbacv1.Cluste
 }
 
 func k8sLogger(namespace string, name string) logr.Logger {
-	reqLogger := log.WithValues("Request.Service.Namespace", "Request.Service.Name", namespace, name)
+	reqLogger := log.WithValues("Request.Namespace", namespace, "Request.Name", name)
 	return reqLogger
 }
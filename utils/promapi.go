@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	"buildpiper.opstreelabs.in/autoscaler/predict"
+	"github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// PrometheusURL returns the in cluster address of the Prometheus managed for the CR,
+// the Service of the CR reaches only its own instance where prometheus-operated
+// spans every instance of the namespace
+func PrometheusURL(cr *autoscaler.CustomAutoScaling) string {
+	params := prometheusServiceParams(cr)
+	return fmt.Sprintf("http://%s.%s.svc:%d", params.Name, params.Namespace, params.Port)
+}
+
+func generatePromAPI(address string) (promv1.API, error) {
+	client, err := api.NewClient(api.Config{Address: address})
+	if err != nil {
+		return nil, err
+	}
+	return promv1.NewAPI(client), nil
+}
+
+// QueryRange evaluates query over [start, end] and returns the first series of the result
+func QueryRange(ctx context.Context, address, query string, start, end time.Time, step time.Duration) ([]predict.Sample, error) {
+	matrix, err := QueryMatrix(ctx, address, query, promv1.Range{Start: start, End: end, Step: step})
+	if err != nil {
+		return nil, err
+	}
+	if len(matrix) == 0 {
+		return nil, nil
+	}
+
+	series := make([]predict.Sample, 0, len(matrix[0].Values))
+	for _, v := range matrix[0].Values {
+		series = append(series, predict.Sample{Time: v.Timestamp.Time(), Value: float64(v.Value)})
+	}
+	return series, nil
+}
+
+// QueryMatrix evaluates query over r and returns every series of the result
+func QueryMatrix(ctx context.Context, address, query string, r promv1.Range) (model.Matrix, error) {
+	promAPI, err := generatePromAPI(address)
+	if err != nil {
+		return nil, err
+	}
+
+	value, _, err := promAPI.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, fmt.Errorf("query_range %q failed: %w", query, err)
+	}
+
+	matrix, ok := value.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("query_range %q returned %s, expected matrix", query, value.Type())
+	}
+	return matrix, nil
+}
+
+// QueryInstant evaluates query at ts, a scalar result is returned as a single
+// sample without labels
+func QueryInstant(ctx context.Context, address, query string, ts time.Time) (model.Vector, error) {
+	promAPI, err := generatePromAPI(address)
+	if err != nil {
+		return nil, err
+	}
+
+	value, _, err := promAPI.Query(ctx, query, ts)
+	if err != nil {
+		return nil, fmt.Errorf("query %q failed: %w", query, err)
+	}
+
+	switch v := value.(type) {
+	case model.Vector:
+		return v, nil
+	case *model.Scalar:
+		return model.Vector{{Metric: model.Metric{}, Value: v.Value, Timestamp: v.Timestamp}}, nil
+	}
+	return nil, fmt.Errorf("query %q returned %s, expected vector or scalar", query, value.Type())
+}
+
+// Rules returns the rule groups loaded by the Prometheus at address
+func Rules(ctx context.Context, address string) (promv1.RulesResult, error) {
+	promAPI, err := generatePromAPI(address)
+	if err != nil {
+		return promv1.RulesResult{}, err
+	}
+	rules, err := promAPI.Rules(ctx)
+	if err != nil {
+		return promv1.RulesResult{}, fmt.Errorf("rules failed: %w", err)
+	}
+	return rules, nil
+}
+
+// Targets returns the scrape targets of the Prometheus at address
+func Targets(ctx context.Context, address string) (promv1.TargetsResult, error) {
+	promAPI, err := generatePromAPI(address)
+	if err != nil {
+		return promv1.TargetsResult{}, err
+	}
+	targets, err := promAPI.Targets(ctx)
+	if err != nil {
+		return promv1.TargetsResult{}, fmt.Errorf("targets failed: %w", err)
+	}
+	return targets, nil
+}
+
+// ScrapePool returns the scrape pool prefix of the targets of the ServiceMonitor of cr
+func ScrapePool(cr *autoscaler.CustomAutoScaling) string {
+	return fmt.Sprintf("serviceMonitor/%s/%s/", cr.Namespace, svcMonitorParams(cr).Name)
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"strconv"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
 	main "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
@@ -20,7 +22,7 @@ type PrometheusParams struct {
 	Namespace                 string
 	SVCMonitorSelector        map[string]string
 	SAName                    string
-	Memory                    string
+	Resources                 main.ResourceRequirements
 	AlertManager              string
 	AlertPort                 string
 	Replicas                  int32
@@ -47,41 +49,103 @@ type PrometheusParams struct {
 	RulesSelector             metav1.LabelSelector
 }
 
+const (
+	// AlertLabelName and AlertLabelNamespace identify the CR an alert was generated for
+	AlertLabelName      = "customautoscaling"
+	AlertLabelNamespace = "customautoscaling_namespace"
+	// AlertAnnotationReplicas carries the replicas asked for by a step of a
+	// threshold ladder, the receiver takes the decision from it
+	AlertAnnotationReplicas = "replicas"
+)
+
+// prometheusReplicas returns spec.monitoring.replicas, defaulting to 3
+func prometheusReplicas(cr *autoscaler.CustomAutoScaling) int32 {
+	if r := cr.Spec.Monitoring.Replicas; r != nil {
+		return *r
+	}
+	return 3
+}
+
+// prometheusRetention returns spec.monitoring.retention, defaulting to 20d
+func prometheusRetention(cr *autoscaler.CustomAutoScaling) string {
+	if r := cr.Spec.Monitoring.Retention; r != "" {
+		return r
+	}
+	return "20d"
+}
+
 type PrometheusRuleParams struct {
 	Name      string
 	Namespace string
 	Groups    []v1.RuleGroup
 }
 
-func GetPrometheusInstance(cr *autoscaler.CustomAutoScaling) (*v1.Prometheus, error) {
-	logger := k8sLogger(cr.Namespace, cr.Name+"-prometheus-instance")
-	client, err := generatePromClient()
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
-	}
+func (p *Provisioner) GetPrometheusInstance(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.Prometheus, error) {
+	name := cr.Name + "-prometheus-instance"
+	logger := k8sLogger(cr.Namespace, name)
 
-	promInstance, err := client.MonitoringV1().Prometheuses(cr.Namespace).Get(context.TODO(), cr.Name+"-prometheus-instance", metav1.GetOptions{})
-	if err != nil {
-		logger.Error(fmt.Errorf("unable to create clusterrolebinding %s", err.Error()), "")
+	promInstance := &v1.Prometheus{}
+	if err := p.get(ctx, "Prometheus", cr.Namespace, name, promInstance); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "unable to fetch prometheus instance")
+		}
 		return nil, err
 	}
 
 	logger.Info("prometheus instance fetched succesfully")
-	return promInstance, err
+	return promInstance, nil
 }
 
 // Create a new Prometheus instance.
-func CreatePrometheusInstance(cr *autoscaler.CustomAutoScaling) (*v1.Prometheus, error) {
-	logger := k8sLogger(cr.Namespace, cr.Name+"-prometheus-instance")
-	client, err := generatePromClient()
+func (p *Provisioner) CreatePrometheusInstance(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.Prometheus, error) {
+	name := cr.Name + "-prometheus-instance"
+	logger := k8sLogger(cr.Namespace, name)
 
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
+	// the additional scrape config of the instance is kept in a secret
+	if _, err := p.getSecret(ctx, cr, cr.Name+"-secret"); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+
+		logger.Info("Secret doesnt exist for scrape config , creating now .......")
+		if _, err := p.createSecret(ctx, cr); err != nil {
+			logger.Error(err, "error while creating scrape config secret", "Secret", cr.Name+"-secret")
+			return nil, err
+		}
+	}
+
+	promInstance := generatePrometheusDef(cr, prometheusParams(cr))
+
+	if err := p.create(ctx, cr, "Prometheus", promInstance); err != nil {
+		logger.Error(err, "error while creating prometheus instance")
+		return nil, err
+	}
+
+	logger.Info("prometheus instance created succesfully")
+
+	return promInstance, nil
+}
+
+// UpdatePrometheusInstance brings the spec of promInstance in line with the
+// CR and reports whether it had to be updated, fields the CR leaves unset
+// keep the value they were defaulted to
+func (p *Provisioner) UpdatePrometheusInstance(ctx context.Context, cr *autoscaler.CustomAutoScaling, promInstance *v1.Prometheus) (bool, error) {
+	desired := generatePrometheusDef(cr, prometheusParams(cr))
+	if apiequality.Semantic.DeepDerivative(desired.Spec, promInstance.Spec) {
+		return false, nil
 	}
-	promData := PrometheusParams{
+
+	promInstance.Spec = desired.Spec
+	if err := p.update(ctx, cr, "Prometheus", promInstance); err != nil {
+		k8sLogger(cr.Namespace, promInstance.Name).Error(err, "error while updating prometheus instance")
+		return false, err
+	}
+	return true, nil
+}
+
+// prometheusParams returns the parameters of the Prometheus instance of cr
+func prometheusParams(cr *autoscaler.CustomAutoScaling) PrometheusParams {
+	return PrometheusParams{
 		Name:      cr.Name + "-prometheus-instance",
 		Namespace: cr.Namespace,
 		SVCMonitorSelector: map[string]string{
@@ -89,20 +153,21 @@ func CreatePrometheusInstance(cr *autoscaler.CustomAutoScaling) (*v1.Prometheus,
 		},
 		Image:             "quay.io/prometheus/prometheus:v2.42.0",
 		SAName:            cr.Name + "-sa",
-		Memory:            cr.Spec.ScalingParamsMapping["memory"],
+		Resources:         cr.Spec.Monitoring.Resources,
 		AlertManager:      cr.Name + "-alert",
 		AlertPort:         "alert-port",
-		Replicas:          3,
+		Replicas:          prometheusReplicas(cr),
 		Shards:            1,
 		LogLevel:          "info",
 		RoutePrefix:       "/",
-		Retention:         "20d",
+		Retention:         prometheusRetention(cr),
 		DisableCompaction: false,
 		ScrapeInterval:    "30s",
 		ListenLocal:       false,
 		EnableAdminAPI:    false,
-		// since we will use external data sources to send the metrics
-		EnableRemoteWriteReceiver: true,
+		// only the operator writes, on behalf of the workloads pushing through
+		// the authenticated remote write endpoint of the CR
+		EnableRemoteWriteReceiver: cr.Spec.Monitoring.RemoteWrite != nil,
 		ExternalUrl:               "",
 		RetentionSize:             "",
 		Paused:                    false,
@@ -127,49 +192,15 @@ func CreatePrometheusInstance(cr *autoscaler.CustomAutoScaling) (*v1.Prometheus,
 			// Key: "scrape-config.yml",
 		},
 	}
-
-	promDef, err := generatePrometheusDef(promData, cr)
-	if err != nil {
-
-		logger.Error(fmt.Errorf("error while creating prometheus instance params  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
-	}
-
-	promInstance, err := client.MonitoringV1().Prometheuses(cr.Namespace).Create(context.TODO(), promDef, metav1.CreateOptions{})
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while creating prometheus instance  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		return nil, err
-	}
-
-	logger.Info("prometheus instance created succesfully")
-
-	return promInstance, nil
 }
 
-func generatePrometheusDef(params PrometheusParams, cr *autoscaler.CustomAutoScaling) (*v1.Prometheus, error) {
-	secretName := cr.Name + "-secret"
-	logger := k8sLogger(cr.Namespace, secretName)
-
-	var err error
-
-	_, err = getSecret(cr, secretName)
-
-	if err != nil {
-		if errors.IsAlreadyExists(err) || errors.IsNotFound(err) {
-			logger.Info("Secret doesnt exist for scrape config , creating now .......")
-			_, err := createSecret(cr)
-			if err != nil {
-				return nil, err
-			}
-
-		} else {
-			logger.Error(fmt.Errorf("get secret failed %s  : %s", cr.Name+"-secret", err.Error()), "")
-			return nil, err
-		}
+// PrometheusPodLabels returns the labels of the pods of the Prometheus of cr
+func PrometheusPodLabels(cr *autoscaler.CustomAutoScaling) map[string]string {
+	return map[string]string{"app": cr.Name + "-prometheus-instance"}
+}
 
-	}
-	lbls := generatePromLabels(params.Name, cr.Spec.ApplicationRef.DeploymentName, cr.Labels)
+func generatePrometheusDef(cr *autoscaler.CustomAutoScaling, params PrometheusParams) *v1.Prometheus {
+	lbls := generatePromLabels(params.Name, cr.Spec.Target.Name, cr.Labels)
 	objectMeta := generateObjectMetaInformation(params.Name, cr.Namespace, lbls, cr.Annotations)
 
 	prometheus := &v1.Prometheus{
@@ -207,12 +238,12 @@ func generatePrometheusDef(params PrometheusParams, cr *autoscaler.CustomAutoSca
 				ServiceMonitorSelector: &metav1.LabelSelector{},
 
 				Replicas: &params.Replicas,
-
-				Resources: main.ResourceRequirements{
-					Requests: map[main.ResourceName]resource.Quantity{
-						main.ResourceMemory: resource.MustParse(params.Memory),
-					},
+				// the Service of the CR selects its Prometheus pods by app
+				PodMetadata: &v1.EmbeddedObjectMetadata{
+					Labels: PrometheusPodLabels(cr),
 				},
+
+				Resources:                 params.Resources,
 				LogLevel:                  params.LogLevel,
 				LogFormat:                 params.LogFormat,
 				ScrapeInterval:            v1.Duration(params.ScrapeInterval),
@@ -231,30 +262,23 @@ func generatePrometheusDef(params PrometheusParams, cr *autoscaler.CustomAutoSca
 		},
 	}
 
-	return prometheus, nil
+	return prometheus
+
+}
 
+func (p *Provisioner) GetPrometheusService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+	return p.GetService(ctx, cr, prometheusServiceParams(cr).Name)
 }
 
-func CreatePrometheusService(cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+func (p *Provisioner) CreatePrometheusService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
 	name := cr.Name + "-prometheus-service"
 	logger := k8sLogger(cr.Namespace, name)
 
-	params := ServiceParams{
-		Name:       name,
-		Namespace:  cr.Namespace,
-		Port:       9090,
-		TargetPort: 9090,
-		TargetApp:  cr.Name + "-prometheus-instance",
-		Type:       "NodePort",
-		NodePort:   30901,
-	}
-
-	service, err := CreateService(cr, params)
+	service, err := p.CreateService(ctx, cr, prometheusServiceParams(cr))
 
 	if err != nil {
-
-		logger.Error(fmt.Errorf("error while creating prometheus  service  %s  in namespace %s : %s", name, cr.Namespace, err.Error()), "")
-		panic(err)
+		logger.Error(err, "error while creating prometheus service")
+		return nil, err
 	}
 
 	logger.Info("Prometheus service created succesfully")
@@ -263,39 +287,28 @@ func CreatePrometheusService(cr *autoscaler.CustomAutoScaling) (*main.Service, e
 
 }
 
-func CreatePrometheusRule(cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule, error) {
-	logger := k8sLogger(cr.Namespace, cr.Name+"-prometheus-instance")
-	client, err := generatePromClient()
-	ruleName := cr.Name + "-prometheus-rule"
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
-	}
-
-	params := PrometheusRuleParams{
-		Name:      ruleName,
-		Namespace: cr.Namespace,
-		Groups: []v1.RuleGroup{
-			{
-				Name: "rule",
-				Rules: []v1.Rule{
-					{
-						Alert: "demo-alert",
-						Expr:  intstr.FromString(cr.Spec.ScalingQuery),
-						For:   "10s",
-					},
-				},
-			},
-		},
+// prometheusServiceParams returns the parameters of the service exposing the
+// Prometheus instance of cr inside the cluster. It is not a NodePort, the
+// remote write receiver of Prometheus does not authenticate its callers
+func prometheusServiceParams(cr *autoscaler.CustomAutoScaling) ServiceParams {
+	return ServiceParams{
+		Name:       cr.Name + "-prometheus-service",
+		Namespace:  cr.Namespace,
+		Port:       9090,
+		TargetPort: 9090,
+		TargetApp:  cr.Name + "-prometheus-instance",
+		Type:       string(main.ServiceTypeClusterIP),
 	}
+}
 
-	promRuleDef := generatePrometheusRuleDef(cr, params)
+func (p *Provisioner) CreatePrometheusRule(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule, error) {
+	ruleName := cr.Name + "-prometheus-rule"
+	logger := k8sLogger(cr.Namespace, ruleName)
 
-	promRule, err := client.MonitoringV1().PrometheusRules(cr.Namespace).Create(context.TODO(), promRuleDef, metav1.CreateOptions{})
+	promRule := generatePrometheusRuleDef(cr, prometheusRuleParams(cr))
 
-	if err != nil {
-		logger.Error(fmt.Errorf("error while creating prometheusRule  %s  in namespace %s : %s", ruleName, cr.Namespace, err.Error()), "")
+	if err := p.create(ctx, cr, "PrometheusRule", promRule); err != nil {
+		logger.Error(err, "error while creating prometheusRule")
 		return nil, err
 	}
 
@@ -304,19 +317,49 @@ func CreatePrometheusRule(cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule,
 	return promRule, nil
 }
 
-func GetPrometheusRule(cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule, error) {
-	logger := k8sLogger(cr.Namespace, cr.Name+"-prometheus-instance")
-	client, err := generatePromClient()
-	ruleName := cr.Name + "-prometheus-rule"
+// UpdatePrometheusRule brings the rules of promRule in line with the
+// thresholds, recording rules and queries of the CR and reports whether it
+// had to be updated
+func (p *Provisioner) UpdatePrometheusRule(ctx context.Context, cr *autoscaler.CustomAutoScaling, promRule *v1.PrometheusRule) (bool, error) {
+	desired := generatePrometheusRuleDef(cr, prometheusRuleParams(cr))
+	if apiequality.Semantic.DeepEqual(desired.Spec, promRule.Spec) {
+		return false, nil
+	}
 
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", cr.Name, cr.Namespace, err.Error()), "")
-		panic(err)
+	promRule.Spec = desired.Spec
+	if err := p.update(ctx, cr, "PrometheusRule", promRule); err != nil {
+		k8sLogger(cr.Namespace, promRule.Name).Error(err, "error while updating prometheusRule")
+		return false, err
 	}
-	promRule, err := client.MonitoringV1().PrometheusRules(cr.Namespace).Get(context.TODO(), ruleName, metav1.GetOptions{})
+	return true, nil
+}
 
+// DeletePrometheusRule removes the PrometheusRule generated for the CR once it
+// has no rules left to hold, a rule of the same name that the CR does not
+// control is left alone
+func (p *Provisioner) DeletePrometheusRule(ctx context.Context, cr *autoscaler.CustomAutoScaling) error {
+	promRule, err := p.GetPrometheusRule(ctx, cr)
 	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheusRule  %s  in namespace %s : %s", ruleName, cr.Namespace, err.Error()), "")
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(promRule, cr) {
+		return nil
+	}
+	return p.delete(ctx, "PrometheusRule", promRule)
+}
+
+func (p *Provisioner) GetPrometheusRule(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule, error) {
+	ruleName := cr.Name + "-prometheus-rule"
+	logger := k8sLogger(cr.Namespace, ruleName)
+
+	promRule := &v1.PrometheusRule{}
+	if err := p.get(ctx, "PrometheusRule", cr.Namespace, ruleName, promRule); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "error while fetching prometheusRule")
+		}
 		return nil, err
 	}
 
@@ -325,6 +368,161 @@ func GetPrometheusRule(cr *autoscaler.CustomAutoScaling) (*v1.PrometheusRule, er
 	return promRule, nil
 }
 
+// prometheusRuleParams returns the rules of cr: the recording rules of every
+// metric with a recording, then with the alerts driver the alerting rules,
+// one per metric and a group per metric with a threshold ladder holding one
+// rule per step
+func prometheusRuleParams(cr *autoscaler.CustomAutoScaling) PrometheusRuleParams {
+	var groups []v1.RuleGroup
+	for _, metric := range cr.Spec.Metrics {
+		if metric.Recording != nil {
+			groups = append(groups, recordingGroup(cr, metric))
+		}
+	}
+	// the other drivers query the metrics through the operator
+	if cr.Spec.Driver != "" && cr.Spec.Driver != autoscaler.AlertsDriver {
+		return PrometheusRuleParams{
+			Name:      cr.Name + "-prometheus-rule",
+			Namespace: cr.Namespace,
+			Groups:    groups,
+		}
+	}
+
+	// every metric without thresholds becomes an alert named after it
+	rules := make([]v1.Rule, 0, len(cr.Spec.Metrics))
+	var ladders []v1.RuleGroup
+	for _, metric := range cr.Spec.Metrics {
+		if len(metric.Thresholds) > 0 {
+			ladders = append(ladders, v1.RuleGroup{
+				Name:  metric.Name + "-thresholds",
+				Rules: MetricAlertingRules(cr, metric),
+			})
+			continue
+		}
+		rules = append(rules, MetricAlertingRules(cr, metric)...)
+	}
+
+	if len(rules) > 0 {
+		groups = append(groups, v1.RuleGroup{
+			Name:  "rule",
+			Rules: rules,
+		})
+	}
+	return PrometheusRuleParams{
+		Name:      cr.Name + "-prometheus-rule",
+		Namespace: cr.Namespace,
+		Groups:    append(groups, ladders...),
+	}
+}
+
+// recordingGroup returns the recording rules of metric, of its whole query or
+// of each of the expressions of its recording
+func recordingGroup(cr *autoscaler.CustomAutoScaling, metric autoscaler.Metric) v1.RuleGroup {
+	group := v1.RuleGroup{Name: metric.Name + "-recording"}
+	if interval := metric.Recording.Interval; interval != nil {
+		group.Interval = v1.Duration(model.Duration(interval.Duration).String())
+	}
+	if len(metric.Recording.Expressions) == 0 {
+		group.Rules = []v1.Rule{{
+			Record: autoscaler.RecordedSeries(cr.Name, metric, -1),
+			Expr:   intstr.FromString(metric.Query),
+		}}
+		return group
+	}
+	for i, expr := range metric.Recording.Expressions {
+		group.Rules = append(group.Rules, v1.Rule{
+			Record: autoscaler.RecordedSeries(cr.Name, metric, i),
+			Expr:   intstr.FromString(expr),
+		})
+	}
+	return group
+}
+
+// HasRecordingRules reports whether a metric of cr is recorded, the other
+// drivers than alerts then need a PrometheusRule as well
+func HasRecordingRules(cr *autoscaler.CustomAutoScaling) bool {
+	for _, metric := range cr.Spec.Metrics {
+		if metric.Recording != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// thresholdRules returns one alerting rule per step of the threshold ladder
+// of metric, all comparing the same query to the value of their step
+func thresholdRules(cr *autoscaler.CustomAutoScaling, metric autoscaler.Metric) []v1.Rule {
+	rules := make([]v1.Rule, 0, len(metric.Thresholds))
+	for _, t := range metric.Thresholds {
+		labels := alertLabels(cr)
+		if t.Severity != "" {
+			labels["severity"] = t.Severity
+		}
+		rules = append(rules, v1.Rule{
+			Alert:  t.AlertName(metric),
+			Expr:   intstr.FromString(fmt.Sprintf("(%s) > %s", cr.Query(metric), strconv.FormatFloat(t.Value.AsApproximateFloat64(), 'g', -1, 64))),
+			For:    v1.Duration(model.Duration(t.ForDuration()).String()),
+			Labels: labels,
+			Annotations: map[string]string{
+				AlertAnnotationReplicas: strconv.Itoa(int(t.Replicas)),
+			},
+		})
+	}
+	return rules
+}
+
+// MetricAlertingRules returns the alerting rules generated for metric of cr
+// whatever its driver, one per threshold step or one firing while the query
+// returns samples
+func MetricAlertingRules(cr *autoscaler.CustomAutoScaling, metric autoscaler.Metric) []v1.Rule {
+	if len(metric.Thresholds) > 0 {
+		return thresholdRules(cr, metric)
+	}
+	return []v1.Rule{{
+		Alert:  metric.Name,
+		Expr:   intstr.FromString(cr.Query(metric)),
+		For:    "10s",
+		Labels: alertLabels(cr),
+	}}
+}
+
+// AlertingRules returns the alerting rules generated for cr, the operator
+// evaluates them itself in embedded mode
+func AlertingRules(cr *autoscaler.CustomAutoScaling) []v1.Rule {
+	var rules []v1.Rule
+	for _, group := range prometheusRuleParams(cr).Groups {
+		for _, rule := range group.Rules {
+			if rule.Alert != "" {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// alertLabels returns the labels identifying the CR on its alerts
+func alertLabels(cr *autoscaler.CustomAutoScaling) map[string]string {
+	return map[string]string{
+		AlertLabelName:      cr.Name,
+		AlertLabelNamespace: cr.Namespace,
+	}
+}
+
+// AlertNames returns the names of the alerts generated for metric
+func AlertNames(metric autoscaler.Metric) []string {
+	if len(metric.Thresholds) == 0 {
+		return []string{metric.Name}
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, t := range metric.Thresholds {
+		if name := t.AlertName(metric); !seen[name] {
+			names, seen[name] = append(names, name), true
+		}
+	}
+	return names
+}
+
 func generatePrometheusRuleDef(cr *autoscaler.CustomAutoScaling, parmas PrometheusRuleParams) *v1.PrometheusRule {
 
 	prometheusRule := &v1.PrometheusRule{
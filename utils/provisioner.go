@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// Provisioner gets, creates and deletes the child resources of a CustomAutoScaling
+// through the manager's client, it is built once in main.go
+type Provisioner struct {
+	Client client.Client
+	Scheme *runtime.Scheme
+	// Recorder records what happened to each child on the CR it belongs to
+	Recorder record.EventRecorder
+}
+
+// NewProvisioner returns a Provisioner using the given client, scheme and recorder
+func NewProvisioner(cl client.Client, scheme *runtime.Scheme, recorder record.EventRecorder) *Provisioner {
+	return &Provisioner{
+		Client:   cl,
+		Scheme:   scheme,
+		Recorder: recorder,
+	}
+}
+
+// get fetches the child resource named name into obj, cluster scoped kinds pass an empty namespace
+func (p *Provisioner) get(ctx context.Context, kind, namespace, name string, obj client.Object) error {
+	err := p.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj)
+	return wrapError(kind, name, "get", err)
+}
+
+// create creates obj and records it on the CR, namespaced children are owned
+// by the CR so that they are garbage collected with it
+func (p *Provisioner) create(ctx context.Context, cr *autoscaler.CustomAutoScaling, kind string, obj client.Object) error {
+	if obj.GetNamespace() != "" {
+		if err := controllerutil.SetControllerReference(cr, obj, p.Scheme); err != nil {
+			return wrapError(kind, obj.GetName(), "create", err)
+		}
+	}
+	if err := p.Client.Create(ctx, obj); err != nil {
+		err = wrapError(kind, obj.GetName(), "create", err)
+		p.Recorder.Eventf(cr, corev1.EventTypeWarning, "CreateFailed", "failed to create %s %s: %s", kind, obj.GetName(), err)
+		return err
+	}
+	p.Recorder.Eventf(cr, corev1.EventTypeNormal, "Created", "created %s %s", kind, obj.GetName())
+	return nil
+}
+
+// update writes the changed obj back and records it on the CR, obj is the
+// live object of the child
+func (p *Provisioner) update(ctx context.Context, cr *autoscaler.CustomAutoScaling, kind string, obj client.Object) error {
+	if err := p.Client.Update(ctx, obj); err != nil {
+		err = wrapError(kind, obj.GetName(), "update", err)
+		p.Recorder.Eventf(cr, corev1.EventTypeWarning, "UpdateFailed", "failed to update %s %s: %s", kind, obj.GetName(), err)
+		return err
+	}
+	p.Recorder.Eventf(cr, corev1.EventTypeNormal, "Updated", "updated %s %s", kind, obj.GetName())
+	return nil
+}
+
+// delete removes obj, a child that is already gone is not an error
+func (p *Provisioner) delete(ctx context.Context, kind string, obj client.Object) error {
+	err := p.Client.Delete(ctx, obj)
+	if err != nil && !errors.IsNotFound(err) {
+		return wrapError(kind, obj.GetName(), "delete", err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestProvisioner(t *testing.T, objs ...client.Object) *Provisioner {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, autoscaler.AddToScheme, v1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return NewProvisioner(cl, scheme, &record.FakeRecorder{})
+}
+
+func newTestCR() *autoscaler.CustomAutoScaling {
+	return &autoscaler.CustomAutoScaling{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "demo-uid"},
+		Spec: autoscaler.CustomAutoScalingSpec{
+			Target:  autoscaler.ScaleTarget{Name: "demo", Service: "demo", Port: 8080},
+			Metrics: []autoscaler.Metric{{Name: "requests", Query: `sum(rate(http_requests_total[1m])) > 100`}},
+			Monitoring: autoscaler.Monitoring{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("400Mi")},
+				},
+			},
+		},
+	}
+}
+
+func TestProvisionerCreateAndGet(t *testing.T) {
+	ctx := context.Background()
+	cr := newTestCR()
+	p := newTestProvisioner(t, cr)
+
+	if _, err := p.GetSAccount(ctx, cr); !apierrors.IsNotFound(err) {
+		t.Fatalf("GetSAccount() before create = %v, want NotFound", err)
+	}
+
+	if _, err := p.CreateServiceAccount(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateClusterRole(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateAlertManager(ctx, cr, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreatePrometheusInstance(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreatePrometheusRule(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := p.GetSAccount(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(sa); owner == nil || owner.UID != cr.UID {
+		t.Errorf("service account owner = %v, want %s", owner, cr.UID)
+	}
+
+	role, err := p.GetClusterRole(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := metav1.GetControllerOf(role); owner != nil {
+		t.Errorf("cluster role has owner %v, cluster scoped children cannot be owned", owner)
+	}
+
+	alertManager, err := p.GetAlertManager(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alertManager.Spec.Replicas == nil || *alertManager.Spec.Replicas != 3 {
+		t.Errorf("alertmanager replicas = %v, want 3", alertManager.Spec.Replicas)
+	}
+
+	prometheus, err := p.GetPrometheusInstance(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := prometheus.Spec.Resources.Requests[corev1.ResourceMemory]; q.String() != "400Mi" {
+		t.Errorf("prometheus memory request = %s, want 400Mi", q.String())
+	}
+	if prometheus.Spec.Replicas == nil || *prometheus.Spec.Replicas != 3 || prometheus.Spec.Retention != "20d" {
+		t.Errorf("prometheus replicas = %v, retention = %s, want the 3 and 20d defaults", prometheus.Spec.Replicas, prometheus.Spec.Retention)
+	}
+	// queries go through the Service of the CR, which selects only its own pods
+	service := prometheusServiceParams(cr)
+	if prometheus.Spec.PodMetadata == nil || prometheus.Spec.PodMetadata.Labels["app"] != service.TargetApp {
+		t.Errorf("prometheus pod metadata = %+v, want app %s", prometheus.Spec.PodMetadata, service.TargetApp)
+	}
+	if url := PrometheusURL(cr); url != "http://demo-prometheus-service.default.svc:9090" {
+		t.Errorf("PrometheusURL() = %s", url)
+	}
+	// the remote write receiver is only on for CRs accepting pushed metrics
+	pushed := newTestCR()
+	pushed.Spec.Monitoring.RemoteWrite = &autoscaler.RemoteWrite{Series: []string{"queue_depth"}}
+	if prometheus.Spec.EnableRemoteWriteReceiver || !generatePrometheusDef(pushed, prometheusParams(pushed)).Spec.EnableRemoteWriteReceiver {
+		t.Errorf("remote write receiver = %t without remoteWrite, want it only with remoteWrite", prometheus.Spec.EnableRemoteWriteReceiver)
+	}
+
+	rule, err := p.GetPrometheusRule(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := rule.Spec.Groups[0].Rules; len(rules) != 1 || rules[0].Alert != "requests" || rules[0].Labels[AlertLabelName] != "demo" {
+		t.Errorf("prometheus rules = %+v, want one alert per metric", rules)
+	}
+
+	// the alertmanager and prometheus configs are provisioned as secrets on the way
+	for _, name := range []string{"demo-alertsecret", "demo-secret"} {
+		if err := p.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: name}, &corev1.Secret{}); err != nil {
+			t.Errorf("secret %s: %v", name, err)
+		}
+	}
+}
+
+func TestProvisionerRecordsChildren(t *testing.T) {
+	ctx := context.Background()
+	cr := newTestCR()
+	p := newTestProvisioner(t, cr)
+	recorder := record.NewFakeRecorder(10)
+	p.Recorder = recorder
+
+	if _, err := p.CreateServiceAccount(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateServiceAccount(ctx, cr); err == nil {
+		t.Fatal("second CreateServiceAccount() succeeded")
+	}
+	// an update from a stale copy of the rule conflicts
+	promRule, err := p.CreatePrometheusRule(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := promRule.DeepCopy()
+	cr.Spec.Metrics[0].Query = `sum(rate(http_requests_total[5m])) > 100`
+	if updated, err := p.UpdatePrometheusRule(ctx, cr, promRule); err != nil || !updated {
+		t.Fatalf("UpdatePrometheusRule() = %t, %v", updated, err)
+	}
+	cr.Spec.Metrics[0].Query = `sum(rate(http_requests_total[1m])) > 200`
+	if _, err := p.UpdatePrometheusRule(ctx, cr, stale); err == nil {
+		t.Fatal("UpdatePrometheusRule() of a stale rule succeeded")
+	}
+
+	for _, want := range []string{
+		"Normal Created created ServiceAccount demo-sa",
+		"Warning CreateFailed failed to create ServiceAccount demo-sa",
+		"Normal Created created PrometheusRule demo-prometheus-rule",
+		"Normal Updated updated PrometheusRule demo-prometheus-rule",
+		"Warning UpdateFailed failed to update PrometheusRule demo-prometheus-rule",
+	} {
+		if got := <-recorder.Events; !strings.HasPrefix(got, want) {
+			t.Errorf("event = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestProvisionerFinalizer(t *testing.T) {
+	ctx := context.Background()
+	cr := newTestCR()
+	p := newTestProvisioner(t, cr)
+
+	if err := p.AddCustomautoscaleFinalizer(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateServiceAccount(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateClusterRole(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateClusterRoleBinding(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake client marks the CR as deleting since it carries a finalizer
+	if err := p.Client.Delete(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Client.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+		t.Fatal(err)
+	}
+
+	// children that were never created, like the prometheus instance, are skipped
+	if err := p.HandleAutoScalerFinalizer(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.GetSAccount(ctx, cr); !apierrors.IsNotFound(err) {
+		t.Errorf("GetSAccount() after finalize = %v, want NotFound", err)
+	}
+	for name, obj := range map[string]client.Object{"demo-clusterrole": &rbacv1.ClusterRole{}, "demo-rolebinding": &rbacv1.ClusterRoleBinding{}} {
+		if err := p.Client.Get(ctx, types.NamespacedName{Name: name}, obj); !apierrors.IsNotFound(err) {
+			t.Errorf("%s after finalize = %v, want NotFound", name, err)
+		}
+	}
+	if err := p.Client.Get(ctx, client.ObjectKeyFromObject(cr), cr); !apierrors.IsNotFound(err) {
+		t.Errorf("CR after finalize = %v, want it released", err)
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	main "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// RemoteWritePath returns the path the remote write requests of a CR are posted to
+func RemoteWritePath(namespace, name string) string {
+	return path.Join("/v1/namespaces", namespace, "customautoscalings", name, "write")
+}
+
+// RemoteWriteService returns the name of the Service exposing the remote
+// write endpoint of the CR called name in its namespace
+func RemoteWriteService(name string) string {
+	return name + "-remote-write"
+}
+
+// RemoteWriteURL returns the URL workloads in the namespace of cr push their
+// metrics to, through the remote write Service
+func RemoteWriteURL(cr *autoscaler.CustomAutoScaling) string {
+	params := remoteWriteServiceParams(cr)
+	return fmt.Sprintf("http://%s.%s.svc:%d%s", params.Name, params.Namespace, params.Port, RemoteWritePath(cr.Namespace, cr.Name))
+}
+
+func (p *Provisioner) GetRemoteWriteService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+	service := &main.Service{}
+	if err := p.get(ctx, "Service", cr.Namespace, RemoteWriteService(cr.Name), service); err != nil {
+		if !errors.IsNotFound(err) {
+			k8sLogger(cr.Namespace, RemoteWriteService(cr.Name)).Error(err, "error while fetching remote write service")
+		}
+		return nil, err
+	}
+	return service, nil
+}
+
+func (p *Provisioner) CreateRemoteWriteService(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Service, error) {
+	return p.CreateService(ctx, cr, remoteWriteServiceParams(cr))
+}
+
+// remoteWriteServiceParams returns the parameters of the ExternalName service
+// resolving to the signals server of the operator, which authenticates the
+// remote write requests of the CR and forwards them to its Prometheus
+func remoteWriteServiceParams(cr *autoscaler.CustomAutoScaling) ServiceParams {
+	host, port := signalsHostPort()
+	return ServiceParams{
+		Name:         RemoteWriteService(cr.Name),
+		Namespace:    cr.Namespace,
+		Port:         port,
+		PortName:     "http",
+		TargetPort:   port,
+		Type:         string(main.ServiceTypeExternalName),
+		ExternalName: host,
+	}
+}
+
+// signalsHostPort splits SignalsURL into its host and port, the port defaults
+// to the one of its scheme
+func signalsHostPort() (string, int) {
+	u, err := url.Parse(SignalsURL)
+	if err != nil {
+		return SignalsURL, 80
+	}
+	host, portName, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, portName = u.Host, ""
+	}
+	if port, err := strconv.Atoi(portName); err == nil {
+		return host, port
+	}
+	if u.Scheme == "https" {
+		return host, 443
+	}
+	return host, 80
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// AlertManagerReplicas is the replica count of the Alertmanager created for a CR
+const AlertManagerReplicas int32 = 3
+
+// Render returns the child resources the operator creates for cr in the order
+// they are provisioned, built by the same generators without cluster access.
+// Namespaced children are owned by cr, as the Provisioner creates them. The
+// signals token Secret is left out since its token is generated on creation.
+// In embedded mode no monitoring stack is generated
+func Render(cr *autoscaler.CustomAutoScaling) []client.Object {
+	if cr.Spec.Monitoring.Embedded != nil {
+		var objs []client.Object
+		if cr.Spec.Driver == autoscaler.HPADriver {
+			objs = append(objs, generateHPADef(cr))
+		}
+		return ownedBy(cr, objs)
+	}
+
+	objs := []client.Object{
+		generateServiceAccountDef(cr.Name+"-sa", cr.Namespace),
+		generateClusterDef(cr.Name+"-clusterrole", cr.Namespace),
+		generateClusterRoleBindindingDef(cr.Name+"-rolebinding", cr.Namespace, cr.Name+"-sa", cr.Name+"-clusterrole"),
+		generateSVCMonitorDef(cr, svcMonitorParams(cr)),
+		generateSecretDef(cr),
+		generatePrometheusDef(cr, prometheusParams(cr)),
+		generateServiceDef(cr, prometheusServiceParams(cr)),
+	}
+	if cr.Spec.Monitoring.RemoteWrite != nil {
+		objs = append(objs, generateServiceDef(cr, remoteWriteServiceParams(cr)))
+	}
+
+	switch cr.Spec.Driver {
+	case "", autoscaler.AlertsDriver:
+		objs = append(objs,
+			generateAlertsecretDef(cr),
+			generateAlertManagerDef(alertManagerParams(cr, AlertManagerReplicas)),
+			generateServiceDef(cr, alertManagerServiceParams(cr)),
+			generatePrometheusRuleDef(cr, prometheusRuleParams(cr)),
+		)
+	case autoscaler.HPADriver:
+		objs = append(objs, generateHPADef(cr))
+	}
+	if cr.Spec.Driver != "" && cr.Spec.Driver != autoscaler.AlertsDriver && HasRecordingRules(cr) {
+		objs = append(objs, generatePrometheusRuleDef(cr, prometheusRuleParams(cr)))
+	}
+
+	return ownedBy(cr, objs)
+}
+
+// ownedBy sets cr as the owner of the namespaced objects of objs
+func ownedBy(cr *autoscaler.CustomAutoScaling, objs []client.Object) []client.Object {
+	owner := metav1.NewControllerRef(cr, autoscaler.GroupVersion.WithKind("CustomAutoScaling"))
+	for _, obj := range objs {
+		if obj.GetNamespace() != "" {
+			obj.SetOwnerReferences([]metav1.OwnerReference{*owner})
+		}
+	}
+	return objs
+}
+
+// RenderYAML writes the children of cr to w as a multi-document YAML stream
+func RenderYAML(w io.Writer, cr *autoscaler.CustomAutoScaling) error {
+	for _, obj := range Render(cr) {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("rendering %s %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName(), err)
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
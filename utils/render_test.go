@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/name.yaml, -update rewrites the file instead
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".yaml")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test ./utils -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the generated object, run go test ./utils -update if the change is intended\ngot:\n%s", path, got)
+	}
+}
+
+// newThresholdsCR returns the test CR with a latency ladder next to its requests alert
+func newThresholdsCR() *autoscaler.CustomAutoScaling {
+	cr := newTestCR()
+	cr.Spec.Metrics = append(cr.Spec.Metrics, autoscaler.Metric{
+		Name:  "latency",
+		Query: `histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket[1m])))`,
+		Thresholds: []autoscaler.Threshold{
+			{Severity: "warning", Value: resource.MustParse("500m"), Replicas: 3},
+			{Severity: "critical", Value: resource.MustParse("1"), For: &metav1.Duration{Duration: 2 * time.Minute}, Replicas: 6},
+			{Name: "latency-extreme", Severity: "critical", Value: resource.MustParse("2.5"), Replicas: 10},
+		},
+	})
+	return cr
+}
+
+// newRecordingCR returns the test CR recording its requests query whole and
+// a sub-expression of a latency ladder
+func newRecordingCR() *autoscaler.CustomAutoScaling {
+	cr := newThresholdsCR()
+	cr.Spec.Metrics[0].Recording = &autoscaler.Recording{Interval: &metav1.Duration{Duration: time.Minute}}
+	cr.Spec.Metrics[1].Recording = &autoscaler.Recording{
+		Expressions: []string{`sum by (le) (rate(http_request_duration_seconds_bucket[1m]))`},
+	}
+	return cr
+}
+
+func TestGenerators(t *testing.T) {
+	cr := newTestCR()
+	cr.Labels = map[string]string{"team": "checkout"}
+	cr.Annotations = map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"}
+
+	tests := []struct {
+		name string
+		obj  interface{}
+	}{
+		{name: "serviceaccount", obj: generateServiceAccountDef(cr.Name+"-sa", cr.Namespace)},
+		{name: "clusterrole", obj: generateClusterDef(cr.Name+"-clusterrole", cr.Namespace)},
+		{name: "clusterrolebinding", obj: generateClusterRoleBindindingDef(cr.Name+"-rolebinding", cr.Namespace, cr.Name+"-sa", cr.Name+"-clusterrole")},
+		{name: "servicemonitor", obj: generateSVCMonitorDef(cr, svcMonitorParams(cr))},
+		{name: "secret", obj: generateSecretDef(cr)},
+		{name: "prometheus", obj: generatePrometheusDef(cr, prometheusParams(cr))},
+		{name: "prometheus-service", obj: generateServiceDef(cr, prometheusServiceParams(cr))},
+		{name: "alertsecret", obj: generateAlertsecretDef(cr)},
+		{name: "alertmanager", obj: generateAlertManagerDef(alertManagerParams(cr, AlertManagerReplicas))},
+		{name: "alertmanager-service", obj: generateServiceDef(cr, alertManagerServiceParams(cr))},
+		{name: "prometheusrule", obj: generatePrometheusRuleDef(cr, prometheusRuleParams(cr))},
+		{name: "prometheusrule-thresholds", obj: generatePrometheusRuleDef(cr, prometheusRuleParams(newThresholdsCR()))},
+		{name: "prometheusrule-recording", obj: generatePrometheusRuleDef(cr, prometheusRuleParams(newRecordingCR()))},
+		{name: "hpa", obj: generateHPADef(newHPACR())},
+		{name: "remotewrite-service", obj: generateServiceDef(cr, remoteWriteServiceParams(cr))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := yaml.Marshal(tt.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, tt.name, data)
+		})
+	}
+}
+
+func TestRenderYAML(t *testing.T) {
+	keda := newTestCR()
+	keda.Spec.Driver = autoscaler.KEDADriver
+	recordingKEDA := newRecordingCR()
+	recordingKEDA.Spec.Driver = autoscaler.KEDADriver
+	embeddedHPA := newHPACR()
+	embeddedHPA.Spec.Monitoring.Embedded = &autoscaler.EmbeddedMonitoring{}
+
+	for name, cr := range map[string]*autoscaler.CustomAutoScaling{
+		"render-alerts":         newTestCR(),
+		"render-hpa":            newHPACR(),
+		"render-keda":           keda,
+		"render-keda-recording": recordingKEDA,
+		"render-embedded-hpa":   embeddedHPA,
+	} {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			if err := RenderYAML(out, cr); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, name, out.Bytes())
+		})
+	}
+}
+
+func TestRenderMatchesProvisioner(t *testing.T) {
+	ctx := context.Background()
+	cr := newTestCR()
+	p := newTestProvisioner(t, cr)
+
+	for _, create := range []func() error{
+		func() error { _, err := p.CreateServiceAccount(ctx, cr); return err },
+		func() error { _, err := p.CreateClusterRole(ctx, cr); return err },
+		func() error { _, err := p.CreateClusterRoleBinding(ctx, cr); return err },
+		func() error { _, err := p.CreateSVCMonitor(ctx, cr); return err },
+		func() error { _, err := p.CreatePrometheusInstance(ctx, cr); return err },
+		func() error { _, err := p.CreatePrometheusService(ctx, cr); return err },
+		func() error { _, err := p.CreateAlertManager(ctx, cr, AlertManagerReplicas); return err },
+		func() error { _, err := p.CreateAlertManagerService(ctx, cr); return err },
+		func() error { _, err := p.CreatePrometheusRule(ctx, cr); return err },
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every rendered object is what the provisioner created, up to server set metadata
+	for _, want := range Render(cr) {
+		got := want.DeepCopyObject().(client.Object)
+		if err := p.Client.Get(ctx, client.ObjectKeyFromObject(want), got); err != nil {
+			t.Errorf("%T %s was rendered but not provisioned: %v", want, want.GetName(), err)
+			continue
+		}
+		got.SetResourceVersion("")
+		got.GetObjectKind().SetGroupVersionKind(want.GetObjectKind().GroupVersionKind())
+		if !apiequality.Semantic.DeepEqual(got, want) {
+			rendered, _ := yaml.Marshal(want)
+			provisioned, _ := yaml.Marshal(got)
+			t.Errorf("%T %s differs between render and provisioning\nrendered:\n%s\nprovisioned:\n%s", want, want.GetName(), rendered, provisioned)
+		}
+	}
+}
@@ -2,24 +2,46 @@ package utils
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"path"
 	"strconv"
+	"strings"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	main "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
-func getSecret(cr *autoscaler.CustomAutoScaling, name string) (*main.Secret, error) {
-	secretName := name
-	logger := k8sLogger(cr.Namespace, secretName)
+// SignalsURL is the base URL the Alertmanager of a CR posts its alerts to, it
+// is set from the --signals-url flag of the manager
+var SignalsURL = "http://autoscaler-signals.autoscaler-system.svc:3030"
+
+// SignalsTokenKey is the key of the bearer token in the signals token Secret
+const SignalsTokenKey = "token"
 
-	secret, err := generateK8sClient().CoreV1().Secrets(cr.Namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+// SignalsTokenSecret returns the name of the Secret holding the bearer token
+// of the signals API of the CR called name
+func SignalsTokenSecret(name string) string {
+	return name + "-signals-token"
+}
 
-	if err != nil {
+// SignalsPath returns the path the signals of a CR are posted to
+func SignalsPath(namespace, name string) string {
+	return path.Join("/v1/namespaces", namespace, "customautoscalings", name, "signals")
+}
 
-		logger.Error(fmt.Errorf("get secret  failed %s  : %s", secretName, err.Error()), "")
+func (p *Provisioner) getSecret(ctx context.Context, cr *autoscaler.CustomAutoScaling, name string) (*main.Secret, error) {
+	secretName := name
+	logger := k8sLogger(cr.Namespace, secretName)
+
+	secret := &main.Secret{}
+	if err := p.get(ctx, "Secret", cr.Namespace, secretName, secret); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "get secret failed")
+		}
 		return nil, err
 	}
 
@@ -28,17 +50,13 @@ func getSecret(cr *autoscaler.CustomAutoScaling, name string) (*main.Secret, err
 	return secret, nil
 }
 
-func createSecret(cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
+func (p *Provisioner) createSecret(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
 	secretName := cr.Name + "-secret"
 	logger := k8sLogger(cr.Namespace, secretName)
 
-	secretDef := generateSecretDef(cr)
-
-	secret, err := generateK8sClient().CoreV1().Secrets(cr.Namespace).Create(context.TODO(), secretDef, metav1.CreateOptions{})
-
-	if err != nil {
-
-		logger.Error(fmt.Errorf("create secret  failed %s  : %s", secretName, err.Error()), "")
+	secret := generateSecretDef(cr)
+	if err := p.create(ctx, cr, "Secret", secret); err != nil {
+		logger.Error(err, "create secret failed")
 		return nil, err
 	}
 
@@ -53,8 +71,8 @@ func generateSecretDef(cr *autoscaler.CustomAutoScaling) *main.Secret {
 scrape_configs:
   - job_name: "prometheus"
     static_configs:
-      - targets: [%s:%s]
-`, cr.Spec.ApplicationRef.DeploymentService, cr.Spec.ApplicationRef.DeploymentPort)
+      - targets: [%s:%d]
+`, cr.Spec.Target.Service, cr.Spec.Target.Port)
 
 	encodedFileContent := base64.StdEncoding.EncodeToString([]byte(filecontent))
 	quotedFileContent := strconv.Quote(encodedFileContent)
@@ -75,21 +93,90 @@ scrape_configs:
 	// - job_name: ` + cr.Name + `_server
 	//   static_configs:
 	//   - targets:
-	//     - ` + cr.Spec.ApplicationRef.DeploymentService + `:` + cr.Spec.ApplicationRef.DeploymentPort + `
+	//     - ` + cr.Spec.Target.Service + `:` + fmt.Sprint(cr.Spec.Target.Port) + `
 	// `),
 
 }
 
-func createAlertConfigSecret(cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
-	secretName := cr.Name + "-alertsecret"
+// GetSignalsToken fetches the Secret holding the signals API token of cr
+func (p *Provisioner) GetSignalsToken(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
+	return p.getSecret(ctx, cr, SignalsTokenSecret(cr.Name))
+}
+
+// CreateSignalsToken creates the Secret holding a new random signals API token for cr
+func (p *Provisioner) CreateSignalsToken(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
+	secretName := SignalsTokenSecret(cr.Name)
 	logger := k8sLogger(cr.Namespace, secretName)
 
-	secretDef := generateAlertsecretDef(cr)
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	secret := generateSignalsTokenDef(cr, hex.EncodeToString(token))
+	if err := p.create(ctx, cr, "Secret", secret); err != nil {
+		logger.Error(err, "create signals token secret failed")
+		return nil, err
+	}
+
+	logger.Info("Signals token secret created succesfully ")
 
-	secret, err := generateK8sClient().CoreV1().Secrets(cr.Namespace).Create(context.TODO(), secretDef, metav1.CreateOptions{})
-	if err != nil {
+	return secret, nil
+}
+
+func generateSignalsTokenDef(cr *autoscaler.CustomAutoScaling, token string) *main.Secret {
+	return &main.Secret{
+		TypeMeta:   generateMetaInformation("Secret", "v1"),
+		ObjectMeta: generateObjectMetaInformation(SignalsTokenSecret(cr.Name), cr.Namespace, cr.ObjectMeta.Labels, cr.ObjectMeta.Annotations),
+		Type:       main.SecretTypeOpaque,
+		Data: map[string][]byte{
+			SignalsTokenKey: []byte(token),
+		},
+	}
+}
+
+// alertConfigKey is the key of the Alertmanager configuration in its Secret
+const alertConfigKey = "alertmanager.yaml"
+
+// GetAlertConfigSecret fetches the Secret holding the Alertmanager configuration of cr
+func (p *Provisioner) GetAlertConfigSecret(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
+	return p.getSecret(ctx, cr, cr.Name+"-alertsecret")
+}
+
+// UpdateAlertConfigSecret brings the Alertmanager configuration in secret in
+// line with cr and reports whether it had to be updated, so a configuration
+// written by an earlier version posts to the signals endpoint of the CR with
+// its token as well
+func (p *Provisioner) UpdateAlertConfigSecret(ctx context.Context, cr *autoscaler.CustomAutoScaling, secret *main.Secret) (bool, error) {
+	config := generateAlertsecretDef(cr).StringData[alertConfigKey]
+	current, ok := secret.Data[alertConfigKey]
+	if !ok {
+		// the fake client of the tests keeps stringData as written
+		current = []byte(secret.StringData[alertConfigKey])
+	}
+	if string(current) == config {
+		return false, nil
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[alertConfigKey] = []byte(config)
+	secret.StringData = nil
+	if err := p.update(ctx, cr, "Secret", secret); err != nil {
+		k8sLogger(cr.Namespace, secret.Name).Error(err, "error while updating alert secret")
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateAlertConfigSecret creates the Secret holding the Alertmanager configuration of cr
+func (p *Provisioner) CreateAlertConfigSecret(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*main.Secret, error) {
+	secretName := cr.Name + "-alertsecret"
+	logger := k8sLogger(cr.Namespace, secretName)
 
-		logger.Error(fmt.Errorf("create alert secret  failed %s  : %s", secretName, err.Error()), "")
+	secret := generateAlertsecretDef(cr)
+	if err := p.create(ctx, cr, "Secret", secret); err != nil {
+		logger.Error(err, "create alert secret failed")
 		return nil, err
 	}
 
@@ -99,13 +186,18 @@ func createAlertConfigSecret(cr *autoscaler.CustomAutoScaling) (*main.Secret, er
 
 }
 
+// generateAlertsecretDef returns the Alertmanager configuration of cr, its
+// receiver posts to the signals endpoint of the CR with the token mounted
+// from the signals token Secret
 func generateAlertsecretDef(cr *autoscaler.CustomAutoScaling) *main.Secret {
+	url := strings.TrimSuffix(SignalsURL, "/") + SignalsPath(cr.Namespace, cr.Name)
+	tokenFile := path.Join("/etc/alertmanager/secrets", SignalsTokenSecret(cr.Name), SignalsTokenKey)
 
 	secret := &main.Secret{
 		TypeMeta:   generateMetaInformation("Secret", "v1"),
 		ObjectMeta: generateObjectMetaInformation(cr.Name+"-alertsecret", cr.Namespace, cr.ObjectMeta.Labels, cr.ObjectMeta.Annotations),
 		StringData: map[string]string{
-			"alertmanager.yaml": `
+			alertConfigKey: fmt.Sprintf(`
 global:
   resolve_timeout: 5m
 inhibit_rules:
@@ -142,10 +234,14 @@ route:
 receivers:
 - name: 'webhook_receiver'
   webhook_configs:
-  - url: "http://localhost:3030/webhook"
+  - url: %q
     send_resolved: false
+    http_config:
+      authorization:
+        type: Bearer
+        credentials_file: %q
 templates:
-- '/etc/alertmanager/config/*.tmpl'`,
+- '/etc/alertmanager/config/*.tmpl'`, url, tokenFile),
 		},
 	}
 	return secret
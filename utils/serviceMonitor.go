@@ -2,9 +2,8 @@ package utils
 
 import (
 	"context"
-	"fmt"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	v1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -19,6 +18,26 @@ type SVCMonitorParams struct {
 	Image      string
 }
 
+// svcMonitorParams returns the parameters of the ServiceMonitor scraping the target of cr
+func svcMonitorParams(cr *autoscaler.CustomAutoScaling) SVCMonitorParams {
+	endpoints := []v1.Endpoint{
+		{
+			Port:     "metrics",
+			Interval: "30s",
+			Path:     "/metrics",
+		},
+	}
+
+	return SVCMonitorParams{
+		Name:      cr.Name + "-svcm",
+		Namespace: cr.Namespace,
+		selector: map[string]string{
+			"app": cr.Spec.Target.Name,
+		},
+		Endpoints: endpoints,
+	}
+}
+
 func generateSVCMonitorDef(cr *autoscaler.CustomAutoScaling, params SVCMonitorParams) *v1.ServiceMonitor {
 
 	lbls := generateSVCMLabels(params.Name, cr.ObjectMeta.Labels)
@@ -39,23 +58,17 @@ func generateSVCMonitorDef(cr *autoscaler.CustomAutoScaling, params SVCMonitorPa
 
 }
 
-func GetSVCMonitor(cr *autoscaler.CustomAutoScaling) (*v1.ServiceMonitor, error) {
+func (p *Provisioner) GetSVCMonitor(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.ServiceMonitor, error) {
 	svcMonitorName := cr.Name + "-svcm"
 	logger := k8sLogger(cr.Namespace, svcMonitorName)
-	client, err := generatePromClient()
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", svcMonitorName, cr.Namespace, err.Error()), "")
-		panic(err)
-	}
 
-	svcMonitor, err := client.MonitoringV1().ServiceMonitors(cr.Namespace).Get(context.TODO(), svcMonitorName, metav1.GetOptions{})
-	if err != nil {
+	svcMonitor := &v1.ServiceMonitor{}
+	if err := p.get(ctx, "ServiceMonitor", cr.Namespace, svcMonitorName, svcMonitor); err != nil {
 		if errors.IsNotFound(err) {
 			logger.Info("servicemonitor doesnt exists")
 			return nil, err
 		}
-		logger.Error(fmt.Errorf("error while fetching servicemonitor %s  in namespace %s : %s", svcMonitorName, cr.Namespace, err.Error()), "")
+		logger.Error(err, "error while fetching servicemonitor")
 		return nil, err
 	}
 
@@ -64,38 +77,14 @@ func GetSVCMonitor(cr *autoscaler.CustomAutoScaling) (*v1.ServiceMonitor, error)
 	return svcMonitor, nil
 }
 
-func CreateSVCMonitor(cr *autoscaler.CustomAutoScaling) (*v1.ServiceMonitor, error) {
+func (p *Provisioner) CreateSVCMonitor(ctx context.Context, cr *autoscaler.CustomAutoScaling) (*v1.ServiceMonitor, error) {
 	svcMonitorName := cr.Name + "-svcm"
 	logger := k8sLogger(cr.Namespace, svcMonitorName)
-	client, err := generatePromClient()
-
-	if err != nil {
-		logger.Error(fmt.Errorf("error while fetching prometheus client  %s  in namespace %s : %s", svcMonitorName, cr.Namespace, err.Error()), "")
-		panic(err)
-	}
-
-	endpoints := []v1.Endpoint{
-		{
-			Port:     "metrics",
-			Interval: "30s",
-			Path:     "/metrics",
-		},
-	}
-
-	params := SVCMonitorParams{
-		Name:      svcMonitorName,
-		Namespace: cr.Namespace,
-		selector: map[string]string{
-			"app": cr.Spec.ApplicationRef.DeploymentName,
-		},
-		Endpoints: endpoints,
-	}
-	SVCDef := generateSVCMonitorDef(cr, params)
 
-	svcMonitor, err := client.MonitoringV1().ServiceMonitors(cr.Namespace).Create(context.TODO(), SVCDef, metav1.CreateOptions{})
+	svcMonitor := generateSVCMonitorDef(cr, svcMonitorParams(cr))
 
-	if err != nil {
-		logger.Error(fmt.Errorf("error while creating servicemonitor %s  in namespace %s : %s", svcMonitorName, cr.Namespace, err.Error()), "")
+	if err := p.create(ctx, cr, "ServiceMonitor", svcMonitor); err != nil {
+		logger.Error(err, "error while creating servicemonitor")
 		return nil, err
 	}
 
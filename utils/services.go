@@ -2,11 +2,10 @@ package utils
 
 import (
 	"context"
-	"fmt"
 
-	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v1"
+	autoscaler "buildpiper.opstreelabs.in/autoscaler/api/v2"
 	main "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -22,16 +21,19 @@ type ServiceParams struct {
 	TargetApp  string
 	Type       string
 	NodePort   int
+	// ExternalName is the host an ExternalName service resolves to, such a
+	// service has no selector
+	ExternalName string
 }
 
-func GetService(cr *autoscaler.CustomAutoScaling, name string) (*main.Service, error) {
+func (p *Provisioner) GetService(ctx context.Context, cr *autoscaler.CustomAutoScaling, name string) (*main.Service, error) {
 
 	logger := k8sLogger(cr.Namespace, name)
-	service, err := generateK8sClient().CoreV1().Services(cr.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
-
-	if err != nil {
-
-		logger.Error(fmt.Errorf("error while fetching   service  %s  in namespace %s : %s", name, cr.Namespace, err.Error()), "")
+	service := &main.Service{}
+	if err := p.get(ctx, "Service", cr.Namespace, name, service); err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "error while fetching service")
+		}
 		return nil, err
 	}
 
@@ -41,17 +43,14 @@ func GetService(cr *autoscaler.CustomAutoScaling, name string) (*main.Service, e
 
 }
 
-func CreateService(cr *autoscaler.CustomAutoScaling, params ServiceParams) (*main.Service, error) {
+func (p *Provisioner) CreateService(ctx context.Context, cr *autoscaler.CustomAutoScaling, params ServiceParams) (*main.Service, error) {
 
 	logger := k8sLogger(cr.Namespace, params.Name)
 
-	serviceDef := generateServiceDef(cr, params)
-	service, err := generateK8sClient().CoreV1().Services(cr.Namespace).Create(context.TODO(), serviceDef, metav1.CreateOptions{})
-
-	if err != nil {
-
-		logger.Error(fmt.Errorf("error while creating   service  %s  in namespace %s : %s", params.Name, cr.Namespace, err.Error()), "")
-		panic(err)
+	service := generateServiceDef(cr, params)
+	if err := p.create(ctx, cr, "Service", service); err != nil {
+		logger.Error(err, "error while creating service")
+		return nil, err
 	}
 
 	logger.Info(params.Name + "service created succesfully")
@@ -66,9 +65,7 @@ func generateServiceDef(cr *autoscaler.CustomAutoScaling, params ServiceParams)
 		TypeMeta:   generateMetaInformation("Service", "v1"),
 		ObjectMeta: generateObjectMetaInformation(params.Name, cr.Namespace, cr.Labels, cr.Annotations),
 		Spec: main.ServiceSpec{
-			Selector: map[string]string{
-				"app": params.TargetApp,
-			},
+			ExternalName: params.ExternalName,
 			Ports: []main.ServicePort{
 				{
 					Name:       params.PortName,
@@ -80,6 +77,11 @@ func generateServiceDef(cr *autoscaler.CustomAutoScaling, params ServiceParams)
 			Type: main.ServiceType(params.Type),
 		},
 	}
+	if params.ExternalName == "" {
+		service.Spec.Selector = map[string]string{
+			"app": params.TargetApp,
+		}
+	}
 
 	return service
 